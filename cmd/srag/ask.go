@@ -11,10 +11,12 @@ import (
 	"github.com/charmbracelet/glamour"
 	"github.com/goccy/go-json"
 	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/mattn/go-runewidth"
 	"github.com/openai/openai-go"
 	"github.com/openai/openai-go/option"
 	"github.com/urfave/cli/v3"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/term"
 
 	"github.com/fanyang89/rag/v1"
 )
@@ -35,6 +37,20 @@ var askCmd = &cli.Command{
 		flagAssistantAPIKey,
 		&cli.IntFlag{Name: "retrieval-limit", Value: 40, Usage: "Number of chunks to retrieve from vector search"},
 		&cli.IntFlag{Name: "selected-limit", Value: 10, Usage: "Number of chunks for LLM to select and use for final answer"},
+		&cli.FloatFlag{Name: "vector-weight", Value: rag.DefaultVectorWeight, Usage: "Fusion weight of vector search, 0 disables it"},
+		&cli.FloatFlag{Name: "keyword-weight", Value: rag.DefaultKeywordWeight, Usage: "Fusion weight of BM25 keyword search, 0 disables it"},
+		&cli.FloatFlag{Name: "min-score", Usage: "Drop retrieved chunks whose similarity score is below this value"},
+		&cli.BoolFlag{Name: "citations", Usage: "Ask the model to cite the chunks it uses"},
+		&cli.StringFlag{
+			Name:  "expand",
+			Usage: "Answer from the parent sections (parent) or the neighboring chunks (neighbors) of the selected chunks",
+		},
+		&cli.IntFlag{Name: "neighbors", Value: 1, Usage: "Chunks on each side of a selected chunk with --expand neighbors"},
+		&cli.StringSliceFlag{
+			Name:  "filter",
+			Usage: "Only retrieve chunks of documents whose metadata matches, e.g. lang=en, tags=go,db or date>=2024-01-01",
+		},
+		&cli.BoolFlag{Name: "no-stream", Usage: "Wait for the whole answer instead of printing it as it is generated"},
 		&cli.BoolFlag{
 			Name:    "vector-only",
 			Aliases: []string{"vc", "vec"},
@@ -75,6 +91,11 @@ var askCmd = &cli.Command{
 		assistantAPIKey := command.String("assistant-api-key")
 		retrievalLimit := command.Int("retrieval-limit")
 		selectedLimit := command.Int("selected-limit")
+		vectorWeight := command.Float("vector-weight")
+		keywordWeight := command.Float("keyword-weight")
+		minScore := command.Float("min-score")
+		citations := command.Bool("citations")
+		stream := !command.Bool("no-stream") && isTerminal(os.Stdout)
 		vectorOnly := command.Bool("vector-only")
 		systemPromptFile := command.String("system-prompt")
 		systemPromptText := command.String("system-text")
@@ -82,6 +103,21 @@ var askCmd = &cli.Command{
 		auditLogDir := command.String("audit-log-dir")
 		jobs := command.Int("jobs")
 
+		expand := command.String("expand")
+		err = rag.ValidateExpand(expand)
+		if err != nil {
+			return err
+		}
+
+		var filters []rag.MetadataFilter
+		for _, s := range command.StringSlice("filter") {
+			f, err := rag.ParseMetadataFilter(s)
+			if err != nil {
+				return err
+			}
+			filters = append(filters, f)
+		}
+
 		// Handle system prompt
 		var systemPrompt string
 		if systemPromptText != "" {
@@ -94,7 +130,7 @@ var askCmd = &cli.Command{
 			systemPrompt = string(content)
 		}
 
-		db, err := rag.OpenDuckDB(dsn, embeddingDimension)
+		store, err := rag.OpenStore(dsn, embeddingDimension)
 		if err != nil {
 			return err
 		}
@@ -116,7 +152,7 @@ var askCmd = &cli.Command{
 		}
 
 		r := rag.RAG{
-			DB:                  db,
+			Store:               store,
 			EmbeddingClient:     embeddingClientInterface,
 			EmbeddingModel:      embeddingModel,
 			EmbeddingDimensions: embeddingDimension,
@@ -124,12 +160,26 @@ var askCmd = &cli.Command{
 			AssistantModel:      assistantModel,
 		}
 
+		param := rag.AskParameter{
+			RetrievalLimit: retrievalLimit,
+			SelectedLimit:  selectedLimit,
+			SystemPrompt:   systemPrompt,
+			VectorWeight:   vectorWeight,
+			KeywordWeight:  keywordWeight,
+			MinScore:       minScore,
+			Citations:      citations,
+			Filters:        filters,
+			Expand:         expand,
+			Neighbors:      command.Int("neighbors"),
+		}
+
 		// Check if query is a file path
 		if _, err := os.Stat(query); err == nil {
-			return processQueryFile(ctx, &r, query, retrievalLimit, selectedLimit, vectorOnly, systemPrompt, jobs)
+			return processQueryFile(ctx, &r, query, param, vectorOnly, stream, jobs)
 		}
 
-		return ask(ctx, &r, query, retrievalLimit, selectedLimit, vectorOnly, systemPrompt)
+		param.Query = query
+		return ask(ctx, &r, param, vectorOnly, stream)
 	},
 }
 
@@ -137,18 +187,21 @@ type queryItem struct {
 	Query string `json:"query"`
 }
 
-func ask(ctx context.Context, r *rag.RAG, query string, retrievalLimit int, selectedLimit int, vectorOnly bool, systemPrompt string) error {
-	// Phase 1: Vector retrieval and display retrieved chunks
-	retrievedChunks, err := r.QueryDocumentChunks(ctx, query, retrievalLimit)
+// ask runs the retrieve, rerank and answer phases for param.Query, with stream the answer is
+// printed as it is generated and replaced by the rendered markdown once complete
+func ask(ctx context.Context, r *rag.RAG, param rag.AskParameter, vectorOnly, stream bool) error {
+	// Phase 1: Hybrid retrieval and display retrieved chunks
+	retrievedChunks, err := r.QueryDocumentChunks(ctx, &param)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Retrieved %d chunks from vector search:\n", len(retrievedChunks))
+	fmt.Printf("Retrieved %d chunks from hybrid search:\n", len(retrievedChunks))
 	tw := table.NewWriter()
-	tw.AppendHeader(table.Row{"Chunk ID", "Document"})
+	tw.AppendHeader(table.Row{"Rank", "Score", "Distance", "BM25", "Chunk ID", "Source"})
 	for _, chunk := range retrievedChunks {
-		tw.AppendRow(table.Row{chunk.ID, chunk.DocumentID})
+		tw.AppendRow(table.Row{chunk.RetrievalRank, formatScore(chunk.Score), formatScore(chunk.Distance),
+			formatScore(chunk.KeywordScore), chunk.ID, formatSource(chunk)})
 	}
 	fmt.Println(tw.Render())
 
@@ -158,16 +211,17 @@ func ask(ctx context.Context, r *rag.RAG, query string, retrievalLimit int, sele
 	}
 
 	// Phase 2: LLM selects the most relevant chunks
-	selectedChunks, err := r.Rerank(ctx, query, retrievedChunks, selectedLimit)
+	selectedChunks, err := r.Rerank(ctx, param.Query, retrievedChunks, param.SelectedLimit)
 	if err != nil {
 		return err
 	}
 
 	fmt.Printf("\nLLM selected %d most relevant chunks:\n", len(selectedChunks))
 	tw2 := table.NewWriter()
-	tw2.AppendHeader(table.Row{"Chunk ID", "Document"})
+	tw2.AppendHeader(table.Row{"Rerank", "Rank", "Score", "Chunk ID", "Source"})
 	for _, chunk := range selectedChunks {
-		tw2.AppendRow(table.Row{chunk.ID, chunk.DocumentID})
+		tw2.AppendRow(table.Row{chunk.RerankRank, chunk.RetrievalRank, formatScore(chunk.Score),
+			chunk.ID, formatSource(chunk)})
 	}
 	fmt.Println(tw2.Render())
 
@@ -175,21 +229,94 @@ func ask(ctx context.Context, r *rag.RAG, query string, retrievalLimit int, sele
 	fmt.Println("\nThe answer is:")
 
 	// Use the RAG's Ask method which handles the client interface properly
-	answer, err := r.Ask(ctx, &rag.AskParameter{
-		Query:          query,
-		SelectedChunks: selectedChunks,
-		RetrievalLimit: retrievalLimit,
-		SelectedLimit:  selectedLimit,
-		SystemPrompt:   systemPrompt,
-	})
+	param.SelectedChunks, err = r.ExpandChunks(ctx, &param, selectedChunks)
 	if err != nil {
 		return err
 	}
+	if !stream {
+		answer, err := r.Ask(ctx, &param)
+		if err != nil {
+			return err
+		}
+		tryPrintMarkdown(answer.Markdown())
+		return nil
+	}
 
-	tryPrintMarkdown(answer)
+	p := &streamPrinter{out: os.Stdout}
+	answer, err := r.AskStream(ctx, &param, p.Write)
+	if err != nil {
+		fmt.Println()
+		return err
+	}
+	p.Clear()
+	tryPrintMarkdown(answer.Markdown())
 	return nil
 }
 
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// streamPrinter prints streamed text and keeps it so it can be erased again
+type streamPrinter struct {
+	out  *os.File
+	text strings.Builder
+}
+
+func (p *streamPrinter) Write(delta string) error {
+	p.text.WriteString(delta)
+	_, err := fmt.Fprint(p.out, delta)
+	return err
+}
+
+// Clear moves the cursor back to where the text started and erases everything below
+func (p *streamPrinter) Clear() {
+	width, _, err := term.GetSize(int(p.out.Fd()))
+	if err != nil || width <= 0 {
+		fmt.Fprintln(p.out)
+		return
+	}
+
+	rows := 0
+	for _, line := range strings.Split(p.text.String(), "\n") {
+		rows += max(1, (runewidth.StringWidth(line)+width-1)/width)
+	}
+	if rows > 1 {
+		fmt.Fprintf(p.out, "\033[%dA", rows-1)
+	}
+	fmt.Fprint(p.out, "\r\033[J")
+}
+
+func formatScore(score float64) string {
+	if score == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.4f", score)
+}
+
+// formatSource prints where a chunk comes from, chunks indexed by older releases only have a document ID
+func formatSource(chunk rag.DocumentChunk) string {
+	if chunk.FilePath == "" {
+		return chunk.DocumentID
+	}
+	source := fmt.Sprintf("%s#%d", chunk.FilePath, chunk.Index)
+	if lines := rag.FormatLines(chunk.LineStart, chunk.LineEnd); lines != "" {
+		source = chunk.FilePath + lines
+	}
+	if symbol := rag.FormatSymbol(chunk.SymbolKind, chunk.Symbol); symbol != "" {
+		source += fmt.Sprintf(" (%s)", symbol)
+	} else if chunk.HeadingPath != "" {
+		source += fmt.Sprintf(" (%s)", chunk.HeadingPath)
+	}
+	if pages := rag.FormatPages(chunk.PageStart, chunk.PageEnd); pages != "" {
+		source += ", " + pages
+	}
+	if commit := rag.FormatCommit(chunk.CommitSHA, chunk.CommitDate); commit != "" {
+		source += ", " + commit
+	}
+	return source
+}
+
 func tryPrintMarkdown(content string) {
 	rendered, err := glamour.Render(content, "dark")
 	if err != nil {
@@ -201,21 +328,22 @@ func tryPrintMarkdown(content string) {
 }
 
 // processQueryFile handles reading queries from different file formats
-func processQueryFile(ctx context.Context, r *rag.RAG, filePath string, retrievalLimit int, selectedLimit int, vectorOnly bool, systemPrompt string, jobs int) error {
+func processQueryFile(ctx context.Context, r *rag.RAG, filePath string, param rag.AskParameter, vectorOnly, stream bool, jobs int) error {
 	ext := strings.ToLower(filepath.Ext(filePath))
 
 	switch ext {
 	case ".ndjson", ".jsonl":
-		return processNdjsonFile(ctx, r, filePath, retrievalLimit, selectedLimit, vectorOnly, systemPrompt, jobs)
+		// Concurrent answers would interleave on the terminal
+		return processNdjsonFile(ctx, r, filePath, param, vectorOnly, stream && jobs == 1, jobs)
 	case ".txt":
-		return processTextFile(ctx, r, filePath, retrievalLimit, selectedLimit, vectorOnly, systemPrompt)
+		return processTextFile(ctx, r, filePath, param, vectorOnly, stream)
 	default:
 		return fmt.Errorf("unsupported file format: %s. Supported formats: .ndjson, .jsonl, .txt", ext)
 	}
 }
 
 // processNdjsonFile processes NDJSON files with query items
-func processNdjsonFile(ctx context.Context, r *rag.RAG, filePath string, retrievalLimit int, selectedLimit int, vectorOnly bool, systemPrompt string, jobs int) error {
+func processNdjsonFile(ctx context.Context, r *rag.RAG, filePath string, param rag.AskParameter, vectorOnly, stream bool, jobs int) error {
 	f, err := os.Open(filePath)
 	if err != nil {
 		return err
@@ -234,14 +362,16 @@ func processNdjsonFile(ctx context.Context, r *rag.RAG, filePath string, retriev
 			if err != nil {
 				return err
 			}
-			return ask(ctx, r, item.Query, retrievalLimit, selectedLimit, vectorOnly, systemPrompt)
+			p := param
+			p.Query = item.Query
+			return ask(ctx, r, p, vectorOnly, stream)
 		})
 	}
 	return g.Wait()
 }
 
 // processTextFile processes plain text files with one query per line
-func processTextFile(ctx context.Context, r *rag.RAG, filePath string, retrievalLimit int, selectedLimit int, vectorOnly bool, systemPrompt string) error {
+func processTextFile(ctx context.Context, r *rag.RAG, filePath string, param rag.AskParameter, vectorOnly, stream bool) error {
 	content, err := os.ReadFile(filePath)
 	if err != nil {
 		return err
@@ -259,7 +389,9 @@ func processTextFile(ctx context.Context, r *rag.RAG, filePath string, retrieval
 		queryCount++
 		fmt.Printf("Processing query %d: %s\n", queryCount, line)
 
-		err := ask(ctx, r, line, retrievalLimit, selectedLimit, vectorOnly, systemPrompt)
+		p := param
+		p.Query = line
+		err := ask(ctx, r, p, vectorOnly, stream)
 		if err != nil {
 			fmt.Printf("Error processing query '%s': %v\n", line, err)
 			continue
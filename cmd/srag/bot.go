@@ -111,6 +111,7 @@ type BotManager struct {
 	bots         []Bot
 	rag          *rag.RAG
 	requestQueue *RequestQueue
+	minScore     float64
 	ctx          context.Context
 	cancel       context.CancelFunc
 }
@@ -126,6 +127,12 @@ func NewBotManager(r *rag.RAG, maxWorkers int) *BotManager {
 	}
 }
 
+// WithMinScore drops retrieved chunks below the similarity score before they reach the LLM
+func (bm *BotManager) WithMinScore(minScore float64) *BotManager {
+	bm.minScore = minScore
+	return bm
+}
+
 func (bm *BotManager) AddBot(bot Bot) {
 	bm.bots = append(bm.bots, bot)
 }
@@ -192,31 +199,44 @@ func (bm *BotManager) handleRequest(item QueueItem) {
 }
 
 func (bm *BotManager) processQuery(ctx context.Context, query string) (string, error) {
+	askParam := &rag.AskParameter{
+		Query:          query,
+		RetrievalLimit: 40,
+		SelectedLimit:  10,
+		MinScore:       bm.minScore,
+		Citations:      true,
+	}
+
 	// Search for relevant document chunks
-	chunks, err := bm.rag.QueryDocumentChunks(ctx, query, 40)
+	chunks, err := bm.rag.QueryDocumentChunks(ctx, askParam)
 	if err != nil {
 		return "", fmt.Errorf("failed to query document chunks: %w", err)
 	}
+	if len(chunks) == 0 {
+		return "Sorry, I couldn't find anything relevant in the documents.", nil
+	}
 
 	// Rerank the chunks
-	chunks, err = bm.rag.Rerank(ctx, query, chunks, 10)
+	chunks, err = bm.rag.Rerank(ctx, query, chunks, askParam.SelectedLimit)
 	if err != nil {
 		return "", fmt.Errorf("failed to rerank chunks: %w", err)
 	}
-
-	// Generate response using LLM
-	askParam := &rag.AskParameter{
-		Query:          query,
-		RetrievalLimit: 50,
-		SelectedLimit:  10,
+	for _, chunk := range chunks {
+		log.Debug().Str("chunk_id", chunk.ID).
+			Int("retrieval_rank", chunk.RetrievalRank).
+			Int("rerank_rank", chunk.RerankRank).
+			Float64("score", chunk.Score).
+			Msg("Selected chunk")
 	}
 
-	response, err := bm.rag.Ask(ctx, askParam)
+	// Generate response using LLM
+	askParam.SelectedChunks = chunks
+	answer, err := bm.rag.Ask(ctx, askParam)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate response: %w", err)
 	}
 
-	return response, nil
+	return answer.Markdown(), nil
 }
 
 func (bm *BotManager) EnqueueRequest(id, query, userID, platform string, callback func(string, error), queueNotifyCallback func(int)) {
@@ -295,6 +315,10 @@ var botCmd = &cli.Command{
 			Usage: "Maximum number of concurrent LLM requests",
 			Value: 3,
 		},
+		&cli.FloatFlag{
+			Name:  "min-score",
+			Usage: "Minimum similarity score of chunks used to answer",
+		},
 	},
 	Action: func(ctx context.Context, command *cli.Command) error {
 		dsn := command.String("dsn")
@@ -312,7 +336,7 @@ var botCmd = &cli.Command{
 			return fmt.Errorf("at least one bot token (telegram or slack) must be provided")
 		}
 
-		db, err := rag.OpenDuckDB(dsn, embeddingDimension)
+		store, err := rag.OpenStore(dsn, embeddingDimension)
 		if err != nil {
 			return err
 		}
@@ -320,14 +344,14 @@ var botCmd = &cli.Command{
 		embeddingClient := openai.NewClient(option.WithBaseURL(embeddingBaseURL))
 		assistantClient := openai.NewClient(option.WithBaseURL(assistantBaseURL))
 		r := &rag.RAG{
-			DB:              db,
+			Store:           store,
 			EmbeddingClient: &embeddingClient,
 			EmbeddingModel:  embeddingModel,
 			AssistantClient: &assistantClient,
 			AssistantModel:  assistantModel,
 		}
 
-		botManager := NewBotManager(r, maxWorkers)
+		botManager := NewBotManager(r, maxWorkers).WithMinScore(command.Float("min-score"))
 
 		// Add Telegram bot if token is provided
 		if telegramToken != "" {
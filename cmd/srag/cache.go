@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var cacheCmd = &cli.Command{
+	Name:  "cache",
+	Usage: "Inspect and prune the embedding cache",
+	Commands: []*cli.Command{
+		cacheStatsCmd,
+		cachePruneCmd,
+	},
+}
+
+var cacheStatsCmd = &cli.Command{
+	Name:  "stats",
+	Usage: "Show the cached embeddings per model and dimension",
+	Flags: []cli.Flag{
+		flagDSN,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		cache, closeStore, err := openEmbeddingCache(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		defer closeStore()
+
+		summaries, err := cache.EmbeddingCacheSummary(ctx)
+		if err != nil {
+			return err
+		}
+		if len(summaries) == 0 {
+			fmt.Println("Embedding cache is empty")
+			return nil
+		}
+
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"Model", "Dimensions", "Entries", "Last used"})
+		for _, s := range summaries {
+			tw.AppendRow(table.Row{s.Model, s.Dimensions, s.Entries, s.LastUsedAt.Local().Format("2006-01-02 15:04:05")})
+		}
+		fmt.Println(tw.Render())
+		return nil
+	},
+}
+
+var cachePruneCmd = &cli.Command{
+	Name:  "prune",
+	Usage: "Delete the cached embeddings selected by --unused, --unused-for or --other-models",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagEmbeddingModel,
+		flagEmbeddingDimension,
+		&cli.BoolFlag{Name: "unused", Usage: "Delete embeddings of text not in any stored chunk"},
+		&cli.DurationFlag{Name: "unused-for", Usage: "Delete embeddings not used for this long, e.g. 720h"},
+		&cli.BoolFlag{Name: "other-models", Usage: "Delete embeddings of models or dimensions other than the configured ones"},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		opts := rag.PruneOptions{
+			Unused:    command.Bool("unused"),
+			UnusedFor: command.Duration("unused-for"),
+		}
+		if command.Bool("other-models") {
+			opts.KeepModel = command.String("embedding-model")
+			opts.KeepDimensions = command.Int64("embedding-dimension")
+			if opts.KeepModel == "" {
+				return errors.New("--other-models requires the embedding model")
+			}
+		}
+		if !opts.Unused && opts.UnusedFor == 0 && opts.KeepModel == "" {
+			return errors.New("nothing to prune, pass --unused, --unused-for or --other-models")
+		}
+
+		cache, closeStore, err := openEmbeddingCache(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		defer closeStore()
+
+		deleted, err := cache.PruneEmbeddingCache(ctx, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %d cached embeddings\n", deleted)
+		return nil
+	},
+}
+
+func openEmbeddingCache(dsn string) (rag.EmbeddingCacheStore, func(), error) {
+	store, err := rag.OpenStore(dsn, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	closeStore := func() { _ = store.Close() }
+	cache, ok := store.(rag.EmbeddingCacheStore)
+	if !ok {
+		closeStore()
+		return nil, nil, errors.Newf("store %T has no embedding cache", store)
+	}
+	return cache, closeStore, nil
+}
@@ -7,6 +7,9 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v3"
 
 	"github.com/fanyang89/rag/v1"
@@ -35,27 +38,42 @@ var chunkCmd = &cli.Command{
 		&cli.StringFlag{
 			Name:    "strategy",
 			Aliases: []string{"s"},
-			Usage:   "Chunking strategy: fixed, semantic, sentence, adaptive",
+			Usage:   "Chunking strategy: fixed, semantic, sentence, adaptive, markdown",
 			Value:   "adaptive",
 			Config:  trimSpace,
 		},
 		&cli.IntFlag{
 			Name:    "max-size",
 			Aliases: []string{"max"},
-			Usage:   "Maximum chunk size in characters",
+			Usage:   "Maximum chunk size in the size unit",
 			Value:   1000,
 		},
 		&cli.IntFlag{
 			Name:    "min-size",
 			Aliases: []string{"min"},
-			Usage:   "Minimum chunk size in characters",
+			Usage:   "Minimum chunk size in the size unit",
 			Value:   100,
 		},
 		&cli.IntFlag{
 			Name:  "overlap",
-			Usage: "Overlap size in characters",
+			Usage: "Overlap size in the size unit",
 			Value: 50,
 		},
+		&cli.StringFlag{
+			Name:   "size-unit",
+			Usage:  "Unit of chunk sizes: chars, tokens",
+			Value:  "chars",
+			Config: trimSpace,
+		},
+		&cli.StringFlag{
+			Name:   "vocab-file",
+			Usage:  "BPE vocab of the embedding model in tiktoken format, e.g. cl100k_base.tiktoken, to count tokens",
+			Config: trimSpace,
+		},
+		&cli.IntFlag{
+			Name:  "max-input-tokens",
+			Usage: "Split chunks with more tokens than the embedding model accepts, 0 disables",
+		},
 		&cli.StringFlag{
 			Name:    "language",
 			Aliases: []string{"l"},
@@ -63,6 +81,23 @@ var chunkCmd = &cli.Command{
 			Value:   "auto",
 			Config:  trimSpace,
 		},
+		&cli.FloatFlag{
+			Name:  "similarity-threshold",
+			Usage: "Semantic strategy ends a chunk where adjacent sentences are less similar than this",
+			Value: 0.7,
+		},
+		&cli.IntFlag{
+			Name:  "parent-size",
+			Usage: "Link chunks to parent sections of up to this size in the size unit for small-to-big retrieval, 0 disables",
+		},
+		&cli.IntFlag{
+			Name:  "sentence-window",
+			Usage: "Number of sentences embedded together by the semantic strategy, and per chunk by the sentence strategy",
+			Value: 3,
+		},
+		flagEmbeddingBaseURL,
+		flagEmbeddingModel,
+		flagEmbeddingDimension,
 	},
 	Action: func(ctx context.Context, command *cli.Command) error {
 		inputPath := command.StringArg("input")
@@ -79,17 +114,35 @@ var chunkCmd = &cli.Command{
 		// Get configuration file path
 		configPath := command.String("config")
 
+		// The semantic strategy embeds sentences if an embedding endpoint is configured
+		var embedder *rag.RAG
+		if baseURL := command.String("embedding-base-url"); baseURL != "" {
+			embeddingClient := openai.NewClient(option.WithBaseURL(baseURL))
+			embedder = &rag.RAG{
+				EmbeddingClient:     &embeddingClient,
+				EmbeddingModel:      command.String("embedding-model"),
+				EmbeddingDimensions: command.Int64("embedding-dimension"),
+			}
+		}
+
 		// If no configuration file specified, create temporary config from command line parameters
 		if configPath == "" {
 			config := &rag.ChunkingConfig{
 				MaxChunkSize:        command.Int("max-size"),
 				MinChunkSize:        command.Int("min-size"),
 				OverlapSize:         command.Int("overlap"),
-				SentenceWindow:      3,
+				SizeUnit:            command.String("size-unit"),
+				VocabFile:           command.String("vocab-file"),
+				MaxInputTokens:      command.Int("max-input-tokens"),
+				SentenceWindow:      command.Int("sentence-window"),
 				Strategy:            command.String("strategy"),
 				Language:            command.String("language"),
 				PreserveSections:    true,
-				SimilarityThreshold: 0.7,
+				SimilarityThreshold: command.Float("similarity-threshold"),
+				ParentChunkSize:     command.Int("parent-size"),
+			}
+			if config.Strategy == "semantic" && embedder == nil {
+				log.Warn().Msg("No embedding base URL, semantic chunks are packed by paragraph")
 			}
 
 			// Create chunker
@@ -97,15 +150,18 @@ var chunkCmd = &cli.Command{
 			if err != nil {
 				return fmt.Errorf("failed to create chunker: %w", err)
 			}
+			if embedder != nil {
+				chunker.WithEmbedder(embedder)
+			}
 
-			// Read and chunk document
-			content, err := os.ReadFile(inputPath)
+			// Load and chunk document
+			file, err := rag.LoadFile(ctx, inputPath)
 			if err != nil {
 				return fmt.Errorf("failed to read input file: %w", err)
 			}
 
 			fileName := filepath.Base(inputPath)
-			doc, err := chunker.ChunkDocument(string(content), fileName)
+			doc, err := chunker.ChunkLoadedFile(ctx, file, fileName)
 			if err != nil {
 				return fmt.Errorf("failed to chunk document: %w", err)
 			}
@@ -127,7 +183,7 @@ var chunkCmd = &cli.Command{
 		}
 
 		// Use configuration file
-		err := rag.ChunkMarkdownFile(inputPath, configPath, outputPath)
+		err := rag.ChunkMarkdownFile(ctx, inputPath, configPath, outputPath, embedder)
 		if err != nil {
 			return fmt.Errorf("failed to chunk document: %w", err)
 		}
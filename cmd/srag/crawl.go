@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var crawlCmd = &cli.Command{
+	Name:  "crawl",
+	Usage: "Crawl a website, index its pages and make embeddings",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "url"},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+		flagEmbeddingBaseURL,
+		flagEmbeddingModel,
+		flagEmbeddingDimension,
+		&cli.StringFlag{
+			Name:    "chunker-config",
+			Aliases: []string{"c"},
+			Usage:   "Chunker configuration file path",
+			Config:  trimSpace,
+		},
+		&cli.IntFlag{
+			Name:  "depth",
+			Usage: "Number of links followed from the start page",
+			Value: 3,
+		},
+		&cli.IntFlag{
+			Name:  "max-pages",
+			Usage: "Maximum number of pages fetched, 0 is unlimited",
+			Value: 1000,
+		},
+		&cli.DurationFlag{
+			Name:  "delay",
+			Usage: "Delay between requests, a longer Crawl-delay of robots.txt wins",
+			Value: 500 * time.Millisecond,
+		},
+		&cli.BoolFlag{
+			Name:  "sitemap",
+			Usage: "Fetch the pages listed by the sitemap of the site instead of following links",
+		},
+		&cli.StringFlag{
+			Name:  "user-agent",
+			Usage: "User agent of requests, robots.txt rules are selected by its product token",
+			Value: rag.DefaultCrawlUserAgent,
+		},
+		&cli.IntFlag{
+			Name:    "workers",
+			Aliases: []string{"j"},
+			Usage:   "Number of embedding batches computed concurrently",
+			Value:   3,
+		},
+		&cli.IntFlag{
+			Name:  "embedding-retries",
+			Usage: "Retries of embedding requests failing with 429, 5xx or a network error, with exponential backoff",
+			Value: 5,
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		startURL := command.StringArg("url")
+		if startURL == "" {
+			_ = cli.ShowSubcommandHelp(command)
+			return errors.New("url is required")
+		}
+
+		embeddingDimension := int64(command.Int("embedding-dimension"))
+		store, err := rag.OpenStore(command.String("dsn"), embeddingDimension)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = store.Close() }()
+		embeddingDimension = rag.GetStoredEmbeddingDimension(store, embeddingDimension)
+
+		// Retries are done by ComputeEmbeddings with backoff
+		embeddingClient := openai.NewClient(option.WithBaseURL(command.String("embedding-base-url")),
+			option.WithMaxRetries(0))
+		retries := command.Int("embedding-retries")
+		if retries == 0 {
+			retries = -1
+		}
+		r := rag.RAG{
+			Store:               store,
+			EmbeddingClient:     &embeddingClient,
+			EmbeddingModel:      command.String("embedding-model"),
+			EmbeddingDimensions: embeddingDimension,
+			EmbeddingRetry:      rag.RetryPolicy{MaxRetries: retries},
+		}
+		err = r.CheckEmbeddingModel(ctx)
+		if err != nil {
+			return err
+		}
+
+		config, err := rag.LoadChunkingConfig(command.String("chunker-config"))
+		if err != nil {
+			return fmt.Errorf("failed to load chunking config: %w", err)
+		}
+		chunker, err := rag.NewDocumentChunker(config, "")
+		if err != nil {
+			return fmt.Errorf("failed to create chunker: %w", err)
+		}
+		chunker.WithEmbedder(&r)
+
+		crawler := rag.NewCrawler(command.Int("depth"))
+		crawler.UserAgent = command.String("user-agent")
+		crawler.MaxPages = command.Int("max-pages")
+		crawler.Delay = command.Duration("delay")
+		crawler.Sitemap = command.Bool("sitemap")
+		crawler.State = r.CrawlState()
+
+		var fetched, unchanged, removed int
+		err = crawler.Crawl(ctx, startURL, func(page *rag.CrawledPage) error {
+			chunks, err := r.IndexPage(ctx, chunker, page)
+			switch {
+			case err != nil:
+				// A page failing to index is retried by the next crawl
+				log.Error().Err(err).Str("url", page.URL).Msg("Failed to index page")
+			case page.NotModified:
+				unchanged++
+			case page.Gone:
+				removed++
+				log.Info().Str("url", page.URL).Msg("Removed page")
+			default:
+				fetched++
+				log.Info().Str("url", page.URL).Int("depth", page.Depth).Int("chunks", chunks).
+					Msg("Processed page")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		log.Info().Int("processed", fetched).Int("unchanged", unchanged).Int("removed", removed).
+			Msg("Crawl completed")
+
+		// Keyword index is static in DuckDB, refresh it for the new chunks
+		err = store.RebuildKeywordIndex(ctx)
+		if err != nil {
+			return err
+		}
+
+		log.Info().Msg("Computing embeddings for new chunks")
+		err = r.ComputeEmbeddings(ctx, true, command.Int("workers"), func() {})
+		var embeddingErr *rag.EmbeddingError
+		if errors.As(err, &embeddingErr) {
+			log.Warn().Int("failed", embeddingErr.Failed()).
+				Msg("Chunks without embedding are retried by the next crawl")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to compute embeddings: %w", err)
+		}
+		log.Info().Msg("Embedding computation completed")
+		return nil
+	},
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/urfave/cli/v3"
@@ -25,17 +26,36 @@ var getChunkCmd = &cli.Command{
 			return errors.New("id is required")
 		}
 		dsn := command.String("dsn")
-		db, err := rag.OpenDuckDB(dsn, 0)
+		store, err := rag.OpenStore(dsn, 0)
 		if err != nil {
 			return err
 		}
 
-		r := rag.RAG{DB: db}
-		c, err := r.GetDocumentChunk(id)
+		r := rag.RAG{Store: store}
+		c, err := r.GetDocumentChunk(ctx, id)
 		if err != nil {
 			return err
 		}
 		fmt.Printf("id=%v document='%s'\n", c.ID, c.DocumentID)
+		if c.FilePath != "" {
+			fmt.Printf("source='%s' offsets=%d-%d chunk=%d\n", c.FilePath, c.StartOffset, c.EndOffset, c.Index)
+		}
+		if c.HeadingPath != "" {
+			fmt.Printf("heading='%s'\n", c.HeadingPath)
+		}
+		if pages := rag.FormatPages(c.PageStart, c.PageEnd); pages != "" {
+			fmt.Printf("pages='%s'\n", pages)
+		}
+		if symbol := rag.FormatSymbol(c.SymbolKind, c.Symbol); symbol != "" {
+			fmt.Printf("symbol='%s' lines=%d-%d\n", symbol, c.LineStart, c.LineEnd)
+		}
+		if c.CommitSHA != "" {
+			fmt.Printf("commit='%s'", c.CommitSHA)
+			if c.CommitDate != nil {
+				fmt.Printf(" date='%s'", c.CommitDate.Format(time.RFC3339))
+			}
+			fmt.Println()
+		}
 		fmt.Println(c.Text)
 		return nil
 	},
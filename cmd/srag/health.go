@@ -30,11 +30,11 @@ var healthCmd = &cli.Command{
 		if dsn == "" {
 			return errors.New("dsn is required")
 		}
-		db, err := rag.OpenDuckDB(dsn, embeddingDimension)
+		store, err := rag.OpenStore(dsn, embeddingDimension)
 		if err != nil {
 			return err
 		}
-		err = db.PingContext(ctx)
+		err = store.Ping(ctx)
 		if err != nil {
 			return err
 		}
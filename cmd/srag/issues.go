@@ -78,11 +78,11 @@ var issueBotCmd = &cli.Command{
 		auditLogDir := command.String("audit-log-dir")
 
 		// Initialize RAG
-		db, err := rag.OpenDuckDB(dsn, embeddingDimension)
+		store, err := rag.OpenStore(dsn, embeddingDimension)
 		if err != nil {
 			return fmt.Errorf("failed to open database: %w", err)
 		}
-		defer db.Close()
+		defer store.Close()
 
 		// Create audit logger if trace is enabled
 		auditLogger := rag.NewAuditLogger(traceEnabled, auditLogDir)
@@ -101,7 +101,7 @@ var issueBotCmd = &cli.Command{
 		}
 
 		r := &rag.RAG{
-			DB:              db,
+			Store:           store,
 			EmbeddingClient: embeddingClientInterface,
 			EmbeddingModel:  embeddingModel,
 			AssistantClient: assistantClientInterface,
@@ -554,12 +554,14 @@ func (p *IssueProcessor) generateAnswer(ctx context.Context, issue GitHubIssue)
 		Query:          query,
 		RetrievalLimit: p.RAGLimit * 2, // Retrieve more chunks for LLM selection
 		SelectedLimit:  p.RAGLimit,
+		Citations:      true,
 	}
 
-	answer, err := p.RAG.Ask(ctx, param)
+	result, err := p.RAG.Ask(ctx, param)
 	if err != nil {
 		return "", err
 	}
+	answer := result.Markdown()
 
 	// Evaluate confidence in the generated answer
 	confidencePrompt := fmt.Sprintf(`You are an expert evaluator. Analyze the following question and answer pair to determine if the answer is confident and accurate.
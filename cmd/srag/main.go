@@ -15,6 +15,8 @@ import (
 var cmd = &cli.Command{
 	Name:  "SlimRAG",
 	Usage: "RAG for minimalists",
+	// Commas separate the values of a single --filter
+	DisableSliceFlagSeparator: true,
 	Commands: []*cli.Command{
 		serveCmd,
 		askCmd,
@@ -22,7 +24,12 @@ var cmd = &cli.Command{
 		healthCmd,
 		chunkCmd,
 		updateCmd,
+		crawlCmd,
 		issueBotCmd,
+		migrateCmd,
+		mcpCmd,
+		cacheCmd,
+		reembedCmd,
 	},
 }
 
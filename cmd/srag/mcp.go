@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+	"github.com/fioepq9/pzlog"
+)
+
+var mcpCmd = &cli.Command{
+	Name:  "mcp",
+	Usage: "Serve the knowledge base over the Model Context Protocol (stdio, or streamable HTTP with --http)",
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "http", Usage: "Serve streamable HTTP at /mcp on this address instead of stdio, e.g. :5001"},
+		flagDSN,
+		flagEmbeddingBaseURL,
+		flagEmbeddingModel,
+		flagEmbeddingDimension,
+		flagAssistantBaseURL,
+		flagAssistantModel,
+		flagAssistantAPIKey,
+		&cli.FloatFlag{Name: "vector-weight", Value: rag.DefaultVectorWeight, Usage: "Fusion weight of vector search"},
+		&cli.FloatFlag{Name: "keyword-weight", Value: rag.DefaultKeywordWeight, Usage: "Fusion weight of BM25 keyword search"},
+		&cli.FloatFlag{Name: "min-score", Usage: "Default minimum similarity score of retrieved chunks"},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		bind := command.String("http")
+		if bind == "" {
+			// stdout carries the protocol
+			log.Logger = log.Output(pzlog.NewPtermWriter(func(w *pzlog.PtermWriter) { w.Out = os.Stderr }))
+			zerolog.SetGlobalLevel(zerolog.WarnLevel)
+		}
+
+		embeddingDimension := command.Int64("embedding-dimension")
+		store, err := rag.OpenStore(command.String("dsn"), embeddingDimension)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = store.Close() }()
+
+		embeddingClient := openai.NewClient(option.WithBaseURL(command.String("embedding-base-url")))
+		assistantClient := openai.NewClient(
+			option.WithBaseURL(command.String("assistant-base-url")),
+			option.WithAPIKey(command.String("assistant-api-key")),
+		)
+		r := &rag.RAG{
+			Store:               store,
+			EmbeddingClient:     &embeddingClient,
+			EmbeddingModel:      command.String("embedding-model"),
+			EmbeddingDimensions: embeddingDimension,
+			AssistantClient:     &assistantClient,
+			AssistantModel:      command.String("assistant-model"),
+		}
+
+		s := rag.NewMCPServer(r).
+			WithFusionWeights(command.Float("vector-weight"), command.Float("keyword-weight")).
+			WithMinScore(command.Float("min-score"))
+		if bind == "" {
+			return s.ServeStdio(ctx, os.Stdin, os.Stdout)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/mcp", s.HTTPHandler())
+		srv := &http.Server{Addr: bind, Handler: mux}
+		go func() {
+			<-ctx.Done()
+			closeCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_ = srv.Shutdown(closeCtx)
+		}()
+		log.Info().Str("bind", bind).Msg("Serving MCP over streamable HTTP at /mcp")
+		err = srv.ListenAndServe()
+		if err == nil || errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	},
+}
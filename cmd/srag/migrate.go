@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var migrateCmd = &cli.Command{
+	Name:  "migrate",
+	Usage: "Upgrade the database schema to the latest version",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagEmbeddingDimension,
+		&cli.BoolFlag{Name: "status", Usage: "Show applied and pending migrations without changing anything"},
+		&cli.BoolFlag{Name: "dry-run", Usage: "Print the statements of pending migrations without running them"},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		m, err := rag.OpenMigrator(command.String("dsn"), command.Int64("embedding-dimension"))
+		if err != nil {
+			return err
+		}
+		defer func() { _ = m.Close() }()
+
+		version, err := m.SchemaVersion(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Schema version: %d, latest: %d\n", version, m.LatestVersion())
+
+		if command.Bool("status") {
+			printMigrationStatus(m.Migrations(), version)
+			return nil
+		}
+
+		if command.Bool("dry-run") {
+			pending, err := m.Pending(ctx)
+			if err != nil {
+				return err
+			}
+			if len(pending) == 0 {
+				fmt.Println("Nothing to migrate")
+			}
+			printMigrationSteps(pending)
+			return nil
+		}
+
+		applied, err := m.Migrate(ctx)
+		printMigrationSteps(applied)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("Nothing to migrate")
+		} else {
+			fmt.Printf("Migrated to version %d\n", applied[len(applied)-1].Version)
+		}
+		return nil
+	},
+}
+
+func printMigrationStatus(migrations []rag.Migration, version int) {
+	tw := table.NewWriter()
+	tw.AppendHeader(table.Row{"Version", "Description", "Status"})
+	for _, migration := range migrations {
+		status := "pending"
+		if migration.Version <= version {
+			status = "applied"
+		}
+		tw.AppendRow(table.Row{migration.Version, migration.Description, status})
+	}
+	fmt.Println(tw.Render())
+}
+
+func printMigrationSteps(steps []rag.MigrationStep) {
+	for _, step := range steps {
+		fmt.Printf("-- %d: %s\n", step.Version, step.Description)
+		for _, statement := range step.Statements {
+			fmt.Printf("%s;\n", statement)
+		}
+		fmt.Println()
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var reembedCmd = &cli.Command{
+	Name:  "reembed",
+	Usage: "Re-embed all chunks with another embedding model or dimension",
+	Description: "Chunks are embedded into a shadow table while queries keep using the current embeddings, " +
+		"then the vector index is rebuilt and the new embeddings are swapped in. " +
+		"An interrupted run is resumed by running the same command again. " +
+		"It runs in the foreground, POST /v1/reembed runs it in the background of serve instead, which keeps " +
+		"answering and switches to the new model at the swap. Other readers are restarted with the new model after the swap.",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagEmbeddingBaseURL,
+		&cli.StringFlag{
+			Name:     "model",
+			Usage:    "Embedding model to switch to",
+			Required: true,
+		},
+		&cli.Int64Flag{
+			Name:     "dimension",
+			Usage:    "Embedding dimension of the model",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:    "workers",
+			Aliases: []string{"j"},
+			Usage:   "Number of embedding batches computed concurrently",
+			Value:   3,
+		},
+		&cli.IntFlag{
+			Name:  "embedding-batch-size",
+			Usage: "Maximum number of chunks per embedding request",
+			Value: rag.DefaultEmbeddingBatchSize,
+		},
+		&cli.IntFlag{
+			Name:  "embedding-batch-chars",
+			Usage: "Maximum number of characters per embedding request",
+			Value: rag.DefaultEmbeddingBatchChars,
+		},
+		&cli.IntFlag{
+			Name:  "embedding-retries",
+			Usage: "Retries of embedding requests failing with 429, 5xx or a network error, with exponential backoff",
+			Value: 5,
+		},
+		&cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "Embed every chunk without reading or writing the embedding cache",
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		model := command.String("model")
+		dimension := command.Int64("dimension")
+		if dimension <= 0 {
+			return fmt.Errorf("invalid dimension %d", dimension)
+		}
+
+		store, err := rag.OpenStore(command.String("dsn"), dimension)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = store.Close() }()
+
+		// Retries are done by the RAG with backoff
+		embeddingClient := openai.NewClient(option.WithBaseURL(command.String("embedding-base-url")),
+			option.WithMaxRetries(0))
+		retries := command.Int("embedding-retries")
+		if retries == 0 {
+			retries = -1
+		}
+		r := rag.RAG{
+			Store:               store,
+			EmbeddingClient:     &embeddingClient,
+			EmbeddingBatchSize:  command.Int("embedding-batch-size"),
+			EmbeddingBatchChars: command.Int("embedding-batch-chars"),
+			EmbeddingRetry:      rag.RetryPolicy{MaxRetries: retries},
+
+			DisableEmbeddingCache: command.Bool("no-cache"),
+		}
+
+		log.Info().Str("model", model).Int64("dimension", dimension).
+			Int64("current_dimension", store.EmbeddingDimension()).Msg("Re-embedding chunks")
+		err = r.Reembed(ctx, model, dimension, command.Int("workers"), func() {})
+		var embeddingErr *rag.EmbeddingError
+		if errors.As(err, &embeddingErr) {
+			log.Warn().Int("failed", embeddingErr.Failed()).
+				Msg("Embeddings were not swapped, run reembed again to retry the failed chunks")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to re-embed: %w", err)
+		}
+
+		log.Info().Str("model", model).Int64("dimension", dimension).Msg("Swapped in the new embeddings")
+		return nil
+	},
+}
@@ -28,6 +28,13 @@ var serveCmd = &cli.Command{
 		flagEmbeddingDimension,
 		flagAssistantBaseURL,
 		flagAssistantModel,
+		flagAssistantAPIKey,
+		flagTrace,
+		flagAuditLogDir,
+		&cli.FloatFlag{Name: "vector-weight", Value: rag.DefaultVectorWeight, Usage: "Default fusion weight of vector search"},
+		&cli.FloatFlag{Name: "keyword-weight", Value: rag.DefaultKeywordWeight, Usage: "Default fusion weight of BM25 keyword search"},
+		&cli.FloatFlag{Name: "min-score", Usage: "Default minimum similarity score of retrieved chunks"},
+		&cli.StringFlag{Name: "profiles", Usage: "JSON file of profiles served as models by /v1/chat/completions"},
 	},
 	Action: func(ctx context.Context, command *cli.Command) error {
 		dsn := command.String("dsn")
@@ -36,15 +43,48 @@ var serveCmd = &cli.Command{
 		embeddingDimension := command.Int64("embedding-dimension")
 		bind := command.String("bind")
 
-		db, err := rag.OpenDuckDB(dsn, embeddingDimension)
+		store, err := rag.OpenStore(dsn, embeddingDimension)
 		if err != nil {
 			return err
 		}
 
-		client := openai.NewClient(option.WithBaseURL(embeddingBaseURL))
-		r := &rag.RAG{DB: db, EmbeddingClient: &client, EmbeddingModel: embeddingModel}
+		assistantModel := command.String("assistant-model")
+		embeddingClient := openai.NewClient(option.WithBaseURL(embeddingBaseURL))
+		assistantClient := openai.NewClient(
+			option.WithBaseURL(command.String("assistant-base-url")),
+			option.WithAPIKey(command.String("assistant-api-key")),
+		)
 
-		s := rag.NewServer(r)
+		// Wrap clients with audit logging if enabled
+		var embeddingClientInterface interface{} = &embeddingClient
+		var assistantClientInterface interface{} = &assistantClient
+		if command.Bool("trace") {
+			auditLogger := rag.NewAuditLogger(true, command.String("audit-log-dir"))
+			embeddingClientInterface = rag.NewAuditEmbeddingsClient(&embeddingClient, auditLogger, embeddingModel)
+			assistantClientInterface = rag.NewAuditChatClient(&assistantClient, auditLogger, assistantModel)
+		}
+
+		r := &rag.RAG{
+			Store:               store,
+			EmbeddingClient:     embeddingClientInterface,
+			EmbeddingModel:      embeddingModel,
+			EmbeddingDimensions: embeddingDimension,
+			AssistantClient:     assistantClientInterface,
+			AssistantModel:      assistantModel,
+		}
+
+		var profiles []rag.Profile
+		if path := command.String("profiles"); path != "" {
+			profiles, err = rag.LoadProfiles(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		s := rag.NewServer(r).
+			WithFusionWeights(command.Float("vector-weight"), command.Float("keyword-weight")).
+			WithMinScore(command.Float("min-score")).
+			WithProfiles(profiles)
 		go func() {
 			select {
 			case <-ctx.Done():
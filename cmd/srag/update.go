@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -27,6 +28,13 @@ var updateCmd = &cli.Command{
 		flagEmbeddingBaseURL,
 		flagEmbeddingModel,
 		flagEmbeddingDimension,
+		flagAssistantBaseURL,
+		flagAssistantAPIKey,
+		&cli.StringFlag{
+			Name:    "caption-model",
+			Usage:   "Vision model of the assistant endpoint captioning images referenced by markdown, empty disables",
+			Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_CAPTION_MODEL")),
+		},
 		&cli.StringFlag{
 			Name:    "chunker-config",
 			Aliases: []string{"c"},
@@ -36,9 +44,28 @@ var updateCmd = &cli.Command{
 		&cli.IntFlag{
 			Name:    "workers",
 			Aliases: []string{"j"},
-			Usage:   "Number of workers for embedding computation",
+			Usage:   "Number of embedding batches computed concurrently",
 			Value:   3,
 		},
+		&cli.IntFlag{
+			Name:  "embedding-batch-size",
+			Usage: "Maximum number of chunks per embedding request",
+			Value: rag.DefaultEmbeddingBatchSize,
+		},
+		&cli.IntFlag{
+			Name:  "embedding-batch-chars",
+			Usage: "Maximum number of characters per embedding request",
+			Value: rag.DefaultEmbeddingBatchChars,
+		},
+		&cli.IntFlag{
+			Name:  "embedding-retries",
+			Usage: "Retries of embedding requests failing with 429, 5xx or a network error, with exponential backoff",
+			Value: 5,
+		},
+		&cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "Embed every chunk without reading or writing the embedding cache",
+		},
 		&cli.BoolFlag{
 			Name:  "force",
 			Usage: "Force reprocess all files regardless of hash",
@@ -50,6 +77,30 @@ var updateCmd = &cli.Command{
 			Usage:   "Glob pattern to filter files",
 			Value:   "*.md",
 		},
+		&cli.BoolFlag{
+			Name:  "git",
+			Usage: "Path is a git repository, process the files changed since the last indexed commit",
+		},
+		&cli.StringFlag{
+			Name:    "s3-endpoint",
+			Usage:   "Object storage of s3://bucket/prefix paths, a host or an http:// URL for plain HTTP",
+			Value:   "s3.amazonaws.com",
+			Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_S3_ENDPOINT")),
+		},
+		&cli.StringFlag{
+			Name:    "s3-access-key",
+			Usage:   "Access key of the object storage, empty reads AWS and MinIO environment variables",
+			Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_S3_ACCESS_KEY")),
+		},
+		&cli.StringFlag{
+			Name:    "s3-secret-key",
+			Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_S3_SECRET_KEY")),
+		},
+		&cli.StringFlag{
+			Name:    "s3-region",
+			Usage:   "Region of the bucket, empty asks the object storage",
+			Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_S3_REGION")),
+		},
 	},
 	Action: func(ctx context.Context, command *cli.Command) error {
 		path, err := getArgumentPath(command)
@@ -73,22 +124,42 @@ var updateCmd = &cli.Command{
 		fileGlob := glob.MustCompile(globStr)
 
 		// Open database
-		db, err := rag.OpenDuckDB(dsn, embeddingDimension)
+		store, err := rag.OpenStore(dsn, embeddingDimension)
 		if err != nil {
 			return err
 		}
-		defer func() { _ = db.Close() }()
+		defer func() { _ = store.Close() }()
 
 		// Validate or set embedding dimension
-		embeddingDimension = rag.GetStoredEmbeddingDimension(db, embeddingDimension)
+		embeddingDimension = rag.GetStoredEmbeddingDimension(store, embeddingDimension)
 
 		// Create RAG instance
-		embeddingClient := openai.NewClient(option.WithBaseURL(baseURL))
+		// Retries are done by ComputeEmbeddings with backoff
+		embeddingClient := openai.NewClient(option.WithBaseURL(baseURL), option.WithMaxRetries(0))
+		assistantClient := openai.NewClient(option.WithBaseURL(command.String("assistant-base-url")),
+			option.WithAPIKey(command.String("assistant-api-key")))
+		retries := command.Int("embedding-retries")
+		if retries == 0 {
+			retries = -1
+		}
 		r := rag.RAG{
-			DB:                  db,
+			Store:               store,
 			EmbeddingClient:     &embeddingClient,
 			EmbeddingModel:      embeddingModel,
 			EmbeddingDimensions: embeddingDimension,
+			EmbeddingBatchSize:  command.Int("embedding-batch-size"),
+			EmbeddingBatchChars: command.Int("embedding-batch-chars"),
+			EmbeddingRetry:      rag.RetryPolicy{MaxRetries: retries},
+			AssistantClient:     &assistantClient,
+			CaptionModel:        command.String("caption-model"),
+
+			DisableEmbeddingCache: command.Bool("no-cache"),
+		}
+
+		// Fail before chunking, chunks can't be embedded with another model than the stored ones
+		err = r.CheckEmbeddingModel(ctx)
+		if err != nil {
+			return err
 		}
 
 		// Create chunking config
@@ -103,59 +174,152 @@ var updateCmd = &cli.Command{
 		if err != nil {
 			return fmt.Errorf("failed to create chunker: %w", err)
 		}
+		// The semantic strategy places boundaries with the embedding model of the chunks
+		chunker.WithEmbedder(&r)
 
 		// Find files to process
-		var filePathListForNow []string
-		err = filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		var filesToProcess []rag.FileInfo
+		var totalFiles int
+		var repo *rag.GitRepo
+		var commits map[string]rag.GitCommit
+		switch {
+		case rag.IsS3URL(path) && command.Bool("git"):
+			return errors.New("--git takes a local repository")
+		case rag.IsS3URL(path):
+			bucket, prefix, err := rag.ParseS3URL(path)
 			if err != nil {
 				return err
 			}
-			if info.IsDir() {
-				return nil
+			r.OSS, err = rag.NewOSSClient(command.String("s3-endpoint"), command.String("s3-access-key"),
+				command.String("s3-secret-key"), command.String("s3-region"))
+			if err != nil {
+				return err
+			}
+			filesToProcess, err = r.FindS3ObjectsToProcess(ctx, bucket, prefix, func(key string) bool {
+				return fileGlob.Match(filepath.Base(key))
+			}, force)
+			if err != nil {
+				return err
+			}
+			totalFiles = len(filesToProcess)
+			log.Info().Int("changed_objects", totalFiles).Msg("Found objects")
+		case command.Bool("git"):
+			repo, err = rag.OpenGitRepo(ctx, path)
+			if err != nil {
+				return err
+			}
+			dirty, err := repo.Dirty(ctx)
+			if err != nil {
+				return err
 			}
+			if dirty {
+				// Changed files are read from the work tree, other files are not looked at
+				log.Warn().Str("commit", repo.Head).
+					Msg("Uncommitted changes are only indexed in files changed by commits since the last update, use --force for all")
+			}
+			filesToProcess, commits, err = r.FindGitFilesToProcess(ctx, repo, globStr, func(filePath string) bool {
+				return fileGlob.Match(filepath.Base(filePath))
+			}, force)
+			if err != nil {
+				return err
+			}
+			totalFiles = len(filesToProcess)
+			log.Info().Str("commit", repo.Head).Int("changed_files", totalFiles).Msg("Found files")
+		default:
+			var filePathListForNow []string
+			err = filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() {
+					return nil
+				}
 
-			if fileGlob.Match(info.Name()) {
-				filePathListForNow = append(filePathListForNow, filePath)
+				if fileGlob.Match(info.Name()) {
+					filePathListForNow = append(filePathListForNow, filePath)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to scan directory: %w", err)
 			}
-			return nil
-		})
-		if err != nil {
-			return fmt.Errorf("failed to scan directory: %w", err)
-		}
-		log.Info().Int("total_files", len(filePathListForNow)).Msg("Found markdown files")
+			totalFiles = len(filePathListForNow)
+			log.Info().Int("total_files", totalFiles).Msg("Found files")
 
-		// find files to process
-		filesToProcess, err := r.FindFilesToProcess(filePathListForNow, force)
-		if err != nil {
-			return err
+			// find files to process
+			filesToProcess, err = r.FindFilesToProcess(ctx, filePathListForNow, force)
+			if err != nil {
+				return err
+			}
 		}
 
 		// Process files
-		bar := progressbar.Default(int64(len(filePathListForNow)))
+		failed := 0
+		bar := progressbar.Default(int64(totalFiles))
 		for _, fileInfo := range filesToProcess {
 			filePath := fileInfo.FilePath
 
+			// Objects are streamed from the bucket, their ETag is recorded
+			if rag.IsS3URL(filePath) {
+				chunks, err := r.IndexS3Object(ctx, chunker, filePath)
+				if err != nil {
+					log.Error().Err(err).Str("object", filePath).Msg("Failed to index object")
+					continue
+				}
+				_ = bar.Add(1)
+				log.Info().Str("object", filePath).Int("chunks", chunks).Msg("Processed object")
+				continue
+			}
+
 			// Chunk document
-			doc, err := chunker.GetDocumentChunks(filePath)
+			doc, err := chunker.GetDocumentChunks(ctx, filePath)
 			if err != nil {
 				log.Error().Err(err).Str("file_path", filePath).
 					Msg("Failed to chunk document")
+				failed++
+				continue
+			}
+
+			// Captions are chunks too, a file whose images fail is retried by the next update
+			err = r.CaptionImages(ctx, &doc, filePath)
+			if err != nil {
+				log.Error().Err(err).Str("file_path", filePath).
+					Msg("Failed to caption images")
+				failed++
+				continue
+			}
+			if commit, ok := commits[filePath]; ok {
+				doc.SetCommit(commit)
+			}
+
+			// Drop chunks of the previous version
+			err = r.RemoveDocumentChunksByFilePath(ctx, filePath)
+			if err != nil {
+				log.Error().Err(err).Str("file_path", filePath).
+					Msg("Failed to remove previous document chunks")
+				failed++
 				continue
 			}
 
 			// Insert new chunks
-			err = r.UpsertDocumentChunks(&doc)
+			err = r.UpsertDocumentChunks(ctx, &doc)
 			if err != nil {
 				log.Error().Err(err).Str("file_path", filePath).
 					Msg("Failed to upsert document chunks")
+				failed++
 				continue
 			}
 
-			// Update file hash record
-			err = r.UpdateProcessedFileHash(fileInfo.FilePath, fileInfo.FileHash)
+			// Update file hash record, files of git repositories are recorded by their document ID
+			fileHash := fileInfo.FileHash
+			if fileHash == "" {
+				fileHash = doc.DocumentID
+			}
+			err = r.UpdateProcessedFileHash(ctx, fileInfo.FilePath, fileHash)
 			if err != nil {
 				log.Error().Err(err).Str("file", filePath).
 					Msg("Failed to update file hash")
+				failed++
 				continue
 			}
 
@@ -166,9 +330,31 @@ var updateCmd = &cli.Command{
 
 		_ = bar.Finish()
 
+		// Files failing to process are retried by the next update from the same commit
+		if repo != nil && failed == 0 {
+			err = r.SetIndexedCommit(ctx, repo, globStr)
+			if err != nil {
+				return err
+			}
+		} else if repo != nil {
+			log.Warn().Int("failed", failed).Str("commit", repo.Head).
+				Msg("Indexed commit is kept, failed files are retried by the next update")
+		}
+
+		// Keyword index is static in DuckDB, refresh it for the new chunks
+		err = store.RebuildKeywordIndex(ctx)
+		if err != nil {
+			return err
+		}
+
 		// Compute embeddings for new chunks
 		log.Info().Msg("Computing embeddings for new chunks")
 		err = r.ComputeEmbeddings(ctx, true, workers, func() {})
+		var embeddingErr *rag.EmbeddingError
+		if errors.As(err, &embeddingErr) {
+			log.Warn().Int("failed", embeddingErr.Failed()).
+				Msg("Chunks without embedding are retried by the next update")
+		}
 		if err != nil {
 			return fmt.Errorf("failed to compute embeddings: %w", err)
 		}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/packages/ssestream"
 )
 
 // AuditEmbeddingsClient wraps OpenAI embeddings client with audit logging
@@ -78,8 +79,86 @@ type AuditChatCompletionsClient struct {
 func (c *AuditChatCompletionsClient) New(ctx context.Context, params openai.ChatCompletionNewParams) (*openai.ChatCompletion, error) {
 	start := time.Now()
 
-	// Log request (sanitize messages for privacy)
-	request := map[string]interface{}{
+	// Make the API call
+	response, err := c.completions.New(ctx, params)
+	duration := time.Since(start)
+
+	// Log the call with detailed response
+	c.auditLogger.LogAPICall(ctx, "chat", c.model, auditChatRequest(params), auditChatResponse(response), err, duration, "")
+
+	return response, err
+}
+
+// NewStreaming passes the stream through and logs the assembled completion once it ends or is closed
+func (c *AuditChatCompletionsClient) NewStreaming(ctx context.Context, params openai.ChatCompletionNewParams) *ssestream.Stream[openai.ChatCompletionChunk] {
+	stream := c.completions.NewStreaming(ctx, params)
+	if err := stream.Err(); err != nil {
+		c.auditLogger.LogAPICall(ctx, "chat_stream", c.model, auditChatRequest(params), nil, err, 0, "")
+		return stream
+	}
+
+	return ssestream.NewStream[openai.ChatCompletionChunk](&auditStreamDecoder{
+		ctx:     ctx,
+		stream:  stream,
+		client:  c,
+		request: auditChatRequest(params),
+		start:   time.Now(),
+	}, nil)
+}
+
+// auditStreamDecoder re-emits the chunks of a stream while accumulating them for the audit log
+type auditStreamDecoder struct {
+	ctx     context.Context
+	stream  *ssestream.Stream[openai.ChatCompletionChunk]
+	client  *AuditChatCompletionsClient
+	request map[string]interface{}
+	start   time.Time
+	acc     openai.ChatCompletionAccumulator
+	event   ssestream.Event
+	logged  bool
+}
+
+func (d *auditStreamDecoder) Next() bool {
+	if !d.stream.Next() {
+		d.log()
+		return false
+	}
+	chunk := d.stream.Current()
+	d.acc.AddChunk(chunk)
+	d.event = ssestream.Event{Data: []byte(chunk.RawJSON())}
+	return true
+}
+
+func (d *auditStreamDecoder) Event() ssestream.Event {
+	return d.event
+}
+
+func (d *auditStreamDecoder) Close() error {
+	d.log()
+	return d.stream.Close()
+}
+
+func (d *auditStreamDecoder) Err() error {
+	return d.stream.Err()
+}
+
+func (d *auditStreamDecoder) log() {
+	if d.logged {
+		return
+	}
+	d.logged = true
+
+	var response *openai.ChatCompletion
+	if len(d.acc.Choices) > 0 {
+		response = &d.acc.ChatCompletion
+	}
+	d.client.auditLogger.LogAPICall(d.ctx, "chat_stream", d.client.model, d.request, auditChatResponse(response),
+		d.stream.Err(), time.Since(d.start), "")
+}
+
+// auditChatRequest logs the request parameters (sanitize messages for privacy)
+func auditChatRequest(params openai.ChatCompletionNewParams) map[string]interface{} {
+	return map[string]interface{}{
 		"model":             params.Model,
 		"messages":          sanitizeMessages(params.Messages),
 		"temperature":       params.Temperature,
@@ -88,44 +167,36 @@ func (c *AuditChatCompletionsClient) New(ctx context.Context, params openai.Chat
 		"frequency_penalty": params.FrequencyPenalty,
 		"presence_penalty":  params.PresencePenalty,
 	}
+}
 
-	// Make the API call
-	response, err := c.completions.New(ctx, params)
-	duration := time.Since(start)
+// auditChatResponse creates a detailed response for audit logging
+func auditChatResponse(response *openai.ChatCompletion) interface{} {
+	if response == nil || len(response.Choices) == 0 {
+		return response
+	}
 
-	// Create a detailed response for audit logging
-	var auditResponse interface{}
-	if response != nil && len(response.Choices) > 0 {
-		// Extract the actual response content
-		auditResponse = map[string]interface{}{
-			"id":      response.ID,
-			"object":  response.Object,
-			"created": response.Created,
-			"model":   response.Model,
-			"choices": []map[string]interface{}{
-				{
-					"index":         response.Choices[0].Index,
-					"finish_reason": response.Choices[0].FinishReason,
-					"message": map[string]interface{}{
-						"role":    response.Choices[0].Message.Role,
-						"content": response.Choices[0].Message.Content,
-					},
+	// Extract the actual response content
+	return map[string]interface{}{
+		"id":      response.ID,
+		"object":  response.Object,
+		"created": response.Created,
+		"model":   response.Model,
+		"choices": []map[string]interface{}{
+			{
+				"index":         response.Choices[0].Index,
+				"finish_reason": response.Choices[0].FinishReason,
+				"message": map[string]interface{}{
+					"role":    response.Choices[0].Message.Role,
+					"content": response.Choices[0].Message.Content,
 				},
 			},
-			"usage": map[string]interface{}{
-				"prompt_tokens":     response.Usage.PromptTokens,
-				"completion_tokens": response.Usage.CompletionTokens,
-				"total_tokens":      response.Usage.TotalTokens,
-			},
-		}
-	} else {
-		auditResponse = response
+		},
+		"usage": map[string]interface{}{
+			"prompt_tokens":     response.Usage.PromptTokens,
+			"completion_tokens": response.Usage.CompletionTokens,
+			"total_tokens":      response.Usage.TotalTokens,
+		},
 	}
-
-	// Log the call with detailed response
-	c.auditLogger.LogAPICall(ctx, "chat", c.model, request, auditResponse, err, duration, "")
-
-	return response, err
 }
 
 // sanitizeMessages removes or masks sensitive content from messages for logging
@@ -0,0 +1,324 @@
+package rag
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// embeddingCachePage bounds the number of hashes looked up per query
+const embeddingCachePage = 1000
+
+// EmbeddingCacheStore is implemented by stores that cache embeddings by model, dimensions and
+// the CalculateStringHash of the text, so unchanged text is never embedded twice
+type EmbeddingCacheStore interface {
+	// GetCachedEmbeddings returns the cached embeddings by text hash and marks them used
+	GetCachedEmbeddings(ctx context.Context, model string, dimensions int64, hashes []string) (map[string][]float32, error)
+	PutCachedEmbeddings(ctx context.Context, model string, dimensions int64, embeddings map[string][]float32) error
+	EmbeddingCacheSummary(ctx context.Context) ([]EmbeddingCacheSummary, error)
+	// PruneEmbeddingCache deletes the entries matching any of the options and returns their number
+	PruneEmbeddingCache(ctx context.Context, opts PruneOptions) (int64, error)
+}
+
+// EmbeddingCacheSummary describes the cached embeddings of one model and dimension
+type EmbeddingCacheSummary struct {
+	Model      string
+	Dimensions int64
+	Entries    int64
+	LastUsedAt time.Time
+}
+
+// PruneOptions selects the cache entries to delete, an entry is deleted if it matches any option
+type PruneOptions struct {
+	Unused         bool          // Entries whose embedding text is not that of any stored chunk
+	UnusedFor      time.Duration // Entries not used for this long, zero disables
+	KeepModel      string        // If set, entries of other models or dimensions
+	KeepDimensions int64
+}
+
+// EmbeddingCacheStats returns the cache hits and misses since the RAG was created
+func (r *RAG) EmbeddingCacheStats() (hits, misses int64) {
+	return atomic.LoadInt64(&r.cacheHits), atomic.LoadInt64(&r.cacheMisses)
+}
+
+func (r *RAG) embeddingCache() EmbeddingCacheStore {
+	if r.DisableEmbeddingCache {
+		return nil
+	}
+	cache, _ := r.Store.(EmbeddingCacheStore)
+	return cache
+}
+
+// cachedEmbeddings looks up the embeddings of texts, the cache is best effort so errors are
+// logged and count as misses
+func (r *RAG) cachedEmbeddings(ctx context.Context, texts []string) map[string][]float32 {
+	cache := r.embeddingCache()
+	if cache == nil || len(texts) == 0 {
+		return nil
+	}
+
+	found := make(map[string][]float32)
+	for start := 0; start < len(texts); start += embeddingCachePage {
+		end := min(start+embeddingCachePage, len(texts))
+		hashes := make([]string, 0, end-start)
+		for _, text := range texts[start:end] {
+			hashes = append(hashes, CalculateStringHash(text))
+		}
+		embeddings, err := cache.GetCachedEmbeddings(ctx, r.EmbeddingModel, r.EmbeddingDimensions, hashes)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to read embedding cache")
+			break
+		}
+		for hash, embedding := range embeddings {
+			found[hash] = embedding
+		}
+	}
+
+	hits := 0
+	for _, text := range texts {
+		if _, ok := found[CalculateStringHash(text)]; ok {
+			hits++
+		}
+	}
+	atomic.AddInt64(&r.cacheHits, int64(hits))
+	atomic.AddInt64(&r.cacheMisses, int64(len(texts)-hits))
+	return found
+}
+
+func (r *RAG) cacheEmbeddings(ctx context.Context, texts []string, embeddings [][]float32) {
+	cache := r.embeddingCache()
+	if cache == nil {
+		return
+	}
+	entries := make(map[string][]float32, len(texts))
+	for i, text := range texts {
+		entries[CalculateStringHash(text)] = embeddings[i]
+	}
+	err := cache.PutCachedEmbeddings(ctx, r.EmbeddingModel, r.EmbeddingDimensions, entries)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to write embedding cache")
+	}
+}
+
+// embedFromCache writes the cached embeddings of chunks and returns the chunks still to embed
+func (r *RAG) embedFromCache(ctx context.Context, chunks []DocumentChunk,
+	write func(context.Context, []DocumentChunk) error) (hits []DocumentChunk, misses []DocumentChunk, err error) {
+	texts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		texts[i] = chunk.EmbeddingText()
+	}
+	found := r.cachedEmbeddings(ctx, texts)
+	if len(found) == 0 {
+		return nil, chunks, nil
+	}
+
+	for i, chunk := range chunks {
+		if embedding, ok := found[CalculateStringHash(texts[i])]; ok {
+			chunk.Embedding = embedding
+			hits = append(hits, chunk)
+		} else {
+			misses = append(misses, chunk)
+		}
+	}
+	for start := 0; start < len(hits); start += embeddingCachePage {
+		err = write(ctx, hits[start:min(start+embeddingCachePage, len(hits))])
+		if err != nil {
+			return nil, chunks, err
+		}
+	}
+	return hits, misses, nil
+}
+
+// sqlEmbeddingCache implements EmbeddingCacheStore on the embedding_cache table, the stores
+// differ in how vectors are bound and read
+type sqlEmbeddingCache struct {
+	db *sql.DB
+	// vector is the SQL expression of the embedding for a placeholder, and of the column when read
+	vector       func(expr string) string
+	column       string
+	encodeVector func([]float32) interface{}
+	decodeVector func(v interface{}) ([]float32, error)
+}
+
+func (c *sqlEmbeddingCache) get(ctx context.Context, model string, dimensions int64, hashes []string) (map[string][]float32, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+
+	args := []interface{}{model, dimensions}
+	placeholders := make([]string, len(hashes))
+	for i, hash := range hashes {
+		args = append(args, hash)
+		placeholders[i] = fmt.Sprintf("$%d", i+3)
+	}
+	in := strings.Join(placeholders, ", ")
+
+	rows, err := c.db.QueryContext(ctx, fmt.Sprintf(`SELECT text_hash, %s FROM embedding_cache
+		WHERE model = $1 AND dimensions = $2 AND text_hash IN (%s)`, c.column, in), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	embeddings := make(map[string][]float32)
+	for rows.Next() {
+		var hash string
+		var v interface{}
+		err = rows.Scan(&hash, &v)
+		if err != nil {
+			return nil, err
+		}
+		embeddings[hash], err = c.decodeVector(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = rows.Err(); err != nil || len(embeddings) == 0 {
+		return embeddings, err
+	}
+
+	_, err = c.db.ExecContext(ctx, fmt.Sprintf(`UPDATE embedding_cache SET last_used_at = now()
+		WHERE model = $1 AND dimensions = $2 AND text_hash IN (%s)`, in), args...)
+	return embeddings, err
+}
+
+func (c *sqlEmbeddingCache) put(ctx context.Context, model string, dimensions int64, embeddings map[string][]float32) error {
+	if len(embeddings) == 0 {
+		return nil
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(`
+		INSERT INTO embedding_cache (model, dimensions, text_hash, embedding)
+		VALUES ($1, $2, $3, %s)
+		ON CONFLICT (model, dimensions, text_hash) DO UPDATE SET last_used_at = now()`, c.vector("$4")))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+
+	for hash, embedding := range embeddings {
+		_, err = stmt.ExecContext(ctx, model, dimensions, hash, c.encodeVector(embedding))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (c *sqlEmbeddingCache) summary(ctx context.Context) ([]EmbeddingCacheSummary, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT model, dimensions, count(*), max(last_used_at)
+		FROM embedding_cache GROUP BY model, dimensions ORDER BY model, dimensions`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var summaries []EmbeddingCacheSummary
+	for rows.Next() {
+		var s EmbeddingCacheSummary
+		err = rows.Scan(&s.Model, &s.Dimensions, &s.Entries, &s.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries, rows.Err()
+}
+
+func (c *sqlEmbeddingCache) prune(ctx context.Context, opts PruneOptions) (int64, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var conditions []string
+	var args []interface{}
+	if opts.Unused {
+		err = createLiveTextHashes(ctx, tx)
+		if err != nil {
+			return 0, err
+		}
+		conditions = append(conditions, `text_hash NOT IN (SELECT text_hash FROM live_text_hashes)`)
+	}
+	if opts.UnusedFor > 0 {
+		args = append(args, fmt.Sprintf("%d seconds", int64(opts.UnusedFor.Seconds())))
+		conditions = append(conditions, fmt.Sprintf(`last_used_at < now() - CAST($%d AS INTERVAL)`, len(args)))
+	}
+	if opts.KeepModel != "" {
+		args = append(args, opts.KeepModel, opts.KeepDimensions)
+		conditions = append(conditions, fmt.Sprintf(`NOT (model = $%d AND dimensions = $%d)`, len(args)-1, len(args)))
+	}
+	if len(conditions) == 0 {
+		return 0, nil
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM embedding_cache WHERE "+strings.Join(conditions, " OR "), args...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if opts.Unused {
+		_, err = tx.ExecContext(ctx, `DROP TABLE live_text_hashes`)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return deleted, tx.Commit()
+}
+
+// createLiveTextHashes fills the temporary table live_text_hashes with the hashes the stored
+// chunks are cached under. Those hash the EmbeddingText, which neither SQL dialect can compute
+// and which differs from the chunk ID for chunks with a heading path and for image captions.
+func createLiveTextHashes(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT COALESCE(heading_path, ''), text FROM document_chunks WHERE is_parent IS NOT TRUE`)
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]struct{})
+	for rows.Next() {
+		var chunk DocumentChunk
+		err = rows.Scan(&chunk.HeadingPath, &chunk.Text)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		hashes[CalculateStringHash(chunk.EmbeddingText())] = struct{}{}
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `CREATE TEMPORARY TABLE live_text_hashes (text_hash VARCHAR PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO live_text_hashes VALUES ($1)`)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+	for hash := range hashes {
+		_, err = stmt.ExecContext(ctx, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
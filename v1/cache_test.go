@@ -0,0 +1,174 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memCacheStore is a memStore with an in-memory embedding cache
+type memCacheStore struct {
+	*memStore
+	cache map[string][]float32 // by model/dimensions/hash
+}
+
+func newMemCacheStore(store *memStore) *memCacheStore {
+	return &memCacheStore{memStore: store, cache: map[string][]float32{}}
+}
+
+func memCacheKey(model string, dimensions int64, hash string) string {
+	return fmt.Sprintf("%s/%d/%s", model, dimensions, hash)
+}
+
+func (s *memCacheStore) GetCachedEmbeddings(_ context.Context, model string, dimensions int64, hashes []string) (map[string][]float32, error) {
+	found := make(map[string][]float32)
+	for _, hash := range hashes {
+		if embedding, ok := s.cache[memCacheKey(model, dimensions, hash)]; ok {
+			found[hash] = embedding
+		}
+	}
+	return found, nil
+}
+
+func (s *memCacheStore) PutCachedEmbeddings(_ context.Context, model string, dimensions int64, embeddings map[string][]float32) error {
+	for hash, embedding := range embeddings {
+		s.cache[memCacheKey(model, dimensions, hash)] = embedding
+	}
+	return nil
+}
+
+func (s *memCacheStore) EmbeddingCacheSummary(context.Context) ([]EmbeddingCacheSummary, error) {
+	return nil, nil
+}
+
+func (s *memCacheStore) PruneEmbeddingCache(context.Context, PruneOptions) (int64, error) {
+	return 0, nil
+}
+
+func TestComputeEmbeddingsCache(t *testing.T) {
+	ctx := context.Background()
+	texts := []string{"alpha", "beta", "gamma"}
+	store := newMemCacheStore(newEmbeddingStore(t, texts...))
+	client := &fakeEmbeddingClient{dimension: 8}
+	r := &RAG{Store: store, EmbeddingClient: client, EmbeddingModel: "m1", EmbeddingDimensions: 8}
+
+	require.NoError(t, r.ComputeEmbeddings(ctx, false, 1, func() {}))
+	assert.Equal(t, 1, client.calls)
+	assert.Len(t, store.cache, 3)
+	hits, misses := r.EmbeddingCacheStats()
+	assert.Equal(t, int64(0), hits)
+	assert.Equal(t, int64(3), misses)
+
+	// A re-chunked document with the same text is embedded from the cache only
+	store.memStore = newEmbeddingStore(t, append(texts, "delta")...)
+	require.NoError(t, r.ComputeEmbeddings(ctx, false, 1, func() {}))
+	assert.Equal(t, 2, client.calls)
+	hits, misses = r.EmbeddingCacheStats()
+	assert.Equal(t, int64(3), hits)
+	assert.Equal(t, int64(4), misses)
+	for _, chunk := range store.chunks {
+		assert.Equal(t, toFloat32Slice(fakeEmbedding(chunk.Text, 8)), chunk.Embedding, chunk.Text)
+	}
+
+	// Another model misses the cache
+	store.memStore = newEmbeddingStore(t, texts...)
+	r.EmbeddingModel = "m2"
+	require.NoError(t, r.ComputeEmbeddings(ctx, false, 1, func() {}))
+	assert.Equal(t, 3, client.calls)
+	assert.Len(t, store.cache, 7)
+
+	// The cache can be disabled
+	store.memStore = newEmbeddingStore(t, texts...)
+	r.DisableEmbeddingCache = true
+	require.NoError(t, r.ComputeEmbeddings(ctx, false, 1, func() {}))
+	assert.Equal(t, 4, client.calls)
+}
+
+func TestQueryEmbeddingCache(t *testing.T) {
+	ctx := context.Background()
+	store := newMemCacheStore(newMemStore(8))
+	client := &fakeEmbeddingClient{dimension: 8}
+	r := &RAG{Store: store, EmbeddingClient: client, EmbeddingModel: "m1", EmbeddingDimensions: 8}
+
+	first, err := r.embedQuery(ctx, "what is chubby")
+	require.NoError(t, err)
+	second, err := r.embedQuery(ctx, "what is chubby")
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, client.calls)
+}
+
+func TestDuckDBEmbeddingCache(t *testing.T) {
+	ctx := context.Background()
+	db := openPlainDuckDB(t)
+	plan, err := duckDBMigrations[5].Plan(ctx, db, 3)
+	require.NoError(t, err)
+	for _, statement := range append(plan, `CREATE TABLE document_chunks (
+		id VARCHAR PRIMARY KEY, text VARCHAR, heading_path VARCHAR, is_parent BOOLEAN)`) {
+		_, err = db.ExecContext(ctx, statement)
+		require.NoError(t, err)
+	}
+	store := &DuckDBStore{db: db, dimension: 3}
+
+	require.NoError(t, store.PutCachedEmbeddings(ctx, "m1", 3, map[string][]float32{
+		"h1": {1, 0, 0},
+		"h2": {0, 1, 0},
+	}))
+	require.NoError(t, store.PutCachedEmbeddings(ctx, "m1", 3, map[string][]float32{"h1": {1, 0, 0}}))
+	require.NoError(t, store.PutCachedEmbeddings(ctx, "m2", 2, map[string][]float32{"h1": {0, 1}}))
+
+	found, err := store.GetCachedEmbeddings(ctx, "m1", 3, []string{"h1", "h3"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]float32{"h1": {1, 0, 0}}, found)
+
+	summaries, err := store.EmbeddingCacheSummary(ctx)
+	require.NoError(t, err)
+	require.Len(t, summaries, 2)
+	assert.Equal(t, "m1", summaries[0].Model)
+	assert.Equal(t, int64(3), summaries[0].Dimensions)
+	assert.Equal(t, int64(2), summaries[0].Entries)
+	assert.WithinDuration(t, time.Now(), summaries[0].LastUsedAt, time.Hour*24)
+
+	deleted, err := store.PruneEmbeddingCache(ctx, PruneOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), deleted)
+
+	deleted, err = store.PruneEmbeddingCache(ctx, PruneOptions{UnusedFor: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), deleted)
+
+	deleted, err = store.PruneEmbeddingCache(ctx, PruneOptions{KeepModel: "m1", KeepDimensions: 3})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	// chunks are cached under the hash of their embedding text, which includes the heading path
+	plain := DocumentChunk{ID: CalculateStringHash("plain"), Text: "plain"}
+	headed := DocumentChunk{ID: CalculateStringHash("body"), Text: "body", HeadingPath: "Guide > Setup"}
+	live := []string{CalculateStringHash(plain.EmbeddingText()), CalculateStringHash(headed.EmbeddingText())}
+	require.NoError(t, store.PutCachedEmbeddings(ctx, "m1", 3, map[string][]float32{
+		live[0]: {1, 1, 0},
+		live[1]: {0, 1, 1},
+	}))
+	for _, chunk := range []DocumentChunk{plain, headed} {
+		_, err = db.ExecContext(ctx, `INSERT INTO document_chunks VALUES (?, ?, ?, false)`,
+			chunk.ID, chunk.Text, chunk.HeadingPath)
+		require.NoError(t, err)
+	}
+	deleted, err = store.PruneEmbeddingCache(ctx, PruneOptions{Unused: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+
+	found, err = store.GetCachedEmbeddings(ctx, "m1", 3, append([]string{"h1", "h2", headed.ID}, live...))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, live, slices.Collect(maps.Keys(found)))
+
+	deleted, err = store.PruneEmbeddingCache(ctx, PruneOptions{Unused: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), deleted)
+}
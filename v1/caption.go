@@ -0,0 +1,198 @@
+package rag
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/openai/openai-go"
+	"github.com/rs/zerolog/log"
+)
+
+// CaptionCacheStore is implemented by stores that cache image captions by model and the
+// CalculateStringHash of the image, so an image is never captioned twice
+type CaptionCacheStore interface {
+	// GetCachedCaption returns the cached caption, empty if there is none
+	GetCachedCaption(ctx context.Context, model, imageHash string) (string, error)
+	PutCachedCaption(ctx context.Context, model, imageHash, caption string) error
+}
+
+const captionPrompt = `Describe this figure from a document so that it can be found by search.
+Say what kind of figure it is (diagram, chart, table, photo, screenshot, ...), what it shows, and
+include the text, labels and numbers in it. Reply with the description only.`
+
+// imageReferencePattern matches markdown images, ![alt](path "title")
+var imageReferencePattern = regexp.MustCompile(`!\[([^\]]*)\]\(\s*(?:<([^>]+)>|([^)\s]+))(?:\s+"[^"]*")?\s*\)`)
+
+// imageReference is an image of a markdown document, start and end are byte offsets
+type imageReference struct {
+	alt        string
+	path       string
+	start, end int
+}
+
+// imageReferences returns the local images referenced by a markdown document, remote and
+// inline images are skipped
+func imageReferences(content string) []imageReference {
+	var refs []imageReference
+	for _, m := range imageReferencePattern.FindAllStringSubmatchIndex(content, -1) {
+		var target string
+		if m[4] >= 0 {
+			target = content[m[4]:m[5]] // <path with spaces>
+		} else {
+			target = content[m[6]:m[7]]
+		}
+		if strings.HasPrefix(target, "data:") || strings.Contains(target, "://") {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(target); err == nil {
+			target = unescaped
+		}
+		refs = append(refs, imageReference{
+			alt:   strings.TrimSpace(content[m[2]:m[3]]),
+			path:  target,
+			start: m[0],
+			end:   m[1],
+		})
+	}
+	return refs
+}
+
+// CaptionImages appends a chunk with the caption of every local image referenced by the markdown
+// document at filePath, other documents are left as they are. Images are resolved relative to the
+// document, caption chunks are located at the reference and link to the image with ImagePath.
+// Missing images are skipped.
+func (r *RAG) CaptionImages(ctx context.Context, doc *Document, filePath string) error {
+	if r.CaptionModel == "" || mimeType(filePath) != "text/markdown" {
+		return nil
+	}
+	buf, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	content := string(buf)
+	refs := imageReferences(content)
+	if len(refs) == 0 {
+		return nil
+	}
+
+	index := 0
+	for _, chunk := range doc.Chunks {
+		if !chunk.IsParent {
+			index = max(index, chunk.Index+1)
+		}
+	}
+	headings := parseHeadings(content)
+	captioned := make(map[string]bool)
+	for _, ref := range refs {
+		imagePath := filepath.Join(filepath.Dir(filePath), filepath.FromSlash(ref.path))
+		if captioned[imagePath] {
+			continue
+		}
+		captioned[imagePath] = true
+
+		image, err := os.ReadFile(imagePath)
+		if err != nil {
+			log.Warn().Err(err).Str("file", filePath).Str("image", ref.path).Msg("Skipping missing image")
+			continue
+		}
+		caption, err := r.captionImage(ctx, image)
+		if err != nil {
+			return fmt.Errorf("failed to caption %s: %w", ref.path, err)
+		}
+		if caption == "" {
+			continue
+		}
+
+		text := caption
+		if ref.alt != "" {
+			text = ref.alt + "\n\n" + caption
+		}
+		start := utf8.RuneCountInString(content[:ref.start])
+		chunk := &DocumentChunk{
+			DocumentID:  doc.DocumentID,
+			Text:        text,
+			Index:       index,
+			FilePath:    filepath.ToSlash(doc.FilePath),
+			StartOffset: start,
+			EndOffset:   start + utf8.RuneCountInString(content[ref.start:ref.end]),
+			HeadingPath: headingPathAt(headings, ref.start),
+			ImagePath:   path.Join(path.Dir(filepath.ToSlash(doc.FilePath)), ref.path),
+		}
+		// Documents referencing the same figure get a caption chunk each, removing one keeps the other
+		chunk.ID = CalculateStringHash(chunk.FilePath + "\n" + chunk.ImagePath + "\n" + text)
+		doc.Chunks = append(doc.Chunks, chunk)
+		index++
+	}
+	return nil
+}
+
+// captionImage returns the caption of an image, from the cache if the image was captioned before
+func (r *RAG) captionImage(ctx context.Context, image []byte) (string, error) {
+	hash := CalculateStringHash(string(image))
+	cache, _ := r.Store.(CaptionCacheStore)
+	if cache != nil {
+		caption, err := cache.GetCachedCaption(ctx, r.CaptionModel, hash)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to read caption cache")
+		} else if caption != "" {
+			return caption, nil
+		}
+	}
+
+	chatClient := ToChatClient(r.AssistantClient)
+	if chatClient == nil {
+		return "", errors.New("failed to get chat client")
+	}
+	dataURL := "data:" + http.DetectContentType(image) + ";base64," + base64.StdEncoding.EncodeToString(image)
+	c, err := chatClient.Completions().New(ctx, openai.ChatCompletionNewParams{
+		Model: r.CaptionModel,
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.UserMessage([]openai.ChatCompletionContentPartUnionParam{
+				openai.TextContentPart(captionPrompt),
+				openai.ImageContentPart(openai.ChatCompletionContentPartImageImageURLParam{URL: dataURL}),
+			}),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(c.Choices) == 0 {
+		return "", errors.New("no choices returned from captioning")
+	}
+
+	caption := strings.TrimSpace(c.Choices[0].Message.Content)
+	if cache != nil && caption != "" {
+		err = cache.PutCachedCaption(ctx, r.CaptionModel, hash, caption)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to write caption cache")
+		}
+	}
+	return caption, nil
+}
+
+func getCachedCaption(ctx context.Context, db *sql.DB, model, imageHash string) (string, error) {
+	var caption string
+	err := db.QueryRowContext(ctx, `SELECT caption FROM caption_cache WHERE model = $1 AND image_hash = $2`,
+		model, imageHash).Scan(&caption)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return caption, err
+}
+
+func putCachedCaption(ctx context.Context, db *sql.DB, model, imageHash, caption string) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO caption_cache (model, image_hash, caption) VALUES ($1, $2, $3)
+		ON CONFLICT (model, image_hash) DO UPDATE SET caption = EXCLUDED.caption`, model, imageHash, caption)
+	return err
+}
@@ -0,0 +1,118 @@
+package rag
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageReferences(t *testing.T) {
+	content := "# Figures\n\n![System structure](images/a.jpg \"Figure 1\")\n" +
+		"![](<images/b c.png>) ![remote](https://example.com/c.png) ![](data:image/png;base64,AAAA)\n" +
+		"![](images/d%20e.png)"
+	refs := imageReferences(content)
+	require.Len(t, refs, 3)
+	assert.Equal(t, imageReference{alt: "System structure", path: "images/a.jpg", start: 11, end: 55}, refs[0])
+	assert.Equal(t, "![System structure](images/a.jpg \"Figure 1\")", content[refs[0].start:refs[0].end])
+	assert.Equal(t, "images/b c.png", refs[1].path)
+	assert.Equal(t, "images/d e.png", refs[2].path)
+}
+
+func TestCaptionImages(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	image, err := os.ReadFile("../testdata/images/abb04181ef4425a428d23df8069ba630d207946fb86ab36745984f674dd9672c.jpg")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "docs", "images"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docs", "images", "structure.jpg"), image, 0644))
+
+	content := "# Chubby\n\n## System structure\n\n![](images/structure.jpg)\nFigure 1: System structure\n\n" +
+		"![again](images/structure.jpg) ![](images/missing.jpg)\n"
+	filePath := filepath.Join(dir, "docs", "chubby.md")
+	require.NoError(t, os.WriteFile(filePath, []byte(content), 0644))
+
+	r, chat := newTestRAG("A diagram of a client application talking to the five replicas of a Chubby cell.")
+	chunker, err := NewDocumentChunker(newMarkdownChunker(1000, 1).config, dir)
+	require.NoError(t, err)
+	doc, err := chunker.GetDocumentChunks(ctx, filePath)
+	require.NoError(t, err)
+	chunks := len(doc.Chunks)
+
+	// Disabled without a caption model
+	require.NoError(t, r.CaptionImages(ctx, &doc, filePath))
+	assert.Len(t, doc.Chunks, chunks)
+
+	r.CaptionModel = "vision"
+	require.NoError(t, r.CaptionImages(ctx, &doc, filePath))
+	require.Len(t, doc.Chunks, chunks+1)
+	caption := doc.Chunks[chunks]
+	assert.Equal(t, "A diagram of a client application talking to the five replicas of a Chubby cell.", caption.Text)
+	assert.Equal(t, "docs/images/structure.jpg", caption.ImagePath)
+	assert.Equal(t, "docs/chubby.md", caption.FilePath)
+	assert.Equal(t, doc.DocumentID, caption.DocumentID)
+	assert.Equal(t, "Chubby > System structure", caption.HeadingPath)
+	assert.Equal(t, "![](images/structure.jpg)", string([]rune(content)[caption.StartOffset:caption.EndOffset]))
+	assert.Equal(t, doc.Chunks[chunks-1].Index+1, caption.Index)
+	assert.Equal(t, CalculateStringHash("docs/chubby.md\ndocs/images/structure.jpg\n"+caption.Text), caption.ID)
+
+	// The image is sent inline
+	require.Len(t, chat.messages, 1)
+	parts := chat.messages[0].OfUser.Content.OfArrayOfContentParts
+	require.Len(t, parts, 2)
+	assert.True(t, strings.HasPrefix(parts[1].OfImageURL.ImageURL.URL, "data:image/jpeg;base64,/9j/"))
+
+	// Cached by image hash, a re-run doesn't call the model
+	chat.messages = nil
+	doc.Chunks = doc.Chunks[:chunks]
+	require.NoError(t, r.CaptionImages(ctx, &doc, filePath))
+	assert.Len(t, doc.Chunks, chunks+1)
+	assert.Nil(t, chat.messages)
+
+	// Another document referencing the same figure has a caption chunk of its own
+	otherPath := filepath.Join(dir, "docs", "cells.md")
+	require.NoError(t, os.WriteFile(otherPath, []byte("# Cells\n\n![](images/structure.jpg)\n"), 0644))
+	other, err := chunker.GetDocumentChunks(ctx, otherPath)
+	require.NoError(t, err)
+	require.NoError(t, r.CaptionImages(ctx, &other, otherPath))
+	otherCaption := other.Chunks[len(other.Chunks)-1]
+	assert.Equal(t, caption.Text, otherCaption.Text)
+	assert.Equal(t, caption.ImagePath, otherCaption.ImagePath)
+	assert.NotEqual(t, caption.ID, otherCaption.ID)
+
+	// Other documents are not scanned for images
+	doc.Chunks = doc.Chunks[:chunks]
+	textPath := filepath.Join(dir, "docs", "chubby.txt")
+	require.NoError(t, os.WriteFile(textPath, []byte(content), 0644))
+	require.NoError(t, r.CaptionImages(ctx, &doc, textPath))
+	assert.Len(t, doc.Chunks, chunks)
+}
+
+func TestDuckDBCaptionCache(t *testing.T) {
+	ctx := context.Background()
+	store := newPlainDuckDBStore(t, 8)
+
+	caption, err := store.GetCachedCaption(ctx, "vision", "hash")
+	require.NoError(t, err)
+	assert.Empty(t, caption)
+
+	require.NoError(t, store.PutCachedCaption(ctx, "vision", "hash", "A diagram"))
+	require.NoError(t, store.PutCachedCaption(ctx, "vision", "hash", "A chart"))
+	caption, err = store.GetCachedCaption(ctx, "vision", "hash")
+	require.NoError(t, err)
+	assert.Equal(t, "A chart", caption)
+	caption, err = store.GetCachedCaption(ctx, "other", "hash")
+	require.NoError(t, err)
+	assert.Empty(t, caption)
+
+	// Caption chunks keep their image
+	require.NoError(t, store.UpsertDocumentChunks(ctx, []*DocumentChunk{{ID: "c", DocumentID: "doc", Text: "A chart",
+		ImagePath: "docs/images/chart.png"}}))
+	chunk, err := store.GetDocumentChunk(ctx, "c")
+	require.NoError(t, err)
+	assert.Equal(t, "docs/images/chart.png", chunk.ImagePath)
+}
@@ -0,0 +1,317 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+	"github.com/openai/openai-go"
+)
+
+// DefaultProfileName is the model name served when no profiles are configured
+const DefaultProfileName = "slimrag"
+
+// Profile is a named set of retrieval settings, exposed as a model by the OpenAI-compatible API.
+// Zero values fall back to the server defaults.
+type Profile struct {
+	Name           string  `json:"name"`
+	Description    string  `json:"description,omitempty"`
+	RetrievalLimit int     `json:"retrieval_limit,omitempty"`
+	SelectedLimit  int     `json:"selected_limit,omitempty"`
+	SystemPrompt   string  `json:"system_prompt,omitempty"`
+	VectorWeight   float64 `json:"vector_weight,omitempty"`
+	KeywordWeight  float64 `json:"keyword_weight,omitempty"`
+	MinScore       float64 `json:"min_score,omitempty"`
+}
+
+// LoadProfiles reads a JSON array of profiles
+func LoadProfiles(path string) ([]Profile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profiles []Profile
+	err = json.Unmarshal(b, &profiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse profiles %s: %w", path, err)
+	}
+	for i, profile := range profiles {
+		if profile.Name == "" {
+			return nil, fmt.Errorf("profile %d in %s has no name", i, path)
+		}
+	}
+	return profiles, nil
+}
+
+func (p *Profile) askParameter(query string) *AskParameter {
+	return &AskParameter{
+		Query:          query,
+		RetrievalLimit: p.RetrievalLimit,
+		SelectedLimit:  p.SelectedLimit,
+		SystemPrompt:   p.SystemPrompt,
+		VectorWeight:   p.VectorWeight,
+		KeywordWeight:  p.KeywordWeight,
+		MinScore:       p.MinScore,
+	}
+}
+
+// WithProfiles sets the profiles served as models, replacing the default profile
+func (s *Server) WithProfiles(profiles []Profile) *Server {
+	if len(profiles) > 0 {
+		s.profiles = profiles
+	}
+	return s
+}
+
+func (s *Server) profile(name string) *Profile {
+	for i := range s.profiles {
+		if s.profiles[i].Name == name {
+			return &s.profiles[i]
+		}
+	}
+	return nil
+}
+
+type modelObject struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+func (s *Server) modelsHandler(c echo.Context) error {
+	models := make([]modelObject, 0, len(s.profiles))
+	for _, profile := range s.profiles {
+		models = append(models, modelObject{ID: profile.Name, Object: "model", OwnedBy: "slimrag"})
+	}
+	return c.JSON(http.StatusOK, echo.Map{"object": "list", "data": models})
+}
+
+// chatMessage is a message of a chat completion request, content is either a string or a list
+// of parts of which only text parts are used
+type chatMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+func (m *chatMessage) text() string {
+	var s string
+	if json.Unmarshal(m.Content, &s) == nil {
+		return s
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(m.Content, &parts) != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, part := range parts {
+		if part.Type == "text" {
+			b.WriteString(part.Text)
+		}
+	}
+	return b.String()
+}
+
+type chatCompletionRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+	Stream   bool          `json:"stream"`
+}
+
+type chatCompletionResponse struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []chatCompletionChoice `json:"choices"`
+	Usage   *chatCompletionUsage   `json:"usage,omitempty"`
+}
+
+type chatCompletionChoice struct {
+	Index        int                  `json:"index"`
+	Message      *chatCompletionDelta `json:"message,omitempty"`
+	Delta        *chatCompletionDelta `json:"delta,omitempty"`
+	FinishReason *string              `json:"finish_reason"`
+}
+
+type chatCompletionDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content"`
+}
+
+type chatCompletionUsage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+}
+
+func openAIError(c echo.Context, status int, errorType, message string) error {
+	return c.JSON(status, echo.Map{"error": echo.Map{"message": message, "type": errorType}})
+}
+
+// chatCompletionsHandler answers the last user message with the RAG pipeline of the profile
+// named by the model, earlier messages are passed to the assistant as they are
+func (s *Server) chatCompletionsHandler(c echo.Context) error {
+	var req chatCompletionRequest
+	err := json.NewDecoder(c.Request().Body).Decode(&req)
+	if err != nil {
+		return openAIError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+	}
+
+	profile := s.profile(req.Model)
+	if profile == nil {
+		return openAIError(c, http.StatusNotFound, "invalid_request_error",
+			fmt.Sprintf("The model '%s' does not exist", req.Model))
+	}
+
+	last := -1
+	for i, m := range req.Messages {
+		if m.Role == "user" {
+			last = i
+		}
+	}
+	if last < 0 {
+		return openAIError(c, http.StatusBadRequest, "invalid_request_error", "messages must contain a user message")
+	}
+
+	ctx := c.Request().Context()
+	p := profile.askParameter(req.Messages[last].text())
+	s.withDefaults(p)
+	err = s.selectChunks(ctx, p)
+	if err != nil {
+		return openAIError(c, http.StatusInternalServerError, "server_error", err.Error())
+	}
+
+	systemPrompt := p.SystemPrompt
+	if systemPrompt == "" {
+		systemPrompt = DefaultSystemPrompt
+	}
+	var messages []openai.ChatCompletionMessageParamUnion
+	for i, m := range req.Messages {
+		switch {
+		case i == last:
+			messages = append(messages, openai.UserMessage(BuildPromptWithSystem(p.Query, p.SelectedChunks, systemPrompt)))
+		case m.Role == "system" || m.Role == "developer":
+			messages = append(messages, openai.SystemMessage(m.text()))
+		case m.Role == "assistant":
+			messages = append(messages, openai.AssistantMessage(m.text()))
+		case m.Role == "user":
+			messages = append(messages, openai.UserMessage(m.text()))
+		}
+	}
+	params := openai.ChatCompletionNewParams{Model: s.r.AssistantModel, Messages: messages}
+
+	chatClient := ToChatClient(s.r.AssistantClient)
+	if chatClient == nil {
+		return openAIError(c, http.StatusInternalServerError, "server_error", "failed to get chat client")
+	}
+	if req.Stream {
+		return s.streamChatCompletion(ctx, c, chatClient, params, profile.Name)
+	}
+
+	completion, err := chatClient.Completions().New(ctx, params)
+	if err != nil {
+		return openAIError(c, http.StatusBadGateway, "server_error", err.Error())
+	}
+	if len(completion.Choices) == 0 {
+		return openAIError(c, http.StatusBadGateway, "server_error", "no choices returned from chat completion")
+	}
+
+	finishReason := completion.Choices[0].FinishReason
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	return c.JSON(http.StatusOK, chatCompletionResponse{
+		ID:      completionID(completion.ID),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   profile.Name,
+		Choices: []chatCompletionChoice{{
+			Message:      &chatCompletionDelta{Role: "assistant", Content: completion.Choices[0].Message.Content},
+			FinishReason: &finishReason,
+		}},
+		Usage: &chatCompletionUsage{
+			PromptTokens:     completion.Usage.PromptTokens,
+			CompletionTokens: completion.Usage.CompletionTokens,
+			TotalTokens:      completion.Usage.TotalTokens,
+		},
+	})
+}
+
+// streamChatCompletion relays the assistant stream as chat.completion.chunk events
+func (s *Server) streamChatCompletion(ctx context.Context, c echo.Context, chatClient ChatClientInterface,
+	params openai.ChatCompletionNewParams, model string) error {
+	stream := chatClient.Completions().NewStreaming(ctx, params)
+	defer func() { _ = stream.Close() }()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	id := completionID("")
+	created := time.Now().Unix()
+	send := func(delta chatCompletionDelta, finishReason *string) error {
+		return writeData(w, chatCompletionResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []chatCompletionChoice{{Delta: &delta, FinishReason: finishReason}},
+		})
+	}
+
+	err := send(chatCompletionDelta{Role: "assistant"}, nil)
+	if err != nil {
+		return nil
+	}
+	for stream.Next() {
+		chunk := stream.Current()
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		err = send(chatCompletionDelta{Content: chunk.Choices[0].Delta.Content}, nil)
+		if err != nil {
+			return nil
+		}
+	}
+	if err = stream.Err(); err != nil {
+		_ = writeData(w, echo.Map{"error": echo.Map{"message": err.Error(), "type": "server_error"}})
+		return nil
+	}
+
+	stop := "stop"
+	_ = send(chatCompletionDelta{}, &stop)
+	_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+	w.Flush()
+	return nil
+}
+
+func writeData(w *echo.Response, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+func completionID(upstream string) string {
+	if upstream != "" {
+		return upstream
+	}
+	return fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+}
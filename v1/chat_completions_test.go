@@ -0,0 +1,105 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newChatServer(t *testing.T, reply string, profiles ...Profile) (*openai.Client, *fakeChatClient) {
+	r, chat := newTestRAG(reply, citationChunks...)
+	srv := httptest.NewServer(NewServer(r).WithProfiles(profiles).e)
+	t.Cleanup(srv.Close)
+	client := openai.NewClient(option.WithBaseURL(srv.URL+"/v1"), option.WithAPIKey("unused"), option.WithMaxRetries(0))
+	return &client, chat
+}
+
+func TestChatCompletionsModels(t *testing.T) {
+	client, _ := newChatServer(t, "")
+	page, err := client.Models.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, page.Data, 1)
+	assert.Equal(t, DefaultProfileName, page.Data[0].ID)
+
+	client, _ = newChatServer(t, "", Profile{Name: "docs"}, Profile{Name: "code"})
+	page, err = client.Models.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, page.Data, 2)
+	assert.Equal(t, "code", page.Data[1].ID)
+}
+
+func TestChatCompletions(t *testing.T) {
+	ctx := context.Background()
+	client, chat := newChatServer(t, "Five replicas.", Profile{Name: "brief", SystemPrompt: "Answer briefly: "})
+
+	completion, err := client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+		Model: "brief",
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage("You are helpful."),
+			openai.UserMessage("What is Chubby?"),
+			openai.AssistantMessage("A lock service."),
+			openai.UserMessage("How many replicas are in a cell?"),
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "brief", completion.Model)
+	require.Len(t, completion.Choices, 1)
+	assert.Equal(t, "Five replicas.", completion.Choices[0].Message.Content)
+	assert.Equal(t, "stop", completion.Choices[0].FinishReason)
+
+	// History is kept, the last user message carries the retrieved context
+	require.Len(t, chat.messages, 4)
+	assert.Equal(t, "What is Chubby?", chat.messages[1].OfUser.Content.OfString.Value)
+	prompt := chat.messages[3].OfUser.Content.OfString.Value
+	assert.True(t, strings.HasPrefix(prompt, "Answer briefly: "))
+	assert.Contains(t, prompt, "Cells consist of five replicas.")
+	assert.True(t, strings.HasSuffix(prompt, "How many replicas are in a cell?"))
+
+	_, err = client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+		Model:    "missing",
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("hi")},
+	})
+	var apiErr *openai.Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+}
+
+func TestChatCompletionsStream(t *testing.T) {
+	client, _ := newChatServer(t, "Chubby is a lock service.")
+
+	stream := client.Chat.Completions.NewStreaming(context.Background(), openai.ChatCompletionNewParams{
+		Model:    DefaultProfileName,
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("What is Chubby?")},
+	})
+	acc := openai.ChatCompletionAccumulator{}
+	for stream.Next() {
+		chunk := stream.Current()
+		assert.Equal(t, DefaultProfileName, chunk.Model)
+		acc.AddChunk(chunk)
+	}
+	require.NoError(t, stream.Err())
+	require.Len(t, acc.Choices, 1)
+	assert.Equal(t, "Chubby is a lock service.", acc.Choices[0].Message.Content)
+	assert.Equal(t, "stop", acc.Choices[0].FinishReason)
+}
+
+func TestLoadProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"name": "docs", "selected_limit": 5, "min_score": 0.3}]`), 0644))
+	profiles, err := LoadProfiles(path)
+	require.NoError(t, err)
+	assert.Equal(t, []Profile{{Name: "docs", SelectedLimit: 5, MinScore: 0.3}}, profiles)
+
+	require.NoError(t, os.WriteFile(path, []byte(`[{"selected_limit": 5}]`), 0644))
+	_, err = LoadProfiles(path)
+	assert.Error(t, err)
+}
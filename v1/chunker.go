@@ -1,6 +1,7 @@
 package rag
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,14 +17,18 @@ import (
 
 // ChunkingConfig chunking configuration
 type ChunkingConfig struct {
-	MaxChunkSize        int     `json:"max_chunk_size"`       // Maximum chunk size (in characters)
-	MinChunkSize        int     `json:"min_chunk_size"`       // Minimum chunk size (in characters)
-	OverlapSize         int     `json:"overlap_size"`         // Overlap size (in characters)
-	SentenceWindow      int     `json:"sentence_window"`      // Sentence window size
-	Strategy            string  `json:"strategy"`             // Chunking strategy: "fixed", "semantic", "sentence", "adaptive"
+	MaxChunkSize        int     `json:"max_chunk_size"`       // Maximum chunk size (in SizeUnit)
+	MinChunkSize        int     `json:"min_chunk_size"`       // Minimum chunk size (in SizeUnit)
+	OverlapSize         int     `json:"overlap_size"`         // Overlap size (in SizeUnit)
+	SizeUnit            string  `json:"size_unit"`            // Unit of chunk sizes: "chars", "tokens"
+	VocabFile           string  `json:"vocab_file"`           // BPE vocab of the embedding model, e.g. cl100k_base.tiktoken
+	MaxInputTokens      int     `json:"max_input_tokens"`     // Chunks with more tokens are split to fit the embedding model, 0 disables
+	SentenceWindow      int     `json:"sentence_window"`      // Sentence window size, also the sentences embedded together by the semantic strategy
+	Strategy            string  `json:"strategy"`             // Chunking strategy: "fixed", "semantic", "sentence", "adaptive", "markdown"
 	Language            string  `json:"language"`             // Language: "zh", "en", "auto"
 	PreserveSections    bool    `json:"preserve_sections"`    // Whether to preserve section structure
-	SimilarityThreshold float64 `json:"similarity_threshold"` // Semantic similarity threshold
+	SimilarityThreshold float64 `json:"similarity_threshold"` // Semantic strategy ends a chunk where adjacent sentences are less similar
+	ParentChunkSize     int     `json:"parent_chunk_size"`    // Chunks are linked to parent sections of up to this size (in SizeUnit), 0 disables
 }
 
 // DefaultChunkingConfig default configuration
@@ -32,6 +37,7 @@ func DefaultChunkingConfig() *ChunkingConfig {
 		MaxChunkSize:        1000,
 		MinChunkSize:        100,
 		OverlapSize:         50,
+		SizeUnit:            "chars",
 		SentenceWindow:      3,
 		Strategy:            "adaptive",
 		Language:            "auto",
@@ -76,6 +82,9 @@ func LoadChunkingConfig(configPath string) (*ChunkingConfig, error) {
 	if config.Strategy == "" {
 		config.Strategy = "adaptive"
 	}
+	if config.SizeUnit == "" {
+		config.SizeUnit = "chars"
+	}
 
 	return config, nil
 }
@@ -85,6 +94,8 @@ type DocumentChunker struct {
 	config    *ChunkingConfig
 	segmenter *gse.Segmenter
 	cwd       string
+	embedder  *RAG      // Embeds sentences for the semantic strategy, see WithEmbedder
+	tokenizer Tokenizer // Counts tokens for SizeUnit "tokens" and MaxInputTokens
 }
 
 // NewDocumentChunker creates a new document chunker
@@ -108,6 +119,21 @@ func NewDocumentChunker(config *ChunkingConfig, cwd string) (*DocumentChunker, e
 		cwd:       cwd,
 	}
 
+	switch config.SizeUnit {
+	case "", "chars", "tokens":
+	default:
+		return nil, fmt.Errorf("unknown size unit %q, expected chars or tokens", config.SizeUnit)
+	}
+	if config.SizeUnit == "tokens" || config.MaxInputTokens > 0 {
+		if config.VocabFile == "" {
+			return nil, fmt.Errorf("vocab_file is required to count tokens")
+		}
+		chunker.tokenizer, err = LoadBPETokenizer(config.VocabFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Configure tokenizer based on language
 	switch config.Language {
 	case "zh":
@@ -123,60 +149,50 @@ func NewDocumentChunker(config *ChunkingConfig, cwd string) (*DocumentChunker, e
 }
 
 // ChunkDocument chunks a document
-func (c *DocumentChunker) ChunkDocument(content string, fileName string) (*Document, error) {
-	if content == "" {
+func (c *DocumentChunker) ChunkDocument(ctx context.Context, content string, fileName string) (*Document, error) {
+	return c.ChunkLoadedFile(ctx, &LoadedFile{Text: content}, fileName)
+}
+
+// ChunkLoadedFile chunks the text of a loaded file, chunks carry the pages they are on
+func (c *DocumentChunker) ChunkLoadedFile(ctx context.Context, file *LoadedFile, fileName string) (*Document, error) {
+	if file.Text == "" {
 		return nil, fmt.Errorf("content is empty")
 	}
 
-	content = c.preprocessText(content)
-	var chunks []*DocumentChunk
-
-	switch c.config.Strategy {
-	case "fixed":
-		chunks = c.fixedSizeChunking(content)
-	case "semantic":
-		chunks = c.semanticChunking(content)
-	case "sentence":
-		chunks = c.sentenceChunking(content)
-	case "adaptive":
-		chunks = c.adaptiveChunking(content)
-	default:
-		chunks = c.adaptiveChunking(content)
+	chunks, metadata, err := c.chunkFile(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		chunk.FilePath = fileName
 	}
 
 	doc := &Document{
 		FileName:   fileName,
 		DocumentID: strings.TrimSuffix(fileName, filepath.Ext(fileName)),
 		Chunks:     chunks,
+		Metadata:   metadata,
 	}
 
 	return doc, nil
 }
 
-// GetDocumentChunks chunks a document, using file path to generate document_id
-func (c *DocumentChunker) GetDocumentChunks(filePath string) (Document, error) {
-	buf, err := os.ReadFile(filePath)
+// GetDocumentChunks loads and chunks a document with the loader for its type. The document ID is
+// the hash of the file bytes, the hash update records for the file, so that the chunks of the
+// version are found again when the file changes or is deleted, also when a loader transforms it.
+func (c *DocumentChunker) GetDocumentChunks(ctx context.Context, filePath string) (Document, error) {
+	documentID, err := CalculateFileHash(filePath)
+	if err != nil {
+		return Document{}, err
+	}
+	file, err := LoadFile(ctx, filePath)
 	if err != nil {
 		return Document{}, err
 	}
 
-	content := string(buf)
-	documentID := CalculateStringHash(content)
-
-	content = c.preprocessText(content)
-
-	var chunks []*DocumentChunk
-	switch c.config.Strategy {
-	case "fixed":
-		chunks = c.fixedSizeChunking(content)
-	case "semantic":
-		chunks = c.semanticChunking(content)
-	case "sentence":
-		chunks = c.sentenceChunking(content)
-	case "adaptive":
-		chunks = c.adaptiveChunking(content)
-	default:
-		chunks = c.adaptiveChunking(content)
+	chunks, metadata, err := c.chunkFile(ctx, file)
+	if err != nil {
+		return Document{}, err
 	}
 
 	// Calculate relative path
@@ -189,6 +205,7 @@ func (c *DocumentChunker) GetDocumentChunks(filePath string) (Document, error) {
 	for _, chunk := range chunks {
 		chunk.DocumentID = documentID
 		chunk.ID = CalculateStringHash(chunk.Text)
+		chunk.FilePath = filepath.ToSlash(relPath)
 	}
 
 	return Document{
@@ -196,9 +213,91 @@ func (c *DocumentChunker) GetDocumentChunks(filePath string) (Document, error) {
 		FilePath:   relPath,
 		DocumentID: documentID,
 		Chunks:     chunks,
+		Metadata:   metadata,
 	}, nil
 }
 
+// chunkFile chunks source code along its declarations and other files with the strategy
+func (c *DocumentChunker) chunkFile(ctx context.Context, file *LoadedFile) ([]*DocumentChunk, Metadata, error) {
+	if file.Code {
+		return c.codeChunking(file), nil, nil
+	}
+	chunks, metadata, err := c.chunkWithFrontMatter(ctx, file.Text)
+	if err != nil {
+		return nil, nil, err
+	}
+	annotatePages(file, chunks)
+	return chunks, metadata, nil
+}
+
+// chunkWithFrontMatter chunks the content after its front matter and returns the front matter as
+// metadata. Offsets stay relative to the whole content. Invalid front matter is chunked as text.
+func (c *DocumentChunker) chunkWithFrontMatter(ctx context.Context, content string) ([]*DocumentChunk, Metadata, error) {
+	metadata, bodyStart, err := parseFrontMatter(content)
+	if err != nil {
+		log.Warn().Err(err).Msg("Ignoring front matter")
+		metadata, bodyStart = nil, 0
+	}
+
+	chunks, err := c.chunkContent(ctx, content[bodyStart:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.config.ParentChunkSize > 0 {
+		chunks = c.linkParents(content[bodyStart:], chunks)
+	}
+	shift := utf8.RuneCountInString(content[:bodyStart])
+	for _, chunk := range chunks {
+		chunk.StartOffset += shift
+		chunk.EndOffset += shift
+	}
+	return chunks, metadata, nil
+}
+
+// chunkContent splits content with the configured strategy, chunks carry their index,
+// source offsets and heading breadcrumb
+func (c *DocumentChunker) chunkContent(ctx context.Context, content string) ([]*DocumentChunk, error) {
+	if c.config.Strategy == "markdown" {
+		// Chunks are cut from the original, whitespace is part of the structure
+		chunks := c.limitInput(c.markdownChunking(content))
+		for i, chunk := range chunks {
+			chunk.Index = i
+		}
+		return chunks, nil
+	}
+
+	normalized := c.preprocessText(content)
+
+	var chunks []*DocumentChunk
+	switch c.config.Strategy {
+	case "fixed":
+		chunks = c.fixedSizeChunking(normalized)
+	case "semantic":
+		if c.embedder == nil {
+			chunks = c.semanticChunking(normalized)
+			break
+		}
+		var err error
+		if chunks, err = c.embeddingChunking(ctx, normalized); err != nil {
+			return nil, err
+		}
+	case "sentence":
+		chunks = c.sentenceChunking(normalized)
+	case "adaptive":
+		chunks = c.adaptiveChunking(normalized)
+	default:
+		chunks = c.adaptiveChunking(normalized)
+	}
+
+	// Strategies restart numbering when splitting long paragraphs
+	chunks = c.limitInput(chunks)
+	for i, chunk := range chunks {
+		chunk.Index = i
+	}
+	annotateProvenance(content, normalized, chunks)
+	return chunks, nil
+}
+
 // preprocessText preprocesses text
 func (c *DocumentChunker) preprocessText(text string) string {
 	// Remove extra whitespace characters
@@ -221,14 +320,12 @@ func (c *DocumentChunker) fixedSizeChunking(content string) []*DocumentChunk {
 	totalLen := len(runes)
 
 	for i := 0; i < totalLen; {
-		end := i + c.config.MaxChunkSize
-		if end > totalLen {
-			end = totalLen
-		}
+		end := c.runesWithin(runes, i, c.config.MaxChunkSize)
 
 		// Try to split at sentence boundaries
 		if end < totalLen {
-			for j := end; j > i+c.config.MinChunkSize && j > i; j-- {
+			minEnd := c.runesWithin(runes, i, c.config.MinChunkSize)
+			for j := end - 1; j > minEnd && j > i; j-- {
 				if c.isSentenceBoundary(runes[j]) {
 					end = j + 1
 					break
@@ -237,7 +334,7 @@ func (c *DocumentChunker) fixedSizeChunking(content string) []*DocumentChunk {
 		}
 
 		chunkText := strings.TrimSpace(string(runes[i:end]))
-		if len([]rune(chunkText)) >= c.config.MinChunkSize {
+		if c.size(chunkText) >= c.config.MinChunkSize {
 			chunk := &DocumentChunk{
 				Text:  chunkText,
 				Index: len(chunks),
@@ -246,7 +343,7 @@ func (c *DocumentChunker) fixedSizeChunking(content string) []*DocumentChunk {
 		}
 
 		// Calculate next starting position (considering overlap)
-		nextStart := end - c.config.OverlapSize
+		nextStart := c.runesBefore(runes, end, c.config.OverlapSize)
 		if nextStart <= i {
 			nextStart = i + 1
 		}
@@ -265,7 +362,7 @@ func (c *DocumentChunker) semanticChunking(content string) []*DocumentChunk {
 
 	for _, paragraph := range paragraphs {
 		// If current paragraph is too long, need further splitting
-		if utf8.RuneCountInString(paragraph) > c.config.MaxChunkSize {
+		if c.size(paragraph) > c.config.MaxChunkSize {
 			// Save current chunk
 			if currentChunk != "" {
 				chunk := &DocumentChunk{
@@ -288,7 +385,7 @@ func (c *DocumentChunker) semanticChunking(content string) []*DocumentChunk {
 		}
 		potentialChunk += paragraph
 
-		if utf8.RuneCountInString(potentialChunk) > c.config.MaxChunkSize {
+		if c.size(potentialChunk) > c.config.MaxChunkSize {
 			// Save current chunk
 			if currentChunk != "" {
 				chunk := &DocumentChunk{
@@ -304,7 +401,7 @@ func (c *DocumentChunker) semanticChunking(content string) []*DocumentChunk {
 	}
 
 	// Save last chunk
-	if currentChunk != "" && utf8.RuneCountInString(currentChunk) >= c.config.MinChunkSize {
+	if currentChunk != "" && c.size(currentChunk) >= c.config.MinChunkSize {
 		chunk := &DocumentChunk{
 			Text:  strings.TrimSpace(currentChunk),
 			Index: len(chunks),
@@ -329,10 +426,10 @@ func (c *DocumentChunker) sentenceChunking(content string) []*DocumentChunk {
 		}
 		potentialChunk += sentence
 
-		if utf8.RuneCountInString(potentialChunk) > c.config.MaxChunkSize ||
+		if c.size(potentialChunk) > c.config.MaxChunkSize ||
 			sentenceCount >= c.config.SentenceWindow {
 			// Save current chunk
-			if currentChunk != "" && utf8.RuneCountInString(currentChunk) >= c.config.MinChunkSize {
+			if currentChunk != "" && c.size(currentChunk) >= c.config.MinChunkSize {
 				chunk := &DocumentChunk{
 					Text:  strings.TrimSpace(currentChunk),
 					Index: len(chunks),
@@ -348,7 +445,7 @@ func (c *DocumentChunker) sentenceChunking(content string) []*DocumentChunk {
 	}
 
 	// Save last chunk
-	if currentChunk != "" && utf8.RuneCountInString(currentChunk) >= c.config.MinChunkSize {
+	if currentChunk != "" && c.size(currentChunk) >= c.config.MinChunkSize {
 		chunk := &DocumentChunk{
 			Text:  strings.TrimSpace(currentChunk),
 			Index: len(chunks),
@@ -390,9 +487,9 @@ func (c *DocumentChunker) hybridChunking(content string) []*DocumentChunk {
 	var chunks []*DocumentChunk
 
 	for _, section := range sections {
-		if utf8.RuneCountInString(section) <= c.config.MaxChunkSize {
+		if c.size(section) <= c.config.MaxChunkSize {
 			// Section size is appropriate, use as a single chunk
-			if utf8.RuneCountInString(section) >= c.config.MinChunkSize {
+			if c.size(section) >= c.config.MinChunkSize {
 				chunk := &DocumentChunk{
 					Text:  strings.TrimSpace(section),
 					Index: len(chunks),
@@ -459,11 +556,13 @@ func (c *DocumentChunker) splitIntoSentences(content string) []string {
 	return result
 }
 
+// sectionHeaderPattern matches ATX and setext headings
+var sectionHeaderPattern = regexp.MustCompile(`(?m)^#{1,6}\s+.+$|^.+\n[=-]+\s*$`)
+
 // splitIntoSections splits into sections
 func (c *DocumentChunker) splitIntoSections(content string) []string {
 	// Use header pattern to split sections
-	headerPattern := regexp.MustCompile(`(?m)^#{1,6}\s+.+$|^.+\n[=-]+\s*$`)
-	indices := headerPattern.FindAllStringIndex(content, -1)
+	indices := sectionHeaderPattern.FindAllStringIndex(content, -1)
 
 	if len(indices) == 0 {
 		// No headers found, split by paragraphs
@@ -508,9 +607,9 @@ func (c *DocumentChunker) splitLongParagraph(paragraph string) []*DocumentChunk
 		}
 		potentialChunk += sentence
 
-		if utf8.RuneCountInString(potentialChunk) > c.config.MaxChunkSize {
+		if c.size(potentialChunk) > c.config.MaxChunkSize {
 			// Save current chunk
-			if currentChunk != "" && utf8.RuneCountInString(currentChunk) >= c.config.MinChunkSize {
+			if currentChunk != "" && c.size(currentChunk) >= c.config.MinChunkSize {
 				chunk := &DocumentChunk{
 					Text:  strings.TrimSpace(currentChunk),
 					Index: len(chunks),
@@ -524,7 +623,7 @@ func (c *DocumentChunker) splitLongParagraph(paragraph string) []*DocumentChunk
 	}
 
 	// Save last chunk
-	if currentChunk != "" && utf8.RuneCountInString(currentChunk) >= c.config.MinChunkSize {
+	if currentChunk != "" && c.size(currentChunk) >= c.config.MinChunkSize {
 		chunk := &DocumentChunk{
 			Text:  strings.TrimSpace(currentChunk),
 			Index: len(chunks),
@@ -535,8 +634,9 @@ func (c *DocumentChunker) splitLongParagraph(paragraph string) []*DocumentChunk
 	return chunks
 }
 
-// ChunkMarkdownFile processes Markdown file and generates chunks.json
-func ChunkMarkdownFile(markdownPath, configPath, outputPath string) error {
+// ChunkMarkdownFile processes Markdown file and generates chunks.json, embedder is used by the
+// semantic strategy and may be nil
+func ChunkMarkdownFile(ctx context.Context, markdownPath, configPath, outputPath string, embedder *RAG) error {
 	// Load configuration
 	config, err := LoadChunkingConfig(configPath)
 	if err != nil {
@@ -553,6 +653,9 @@ func ChunkMarkdownFile(markdownPath, configPath, outputPath string) error {
 	if err != nil {
 		return fmt.Errorf("failed to create chunker: %w", err)
 	}
+	if embedder != nil {
+		chunker.WithEmbedder(embedder)
+	}
 
 	// Read Markdown file
 	content, err := os.ReadFile(markdownPath)
@@ -562,7 +665,7 @@ func ChunkMarkdownFile(markdownPath, configPath, outputPath string) error {
 
 	// Perform chunking
 	fileName := filepath.Base(markdownPath)
-	doc, err := chunker.ChunkDocument(string(content), fileName)
+	doc, err := chunker.ChunkDocument(ctx, string(content), fileName)
 	if err != nil {
 		return fmt.Errorf("failed to chunk document: %w", err)
 	}
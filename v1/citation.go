@@ -0,0 +1,160 @@
+package rag
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// citationPattern matches markers like [1], [2, 3] or [2，3]
+var citationPattern = regexp.MustCompile(`\[(\d+(?:\s*[,，]\s*\d+)*)\]`)
+
+// resolveCitations maps the fragment numbers cited in answer text to chunks. Sources are numbered
+// in order of first citation and the markers are rewritten accordingly. Markers with a number that
+// doesn't refer to a chunk, e.g. an array index, and markers in code are left as they are.
+func resolveCitations(answerText string, chunks []DocumentChunk) *Answer {
+	answer := &Answer{}
+	numbers := make(map[int]int) // fragment number -> source number
+	code := markdownCode(answerText)
+
+	var b strings.Builder
+	last := 0
+	for _, m := range citationPattern.FindAllStringSubmatchIndex(answerText, -1) {
+		// [1](https://...) is a markdown link, not a citation
+		if m[1] < len(answerText) && answerText[m[1]] == '(' {
+			continue
+		}
+		if within(m[0], code) {
+			continue
+		}
+		cited, ok := citedFragments(answerText[m[2]:m[3]], len(chunks))
+		if !ok {
+			continue
+		}
+		b.WriteString(answerText[last:m[0]])
+		last = m[1]
+
+		for _, n := range cited {
+			number, ok := numbers[n]
+			if !ok {
+				number = len(answer.Sources) + 1
+				numbers[n] = number
+				answer.Sources = append(answer.Sources, newSource(number, chunks[n-1]))
+			}
+			b.WriteString(fmt.Sprintf("[%d]", number))
+		}
+	}
+	b.WriteString(answerText[last:])
+
+	answer.Text = b.String()
+	return answer
+}
+
+// citedFragments parses the numbers of a citation marker, false if one isn't a fragment number
+func citedFragments(marker string, fragments int) ([]int, bool) {
+	var cited []int
+	for _, field := range strings.FieldsFunc(marker, func(r rune) bool {
+		return r == ',' || r == '，' || r == ' '
+	}) {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 1 || n > fragments {
+			return nil, false
+		}
+		cited = append(cited, n)
+	}
+	return cited, true
+}
+
+// markdownCode returns the spans of the code blocks and inline code of markdown source, including
+// the fences and backticks
+func markdownCode(source string) [][2]int {
+	b := []byte(source)
+	doc := markdownParser.Parse(text.NewReader(b))
+	spans := nestedCodeSpans(doc, b)
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if _, ok := n.(*ast.CodeSpan); !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			if t, ok := c.(*ast.Text); ok {
+				spans = append(spans, [2]int{t.Segment.Start - 1, t.Segment.Stop + 1})
+			}
+		}
+		return ast.WalkSkipChildren, nil
+	})
+	return spans
+}
+
+func newSource(number int, chunk DocumentChunk) Source {
+	return Source{
+		Number:      number,
+		ChunkID:     chunk.ID,
+		DocumentID:  chunk.DocumentID,
+		FilePath:    chunk.FilePath,
+		HeadingPath: chunk.HeadingPath,
+		StartOffset: chunk.StartOffset,
+		EndOffset:   chunk.EndOffset,
+		PageStart:   chunk.PageStart,
+		PageEnd:     chunk.PageEnd,
+		ImagePath:   chunk.ImagePath,
+		Symbol:      chunk.Symbol,
+		SymbolKind:  chunk.SymbolKind,
+		LineStart:   chunk.LineStart,
+		LineEnd:     chunk.LineEnd,
+		CommitSHA:   chunk.CommitSHA,
+		CommitDate:  chunk.CommitDate,
+	}
+}
+
+// Markdown renders the answer followed by its sources
+func (a *Answer) Markdown() string {
+	if len(a.Sources) == 0 {
+		return a.Text
+	}
+
+	var b strings.Builder
+	b.WriteString(a.Text)
+	b.WriteString("\n\n**Sources:**\n\n")
+	for _, source := range a.Sources {
+		b.WriteString(fmt.Sprintf("- [%d] %s\n", source.Number, source.String()))
+	}
+	return b.String()
+}
+
+// String returns the file path, heading or symbol, pages and commit of the source, or its chunk ID if
+// unknown
+func (s Source) String() string {
+	location := s.location()
+	if pages := FormatPages(s.PageStart, s.PageEnd); pages != "" {
+		location += ", " + pages
+	}
+	if commit := FormatCommit(s.CommitSHA, s.CommitDate); commit != "" {
+		location += ", " + commit
+	}
+	return location
+}
+
+func (s Source) location() string {
+	filePath := s.FilePath
+	if filePath != "" {
+		filePath += FormatLines(s.LineStart, s.LineEnd)
+	}
+	heading := s.HeadingPath
+	if symbol := FormatSymbol(s.SymbolKind, s.Symbol); symbol != "" {
+		heading = symbol
+	}
+	switch {
+	case filePath != "" && heading != "":
+		return fmt.Sprintf("%s (%s)", filePath, heading)
+	case filePath != "":
+		return filePath
+	case heading != "":
+		return heading
+	default:
+		return "chunk " + s.ChunkID
+	}
+}
@@ -0,0 +1,140 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/packages/ssestream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeChatClient answers every completion with reply and records the last request
+type fakeChatClient struct {
+	reply    string
+	prompt   string
+	messages []openai.ChatCompletionMessageParamUnion
+}
+
+func (c *fakeChatClient) Completions() ChatCompletionsInterface { return c }
+
+func (c *fakeChatClient) New(_ context.Context, params openai.ChatCompletionNewParams) (*openai.ChatCompletion, error) {
+	c.messages = params.Messages
+	if len(params.Messages) > 0 && params.Messages[0].OfUser != nil {
+		c.prompt = params.Messages[0].OfUser.Content.OfString.Value
+	}
+	return &openai.ChatCompletion{
+		Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: c.reply}}},
+	}, nil
+}
+
+// NewStreaming sends the reply one word per chunk
+func (c *fakeChatClient) NewStreaming(ctx context.Context, params openai.ChatCompletionNewParams) *ssestream.Stream[openai.ChatCompletionChunk] {
+	_, _ = c.New(ctx, params)
+	var events [][]byte
+	for _, word := range strings.SplitAfter(c.reply, " ") {
+		content, _ := json.Marshal(word)
+		events = append(events, []byte(fmt.Sprintf(
+			`{"id":"fake","object":"chat.completion.chunk","model":"fake","choices":[{"index":0,"delta":{"content":%s}}]}`, content)))
+	}
+	return ssestream.NewStream[openai.ChatCompletionChunk](&sliceDecoder{events: events}, nil)
+}
+
+type sliceDecoder struct {
+	events [][]byte
+	cur    ssestream.Event
+}
+
+func (d *sliceDecoder) Next() bool {
+	if len(d.events) == 0 {
+		return false
+	}
+	d.cur, d.events = ssestream.Event{Data: d.events[0]}, d.events[1:]
+	return true
+}
+
+func (d *sliceDecoder) Event() ssestream.Event { return d.cur }
+func (d *sliceDecoder) Close() error           { return nil }
+func (d *sliceDecoder) Err() error             { return nil }
+
+var citationChunks = []DocumentChunk{
+	{ID: "c1", DocumentID: "d1", Text: "Chubby is a lock service.", FilePath: "chubby.md", HeadingPath: "Introduction"},
+	{ID: "c2", DocumentID: "d1", Text: "Cells consist of five replicas.", FilePath: "chubby.md", HeadingPath: "Design > System structure", StartOffset: 10, EndOffset: 41},
+	{ID: "c3", DocumentID: "d2", Text: "Paxos is used for consensus."},
+}
+
+func TestResolveCitations(t *testing.T) {
+	answer := resolveCitations("Cells have five replicas [2]. Chubby locks [1][2] via Paxos [3].", citationChunks)
+
+	assert.Equal(t, "Cells have five replicas [1]. Chubby locks [2][1] via Paxos [3].", answer.Text)
+	require.Len(t, answer.Sources, 3)
+	assert.Equal(t, Source{Number: 1, ChunkID: "c2", DocumentID: "d1", FilePath: "chubby.md",
+		HeadingPath: "Design > System structure", StartOffset: 10, EndOffset: 41}, answer.Sources[0])
+	assert.Equal(t, "c1", answer.Sources[1].ChunkID)
+	assert.Equal(t, "c3", answer.Sources[2].ChunkID)
+
+	lists := resolveCitations("Both [1, 3].", citationChunks)
+	assert.Equal(t, "Both [1][2].", lists.Text)
+	assert.Len(t, lists.Sources, 2)
+
+	links := resolveCitations("See [1](https://example.com).", citationChunks)
+	assert.Equal(t, "See [1](https://example.com).", links.Text)
+	assert.Empty(t, links.Sources)
+
+	// Numbers of no fragment are not citations, e.g. array indexes
+	unknown := resolveCitations("Paxos [3，9] picks votes[5] and [4], see [2].", citationChunks)
+	assert.Equal(t, "Paxos [3，9] picks votes[5] and [4], see [1].", unknown.Text)
+	require.Len(t, unknown.Sources, 1)
+	assert.Equal(t, "c2", unknown.Sources[0].ChunkID)
+}
+
+func TestResolveCitationsCode(t *testing.T) {
+	text := "Read `replicas[1]` [2]:\n\n```go\nleader := replicas[1] // [3]\n```\n\n- item\n\n  ~~~\n  cells[2]\n  ~~~\n\nDone [1]."
+	answer := resolveCitations(text, citationChunks)
+
+	assert.Equal(t, strings.NewReplacer(" [2]:", " [1]:", "Done [1]", "Done [2]").Replace(text), answer.Text)
+	require.Len(t, answer.Sources, 2)
+	assert.Equal(t, "c2", answer.Sources[0].ChunkID)
+	assert.Equal(t, "c1", answer.Sources[1].ChunkID)
+}
+
+func TestAnswerMarkdown(t *testing.T) {
+	assert.Equal(t, "no sources", (&Answer{Text: "no sources"}).Markdown())
+
+	answer := resolveCitations("Yes [2][3].", citationChunks)
+	assert.Equal(t, "Yes [1][2].\n\n**Sources:**\n\n- [1] chubby.md (Design > System structure)\n- [2] chunk c3\n", answer.Markdown())
+}
+
+func TestBuildCitationPrompt(t *testing.T) {
+	prompt := BuildCitationPrompt("What is Chubby?", citationChunks, DefaultSystemPrompt)
+
+	assert.True(t, strings.HasPrefix(prompt, DefaultSystemPrompt))
+	assert.Contains(t, prompt, citationInstruction)
+	assert.Contains(t, prompt, "Knowledge fragment [1] (source: chubby.md > Introduction): Chubby is a lock service.")
+	assert.Contains(t, prompt, "Knowledge fragment [3]: Paxos is used for consensus.")
+	assert.True(t, strings.HasSuffix(prompt, "Question: What is Chubby?"))
+}
+
+func TestAskCitations(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeChatClient{reply: "Chubby is a lock service [1]."}
+	r := &RAG{AssistantClient: client}
+
+	answer, err := r.Ask(ctx, &AskParameter{Query: "What is Chubby?", SelectedChunks: citationChunks, Citations: true})
+	require.NoError(t, err)
+	assert.Contains(t, client.prompt, citationInstruction)
+	assert.Equal(t, "Chubby is a lock service [1].", answer.Text)
+	require.Len(t, answer.Sources, 1)
+	assert.Equal(t, "c1", answer.Sources[0].ChunkID)
+
+	// Without citations the answer has no sources and renders as the plain text
+	answer, err = r.Ask(ctx, &AskParameter{Query: "What is Chubby?", SelectedChunks: citationChunks})
+	require.NoError(t, err)
+	assert.NotContains(t, client.prompt, citationInstruction)
+	assert.Empty(t, answer.Sources)
+	assert.Equal(t, answer.Text, answer.Markdown())
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/packages/ssestream"
 )
 
 // EmbeddingClientInterface defines the interface for embedding clients
@@ -19,6 +20,7 @@ type ChatClientInterface interface {
 // ChatCompletionsInterface defines the interface for chat completions
 type ChatCompletionsInterface interface {
 	New(ctx context.Context, params openai.ChatCompletionNewParams) (*openai.ChatCompletion, error)
+	NewStreaming(ctx context.Context, params openai.ChatCompletionNewParams) *ssestream.Stream[openai.ChatCompletionChunk]
 }
 
 // OriginalOpenAIEmbeddingClient wraps the original OpenAI embedding client
@@ -48,6 +50,10 @@ func (c *OriginalOpenAIChatCompletionsClient) New(ctx context.Context, params op
 	return c.completions.New(ctx, params)
 }
 
+func (c *OriginalOpenAIChatCompletionsClient) NewStreaming(ctx context.Context, params openai.ChatCompletionNewParams) *ssestream.Stream[openai.ChatCompletionChunk] {
+	return c.completions.NewStreaming(ctx, params)
+}
+
 // ToEmbeddingClient converts an *openai.Client to EmbeddingClientInterface
 func ToEmbeddingClient(client interface{}) EmbeddingClientInterface {
 	switch c := client.(type) {
@@ -0,0 +1,559 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// CodeSymbol is a declaration of a source file with its doc comment, offsets are rune offsets
+// of LoadedFile.Text. Members are the declarations of classes and similar containers.
+type CodeSymbol struct {
+	Name       string // Qualified by the container for members, e.g. "Server.Start"
+	Kind       string // "func", "method", "type", "class", ...
+	Start, End int
+	Members    []CodeSymbol
+}
+
+// codeLoader finds the declarations of source files by their braces, or by their indentation
+// for languages like Python
+type codeLoader struct {
+	indent bool
+	// singleQuoteStrings is set for languages where '...' is a string rather than a character
+	singleQuoteStrings bool
+}
+
+func (l codeLoader) Load(ctx context.Context, filePath string) (*LoadedFile, error) {
+	return loadFromStream(ctx, l, filePath)
+}
+
+func (l codeLoader) LoadStream(_ context.Context, r io.Reader) (*LoadedFile, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text := string(buf)
+	if l.indent {
+		return &LoadedFile{Text: text, Code: true, Symbols: indentSymbols(text)}, nil
+	}
+	return &LoadedFile{Text: text, Code: true, Symbols: braceSymbols(text, l.singleQuoteStrings)}, nil
+}
+
+// declarationPattern finds the kind and name of a declaration in its header
+var declarationPattern = regexp.MustCompile(`\b(class|interface|struct|enum|trait|impl|union|record|object|` +
+	`namespace|module|protocol|extension|fn|func|fun|function|def|type)\s+([A-Za-z_$][\w$]*)`)
+
+// variablePattern finds JavaScript style bindings, functions if they are assigned one
+var variablePattern = regexp.MustCompile(`^(?:export\s+)?(?:const|let|var)\s+([A-Za-z_$][\w$]*)\s*(?::[^=]+)?=\s*(async\b|function\b|\([^)]*\)\s*=>|[\w$]+\s*=>)?`)
+
+// callablePattern finds C style functions, the name is the identifier before the parameters
+var callablePattern = regexp.MustCompile(`([A-Za-z_][\w]*(?:::[~A-Za-z_][\w]*)*)\s*\(`)
+
+var controlKeywords = map[string]bool{
+	"if": true, "for": true, "while": true, "switch": true, "return": true, "catch": true, "sizeof": true,
+}
+
+// containerKinds have members chunked on their own when the container is too large for a chunk
+var containerKinds = map[string]bool{
+	"class": true, "interface": true, "struct": true, "enum": true, "trait": true, "impl": true,
+	"object": true, "namespace": true, "module": true, "protocol": true, "extension": true, "record": true,
+}
+
+// declaration returns the kind and name of a declaration from its header, empty if it declares
+// nothing that can be named such as an import
+func declaration(header string, member bool) (kind, name string) {
+	header = strings.TrimSpace(header)
+	if m := declarationPattern.FindStringSubmatch(header); m != nil {
+		kind, name = m[1], m[2]
+		switch kind {
+		case "fn", "func", "fun", "function", "def":
+			kind = "function"
+		}
+	} else if m := variablePattern.FindStringSubmatch(header); m != nil {
+		kind, name = "variable", m[1]
+		if m[2] != "" {
+			kind = "function"
+		}
+	} else if m := callablePattern.FindStringSubmatch(header); m != nil && !controlKeywords[m[1]] &&
+		!strings.HasSuffix(strings.TrimSpace(header[:strings.Index(header, m[0])]), "=") {
+		kind, name = "function", m[1]
+	}
+	if member && kind == "function" {
+		kind = "method"
+	}
+	return kind, name
+}
+
+// codeLine is a line of source code, offsets are rune offsets without the line break
+type codeLine struct {
+	start, end int
+	text       string
+	indent     int
+	depth      int  // Brace depth at the start of the line
+	after      int  // Brace depth at the end of the line
+	opened     bool // A brace opened on the line, even if it closed again
+	parens     int  // Paren and bracket depth at the end of the line
+	blank      bool
+	comment    bool // Only comments
+	cont       bool // Starts inside brackets or a multi-line string, Python only
+}
+
+// braceSymbols finds the declarations of brace languages: a declaration starts on a line at the
+// brace depth of its container and ends where the depth returns, comments and annotations right
+// above it are attached
+func braceSymbols(text string, singleQuoteStrings bool) []CodeSymbol {
+	lines := scanBraces([]rune(text), singleQuoteStrings)
+	return braceDeclarations(lines, 0, len(lines), 0, "")
+}
+
+func scanBraces(runes []rune, singleQuoteStrings bool) []codeLine {
+	const (
+		code = iota
+		lineComment
+		blockComment
+		quoted
+	)
+	var lines []codeLine
+	state, quote, depth, parens := code, rune(0), 0, 0
+	line := codeLine{}
+	hasCode := false
+	for i := 0; i <= len(runes); i++ {
+		if i == len(runes) || runes[i] == '\n' {
+			line.end = i
+			line.text = string(runes[line.start:i])
+			line.blank = strings.TrimSpace(line.text) == ""
+			line.comment = !line.blank && !hasCode
+			line.after = depth
+			line.parens = parens
+			line.indent = indentWidth(line.text)
+			lines = append(lines, line)
+			if state == lineComment || (state == quoted && quote != '`') {
+				state = code
+			}
+			line = codeLine{start: i + 1, depth: depth}
+			hasCode = false
+			continue
+		}
+
+		r := runes[i]
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		switch state {
+		case code:
+			switch {
+			case r == '/' && next == '/':
+				state = lineComment
+				i++
+			case r == '/' && next == '*':
+				state = blockComment
+				i++
+			case r == '"' || r == '`' || (r == '\'' && singleQuoteStrings):
+				state, quote, hasCode = quoted, r, true
+			case r == '\'':
+				// A character literal, or a lifetime which isn't closed
+				hasCode = true
+				if next == '\\' && i+3 < len(runes) && runes[i+3] == '\'' {
+					i += 3
+				} else if i+2 < len(runes) && runes[i+2] == '\'' {
+					i += 2
+				}
+			case r == '{':
+				depth++
+				line.opened, hasCode = true, true
+			case r == '}':
+				depth = max(depth-1, 0)
+				hasCode = true
+			case r == '(' || r == '[':
+				parens++
+				hasCode = true
+			case r == ')' || r == ']':
+				parens = max(parens-1, 0)
+				hasCode = true
+			case !unicode.IsSpace(r):
+				hasCode = true
+			}
+		case blockComment:
+			if r == '*' && next == '/' {
+				state = code
+				i++
+			}
+		case quoted:
+			if r == '\\' {
+				i++
+			} else if r == quote {
+				state = code
+			}
+		}
+	}
+	return lines
+}
+
+func braceDeclarations(lines []codeLine, from, to, depth int, container string) []CodeSymbol {
+	var symbols []CodeSymbol
+	pending := -1 // First comment or annotation line right above the declaration
+	for i := from; i < to; {
+		l := lines[i]
+		trimmed := strings.TrimSpace(l.text)
+		switch {
+		case l.blank:
+			pending = -1
+			i++
+			continue
+		case l.depth != depth:
+			i++
+			continue
+		case l.comment || isAnnotation(trimmed):
+			if pending < 0 {
+				pending = i
+			}
+			i++
+			continue
+		}
+
+		// The declaration ends where the depth returns after a block opened, or at the end of a
+		// statement not continued by a block on the next lines
+		end, opened := i, false
+		for ; end < to; end++ {
+			e := lines[end]
+			opened = opened || e.opened || e.after > depth
+			if e.after > depth || e.parens > 0 {
+				continue
+			}
+			text := strings.TrimSpace(e.text)
+			if opened || strings.HasSuffix(text, ";") || !continuesOnNextLine(lines, end, to, l.indent) {
+				break
+			}
+		}
+		end = min(end, to-1)
+
+		headerEnd := i
+		for headerEnd < end && !lines[headerEnd].opened {
+			headerEnd++
+		}
+		var header strings.Builder
+		for _, h := range lines[i : headerEnd+1] {
+			header.WriteString(h.text)
+			header.WriteString(" ")
+		}
+		kind, name := declaration(strings.SplitN(header.String(), "{", 2)[0], container != "")
+		if name != "" {
+			start := i
+			if pending >= 0 {
+				start = pending
+			}
+			if container != "" {
+				name = container + "." + name
+			}
+			symbol := CodeSymbol{Name: name, Kind: kind, Start: lines[start].start, End: lines[end].end}
+			if containerKinds[kind] && opened {
+				symbol.Members = braceDeclarations(lines, headerEnd+1, end, depth+1, name)
+			}
+			symbols = append(symbols, symbol)
+		}
+		pending = -1
+		i = end + 1
+	}
+	return symbols
+}
+
+// headerContinuations start lines continuing the header of a declaration
+var headerContinuations = regexp.MustCompile(`^(\{|:|->|where\b|throws\b|extends\b|implements\b)`)
+
+// continuesOnNextLine reports whether the declaration on line i continues on the next line with
+// its block, a clause like where or an indented continuation like an initializer list
+func continuesOnNextLine(lines []codeLine, i, to, indent int) bool {
+	for j := i + 1; j < to; j++ {
+		if lines[j].blank {
+			continue
+		}
+		text := strings.TrimSpace(lines[j].text)
+		return headerContinuations.MatchString(text) || (lines[j].indent > indent && !lines[j].comment)
+	}
+	return false
+}
+
+// isAnnotation reports whether a line decorates the declaration below it, like @Override or #[test]
+func isAnnotation(trimmed string) bool {
+	return strings.HasPrefix(trimmed, "@") || strings.HasPrefix(trimmed, "#[")
+}
+
+func indentWidth(line string) int {
+	width := 0
+	for _, r := range line {
+		switch r {
+		case ' ':
+			width++
+		case '\t':
+			width += 8 - width%8
+		default:
+			return width
+		}
+	}
+	return width
+}
+
+// pythonDeclarationPattern finds functions and classes of indented languages
+var pythonDeclarationPattern = regexp.MustCompile(`^(?:async\s+)?(def|class)\s+([A-Za-z_]\w*)`)
+
+// indentSymbols finds the declarations of languages structured by indentation: a declaration
+// is a line with the indentation of its container and the lines indented below it, comments and
+// decorators right above it are attached
+func indentSymbols(text string) []CodeSymbol {
+	lines := scanIndents([]rune(text))
+	return indentDeclarations(lines, 0, len(lines), 0, "")
+}
+
+func scanIndents(runes []rune) []codeLine {
+	var lines []codeLine
+	brackets := 0
+	var quote string // Open string delimiter, only triple quotes span lines
+	line := codeLine{}
+	hasCode := false
+	for i := 0; i <= len(runes); i++ {
+		if i == len(runes) || runes[i] == '\n' {
+			line.end = i
+			line.text = string(runes[line.start:i])
+			line.blank = strings.TrimSpace(line.text) == ""
+			line.comment = !line.blank && !hasCode && !line.cont
+			line.indent = indentWidth(line.text)
+			lines = append(lines, line)
+			if len(quote) == 1 {
+				quote = ""
+			}
+			line = codeLine{start: i + 1, cont: brackets > 0 || quote != ""}
+			hasCode = false
+			continue
+		}
+
+		r := runes[i]
+		if quote != "" {
+			switch {
+			case r == '\\':
+				i++
+			case strings.HasPrefix(string(runes[i:min(i+len(quote), len(runes))]), quote):
+				i += len(quote) - 1
+				quote = ""
+			}
+			continue
+		}
+		switch {
+		case r == '#':
+			// Comment to the end of the line
+			for i+1 < len(runes) && runes[i+1] != '\n' {
+				i++
+			}
+		case r == '"' || r == '\'':
+			hasCode = true
+			quote = string(r)
+			if i+2 < len(runes) && runes[i+1] == r && runes[i+2] == r {
+				quote = strings.Repeat(string(r), 3)
+				i += 2
+			}
+		case r == '(' || r == '[' || r == '{':
+			brackets++
+			hasCode = true
+		case r == ')' || r == ']' || r == '}':
+			brackets = max(brackets-1, 0)
+			hasCode = true
+		case !unicode.IsSpace(r):
+			hasCode = true
+		}
+	}
+	return lines
+}
+
+func indentDeclarations(lines []codeLine, from, to, indent int, container string) []CodeSymbol {
+	var symbols []CodeSymbol
+	pending := -1
+	for i := from; i < to; {
+		l := lines[i]
+		trimmed := strings.TrimSpace(l.text)
+		switch {
+		case l.blank:
+			pending = -1
+			i++
+			continue
+		case l.cont || l.indent != indent:
+			i++
+			continue
+		case l.comment || strings.HasPrefix(trimmed, "@"):
+			if pending < 0 {
+				pending = i
+			}
+			i++
+			continue
+		}
+
+		// The body is every following line indented deeper or continuing a statement
+		end, body := i, -1
+		for j := i + 1; j < to; j++ {
+			if lines[j].blank {
+				continue
+			}
+			if !lines[j].cont && lines[j].indent <= indent {
+				break
+			}
+			if body < 0 && !lines[j].cont {
+				body = j
+			}
+			end = j
+		}
+
+		if m := pythonDeclarationPattern.FindStringSubmatch(trimmed); m != nil {
+			kind, name := m[1], m[2]
+			if kind == "def" {
+				kind = "function"
+				if container != "" {
+					kind = "method"
+				}
+			}
+			if container != "" {
+				name = container + "." + name
+			}
+			start := i
+			if pending >= 0 {
+				start = pending
+			}
+			symbol := CodeSymbol{Name: name, Kind: kind, Start: lines[start].start, End: lines[end].end}
+			if kind == "class" && body >= 0 {
+				symbol.Members = indentDeclarations(lines, body, end+1, lines[body].indent, name)
+			}
+			symbols = append(symbols, symbol)
+		}
+		pending = -1
+		i = end + 1
+	}
+	return symbols
+}
+
+// codeChunking chunks source code along its declarations: a declaration fitting MaxChunkSize is a
+// chunk, larger containers are split into their members, and anything else larger is split
+// between lines. Code between declarations, like imports, is chunked without a symbol.
+func (c *DocumentChunker) codeChunking(file *LoadedFile) []*DocumentChunk {
+	runes := []rune(file.Text)
+	chunks := c.limitInput(c.symbolChunks(runes, file.Symbols, 0, len(runes), nil))
+
+	var breaks []int
+	for i, r := range runes {
+		if r == '\n' {
+			breaks = append(breaks, i)
+		}
+	}
+	lineAt := func(offset int) int {
+		return sort.SearchInts(breaks, offset) + 1
+	}
+	for i, chunk := range chunks {
+		chunk.Index = i
+		chunk.LineStart = lineAt(chunk.StartOffset)
+		chunk.LineEnd = lineAt(max(chunk.EndOffset-1, chunk.StartOffset))
+	}
+	return chunks
+}
+
+// symbolChunks chunks runes[start:end] with the declarations in it, code between them belongs to
+// the container
+func (c *DocumentChunker) symbolChunks(runes []rune, symbols []CodeSymbol, start, end int,
+	container *CodeSymbol) []*DocumentChunk {
+	var chunks []*DocumentChunk
+	pos := start
+	for i := range symbols {
+		symbol := &symbols[i]
+		chunks = append(chunks, c.codeSpan(runes, pos, symbol.Start, container)...)
+		if len(symbol.Members) > 0 && c.size(string(runes[symbol.Start:symbol.End])) > c.config.MaxChunkSize {
+			chunks = append(chunks, c.symbolChunks(runes, symbol.Members, symbol.Start, symbol.End, symbol)...)
+		} else {
+			chunks = append(chunks, c.codeSpan(runes, symbol.Start, symbol.End, symbol)...)
+		}
+		pos = max(pos, symbol.End)
+	}
+	return append(chunks, c.codeSpan(runes, pos, end, container)...)
+}
+
+// codeSpan returns runes[start:end] without surrounding blank lines as chunks of the symbol, split
+// between lines if it exceeds MaxChunkSize
+func (c *DocumentChunker) codeSpan(runes []rune, start, end int, symbol *CodeSymbol) []*DocumentChunk {
+	for start < end && unicode.IsSpace(runes[start]) {
+		start++
+	}
+	for end > start && unicode.IsSpace(runes[end-1]) {
+		end--
+	}
+	if start >= end {
+		return nil
+	}
+	// Keep the indentation of the first line
+	for start > 0 && (runes[start-1] == ' ' || runes[start-1] == '\t') {
+		start--
+	}
+
+	newChunk := func(from, to int) *DocumentChunk {
+		chunk := &DocumentChunk{Text: string(runes[from:to]), StartOffset: from, EndOffset: to}
+		if symbol != nil {
+			chunk.Symbol, chunk.SymbolKind = symbol.Name, symbol.Kind
+		}
+		return chunk
+	}
+	limit := c.config.MaxChunkSize
+	if c.size(string(runes[start:end])) <= limit {
+		return []*DocumentChunk{newChunk(start, end)}
+	}
+
+	var chunks []*DocumentChunk
+	from := start
+	for from < end {
+		// Take whole lines while they fit, a single line too long is cut
+		to := from
+		for to < end {
+			next := to
+			for next < end && runes[next] != '\n' {
+				next++
+			}
+			if next < end {
+				next++
+			}
+			if to > from && c.size(string(runes[from:next])) > limit {
+				break
+			}
+			to = next
+		}
+		if c.size(string(runes[from:to])) > limit {
+			to = max(c.runesWithin(runes[:to], from, limit), from+1)
+		}
+		piece := to
+		for piece > from && unicode.IsSpace(runes[piece-1]) {
+			piece--
+		}
+		if piece > from {
+			chunks = append(chunks, newChunk(from, piece))
+		}
+		from = to
+	}
+	return chunks
+}
+
+// FormatLines returns ":12" or ":12-40" for the lines of a source code chunk, empty if unknown
+func FormatLines(start, end int) string {
+	switch {
+	case start == 0:
+		return ""
+	case end <= start:
+		return fmt.Sprintf(":%d", start)
+	default:
+		return fmt.Sprintf(":%d-%d", start, end)
+	}
+}
+
+// FormatSymbol returns the declaration of a source code chunk like "method RAG.Ask", empty for
+// other chunks
+func FormatSymbol(kind, name string) string {
+	if name == "" {
+		return ""
+	}
+	return strings.TrimSpace(kind + " " + name)
+}
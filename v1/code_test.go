@@ -0,0 +1,255 @@
+package rag
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testGoSource = `// Copyright 2026 The SlimRAG Authors.
+
+// Package locks implements leases.
+package locks
+
+import (
+	"context"
+	"time"
+)
+
+// Lease is held by one client.
+type Lease struct {
+	Holder  string
+	Expires time.Time
+}
+
+type (
+	// Mode is shared or exclusive.
+	Mode int
+	Set[T any] map[string]T
+)
+
+const (
+	Shared Mode = iota
+	Exclusive
+)
+
+var defaultTTL = 12 * time.Second
+
+// Acquire blocks until the lease is held.
+func Acquire(ctx context.Context, holder string) (*Lease, error) {
+	return &Lease{Holder: holder, Expires: time.Now().Add(defaultTTL)}, nil
+}
+
+func (l *Lease) Release() {}
+
+func (s Set[T]) Len() int { return len(s) }
+`
+
+// symbolTexts returns the kind, name and text of symbols and their members
+func symbolTexts(text string, symbols []CodeSymbol) [][3]string {
+	runes := []rune(text)
+	var texts [][3]string
+	for _, s := range symbols {
+		texts = append(texts, [3]string{s.Kind, s.Name, string(runes[s.Start:s.End])})
+		texts = append(texts, symbolTexts(text, s.Members)...)
+	}
+	return texts
+}
+
+func TestGoSymbols(t *testing.T) {
+	symbols, err := goSymbols([]byte(testGoSource))
+	require.NoError(t, err)
+	texts := symbolTexts(testGoSource, symbols)
+	var names []string
+	for _, s := range texts {
+		names = append(names, s[0]+" "+s[1])
+	}
+	assert.Equal(t, []string{"package locks", "type Lease", "type Mode, Set", "const Shared, Exclusive",
+		"var defaultTTL", "func Acquire", "method Lease.Release", "method Set.Len"}, names)
+
+	assert.True(t, strings.HasPrefix(texts[0][2], "// Copyright"))
+	assert.True(t, strings.HasSuffix(texts[0][2], `"time"
+)`))
+	assert.True(t, strings.HasPrefix(texts[1][2], "// Lease is held by one client.\ntype Lease struct {"))
+	assert.True(t, strings.HasPrefix(texts[2][2], "type (\n\t// Mode is shared or exclusive."))
+	assert.True(t, strings.HasPrefix(texts[5][2], "// Acquire blocks"))
+	assert.True(t, strings.HasSuffix(texts[5][2], "nil\n}"))
+
+	_, err = goSymbols([]byte("package broken\nfunc {"))
+	assert.Error(t, err)
+}
+
+func TestBraceSymbols(t *testing.T) {
+	source := `import { Lock } from "./lock";
+import type { Lease } from './lease'
+
+/**
+ * Manages the locks of a cell, see "}" handling.
+ */
+@Injectable()
+export class LockManager {
+  private locks = new Map<string, Lock>();
+
+  // Acquires a lock
+  acquire(name: string,
+          ttl: number): Lock {
+    if (this.locks.has(name)) {
+      throw new Error('held: }');
+    }
+    return this.locks.get(name);
+  }
+
+  release(name) { this.locks.delete(name); }
+}
+
+export const timeout = (ms) => new Promise(r => setTimeout(r, ms));
+
+export function parse(text) {
+  return text.split("{");
+}
+`
+	texts := symbolTexts(source, braceSymbols(source, true))
+	var names []string
+	for _, s := range texts {
+		names = append(names, s[0]+" "+s[1])
+	}
+	assert.Equal(t, []string{"class LockManager", "method LockManager.acquire", "method LockManager.release",
+		"function timeout", "function parse"}, names)
+	assert.True(t, strings.HasPrefix(texts[0][2], "/**\n * Manages"))
+	assert.True(t, strings.HasSuffix(texts[0][2], "delete(name); }\n}"))
+	assert.True(t, strings.HasPrefix(texts[1][2], "  // Acquires a lock\n  acquire(name: string,"))
+	assert.True(t, strings.HasSuffix(texts[1][2], "get(name);\n  }"))
+	assert.Equal(t, "export function parse(text) {\n  return text.split(\"{\");\n}", texts[4][2])
+
+	// Lifetimes and character literals don't open strings, blocks may start on the next line
+	rust := `/// Splits at braces.
+#[inline]
+pub fn split<'a>(s: &'a str) -> Vec<&'a str>
+where
+    'a: 'a,
+{
+    s.split('{').collect()
+}
+
+impl Cell {
+    pub fn new() -> Self { Cell {} }
+}
+
+int main(int argc, char **argv)
+{
+    return 0;
+}
+`
+	texts = symbolTexts(rust, braceSymbols(rust, false))
+	names = nil
+	for _, s := range texts {
+		names = append(names, s[0]+" "+s[1])
+	}
+	assert.Equal(t, []string{"function split", "impl Cell", "method Cell.new", "function main"}, names)
+	assert.True(t, strings.HasPrefix(texts[0][2], "/// Splits at braces.\n#[inline]\npub fn split"))
+	assert.True(t, strings.HasSuffix(texts[0][2], "collect()\n}"))
+	assert.True(t, strings.HasSuffix(texts[3][2], "return 0;\n}"))
+}
+
+func TestIndentSymbols(t *testing.T) {
+	source := `"""Lock service client."""
+import time
+
+# Default lease
+TTL = 12
+
+
+@dataclass
+class Lease:
+    """A lease.
+
+Continued at column 0.
+"""
+    holder: str
+
+    def renew(self, ttl=(
+        TTL)):
+        # Renew before expiry
+        return time.time() + ttl
+
+    async def release(self):
+        pass
+
+
+def acquire(name):
+    return Lease(name)
+`
+	texts := symbolTexts(source, indentSymbols(source))
+	var names []string
+	for _, s := range texts {
+		names = append(names, s[0]+" "+s[1])
+	}
+	assert.Equal(t, []string{"class Lease", "method Lease.renew", "method Lease.release", "function acquire"}, names)
+	assert.True(t, strings.HasPrefix(texts[0][2], "@dataclass\nclass Lease:"))
+	assert.True(t, strings.HasSuffix(texts[0][2], "pass"))
+	assert.True(t, strings.HasPrefix(texts[1][2], "    def renew"))
+	assert.True(t, strings.HasSuffix(texts[1][2], "return time.time() + ttl"))
+	assert.Equal(t, "def acquire(name):\n    return Lease(name)", texts[3][2])
+}
+
+func TestChunkCode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "locks.go")
+	require.NoError(t, os.WriteFile(path, []byte(testGoSource), 0644))
+	assert.IsType(t, goLoader{}, LoaderFor("main.go"))
+	assert.IsType(t, codeLoader{}, LoaderFor("app.ts"))
+
+	c := newMarkdownChunker(120, 1)
+	c.cwd = dir
+	doc, err := c.GetDocumentChunks(context.Background(), path)
+	require.NoError(t, err)
+	assertVerbatim(t, testGoSource, doc.Chunks)
+
+	var symbols []string
+	for _, chunk := range doc.Chunks {
+		symbols = append(symbols, FormatSymbol(chunk.SymbolKind, chunk.Symbol))
+		assert.Equal(t, "locks.go", chunk.FilePath)
+		assert.Empty(t, chunk.HeadingPath)
+	}
+	assert.Equal(t, []string{"package locks", "type Lease", "type Mode, Set", "const Shared, Exclusive",
+		"var defaultTTL", "func Acquire", "func Acquire", "method Lease.Release", "method Set.Len"}, symbols)
+
+	acquire := doc.Chunks[5]
+	assert.True(t, strings.HasPrefix(acquire.Text, "// Acquire blocks"))
+	assert.Equal(t, 30, acquire.LineStart)
+	assert.Equal(t, 31, acquire.LineEnd)
+	assert.Equal(t, 32, doc.Chunks[6].LineStart)
+	assert.Equal(t, 33, doc.Chunks[6].LineEnd)
+	assert.Equal(t, "locks.go:30-31 (func Acquire)", newSource(1, *acquire).String())
+
+	// Large classes are split into their members
+	source := "class Cell:\n    name = 'cell'\n\n" +
+		"    def elect(self):\n        return self.replicas[0]\n\n" +
+		"    def serve(self):\n        pass\n"
+	path = filepath.Join(dir, "cell.py")
+	require.NoError(t, os.WriteFile(path, []byte(source), 0644))
+	doc, err = newMarkdownChunker(60, 1).GetDocumentChunks(context.Background(), path)
+	require.NoError(t, err)
+	assertVerbatim(t, source, doc.Chunks)
+	symbols = nil
+	for _, chunk := range doc.Chunks {
+		symbols = append(symbols, FormatSymbol(chunk.SymbolKind, chunk.Symbol))
+	}
+	assert.Equal(t, []string{"class Cell", "method Cell.elect", "method Cell.serve"}, symbols)
+	assert.Equal(t, "class Cell:\n    name = 'cell'", doc.Chunks[0].Text)
+
+	// Symbols and lines are stored
+	store := newPlainDuckDBStore(t, 3)
+	require.NoError(t, store.UpsertDocumentChunks(context.Background(), doc.Chunks))
+	chunk, err := store.GetDocumentChunk(context.Background(), doc.Chunks[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Cell.elect", chunk.Symbol)
+	assert.Equal(t, "method", chunk.SymbolKind)
+	assert.Equal(t, 4, chunk.LineStart)
+	assert.Equal(t, 5, chunk.LineEnd)
+}
@@ -0,0 +1,520 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// DefaultCrawlUserAgent identifies the crawler to sites and their robots.txt
+const DefaultCrawlUserAgent = "srag/1.0"
+
+// maxPageSize is the largest response body read from a site
+const maxPageSize = 10 << 20
+
+// Validators of crawled pages are stored as file hashes of processed files
+const (
+	etagValidator         = "etag:"
+	lastModifiedValidator = "last-modified:"
+)
+
+// CrawlState is what the crawler knows about pages indexed before, so unchanged pages are
+// revalidated with conditional requests instead of being fetched again
+type CrawlState interface {
+	// PageValidator returns the validator of the indexed version of a page, empty if not indexed
+	PageValidator(ctx context.Context, pageURL string) (string, error)
+	// PageLinks returns the links of the indexed version of a page
+	PageLinks(ctx context.Context, pageURL string) ([]string, error)
+}
+
+// CrawledPage is a page visited by the crawler
+type CrawledPage struct {
+	URL         string
+	Depth       int
+	ContentType string // Media type without parameters
+	Body        []byte
+	// Validator is etag:<ETag>, last-modified:<Last-Modified> or the content hash of the page
+	Validator string
+	Links     []string // Same-origin links of the page
+	// NotModified pages are unchanged since their validator in the CrawlState, a 304 has no body
+	NotModified bool
+	// Gone pages answered 404 or 410, their indexed version is obsolete
+	Gone bool
+}
+
+// Crawler fetches the pages of a site reachable from a start URL, by following same-origin links
+// or from the sitemap of the site. robots.txt is respected.
+type Crawler struct {
+	Client    *http.Client
+	UserAgent string
+	// MaxDepth is the number of links followed from the start page, 0 fetches only the start page
+	MaxDepth int
+	// MaxPages stops the crawl after as many pages, 0 is unlimited
+	MaxPages int
+	// Delay is waited between requests, a longer Crawl-delay of robots.txt wins
+	Delay time.Duration
+	// Sitemap fetches the pages listed by the sitemaps of robots.txt or /sitemap.xml, links are
+	// not followed
+	Sitemap bool
+	// State revalidates indexed pages, nil fetches every page
+	State CrawlState
+
+	robots  *robotsRules
+	lastHit time.Time
+}
+
+// NewCrawler returns a crawler with the default user agent following links up to maxDepth
+func NewCrawler(maxDepth int) *Crawler {
+	return &Crawler{Client: http.DefaultClient, UserAgent: DefaultCrawlUserAgent, MaxDepth: maxDepth}
+}
+
+type crawlItem struct {
+	url   string
+	depth int
+}
+
+// Crawl visits the pages of the site of start breadth first. Pages disallowed by robots.txt and
+// pages other than text are skipped. An error of visit stops the crawl.
+func (c *Crawler) Crawl(ctx context.Context, start string, visit func(*CrawledPage) error) error {
+	startURL, err := url.Parse(start)
+	if err != nil {
+		return fmt.Errorf("invalid start URL: %w", err)
+	}
+	if startURL.Scheme != "http" && startURL.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme of %s", start)
+	}
+	origin := &url.URL{Scheme: startURL.Scheme, Host: startURL.Host}
+
+	c.lastHit = time.Time{}
+	c.robots, err = c.fetchRobots(ctx, origin)
+	if err != nil {
+		return err
+	}
+
+	var queue []crawlItem
+	if c.Sitemap {
+		urls, err := c.fetchSitemaps(ctx, origin)
+		if err != nil {
+			return err
+		}
+		for _, u := range urls {
+			queue = append(queue, crawlItem{url: u})
+		}
+	} else {
+		queue = append(queue, crawlItem{url: normalizeURL(startURL)})
+	}
+
+	seen := make(map[string]bool)
+	pages := 0
+	for len(queue) > 0 {
+		item := queue[0]
+		queue = queue[1:]
+		if seen[item.url] {
+			continue
+		}
+		seen[item.url] = true
+		if c.MaxPages > 0 && pages >= c.MaxPages {
+			log.Info().Int("max_pages", c.MaxPages).Msg("Crawl stopped at page limit")
+			break
+		}
+
+		u, _ := url.Parse(item.url)
+		if !sameOrigin(u, origin) {
+			continue
+		}
+		if !c.robots.Allowed(u.RequestURI()) {
+			log.Debug().Str("url", item.url).Msg("Disallowed by robots.txt")
+			continue
+		}
+
+		page, err := c.fetchPage(ctx, u, item.depth)
+		if err != nil {
+			log.Warn().Err(err).Str("url", item.url).Msg("Failed to fetch page")
+			continue
+		}
+		if page == nil {
+			continue
+		}
+		if page.URL != item.url {
+			// Redirected to a page visited before or disallowed
+			final, _ := url.Parse(page.URL)
+			if seen[page.URL] || !c.robots.Allowed(final.RequestURI()) {
+				continue
+			}
+			seen[page.URL] = true
+		}
+		pages++
+
+		err = visit(page)
+		if err != nil {
+			return err
+		}
+		if c.Sitemap || item.depth >= c.MaxDepth {
+			continue
+		}
+		for _, link := range page.Links {
+			if !seen[link] {
+				queue = append(queue, crawlItem{url: link, depth: item.depth + 1})
+			}
+		}
+	}
+	return nil
+}
+
+// fetchPage fetches a page conditionally on its validator in the state, nil if it is not text
+func (c *Crawler) fetchPage(ctx context.Context, u *url.URL, depth int) (*CrawledPage, error) {
+	pageURL := u.String()
+	var validator string
+	if c.State != nil {
+		var err error
+		validator, err = c.State.PageValidator(ctx, pageURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	header := make(http.Header)
+	if etag, ok := strings.CutPrefix(validator, etagValidator); ok {
+		header.Set("If-None-Match", etag)
+	} else if modified, ok := strings.CutPrefix(validator, lastModifiedValidator); ok {
+		header.Set("If-Modified-Since", modified)
+	}
+	resp, err := c.get(ctx, pageURL, header)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	page := &CrawledPage{URL: pageURL, Depth: depth}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && validator != "":
+		page.NotModified = true
+		page.Validator = validator
+		page.Links, err = c.State.PageLinks(ctx, pageURL)
+		if err != nil {
+			return nil, err
+		}
+		return page, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		page.Gone = true
+		return page, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// Redirects are followed within the site only, the page is the target
+	if final := resp.Request.URL; final.String() != pageURL {
+		if !sameOrigin(final, u) {
+			return nil, nil
+		}
+		page.URL = normalizeURL(final)
+		if c.State != nil {
+			validator, err = c.State.PageValidator(ctx, page.URL)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	page.ContentType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(page.ContentType, "text/") {
+		log.Debug().Str("url", pageURL).Str("content_type", page.ContentType).Msg("Skipping page other than text")
+		return nil, nil
+	}
+	page.Body, err = io.ReadAll(io.LimitReader(resp.Body, maxPageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.Header.Get("ETag") != "":
+		page.Validator = etagValidator + resp.Header.Get("ETag")
+	case resp.Header.Get("Last-Modified") != "":
+		page.Validator = lastModifiedValidator + resp.Header.Get("Last-Modified")
+	default:
+		page.Validator = CalculateStringHash(string(page.Body))
+	}
+	// Servers may ignore conditional requests
+	page.NotModified = page.Validator == validator
+	if page.ContentType == "text/html" {
+		final, _ := url.Parse(page.URL)
+		page.Links = extractLinks(final, page.Body)
+	}
+	return page, nil
+}
+
+// get sends a GET request after waiting for the delay since the previous one
+func (c *Crawler) get(ctx context.Context, u string, header http.Header) (*http.Response, error) {
+	delay := c.Delay
+	if c.robots != nil {
+		delay = max(delay, c.robots.delay)
+	}
+	if wait := time.Until(c.lastHit.Add(delay)); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	c.lastHit = time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// fetchRobots returns the robots.txt rules of the site, a missing robots.txt allows everything
+// and an unreachable one fails the crawl
+func (c *Crawler) fetchRobots(ctx context.Context, origin *url.URL) (*robotsRules, error) {
+	resp, err := c.get(ctx, origin.JoinPath("robots.txt").String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch robots.txt: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return parseRobots(io.LimitReader(resp.Body, maxPageSize), c.UserAgent), nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return &robotsRules{}, nil
+	default:
+		return nil, fmt.Errorf("failed to fetch robots.txt: %s", resp.Status)
+	}
+}
+
+// sitemap is a urlset or a sitemapindex
+type sitemap struct {
+	XMLName xml.Name
+	URLs    []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// fetchSitemaps returns the same-origin pages of the sitemaps listed by robots.txt, or of
+// /sitemap.xml, sitemap indexes are followed
+func (c *Crawler) fetchSitemaps(ctx context.Context, origin *url.URL) ([]string, error) {
+	queue := c.robots.sitemaps
+	if len(queue) == 0 {
+		queue = []string{origin.JoinPath("sitemap.xml").String()}
+	}
+
+	var urls []string
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		loc := strings.TrimSpace(queue[0])
+		queue = queue[1:]
+		u, err := url.Parse(loc)
+		if err != nil || seen[loc] || !sameOrigin(u, origin) {
+			continue
+		}
+		seen[loc] = true
+
+		resp, err := c.get(ctx, loc, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch sitemap %s: %w", loc, err)
+		}
+		var s sitemap
+		if resp.StatusCode == http.StatusOK {
+			err = xml.NewDecoder(io.LimitReader(resp.Body, maxPageSize)).Decode(&s)
+		} else {
+			err = errors.New(resp.Status)
+		}
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch sitemap %s: %w", loc, err)
+		}
+
+		for _, entry := range s.Sitemaps {
+			queue = append(queue, entry.Loc)
+		}
+		for _, entry := range s.URLs {
+			if u, err := url.Parse(strings.TrimSpace(entry.Loc)); err == nil && sameOrigin(u, origin) {
+				urls = append(urls, normalizeURL(u))
+			}
+		}
+	}
+	return urls, nil
+}
+
+// extractLinks returns the same-origin links of an HTML page without fragments
+func extractLinks(base *url.URL, body []byte) []string {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	if b := findElement(doc, atom.Base); b != nil {
+		if href, err := base.Parse(attr(b, "href")); err == nil {
+			base = href
+		}
+	}
+
+	var links []string
+	seen := make(map[string]bool)
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.A && !strings.Contains(attr(n, "rel"), "nofollow") {
+			if u, err := base.Parse(strings.TrimSpace(attr(n, "href"))); err == nil && sameOrigin(u, base) {
+				link := normalizeURL(u)
+				if !seen[link] {
+					seen[link] = true
+					links = append(links, link)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return links
+}
+
+func sameOrigin(u, origin *url.URL) bool {
+	return strings.EqualFold(u.Scheme, origin.Scheme) && strings.EqualFold(u.Host, origin.Host)
+}
+
+// normalizeURL drops the fragment, pages are identified by the rest of their URL
+func normalizeURL(u *url.URL) string {
+	n := *u
+	n.Fragment = ""
+	n.RawFragment = ""
+	if n.Path == "" {
+		n.Path = "/"
+	}
+	return n.String()
+}
+
+// isURL reports whether a processed file is a crawled page or a bucket object rather than a local file
+func isURL(filePath string) bool {
+	return strings.Contains(filePath, "://")
+}
+
+// pageDocumentID is the document ID of a version of a crawled page or bucket object. Validators
+// like Last-Modified are shared by pages, so the ID depends on the URL too.
+func pageDocumentID(pageURL, validator string) string {
+	return CalculateStringHash(pageURL + "\n" + validator)
+}
+
+func crawlLinksKey(pageURL string) string {
+	return "crawl_links " + pageURL
+}
+
+// CrawlState returns the state of the pages indexed by IndexPage
+func (r *RAG) CrawlState() CrawlState {
+	return ragCrawlState{r}
+}
+
+type ragCrawlState struct {
+	r *RAG
+}
+
+func (s ragCrawlState) PageValidator(ctx context.Context, pageURL string) (string, error) {
+	return s.r.GetProcessedFileHash(ctx, pageURL)
+}
+
+func (s ragCrawlState) PageLinks(ctx context.Context, pageURL string) ([]string, error) {
+	value, err := s.r.Store.GetMeta(ctx, crawlLinksKey(pageURL))
+	if err != nil || value == "" {
+		return nil, err
+	}
+	var links []string
+	err = json.Unmarshal([]byte(value), &links)
+	return links, err
+}
+
+// replaceURLDocument chunks the file of a crawled page or bucket object at docURL and replaces the
+// chunks of its previous version, the validator identifies the version
+func (r *RAG) replaceURLDocument(ctx context.Context, chunker *DocumentChunker, file *LoadedFile,
+	docURL, name, validator string) (*Document, error) {
+	doc := &Document{}
+	if strings.TrimSpace(file.Text) != "" {
+		var err error
+		doc, err = chunker.ChunkLoadedFile(ctx, file, docURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to chunk %s: %w", docURL, err)
+		}
+	}
+	doc.FileName = name
+	doc.FilePath = docURL
+	doc.DocumentID = pageDocumentID(docURL, validator)
+	for _, chunk := range doc.Chunks {
+		chunk.DocumentID = doc.DocumentID
+		chunk.ID = CalculateStringHash(chunk.Text)
+	}
+
+	// Drop chunks of the previous version
+	err := r.RemoveDocumentChunksByFilePath(ctx, docURL)
+	if err != nil {
+		return nil, err
+	}
+	err = r.UpsertDocumentChunks(ctx, doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, r.UpdateProcessedFileHash(ctx, docURL, validator)
+}
+
+// IndexPage replaces the chunks of a crawled page and records its validator and links, HTML is
+// converted to markdown before chunking. Unchanged pages are left as they are and gone pages are
+// removed. It returns the number of chunks written.
+func (r *RAG) IndexPage(ctx context.Context, chunker *DocumentChunker, page *CrawledPage) (int, error) {
+	if page.NotModified {
+		return 0, nil
+	}
+	if page.Gone {
+		err := r.RemoveDocumentChunksByFilePath(ctx, page.URL)
+		if err != nil {
+			return 0, err
+		}
+		return 0, r.Store.SetMeta(ctx, crawlLinksKey(page.URL), "")
+	}
+
+	file := &LoadedFile{Text: string(page.Body)}
+	if page.ContentType == "text/html" {
+		var err error
+		file, err = loadHTML(bytes.NewReader(page.Body))
+		if err != nil {
+			return 0, fmt.Errorf("failed to load %s: %w", page.URL, err)
+		}
+	}
+
+	u, _ := url.Parse(page.URL)
+	doc, err := r.replaceURLDocument(ctx, chunker, file, page.URL, path.Base(u.Path), page.Validator)
+	if err != nil {
+		return 0, err
+	}
+	links, err := json.Marshal(page.Links)
+	if err != nil {
+		return 0, err
+	}
+	return len(doc.Chunks), r.Store.SetMeta(ctx, crawlLinksKey(page.URL), string(links))
+}
@@ -0,0 +1,301 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSite serves pages by path, pages with an ETag or a modification time answer conditional
+// requests with 304
+type testSite struct {
+	mu       sync.Mutex
+	pages    map[string]testSitePage
+	robots   string
+	requests []string
+	agents   []string
+}
+
+type testSitePage struct {
+	body     string
+	etag     string
+	modified time.Time
+	mime     string
+	redirect string
+}
+
+func newTestSite(t *testing.T) (*testSite, *httptest.Server) {
+	site := &testSite{pages: map[string]testSitePage{}}
+	server := httptest.NewServer(site)
+	t.Cleanup(server.Close)
+	return site, server
+}
+
+func (s *testSite) set(path string, page testSitePage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pages[path] = page
+}
+
+func (s *testSite) remove(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pages, path)
+}
+
+// fetched returns the paths requested since the previous call
+func (s *testSite) fetched() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := s.requests
+	s.requests = nil
+	return requests
+}
+
+func (s *testSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.URL.Path)
+	s.agents = append(s.agents, r.UserAgent())
+	page, ok := s.pages[r.URL.Path]
+	robots := s.robots
+	s.mu.Unlock()
+
+	if r.URL.Path == "/robots.txt" && robots != "" {
+		_, _ = w.Write([]byte(robots))
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if page.redirect != "" {
+		http.Redirect(w, r, page.redirect, http.StatusMovedPermanently)
+		return
+	}
+	if page.etag != "" {
+		w.Header().Set("ETag", page.etag)
+	}
+	contentType := page.mime
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, r.URL.Path, page.modified, strings.NewReader(page.body))
+}
+
+func htmlPage(title, body string, links ...string) string {
+	var b strings.Builder
+	b.WriteString("<html><head><title>" + title + "</title></head><body><nav>")
+	for _, link := range links {
+		b.WriteString(`<a href="` + link + `">` + link + `</a>`)
+	}
+	b.WriteString("</nav><main><h1>" + title + "</h1><p>" + body + "</p></main></body></html>")
+	return b.String()
+}
+
+func crawlURLs(t *testing.T, c *Crawler, start string) []string {
+	var urls []string
+	err := c.Crawl(context.Background(), start, func(page *CrawledPage) error {
+		urls = append(urls, page.URL)
+		return nil
+	})
+	require.NoError(t, err)
+	return urls
+}
+
+func TestCrawlLinks(t *testing.T) {
+	site, server := newTestSite(t)
+	site.robots = "User-agent: *\nDisallow: /private\n\nUser-agent: otherbot\nDisallow: /\n"
+	site.set("/", testSitePage{body: htmlPage("Home", "Welcome.",
+		"/a", "/old", "b#section", "/private/x", "https://example.com/external", "/a")})
+	site.set("/a", testSitePage{body: htmlPage("A", "Page A.", "/a/deep", "/")})
+	site.set("/b", testSitePage{body: htmlPage("B", "Page B.")})
+	site.set("/old", testSitePage{redirect: "/b"})
+	site.set("/a/deep", testSitePage{body: htmlPage("Deep", "Deep page.")})
+	site.set("/private/x", testSitePage{body: htmlPage("Private", "Secret.")})
+
+	c := NewCrawler(1)
+	c.Client = server.Client()
+	urls := crawlURLs(t, c, server.URL)
+	assert.Equal(t, []string{server.URL + "/", server.URL + "/a", server.URL + "/b"}, urls)
+	assert.NotContains(t, site.fetched(), "/private/x")
+	assert.Contains(t, site.agents, DefaultCrawlUserAgent)
+
+	c.MaxDepth = 2
+	urls = crawlURLs(t, c, server.URL+"/")
+	assert.Contains(t, urls, server.URL+"/a/deep")
+	assert.Len(t, urls, 4)
+
+	c.MaxPages = 2
+	assert.Len(t, crawlURLs(t, c, server.URL), 2)
+
+	// Non-text pages are skipped
+	site.set("/b", testSitePage{body: "\x89PNG", mime: "image/png"})
+	c.MaxPages = 0
+	c.MaxDepth = 1
+	assert.Equal(t, []string{server.URL + "/", server.URL + "/a"}, crawlURLs(t, c, server.URL))
+}
+
+func TestCrawlDelay(t *testing.T) {
+	site, server := newTestSite(t)
+	site.robots = "User-agent: *\nCrawl-delay: 0.05\n"
+	site.set("/", testSitePage{body: htmlPage("Home", "Welcome.", "/a")})
+	site.set("/a", testSitePage{body: htmlPage("A", "Page A.")})
+
+	c := NewCrawler(1)
+	c.Client = server.Client()
+	begin := time.Now()
+	assert.Len(t, crawlURLs(t, c, server.URL), 2)
+	// robots.txt, / and /a
+	assert.GreaterOrEqual(t, time.Since(begin), 100*time.Millisecond)
+}
+
+func TestCrawlSitemap(t *testing.T) {
+	site, server := newTestSite(t)
+	site.robots = "User-agent: *\nDisallow: /b\nSitemap: " + server.URL + "/sitemap-index.xml\n"
+	site.set("/sitemap-index.xml", testSitePage{mime: "application/xml", body: `<?xml version="1.0"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>` + server.URL + `/sitemap.xml</loc></sitemap>
+</sitemapindex>`})
+	site.set("/sitemap.xml", testSitePage{mime: "application/xml", body: `<?xml version="1.0"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>` + server.URL + `/a</loc></url>
+  <url><loc>` + server.URL + `/b</loc></url>
+  <url><loc>https://example.com/c</loc></url>
+</urlset>`})
+	site.set("/", testSitePage{body: htmlPage("Home", "Welcome.", "/a")})
+	site.set("/a", testSitePage{body: htmlPage("A", "Page A.", "/d")})
+	site.set("/b", testSitePage{body: htmlPage("B", "Page B.")})
+	site.set("/d", testSitePage{body: htmlPage("D", "Page D.")})
+
+	c := NewCrawler(3)
+	c.Client = server.Client()
+	c.Sitemap = true
+	assert.Equal(t, []string{server.URL + "/a"}, crawlURLs(t, c, server.URL))
+}
+
+func TestParseRobots(t *testing.T) {
+	robots := parseRobots(strings.NewReader(`# comment
+User-agent: *
+Disallow: /
+
+User-agent: srag
+User-agent: other
+Allow: /docs/public
+Disallow: /docs   # private docs
+Disallow: /*.json$
+Disallow:
+Crawl-delay: 2
+
+Sitemap: https://example.com/sitemap.xml
+`), DefaultCrawlUserAgent)
+	assert.Equal(t, 2*time.Second, robots.delay)
+	assert.Equal(t, []string{"https://example.com/sitemap.xml"}, robots.sitemaps)
+	for path, allowed := range map[string]bool{
+		"/":                  true,
+		"/docs":              false,
+		"/docs/guide":        false,
+		"/docs/public/intro": true,
+		"/data.json":         false,
+		"/data.json?x=1":     true,
+		"/robots.txt":        true,
+	} {
+		assert.Equal(t, allowed, robots.Allowed(path), path)
+	}
+
+	robots = parseRobots(strings.NewReader("User-agent: *\nDisallow: /\n"), "curl/8.0")
+	assert.False(t, robots.Allowed("/index.html"))
+	assert.True(t, parseRobots(strings.NewReader(""), "srag").Allowed("/"))
+}
+
+func TestIndexCrawledPages(t *testing.T) {
+	ctx := context.Background()
+	site, server := newTestSite(t)
+	modified := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	site.set("/", testSitePage{body: htmlPage("Home", "Welcome to the lock service.", "/a", "/b", "/c.txt"),
+		etag: `"home-1"`})
+	site.set("/a", testSitePage{body: htmlPage("Leases", "Leases expire after twelve seconds.", "/a/deep"),
+		etag: `"a-1"`})
+	site.set("/a/deep", testSitePage{body: htmlPage("Deep", "Only reachable through A.")})
+	site.set("/b", testSitePage{body: htmlPage("Sessions", "Sessions are kept alive by KeepAlives."),
+		modified: modified})
+	site.set("/c.txt", testSitePage{body: "Plain text about cells.", mime: "text/plain"})
+
+	store := newMemStore(3)
+	r := &RAG{Store: store}
+	chunker := newMarkdownChunker(1000, 1)
+	crawl := func() {
+		c := NewCrawler(2)
+		c.Client = server.Client()
+		c.State = r.CrawlState()
+		err := c.Crawl(ctx, server.URL, func(page *CrawledPage) error {
+			_, err := r.IndexPage(ctx, chunker, page)
+			return err
+		})
+		require.NoError(t, err)
+	}
+	texts := func() []string {
+		chunks, err := store.ListDocumentChunks(ctx, true)
+		require.NoError(t, err)
+		var texts []string
+		for _, chunk := range chunks {
+			texts = append(texts, chunk.Text)
+		}
+		slices.Sort(texts)
+		return texts
+	}
+
+	crawl()
+	site.fetched()
+	assert.Equal(t, []string{
+		"# Deep\n\nOnly reachable through A.",
+		"# Home\n\nWelcome to the lock service.",
+		"# Leases\n\nLeases expire after twelve seconds.",
+		"# Sessions\n\nSessions are kept alive by KeepAlives.",
+		"Plain text about cells.",
+	}, texts())
+	info, err := store.GetProcessedFile(ctx, server.URL+"/a")
+	require.NoError(t, err)
+	assert.Equal(t, `etag:"a-1"`, info.FileHash)
+	info, err = store.GetProcessedFile(ctx, server.URL+"/b")
+	require.NoError(t, err)
+	assert.Equal(t, "last-modified:"+modified.Format(http.TimeFormat), info.FileHash)
+
+	chunk, err := store.GetDocumentChunk(ctx, CalculateStringHash("# Leases\n\nLeases expire after twelve seconds."))
+	require.NoError(t, err)
+	assert.Equal(t, server.URL+"/a", chunk.FilePath)
+	assert.Equal(t, "Leases", chunk.HeadingPath)
+
+	// Unchanged pages are revalidated, their links are still followed
+	crawl()
+	assert.ElementsMatch(t, []string{"/robots.txt", "/", "/a", "/a/deep", "/b", "/c.txt"}, site.fetched())
+	assert.Len(t, texts(), 5)
+
+	// Changed pages replace their chunks, gone pages are removed
+	site.set("/a", testSitePage{body: htmlPage("Leases", "Leases expire after a minute.", "/a/deep"),
+		etag: `"a-2"`})
+	site.remove("/b")
+	crawl()
+	assert.Equal(t, []string{
+		"# Deep\n\nOnly reachable through A.",
+		"# Home\n\nWelcome to the lock service.",
+		"# Leases\n\nLeases expire after a minute.",
+		"Plain text about cells.",
+	}, texts())
+	info, err = store.GetProcessedFile(ctx, server.URL+"/b")
+	require.NoError(t, err)
+	assert.Nil(t, info)
+
+	// Crawled pages are not local files removed by update
+	_, err = r.FindFilesToProcess(ctx, nil, false)
+	require.NoError(t, err)
+	assert.Len(t, texts(), 4)
+}
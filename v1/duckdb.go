@@ -1,6 +1,7 @@
 package rag
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strconv"
@@ -10,7 +11,15 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-func OpenDuckDB(dsn string, defaultDimension int64) (*sql.DB, error) {
+// DuckDBStore is the embedded Store backed by DuckDB with the vss and fts extensions
+type DuckDBStore struct {
+	db        *sql.DB
+	dimension int64
+}
+
+var _ Store = (*DuckDBStore)(nil)
+
+func OpenDuckDB(dsn string, defaultDimension int64) (*DuckDBStore, error) {
 	if len(dsn) == 0 {
 		dsn = ":memory:"
 	}
@@ -23,93 +32,715 @@ func OpenDuckDB(dsn string, defaultDimension int64) (*sql.DB, error) {
 	db := sql.OpenDB(connector)
 	err = MigrateDuckDB(db, defaultDimension)
 	if err != nil {
+		_ = db.Close()
 		return nil, err
 	}
-	return db, nil
+
+	dimension, err := readEmbeddingDimension(db, "SELECT value FROM meta WHERE key = 'embedding_dimension'")
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &DuckDBStore{db: db, dimension: dimension}, nil
 }
 
+// MigrateDuckDB loads the extensions and upgrades the schema to the latest version. The keyword
+// index is built when it is missing or the schema changed, writers refresh it with
+// RebuildKeywordIndex.
 func MigrateDuckDB(db *sql.DB, defaultDimension int64) error {
+	err := loadDuckDBExtensions(db)
+	if err != nil {
+		return err
+	}
+
+	applied, err := NewDuckDBMigrator(db, defaultDimension).Migrate(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, step := range applied {
+		log.Info().Int("version", step.Version).Str("description", step.Description).
+			Msg("Applied schema migration")
+	}
+	if len(applied) > 0 {
+		return RebuildFullTextIndex(db)
+	}
+
+	// Rebuilding reads the whole corpus, opening for queries must not pay for it
+	exists, err := fullTextIndexExists(db)
+	if err != nil || exists {
+		return err
+	}
+	return RebuildFullTextIndex(db)
+}
+
+// fullTextIndexExists reports whether the fts extension created the index schema of document_chunks
+func fullTextIndexExists(db *sql.DB) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT count(*) FROM information_schema.schemata
+		WHERE schema_name = 'fts_main_document_chunks'`).Scan(&n)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to look up fts index")
+	}
+	return n > 0, nil
+}
+
+func loadDuckDBExtensions(db *sql.DB) error {
 	// https://duckdb.org/docs/stable/core_extensions/vss.html#limitations
 	_, err := db.Exec(`INSTALL vss; LOAD vss; SET hnsw_enable_experimental_persistence = true;`)
 	if err != nil {
 		return errors.Wrap(err, "Failed to install or load vss extension")
 	}
 
-	// Create metadata table to store embedding dimensions
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS meta (
-			key VARCHAR PRIMARY KEY,
-			value VARCHAR NOT NULL
-		);
-	`)
+	// https://duckdb.org/docs/stable/core_extensions/full_text_search.html
+	_, err = db.Exec(`INSTALL fts; LOAD fts;`)
+	if err != nil {
+		return errors.Wrap(err, "Failed to install or load fts extension")
+	}
+	return nil
+}
+
+// NewDuckDBMigrator returns the migrator of a DuckDB database, the extensions must be loaded
+func NewDuckDBMigrator(db *sql.DB, defaultDimension int64) *Migrator {
+	return &Migrator{
+		db:               db,
+		migrations:       duckDBMigrations,
+		defaultDimension: defaultDimension,
+		dimension:        duckDBDimension,
+	}
+}
+
+// duckDBDimension looks for the embedding dimension in meta, the legacy rag_metadata table
+// and finally the size of the embedding column
+func duckDBDimension(ctx context.Context, db *sql.DB) (int64, error) {
+	for _, table := range []string{"meta", "rag_metadata"} {
+		d, err := metaDimension(ctx, db, table)
+		if err != nil || d != 0 {
+			return d, err
+		}
+	}
+
+	dataType, err := columnType(ctx, db, "document_chunks", "embedding")
+	if err != nil {
+		return 0, err
+	}
+	var d int64
+	if _, err = fmt.Sscanf(dataType, "FLOAT[%d]", &d); err != nil {
+		return 0, nil
+	}
+	return d, nil
+}
+
+var duckDBMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "create meta, document_chunks and processed_files tables",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS meta (
+	key VARCHAR PRIMARY KEY,
+	value VARCHAR NOT NULL)`,
+				fmt.Sprintf(`CREATE TABLE IF NOT EXISTS document_chunks (
+	id VARCHAR PRIMARY KEY,
+	document_id VARCHAR,
+	text VARCHAR,
+	embedding FLOAT[%d])`, dimension),
+				`CREATE TABLE IF NOT EXISTS processed_files (
+	file_path VARCHAR PRIMARY KEY,
+	file_name VARCHAR NOT NULL,
+	file_hash VARCHAR NOT NULL,
+	processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+				fmt.Sprintf(`INSERT INTO meta (key, value) VALUES ('embedding_dimension', '%d') ON CONFLICT DO NOTHING`, dimension),
+			}, nil
+		},
+	},
+	{
+		Version:     2,
+		Description: "move legacy rag_metadata into meta",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			exists, err := tableExists(ctx, db, "rag_metadata")
+			if err != nil || !exists {
+				return nil, err
+			}
+			return []string{
+				`INSERT INTO meta (key, value) SELECT key, value FROM rag_metadata ON CONFLICT DO NOTHING`,
+				`DROP TABLE rag_metadata`,
+			}, nil
+		},
+	},
+	{
+		Version:     3,
+		Description: "fixed size embedding column with HNSW index",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			dataType, err := columnType(ctx, db, "document_chunks", "embedding")
+			if err != nil {
+				return nil, err
+			}
+
+			var statements []string
+			if want := fmt.Sprintf("FLOAT[%d]", dimension); dataType != want {
+				// Older databases stored FLOAT[], which the vss extension can't index
+				statements = append(statements,
+					`DROP INDEX IF EXISTS hnsw_idx`,
+					fmt.Sprintf(`ALTER TABLE document_chunks ALTER COLUMN embedding TYPE %s`, want),
+				)
+			}
+			return append(statements, `CREATE INDEX IF NOT EXISTS hnsw_idx ON document_chunks USING HNSW (embedding)`), nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "add processed_files.file_name",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			dataType, err := columnType(ctx, db, "processed_files", "file_name")
+			if err != nil || dataType != "" {
+				return nil, err
+			}
+			return []string{
+				`ALTER TABLE processed_files ADD COLUMN file_name VARCHAR`,
+				`UPDATE processed_files SET file_name = regexp_extract(file_path, '[^/\\]+$')`,
+			}, nil
+		},
+	},
+	{
+		Version:     5,
+		Description: "add chunk provenance columns",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return addChunkColumns(ctx, db, []struct{ name, dataType string }{
+				{"file_path", "VARCHAR"},
+				{"start_offset", "INTEGER"},
+				{"end_offset", "INTEGER"},
+				{"chunk_index", "INTEGER"},
+				{"heading_path", "VARCHAR"},
+			})
+		},
+	},
+	{
+		Version:     6,
+		Description: "create embedding_cache table",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS embedding_cache (
+	model VARCHAR NOT NULL,
+	dimensions INTEGER NOT NULL,
+	text_hash VARCHAR NOT NULL,
+	embedding FLOAT[] NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (model, dimensions, text_hash)
+)`,
+			}, nil
+		},
+	},
+	{
+		Version:     7,
+		Description: "create document_metadata table",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS document_metadata (
+	document_id VARCHAR NOT NULL,
+	key VARCHAR NOT NULL,
+	value VARCHAR NOT NULL,
+	PRIMARY KEY (document_id, key, value)
+)`,
+				`CREATE INDEX IF NOT EXISTS document_metadata_key_value_idx ON document_metadata (key, value)`,
+			}, nil
+		},
+	},
+	{
+		Version:     8,
+		Description: "add parent section columns",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return addChunkColumns(ctx, db, []struct{ name, dataType string }{
+				{"parent_id", "VARCHAR"},
+				{"is_parent", "BOOLEAN"},
+			})
+		},
+	},
+	{
+		Version:     9,
+		Description: "add chunk page columns",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return addChunkColumns(ctx, db, []struct{ name, dataType string }{
+				{"page_start", "INTEGER"},
+				{"page_end", "INTEGER"},
+			})
+		},
+	},
+	{
+		Version:     10,
+		Description: "add image captions",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			statements, err := addChunkColumns(ctx, db, []struct{ name, dataType string }{
+				{"image_path", "VARCHAR"},
+			})
+			if err != nil {
+				return nil, err
+			}
+			return append(statements, `CREATE TABLE IF NOT EXISTS caption_cache (
+	model VARCHAR NOT NULL,
+	image_hash VARCHAR NOT NULL,
+	caption VARCHAR NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (model, image_hash)
+)`), nil
+		},
+	},
+	{
+		Version:     11,
+		Description: "add chunk symbol columns",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return addChunkColumns(ctx, db, []struct{ name, dataType string }{
+				{"symbol", "VARCHAR"},
+				{"symbol_kind", "VARCHAR"},
+				{"line_start", "INTEGER"},
+				{"line_end", "INTEGER"},
+			})
+		},
+	},
+	{
+		Version:     12,
+		Description: "add chunk commit columns",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return addChunkColumns(ctx, db, []struct{ name, dataType string }{
+				{"commit_sha", "VARCHAR"},
+				{"commit_date", "TIMESTAMP"},
+			})
+		},
+	},
+}
+
+// addChunkColumns returns the statements adding the missing columns to document_chunks
+func addChunkColumns(ctx context.Context, db execer, columns []struct{ name, dataType string }) ([]string, error) {
+	var statements []string
+	for _, column := range columns {
+		dataType, err := columnType(ctx, db, "document_chunks", column.name)
+		if err != nil {
+			return nil, err
+		}
+		if dataType == "" {
+			statements = append(statements, fmt.Sprintf(
+				`ALTER TABLE document_chunks ADD COLUMN %s %s`, column.name, column.dataType))
+		}
+	}
+	if len(statements) == 0 {
+		return nil, nil
+	}
+
+	// Tables with an HNSW index can't be altered
+	statements = append([]string{`DROP INDEX IF EXISTS hnsw_idx`}, statements...)
+	return append(statements, `CREATE INDEX hnsw_idx ON document_chunks USING HNSW (embedding)`), nil
+}
+
+// RebuildFullTextIndex (re)creates the BM25 index over document_chunks.text.
+// DuckDB fts indexes are not updated on writes, call it after chunks are inserted or removed.
+func RebuildFullTextIndex(db *sql.DB) error {
+	// Keep digits and non-latin letters so error codes, flags and CJK terms stay searchable
+	_, err := db.Exec(`PRAGMA create_fts_index('document_chunks', 'id', 'text',
+		stemmer = 'porter', ignore = '(\.|[^\p{L}\p{N}_\-])+', overwrite = 1)`)
 	if err != nil {
-		return errors.Wrap(err, "Failed to create meta table")
+		return errors.Wrap(err, "Failed to create fts index")
 	}
+	return nil
+}
 
-	// Check if embedding dimension is already set
+func readEmbeddingDimension(db *sql.DB, query string) (int64, error) {
 	var storedDimension string
-	err = db.QueryRow("SELECT value FROM meta WHERE key = 'embedding_dimension'").Scan(&storedDimension)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return errors.Wrap(err, "Failed to query embedding dimension")
+	err := db.QueryRow(query).Scan(&storedDimension)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to query embedding dimension")
 	}
-	if storedDimension == "" {
-		storedDimension = fmt.Sprintf("%d", defaultDimension)
+	d, err := strconv.ParseInt(storedDimension, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Invalid embedding dimension %q", storedDimension)
+	}
+	return d, nil
+}
+
+// DB exposes the underlying connection for maintenance commands
+func (s *DuckDBStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *DuckDBStore) GetMeta(ctx context.Context, key string) (string, error) {
+	return getMeta(ctx, s.db, key)
+}
+
+func (s *DuckDBStore) SetMeta(ctx context.Context, key, value string) error {
+	return setMeta(ctx, s.db, key, value)
+}
+
+func (s *DuckDBStore) EmbeddingDimension() int64 {
+	return s.dimension
+}
+
+func (s *DuckDBStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *DuckDBStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *DuckDBStore) UpsertDocumentChunks(ctx context.Context, chunks []*DocumentChunk) error {
+	if len(chunks) == 0 {
+		return nil
 	}
 
-	createTableDocumentChunks := fmt.Sprintf(`
-			CREATE TABLE IF NOT EXISTS document_chunks (
-				id VARCHAR PRIMARY KEY,
-				document_id VARCHAR,
-				text VARCHAR,
-				embedding FLOAT[%s]);`, storedDimension)
-	_, err = db.Exec(createTableDocumentChunks)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return errors.Wrap(err, "Failed to create document_chunks table")
+		return err
 	}
+	defer func() { _ = tx.Rollback() }()
 
-	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS hnsw_idx ON document_chunks USING HNSW (embedding);`)
+	// The HNSW indexed embedding is only written on insert, conflicts keep the stored one
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(`
+		INSERT INTO document_chunks (%s, embedding)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?::FLOAT[%d])
+		ON CONFLICT (id) DO UPDATE SET
+			document_id = EXCLUDED.document_id,
+			file_path = EXCLUDED.file_path,
+			start_offset = EXCLUDED.start_offset,
+			end_offset = EXCLUDED.end_offset,
+			chunk_index = EXCLUDED.chunk_index,
+			heading_path = EXCLUDED.heading_path,
+			parent_id = EXCLUDED.parent_id,
+			is_parent = EXCLUDED.is_parent,
+			page_start = EXCLUDED.page_start,
+			page_end = EXCLUDED.page_end,
+			image_path = EXCLUDED.image_path,
+			symbol = EXCLUDED.symbol,
+			symbol_kind = EXCLUDED.symbol_kind,
+			line_start = EXCLUDED.line_start,
+			line_end = EXCLUDED.line_end,
+			commit_sha = EXCLUDED.commit_sha,
+			commit_date = EXCLUDED.commit_date`, chunkColumns, s.dimension))
 	if err != nil {
-		return errors.Wrap(err, "Failed to create hnsw_idx index")
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+
+	for _, chunk := range chunks {
+		var embedding interface{}
+		if chunk.Embedding != nil {
+			embedding = chunk.Embedding
+		}
+		_, err = stmt.ExecContext(ctx, append(chunkArgs(chunk), embedding)...)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = db.Exec(`INSERT INTO meta (key, value) VALUES ('embedding_dimension', ?) ON CONFLICT DO NOTHING`, storedDimension)
+	return tx.Commit()
+}
+
+func (s *DuckDBStore) GetDocumentChunk(ctx context.Context, id string) (*DocumentChunk, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT "+chunkColumns+", embedding FROM document_chunks WHERE id = ?", id)
+
+	var chunk DocumentChunk
+	var cs chunkScanner
+	var embeddingInterface interface{}
+	err := row.Scan(append(cs.dest(&chunk), &embeddingInterface)...)
 	if err != nil {
-		return errors.Wrap(err, "Failed to insert metadata")
+		return nil, err
 	}
+	cs.fill(&chunk)
+	chunk.Embedding = duckDBEmbedding(embeddingInterface)
 
-	// Create table to track processed files and their hashes
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS processed_files (
-			file_path VARCHAR PRIMARY KEY,
-			file_name VARCHAR NOT NULL,
-			file_hash VARCHAR NOT NULL,
-			processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP);`)
+	return &chunk, nil
+}
+
+// duckDBEmbedding converts a scanned FLOAT[] from []interface{} to []float32
+func duckDBEmbedding(v interface{}) []float32 {
+	embeddingSlice, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	embedding := make([]float32, len(embeddingSlice))
+	for i, v := range embeddingSlice {
+		switch f := v.(type) {
+		case float32:
+			embedding[i] = f
+		case float64:
+			embedding[i] = float32(f)
+		}
+	}
+	return embedding
+}
+
+func (s *DuckDBStore) ListDocumentChunks(ctx context.Context, withoutEmbedding bool) ([]DocumentChunk, error) {
+	query := "SELECT " + chunkColumns + " FROM document_chunks WHERE is_parent IS NOT TRUE"
+	if withoutEmbedding {
+		query += " AND embedding IS NULL"
+	}
+	rows, err := s.db.QueryContext(ctx, query)
 	if err != nil {
-		return errors.Wrap(err, "Failed to create processed_files table")
+		return nil, err
 	}
+	return scanChunks(rows)
+}
 
-	return nil
+func (s *DuckDBStore) ListChunksByIndex(ctx context.Context, documentID string, from, to int) ([]DocumentChunk, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+chunkColumns+` FROM document_chunks
+		WHERE document_id = ? AND chunk_index BETWEEN ? AND ? AND is_parent IS NOT TRUE
+		ORDER BY chunk_index`, documentID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return scanChunks(rows)
 }
 
-// GetStoredEmbeddingDimension retrieves the stored embedding dimension from the database
-func GetStoredEmbeddingDimension(db *sql.DB, defaultDimension int64) int64 {
-	var storedDimension string
-	err := db.QueryRow("SELECT value FROM meta WHERE key = 'embedding_dimension'").
-		Scan(&storedDimension)
+func (s *DuckDBStore) UpdateEmbedding(ctx context.Context, id string, embedding []float32) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE document_chunks SET embedding = ? WHERE id = ?", embedding, id)
+	return err
+}
+
+func (s *DuckDBStore) UpdateEmbeddings(ctx context.Context, chunks []DocumentChunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return defaultDimension
+		return err
 	}
+	defer func() { _ = tx.Rollback() }()
 
-	d, err := strconv.ParseInt(storedDimension, 10, 64)
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(
+		"UPDATE document_chunks SET embedding = ?::FLOAT[%d] WHERE id = ?", s.dimension))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+
+	for _, chunk := range chunks {
+		_, err = stmt.ExecContext(ctx, chunk.Embedding, chunk.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *DuckDBStore) RemoveDocumentChunks(ctx context.Context, documentID string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM document_chunks WHERE document_id = ?", documentID)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, "DELETE FROM document_metadata WHERE document_id = ?", documentID)
+	return err
+}
+
+func (s *DuckDBStore) SetDocumentMetadata(ctx context.Context, documentID string, metadata Metadata) error {
+	return setDocumentMetadata(ctx, s.db, documentID, metadata)
+}
+
+func (s *DuckDBStore) VectorSearch(ctx context.Context, embedding []float32, limit int, filters []MetadataFilter) ([]DocumentChunk, error) {
+	where, args, err := metadataWhere(filters, 3)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT %[2]s,
+			array_distance(embedding, $1::FLOAT[%[1]d]),
+			array_cosine_similarity(embedding, $1::FLOAT[%[1]d])
+		FROM document_chunks %[3]s
+		ORDER BY array_distance(embedding, $1::FLOAT[%[1]d]) LIMIT $2`, s.dimension, chunkColumns, where),
+		append([]interface{}{embedding, limit}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var chunks []DocumentChunk
+	for rows.Next() {
+		var chunk DocumentChunk
+		var cs chunkScanner
+		var distance, score sql.NullFloat64
+		err = rows.Scan(append(cs.dest(&chunk), &distance, &score)...)
+		if err != nil {
+			return nil, err
+		}
+		cs.fill(&chunk)
+		if !distance.Valid {
+			// Chunks without embedding sort last, nothing useful follows
+			break
+		}
+		chunk.Distance = distance.Float64
+		chunk.Score = score.Float64
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, rows.Err()
+}
+
+func (s *DuckDBStore) KeywordSearch(ctx context.Context, query string, embedding []float32, limit int, filters []MetadataFilter) ([]DocumentChunk, error) {
+	condition, args, err := andMetadata(filters, 4)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT %[2]s, bm25,
+			array_distance(embedding, $1::FLOAT[%[1]d]),
+			array_cosine_similarity(embedding, $1::FLOAT[%[1]d])
+		FROM (
+			SELECT *, fts_main_document_chunks.match_bm25(id, $2) AS bm25
+			FROM document_chunks
+			WHERE is_parent IS NOT TRUE %[3]s
+		) WHERE bm25 IS NOT NULL
+		ORDER BY bm25 DESC LIMIT $3`, s.dimension, chunkColumns, condition),
+		append([]interface{}{embedding, query, limit}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var chunks []DocumentChunk
+	for rows.Next() {
+		var chunk DocumentChunk
+		var cs chunkScanner
+		var distance, score sql.NullFloat64
+		err = rows.Scan(append(cs.dest(&chunk), &chunk.KeywordScore, &distance, &score)...)
+		if err != nil {
+			return nil, err
+		}
+		cs.fill(&chunk)
+		chunk.Distance = distance.Float64
+		chunk.Score = score.Float64
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+func (s *DuckDBStore) RebuildKeywordIndex(ctx context.Context) error {
+	return RebuildFullTextIndex(s.db)
+}
+
+func (s *DuckDBStore) GetProcessedFile(ctx context.Context, filePath string) (*FileInfo, error) {
+	var info FileInfo
+	err := s.db.QueryRowContext(ctx,
+		"SELECT file_path, file_name, file_hash, processed_at FROM processed_files WHERE file_path = ?", filePath).
+		Scan(&info.FilePath, &info.FileName, &info.FileHash, &info.ProcessedAt)
 	if err != nil {
-		log.Panic().Err(err).Msg("")
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (s *DuckDBStore) ListProcessedFiles(ctx context.Context) ([]FileInfo, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT file_path, file_name, file_hash, processed_at FROM processed_files")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var infos []FileInfo
+	for rows.Next() {
+		var info FileInfo
+		err = rows.Scan(&info.FilePath, &info.FileName, &info.FileHash, &info.ProcessedAt)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
+
+func (s *DuckDBStore) UpsertProcessedFile(ctx context.Context, info *FileInfo) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO processed_files (file_path, file_name, file_hash, processed_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (file_path) DO UPDATE SET
+			file_hash = EXCLUDED.file_hash,
+			processed_at = EXCLUDED.processed_at`,
+		info.FilePath, info.FileName, info.FileHash)
+	return err
+}
+
+func (s *DuckDBStore) RemoveProcessedFile(ctx context.Context, filePath string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM processed_files WHERE file_path = ?", filePath)
+	return err
+}
+
+func (s *DuckDBStore) embeddingCache() *sqlEmbeddingCache {
+	return &sqlEmbeddingCache{
+		db:           s.db,
+		vector:       func(expr string) string { return expr + "::FLOAT[]" },
+		column:       "embedding",
+		encodeVector: func(v []float32) interface{} { return v },
+		decodeVector: func(v interface{}) ([]float32, error) {
+			embedding := duckDBEmbedding(v)
+			if embedding == nil {
+				return nil, errors.Newf("unexpected embedding type %T", v)
+			}
+			return embedding, nil
+		},
+	}
+}
+
+func (s *DuckDBStore) GetCachedEmbeddings(ctx context.Context, model string, dimensions int64, hashes []string) (map[string][]float32, error) {
+	return s.embeddingCache().get(ctx, model, dimensions, hashes)
+}
+
+func (s *DuckDBStore) PutCachedEmbeddings(ctx context.Context, model string, dimensions int64, embeddings map[string][]float32) error {
+	return s.embeddingCache().put(ctx, model, dimensions, embeddings)
+}
+
+func (s *DuckDBStore) GetCachedCaption(ctx context.Context, model, imageHash string) (string, error) {
+	return getCachedCaption(ctx, s.db, model, imageHash)
+}
+
+func (s *DuckDBStore) PutCachedCaption(ctx context.Context, model, imageHash, caption string) error {
+	return putCachedCaption(ctx, s.db, model, imageHash, caption)
+}
+
+func (s *DuckDBStore) EmbeddingCacheSummary(ctx context.Context) ([]EmbeddingCacheSummary, error) {
+	return s.embeddingCache().summary(ctx)
+}
+
+func (s *DuckDBStore) PruneEmbeddingCache(ctx context.Context, opts PruneOptions) (int64, error) {
+	return s.embeddingCache().prune(ctx, opts)
+}
+
+func (s *DuckDBStore) reembed() *sqlReembed {
+	return &sqlReembed{
+		db:             s.db,
+		vectorType:     "FLOAT[]",
+		encodeVector:   func(v []float32) interface{} { return v },
+		swapStatements: duckDBReembedSwap,
 	}
+}
 
-	if d != defaultDimension {
-		log.Warn().
-			Int64("stored_dimension", d).
-			Int64("default_dimension", defaultDimension).
-			Msg("Stored embedding dimension does not match default value, using stored value")
+// duckDBReembedSwap retypes the embedding column, tables with an HNSW index can't be altered
+func duckDBReembedSwap(dimension int64) []string {
+	return []string{
+		`DROP INDEX IF EXISTS hnsw_idx`,
+		fmt.Sprintf(`ALTER TABLE document_chunks ALTER COLUMN embedding TYPE FLOAT[%d] USING NULL`, dimension),
+		fmt.Sprintf(`UPDATE document_chunks SET embedding = r.embedding::FLOAT[%d]
+		FROM embedding_reembed r WHERE document_chunks.id = r.id`, dimension),
+		`CREATE INDEX hnsw_idx ON document_chunks USING HNSW (embedding)`,
 	}
-	return d
+}
+
+func (s *DuckDBStore) BeginReembed(ctx context.Context, model string, dimension int64) (int64, error) {
+	return s.reembed().begin(ctx, model, dimension)
+}
+
+func (s *DuckDBStore) ListReembedPending(ctx context.Context) ([]DocumentChunk, error) {
+	return s.reembed().pending(ctx)
+}
+
+func (s *DuckDBStore) UpdateReembedEmbeddings(ctx context.Context, chunks []DocumentChunk) error {
+	return s.reembed().update(ctx, chunks)
+}
+
+func (s *DuckDBStore) SwapReembed(ctx context.Context) error {
+	dimension, err := s.reembed().swap(ctx)
+	if err != nil {
+		return err
+	}
+	s.dimension = dimension
+	return nil
 }
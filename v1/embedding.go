@@ -0,0 +1,387 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/openai/openai-go"
+	"github.com/rs/zerolog/log"
+	"github.com/schollz/progressbar/v3"
+	"github.com/sourcegraph/conc/pool"
+)
+
+const (
+	DefaultEmbeddingBatchSize  = 64
+	DefaultEmbeddingBatchChars = 32000
+)
+
+// RetryPolicy controls the exponential backoff of embedding requests that failed with 429, 5xx or
+// a network error, zero values mean the defaults
+type RetryPolicy struct {
+	MaxRetries     int           // Retries after the first attempt, default 5, negative disables retries
+	InitialBackoff time.Duration // Wait before the first retry, default 1s
+	MaxBackoff     time.Duration // Upper bound of the backoff, default 60s, a longer Retry-After is still honored
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxRetries == 0 {
+		p.MaxRetries = 5
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = time.Second
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Minute
+	}
+	return p
+}
+
+// backoff returns the wait before retry attempt (0-based), with up to 50% jitter
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff << min(attempt, 30)
+	if d <= 0 || d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// wait returns the wait before retry attempt, the Retry-After of the server if it sent one
+func (p RetryPolicy) wait(retryAfter time.Duration, attempt int) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	return p.backoff(attempt)
+}
+
+// EmbeddingFailure is a batch of chunks that could not be embedded
+type EmbeddingFailure struct {
+	ChunkIDs []string
+	Err      error
+}
+
+// EmbeddingError reports the chunks ComputeEmbeddings could not embed, the others were stored
+type EmbeddingError struct {
+	Total    int // Chunks that needed an embedding
+	Embedded int
+	Failures []EmbeddingFailure
+}
+
+// Failed is the number of chunks without embedding
+func (e *EmbeddingError) Failed() int {
+	n := 0
+	for _, f := range e.Failures {
+		n += len(f.ChunkIDs)
+	}
+	return n
+}
+
+func (e *EmbeddingError) Error() string {
+	// Batches usually fail for the same few reasons
+	counts := make(map[string]int)
+	var reasons []string
+	for _, f := range e.Failures {
+		reason := f.Err.Error()
+		if counts[reason] == 0 {
+			reasons = append(reasons, reason)
+		}
+		counts[reason] += len(f.ChunkIDs)
+	}
+	for i, reason := range reasons {
+		reasons[i] = fmt.Sprintf("%s (%d chunks)", reason, counts[reason])
+	}
+	return fmt.Sprintf("failed to embed %d of %d chunks: %s", e.Failed(), e.Total, strings.Join(reasons, "; "))
+}
+
+func (e *EmbeddingError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// ComputeEmbeddings embeds the stored chunks, only those without an embedding if onlyEmpty.
+// Chunks are sent in batches, workers batches at a time, and callback is called per embedded chunk.
+// Batches failing with 429 or 5xx are retried with backoff. If chunks are left without embedding
+// the error is an *EmbeddingError, if ctx is done the context error is returned.
+func (r *RAG) ComputeEmbeddings(ctx context.Context, onlyEmpty bool, workers int, callback func()) error {
+	if ToEmbeddingClient(r.EmbeddingClient) == nil {
+		return errors.New("failed to get embedding client")
+	}
+
+	err := r.checkEmbeddingModel(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	chunks, err := r.Store.ListDocumentChunks(ctx, onlyEmpty)
+	if err != nil {
+		return err
+	}
+	return r.embedChunks(ctx, chunks, workers, callback, r.Store.UpdateEmbeddings)
+}
+
+// embedChunks embeds chunks in batches and writes the embeddings with write, see ComputeEmbeddings
+func (r *RAG) embedChunks(ctx context.Context, chunks []DocumentChunk, workers int, callback func(),
+	write func(context.Context, []DocumentChunk) error) error {
+	bar := progressbar.Default(int64(len(chunks)))
+	bar.Describe("Computing embeddings")
+	defer func() { _ = bar.Finish() }()
+
+	// Empty chunks have nothing to embed
+	nonEmpty := chunks[:0]
+	for _, chunk := range chunks {
+		if len(chunk.Text) == 0 {
+			_ = bar.Add(1)
+			continue
+		}
+		nonEmpty = append(nonEmpty, chunk)
+	}
+
+	var mu sync.Mutex
+	result := &EmbeddingError{Total: len(nonEmpty)}
+
+	hits, nonEmpty, err := r.embedFromCache(ctx, nonEmpty, write)
+	if err != nil {
+		return err
+	}
+	result.Embedded = len(hits)
+	_ = bar.Add(len(hits))
+	for range hits {
+		callback()
+	}
+
+	p := pool.New().WithMaxGoroutines(workers)
+	for _, batch := range r.embeddingBatches(nonEmpty) {
+		if ctx.Err() != nil {
+			break
+		}
+		p.Go(func() {
+			defer func() { _ = bar.Add(len(batch)) }()
+
+			err := r.embedBatch(ctx, batch, write)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				ids := make([]string, len(batch))
+				for i, chunk := range batch {
+					ids[i] = chunk.ID
+				}
+				result.Failures = append(result.Failures, EmbeddingFailure{ChunkIDs: ids, Err: err})
+				log.Error().Err(err).Int("chunks", len(batch)).Str("first_chunk_id", ids[0]).
+					Msg("Compute embeddings")
+				return
+			}
+			result.Embedded += len(batch)
+			for range batch {
+				callback()
+			}
+		})
+	}
+	p.Wait()
+
+	if err = ctx.Err(); err != nil {
+		return fmt.Errorf("embedding cancelled after %d of %d chunks: %w", result.Embedded, result.Total, err)
+	}
+	cacheHits, cacheMisses := r.EmbeddingCacheStats()
+	log.Info().Int("total", result.Total).Int("embedded", result.Embedded).Int("failed", result.Failed()).
+		Int64("cache_hits", cacheHits).Int64("cache_misses", cacheMisses).
+		Msg("Embedding summary")
+	if len(result.Failures) > 0 {
+		return result
+	}
+	return nil
+}
+
+// embeddingBatches groups chunks by EmbeddingBatchSize and EmbeddingBatchChars, a chunk longer
+// than EmbeddingBatchChars is sent on its own
+func (r *RAG) embeddingBatches(chunks []DocumentChunk) [][]DocumentChunk {
+	maxChunks := r.EmbeddingBatchSize
+	if maxChunks <= 0 {
+		maxChunks = DefaultEmbeddingBatchSize
+	}
+	maxChars := r.EmbeddingBatchChars
+	if maxChars <= 0 {
+		maxChars = DefaultEmbeddingBatchChars
+	}
+
+	var batches [][]DocumentChunk
+	start, chars := 0, 0
+	for i, chunk := range chunks {
+		n := utf8.RuneCountInString(chunk.EmbeddingText())
+		if i > start && (i-start == maxChunks || chars+n > maxChars) {
+			batches = append(batches, chunks[start:i])
+			start, chars = i, 0
+		}
+		chars += n
+	}
+	if start < len(chunks) {
+		batches = append(batches, chunks[start:])
+	}
+	return batches
+}
+
+// EmbeddingText returns the text the chunk is embedded with, its text after its heading breadcrumb
+// so that retrieval sees the section of the chunk. Text stays a verbatim slice of the document.
+func (c *DocumentChunk) EmbeddingText() string {
+	if c.HeadingPath == "" {
+		return c.Text
+	}
+	return c.HeadingPath + "\n\n" + c.Text
+}
+
+// embedBatch embeds the chunks with one request and writes the embeddings in one call
+func (r *RAG) embedBatch(ctx context.Context, batch []DocumentChunk, write func(context.Context, []DocumentChunk) error) error {
+	input := make([]string, len(batch))
+	for i, chunk := range batch {
+		input[i] = chunk.EmbeddingText()
+	}
+	embeddings, err := r.requestEmbeddings(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	embedded := make([]DocumentChunk, len(batch))
+	for i, chunk := range batch {
+		chunk.Embedding = embeddings[i]
+		embedded[i] = chunk
+	}
+	err = write(ctx, embedded)
+	if err != nil {
+		return err
+	}
+	r.cacheEmbeddings(ctx, input, embeddings)
+	return nil
+}
+
+// EmbedTexts embeds texts in batches with retries and returns the embeddings in the same order.
+// Cached embeddings are reused and new ones are cached.
+func (r *RAG) EmbedTexts(ctx context.Context, texts []string) ([][]float32, error) {
+	if ToEmbeddingClient(r.EmbeddingClient) == nil {
+		return nil, errors.New("failed to get embedding client")
+	}
+
+	embeddings := make([][]float32, len(texts))
+	found := r.cachedEmbeddings(ctx, texts)
+	var misses []DocumentChunk
+	for i, text := range texts {
+		if embedding, ok := found[CalculateStringHash(text)]; ok {
+			embeddings[i] = embedding
+			continue
+		}
+		misses = append(misses, DocumentChunk{Text: text, Index: i})
+	}
+
+	for _, batch := range r.embeddingBatches(misses) {
+		input := make([]string, len(batch))
+		for i, chunk := range batch {
+			input[i] = chunk.Text
+		}
+		batchEmbeddings, err := r.requestEmbeddings(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for i, chunk := range batch {
+			embeddings[chunk.Index] = batchEmbeddings[i]
+		}
+		r.cacheEmbeddings(ctx, input, batchEmbeddings)
+	}
+	return embeddings, nil
+}
+
+// requestEmbeddings embeds input with one request, the embeddings are in input order
+func (r *RAG) requestEmbeddings(ctx context.Context, input []string) ([][]float32, error) {
+	rsp, err := r.embedWithRetry(ctx, openai.EmbeddingNewParams{
+		Model: r.EmbeddingModel,
+		Input: openai.EmbeddingNewParamsInputUnion{
+			OfArrayOfStrings: input,
+		},
+		Dimensions:     openai.Int(r.EmbeddingDimensions),
+		EncodingFormat: openai.EmbeddingNewParamsEncodingFormatFloat,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp.Data) != len(input) {
+		return nil, fmt.Errorf("embedding response has %d embeddings for %d inputs", len(rsp.Data), len(input))
+	}
+
+	// The response is not guaranteed to keep the input order
+	embeddings := make([][]float32, len(input))
+	for _, data := range rsp.Data {
+		if data.Index < 0 || int(data.Index) >= len(input) || embeddings[data.Index] != nil {
+			return nil, fmt.Errorf("embedding response has an invalid index %d", data.Index)
+		}
+		embeddings[data.Index] = toFloat32Slice(data.Embedding)
+	}
+	return embeddings, nil
+}
+
+// embedWithRetry sends an embedding request, retrying rate limits, server and network errors
+func (r *RAG) embedWithRetry(ctx context.Context, params openai.EmbeddingNewParams) (*openai.CreateEmbeddingResponse, error) {
+	embeddingClient := ToEmbeddingClient(r.EmbeddingClient)
+	if embeddingClient == nil {
+		return nil, errors.New("failed to get embedding client")
+	}
+	policy := r.EmbeddingRetry.withDefaults()
+
+	for attempt := 0; ; attempt++ {
+		rsp, err := embeddingClient.New(ctx, params)
+		if err == nil {
+			return rsp, nil
+		}
+		wait, retryable := retryAfter(err)
+		if !retryable || attempt >= policy.MaxRetries || ctx.Err() != nil {
+			if attempt > 0 {
+				return nil, fmt.Errorf("after %d attempts: %w", attempt+1, err)
+			}
+			return nil, err
+		}
+		wait = policy.wait(wait, attempt)
+
+		log.Warn().Err(err).Int("attempt", attempt+1).Dur("backoff", wait).Msg("Retrying embedding request")
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryAfter tells whether err is a rate limit, server or network error, and the wait the server
+// asked for. The clients are built without retries of their own, so dropped connections, timeouts
+// and DNS failures are retried here.
+func retryAfter(err error) (time.Duration, bool) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return 0, false
+	}
+	var apiErr *openai.Error
+	if !errors.As(err, &apiErr) {
+		var netErr net.Error
+		return 0, errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	if apiErr.StatusCode != http.StatusTooManyRequests && apiErr.StatusCode < 500 {
+		return 0, false
+	}
+	if apiErr.Response != nil {
+		if seconds, err := strconv.Atoi(apiErr.Response.Header.Get("Retry-After")); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return 0, true
+}
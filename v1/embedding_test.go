@@ -0,0 +1,322 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddingBatches(t *testing.T) {
+	chunk := func(n int) DocumentChunk { return DocumentChunk{Text: strings.Repeat("字", n)} }
+	sizes := func(batches [][]DocumentChunk) []int {
+		var n []int
+		for _, batch := range batches {
+			n = append(n, len(batch))
+		}
+		return n
+	}
+
+	r := &RAG{EmbeddingBatchSize: 3, EmbeddingBatchChars: 10}
+	assert.Empty(t, r.embeddingBatches(nil))
+	assert.Equal(t, []int{3, 2}, sizes(r.embeddingBatches([]DocumentChunk{chunk(1), chunk(1), chunk(1), chunk(1), chunk(1)})))
+	// Characters are counted, not bytes
+	assert.Equal(t, []int{2, 1}, sizes(r.embeddingBatches([]DocumentChunk{chunk(4), chunk(6), chunk(1)})))
+	// Oversized chunks go alone
+	assert.Equal(t, []int{1, 1, 1}, sizes(r.embeddingBatches([]DocumentChunk{chunk(2), chunk(20), chunk(2)})))
+
+	r = &RAG{}
+	many := make([]DocumentChunk, DefaultEmbeddingBatchSize+1)
+	assert.Equal(t, []int{DefaultEmbeddingBatchSize, 1}, sizes(r.embeddingBatches(many)))
+}
+
+// reversedEmbeddingClient returns the embeddings in reverse order
+type reversedEmbeddingClient struct {
+	fakeEmbeddingClient
+}
+
+func (c *reversedEmbeddingClient) New(ctx context.Context, params openai.EmbeddingNewParams) (*openai.CreateEmbeddingResponse, error) {
+	rsp, err := c.fakeEmbeddingClient.New(ctx, params)
+	for i, j := 0, len(rsp.Data)-1; i < j; i, j = i+1, j-1 {
+		rsp.Data[i], rsp.Data[j] = rsp.Data[j], rsp.Data[i]
+	}
+	return rsp, err
+}
+
+func TestComputeEmbeddingsBatched(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore(8)
+	var chunks []*DocumentChunk
+	for _, text := range []string{"alpha", "bravo", "charlie", "delta", "echo", "", "foxtrot", "golf"} {
+		chunks = append(chunks, &DocumentChunk{ID: "id-" + text, Text: text, FilePath: "a.md", Index: len(chunks)})
+	}
+	require.NoError(t, store.UpsertDocumentChunks(ctx, chunks))
+
+	client := &reversedEmbeddingClient{fakeEmbeddingClient{dimension: 8}}
+	r := &RAG{Store: store, EmbeddingClient: client, EmbeddingDimensions: 8, EmbeddingBatchSize: 3}
+
+	embedded := 0
+	err := r.ComputeEmbeddings(ctx, true, 2, func() { embedded++ })
+	require.NoError(t, err)
+	assert.Equal(t, 7, embedded)
+	assert.Equal(t, 3, client.calls)
+	assert.Equal(t, 3, store.batches)
+
+	for _, chunk := range chunks {
+		stored, err := store.GetDocumentChunk(ctx, chunk.ID)
+		require.NoError(t, err)
+		if chunk.Text == "" {
+			assert.Nil(t, stored.Embedding)
+			continue
+		}
+		assert.Equal(t, toFloat32Slice(fakeEmbedding(chunk.Text, 8)), stored.Embedding, chunk.Text)
+	}
+}
+
+func TestComputeEmbeddingsHeadingPath(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore(8)
+	chunk := &DocumentChunk{ID: "c1", Text: "Run it twice.", FilePath: "a.md", HeadingPath: "Guide > Install"}
+	require.NoError(t, store.UpsertDocumentChunks(ctx, []*DocumentChunk{chunk}))
+	assert.Equal(t, "Guide > Install\n\nRun it twice.", chunk.EmbeddingText())
+
+	// The breadcrumb is embedded before the text, the stored text stays verbatim
+	r := &RAG{Store: store, EmbeddingClient: &fakeEmbeddingClient{dimension: 8}, EmbeddingDimensions: 8}
+	require.NoError(t, r.ComputeEmbeddings(ctx, true, 1, func() {}))
+	stored, err := store.GetDocumentChunk(ctx, "c1")
+	require.NoError(t, err)
+	assert.Equal(t, "Run it twice.", stored.Text)
+	assert.Equal(t, toFloat32Slice(fakeEmbedding("Guide > Install\n\nRun it twice.", 8)), stored.Embedding)
+}
+
+func newEmbeddingStore(t *testing.T, texts ...string) *memStore {
+	store := newMemStore(8)
+	var chunks []*DocumentChunk
+	for i, text := range texts {
+		chunks = append(chunks, &DocumentChunk{ID: "id-" + text, Text: text, FilePath: "a.md", Index: i})
+	}
+	require.NoError(t, store.UpsertDocumentChunks(context.Background(), chunks))
+	return store
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}.withDefaults()
+	assert.Equal(t, 5, p.MaxRetries)
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		d := p.backoff(attempt)
+		assert.GreaterOrEqual(t, d, want/2, "attempt %d", attempt)
+		assert.LessOrEqual(t, d, want, "attempt %d", attempt)
+	}
+	assert.LessOrEqual(t, p.backoff(100), time.Second)
+
+	// A Retry-After longer than the backoff limit is honored
+	assert.Equal(t, 2*time.Minute, p.wait(2*time.Minute, 0))
+	assert.LessOrEqual(t, p.wait(0, 0), 100*time.Millisecond)
+}
+
+func TestRetryAfter(t *testing.T) {
+	limited := &openai.Error{StatusCode: http.StatusTooManyRequests,
+		Response: &http.Response{Header: http.Header{"Retry-After": []string{"120"}}}}
+	wait, retryable := retryAfter(fmt.Errorf("embed: %w", limited))
+	assert.True(t, retryable)
+	assert.Equal(t, 2*time.Minute, wait)
+
+	for i, err := range []error{
+		&openai.Error{StatusCode: http.StatusBadGateway},
+		&net.OpError{Op: "dial", Err: errors.New("connection refused")},
+		&net.DNSError{Err: "no such host", Name: "embeddings.example.com"},
+		fmt.Errorf("read body: %w", io.ErrUnexpectedEOF),
+	} {
+		_, retryable = retryAfter(err)
+		assert.True(t, retryable, "error %d", i)
+	}
+	for i, err := range []error{
+		&openai.Error{StatusCode: http.StatusBadRequest},
+		context.Canceled,
+		&url.Error{Op: "Post", URL: "http://embeddings", Err: context.DeadlineExceeded},
+		errors.New("model refused input"),
+	} {
+		_, retryable = retryAfter(err)
+		assert.False(t, retryable, "error %d", i)
+	}
+}
+
+func TestComputeEmbeddingsRetryDroppedConnection(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			// The connection is closed without a response, like a proxy resetting it
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			_ = conn.Close()
+			return
+		}
+		var req struct{ Input []string }
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		embedding, _ := json.Marshal(fakeEmbedding(req.Input[0], 8))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"object": "list", "model": "m", "data": [{"object": "embedding", "index": 0, "embedding": %s}]}`,
+			embedding)
+	}))
+	defer srv.Close()
+
+	client := openai.NewClient(option.WithBaseURL(srv.URL), option.WithAPIKey("unused"), option.WithMaxRetries(0))
+	store := newEmbeddingStore(t, "alpha")
+	r := &RAG{Store: store, EmbeddingClient: &client, EmbeddingDimensions: 8,
+		EmbeddingRetry: RetryPolicy{InitialBackoff: time.Millisecond}}
+
+	require.NoError(t, r.ComputeEmbeddings(context.Background(), true, 1, func() {}))
+	assert.Equal(t, int32(2), requests.Load())
+	missing, err := store.ListDocumentChunks(context.Background(), true)
+	require.NoError(t, err)
+	assert.Empty(t, missing)
+}
+
+func TestComputeEmbeddingsRetry(t *testing.T) {
+	var requests atomic.Int32
+	var badRequest atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		switch {
+		case badRequest.Load():
+			http.Error(w, `{"error": {"message": "input too long"}}`, http.StatusBadRequest)
+			return
+		case n == 1:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, `{"error": {"message": "slow down"}}`, http.StatusTooManyRequests)
+			return
+		case n == 2:
+			http.Error(w, `{"error": {"message": "overloaded"}}`, http.StatusServiceUnavailable)
+			return
+		}
+
+		var req struct{ Input []string }
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		var data []string
+		for i, input := range req.Input {
+			embedding, _ := json.Marshal(fakeEmbedding(input, 8))
+			data = append(data, fmt.Sprintf(`{"object": "embedding", "index": %d, "embedding": %s}`, i, embedding))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"object": "list", "model": "m", "data": [%s]}`, strings.Join(data, ","))
+	}))
+	defer srv.Close()
+
+	client := openai.NewClient(option.WithBaseURL(srv.URL), option.WithAPIKey("unused"), option.WithMaxRetries(0))
+	store := newEmbeddingStore(t, "alpha", "bravo")
+	r := &RAG{Store: store, EmbeddingClient: &client, EmbeddingDimensions: 8,
+		EmbeddingRetry: RetryPolicy{InitialBackoff: time.Millisecond}}
+
+	require.NoError(t, r.ComputeEmbeddings(context.Background(), true, 1, func() {}))
+	assert.Equal(t, int32(3), requests.Load())
+	missing, err := store.ListDocumentChunks(context.Background(), true)
+	require.NoError(t, err)
+	assert.Empty(t, missing)
+
+	// Client errors are not retried
+	requests.Store(100)
+	badRequest.Store(true)
+	store = newEmbeddingStore(t, "charlie")
+	r.Store = store
+	err = r.ComputeEmbeddings(context.Background(), true, 1, func() {})
+	var embeddingErr *EmbeddingError
+	require.ErrorAs(t, err, &embeddingErr)
+	assert.Equal(t, int32(101), requests.Load())
+	var apiErr *openai.Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+}
+
+// failingEmbeddingClient fails every request containing poison
+type failingEmbeddingClient struct {
+	fakeEmbeddingClient
+	poison string
+}
+
+func (c *failingEmbeddingClient) New(ctx context.Context, params openai.EmbeddingNewParams) (*openai.CreateEmbeddingResponse, error) {
+	for _, input := range params.Input.OfArrayOfStrings {
+		if input == c.poison {
+			return nil, errors.New("model refused input")
+		}
+	}
+	return c.fakeEmbeddingClient.New(ctx, params)
+}
+
+func TestComputeEmbeddingsPartialFailure(t *testing.T) {
+	ctx := context.Background()
+	store := newEmbeddingStore(t, "alpha", "bravo", "charlie", "delta", "echo")
+	r := &RAG{
+		Store:              store,
+		EmbeddingClient:    &failingEmbeddingClient{fakeEmbeddingClient{dimension: 8}, "charlie"},
+		EmbeddingBatchSize: 2,
+	}
+
+	embedded := 0
+	err := r.ComputeEmbeddings(ctx, true, 3, func() { embedded++ })
+	var embeddingErr *EmbeddingError
+	require.ErrorAs(t, err, &embeddingErr)
+	assert.Equal(t, 5, embeddingErr.Total)
+	assert.Equal(t, 3, embeddingErr.Embedded)
+	assert.Equal(t, 2, embeddingErr.Failed())
+	assert.Equal(t, 3, embedded)
+	require.Len(t, embeddingErr.Failures, 1)
+	assert.ElementsMatch(t, []string{"id-charlie", "id-delta"}, embeddingErr.Failures[0].ChunkIDs)
+	assert.Equal(t, "failed to embed 2 of 5 chunks: model refused input (2 chunks)", err.Error())
+
+	// The next run only retries the chunks left without embedding
+	missing, err := store.ListDocumentChunks(ctx, true)
+	require.NoError(t, err)
+	assert.Len(t, missing, 2)
+}
+
+// blockingEmbeddingClient blocks every request until its context is done
+type blockingEmbeddingClient struct {
+	started chan struct{}
+}
+
+func (c *blockingEmbeddingClient) New(ctx context.Context, _ openai.EmbeddingNewParams) (*openai.CreateEmbeddingResponse, error) {
+	select {
+	case c.started <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestComputeEmbeddingsCancel(t *testing.T) {
+	store := newEmbeddingStore(t, "alpha", "bravo", "charlie", "delta")
+	client := &blockingEmbeddingClient{started: make(chan struct{}, 1)}
+	r := &RAG{Store: store, EmbeddingClient: client, EmbeddingBatchSize: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-client.started
+		cancel()
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- r.ComputeEmbeddings(ctx, true, 2, func() {}) }()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+		var embeddingErr *EmbeddingError
+		assert.False(t, errors.As(err, &embeddingErr))
+	case <-time.After(5 * time.Second):
+		t.Fatal("ComputeEmbeddings did not return after cancellation")
+	}
+}
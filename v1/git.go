@@ -0,0 +1,342 @@
+package rag
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// GitRepo runs git in a directory of a work tree, paths of files are relative to the directory
+type GitRepo struct {
+	Dir  string // Indexed directory, the top level of the work tree or a directory in it
+	Head string // Commit checked out when the repository was opened
+}
+
+// GitCommit is the commit that last changed a file
+type GitCommit struct {
+	SHA  string
+	Date time.Time // Author date
+}
+
+// GitChange is a file changed between two commits as listed by git diff --name-status
+type GitChange struct {
+	Status  byte   // A, C, D, M, R or T
+	Path    string // Slash separated
+	OldPath string // Source of a rename or copy
+}
+
+// OpenGitRepo opens the work tree containing dir, it must have at least one commit
+func OpenGitRepo(ctx context.Context, dir string) (*GitRepo, error) {
+	repo := &GitRepo{Dir: dir}
+	head, err := repo.git(ctx, "rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a git repository with commits: %w", dir, err)
+	}
+	repo.Head = strings.TrimSpace(head)
+	return repo, nil
+}
+
+func (g *GitRepo) command(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, "git", append([]string{"-C", g.Dir}, args...)...)
+}
+
+func (g *GitRepo) git(ctx context.Context, args ...string) (string, error) {
+	cmd := g.command(ctx, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return string(out), nil
+}
+
+// splitNUL splits the output of git commands run with -z
+func splitNUL(out string) []string {
+	return strings.FieldsFunc(out, func(r rune) bool { return r == 0 })
+}
+
+// HasCommit tells whether sha is a commit of the repository, history rewritten by a force push
+// or a shallow clone loses indexed commits
+func (g *GitRepo) HasCommit(ctx context.Context, sha string) bool {
+	_, err := g.git(ctx, "cat-file", "-e", sha+"^{commit}")
+	return err == nil
+}
+
+// Dirty tells whether tracked files of the directory have uncommitted changes, update reads the
+// work tree so their chunks don't match the indexed commit
+func (g *GitRepo) Dirty(ctx context.Context) (bool, error) {
+	out, err := g.git(ctx, "status", "--porcelain", "--untracked-files=no", "--", ".")
+	if err != nil {
+		return false, err
+	}
+	return out != "", nil
+}
+
+// Files returns the tracked files of the directory
+func (g *GitRepo) Files(ctx context.Context) ([]string, error) {
+	out, err := g.git(ctx, "ls-files", "-z")
+	if err != nil {
+		return nil, err
+	}
+	return splitNUL(out), nil
+}
+
+// Diff returns the files of the directory changed from commit from to Head, with renames detected
+func (g *GitRepo) Diff(ctx context.Context, from string) ([]GitChange, error) {
+	out, err := g.git(ctx, "diff", "--name-status", "-z", "-M", "--relative", from, g.Head)
+	if err != nil {
+		return nil, err
+	}
+	fields := splitNUL(out)
+	var changes []GitChange
+	for i := 0; i < len(fields); {
+		// Renames and copies have a similarity score, e.g. R087, and both paths
+		change := GitChange{Status: fields[i][0]}
+		switch {
+		case (change.Status == 'R' || change.Status == 'C') && i+2 < len(fields):
+			change.OldPath, change.Path = fields[i+1], fields[i+2]
+			i += 3
+		case i+1 < len(fields):
+			change.Path = fields[i+1]
+			i += 2
+		default:
+			return nil, fmt.Errorf("unexpected git diff output: %q", fields[i])
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// LastCommits returns the commit that last changed each of paths up to Head, looking at the
+// commits after since or at the whole history when since is empty. The log is read until all
+// paths are found.
+func (g *GitRepo) LastCommits(ctx context.Context, since string, paths []string) (map[string]GitCommit, error) {
+	commits := make(map[string]GitCommit, len(paths))
+	if len(paths) == 0 {
+		return commits, nil
+	}
+	missing := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		missing[p] = true
+	}
+
+	revision := g.Head
+	if since != "" {
+		revision = since + ".." + g.Head
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Commit lines are marked by \x01, the first file of a commit follows its line after a newline
+	cmd := g.command(ctx, "log", "-z", "--name-only", "--relative", "--format=\x01%H %aI", revision)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	var commit GitCommit
+	reader := bufio.NewReader(stdout)
+	for len(missing) > 0 {
+		field, err := reader.ReadString(0)
+		if err != nil {
+			break
+		}
+		field = strings.TrimPrefix(strings.TrimSuffix(field, "\x00"), "\n")
+		if line, ok := strings.CutPrefix(field, "\x01"); ok {
+			sha, date, _ := strings.Cut(line, " ")
+			commit.SHA = sha
+			commit.Date, err = time.Parse(time.RFC3339, date)
+			if err != nil {
+				cancel()
+				_ = cmd.Wait()
+				return nil, fmt.Errorf("unexpected date of commit %s: %w", sha, err)
+			}
+			continue
+		}
+		if missing[field] {
+			commits[field] = commit
+			delete(missing, field)
+		}
+	}
+
+	// The rest of the log is not needed
+	cancel()
+	err = cmd.Wait()
+	if err != nil && len(missing) > 0 {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git log: %s", msg)
+		}
+		return nil, fmt.Errorf("git log: %w", err)
+	}
+	return commits, nil
+}
+
+// gitCommitKey is the meta key of the last indexed commit of a directory and the pattern of the
+// files indexed, stored as "<commit> <pattern>"
+func gitCommitKey(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return "git_commit " + dir
+}
+
+// IndexedCommit returns the commit and the file pattern recorded by SetIndexedCommit for the
+// directory, empty if none
+func (r *RAG) IndexedCommit(ctx context.Context, repo *GitRepo) (commit string, pattern string, err error) {
+	value, err := r.Store.GetMeta(ctx, gitCommitKey(repo.Dir))
+	if err != nil {
+		return "", "", err
+	}
+	commit, pattern, _ = strings.Cut(value, " ")
+	return commit, pattern, nil
+}
+
+// SetIndexedCommit records Head as indexed with the pattern of the files indexed, the next update
+// with the same pattern processes the files changed since
+func (r *RAG) SetIndexedCommit(ctx context.Context, repo *GitRepo, pattern string) error {
+	return r.Store.SetMeta(ctx, gitCommitKey(repo.Dir), repo.Head+" "+pattern)
+}
+
+// FindGitFilesToProcess returns the files of repo added, modified, renamed or copied since its
+// last indexed commit, with the commit that last changed them by file path. Only files whose path
+// is accepted by match are processed, pattern names the files it accepts, e.g. the glob of update.
+// On the first update, with force, when the indexed commit is no longer in the repository, or
+// when pattern differs from the one recorded with it all tracked files are returned, files
+// unchanged since the indexed commit would otherwise be missed. Chunks of deleted files and of the
+// old paths of renamed files are removed.
+//
+// File hashes are not computed, the returned infos have an empty FileHash.
+func (r *RAG) FindGitFilesToProcess(ctx context.Context, repo *GitRepo, pattern string,
+	match func(filePath string) bool, force bool) ([]FileInfo, map[string]GitCommit, error) {
+	indexed, indexedPattern, err := r.IndexedCommit(ctx, repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case indexed == "" || force:
+	case !repo.HasCommit(ctx, indexed):
+		log.Warn().Str("commit", indexed).Msg("Indexed commit is not in the repository, processing all files")
+		indexed = ""
+	case indexedPattern != pattern:
+		log.Info().Str("indexed_pattern", indexedPattern).Str("pattern", pattern).
+			Msg("File pattern changed since the indexed commit, processing all files")
+		indexed = ""
+	}
+
+	var paths []string
+	var removed []string
+	switch {
+	case indexed != "" && !force:
+		changes, err := repo.Diff(ctx, indexed)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, change := range changes {
+			switch change.Status {
+			case 'D':
+				removed = append(removed, change.Path)
+				continue
+			case 'R':
+				removed = append(removed, change.OldPath)
+			}
+			paths = append(paths, change.Path)
+		}
+	default:
+		// Recorded files no longer tracked were deleted while the indexed commit was unknown
+		paths, err = repo.Files(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		indexed = ""
+		tracked := make(map[string]bool, len(paths))
+		for _, p := range paths {
+			tracked[p] = true
+		}
+		processed, err := r.Store.ListProcessedFiles(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, info := range processed {
+			rel, err := filepath.Rel(repo.Dir, info.FilePath)
+			if isURL(info.FilePath) || err != nil || !filepath.IsLocal(rel) {
+				continue
+			}
+			if !tracked[filepath.ToSlash(rel)] {
+				removed = append(removed, filepath.ToSlash(rel))
+			}
+		}
+	}
+
+	for _, p := range removed {
+		err = r.RemoveDocumentChunksByFilePath(ctx, filepath.Join(repo.Dir, filepath.FromSlash(p)))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var matched []string
+	for _, p := range paths {
+		if match(p) {
+			matched = append(matched, p)
+		}
+	}
+	lastCommits, err := repo.LastCommits(ctx, indexed, matched)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	infos := make([]FileInfo, 0, len(matched))
+	commits := make(map[string]GitCommit, len(matched))
+	for _, p := range matched {
+		filePath := filepath.Join(repo.Dir, filepath.FromSlash(p))
+		infos = append(infos, FileInfo{
+			FilePath:    filePath,
+			FileName:    filepath.Base(filePath),
+			ProcessedAt: time.Now(),
+		})
+		if commit, ok := lastCommits[p]; ok {
+			commits[filePath] = commit
+		}
+	}
+	return infos, commits, nil
+}
+
+// SetCommit records the commit a document was indexed at on its chunks
+func (d *Document) SetCommit(commit GitCommit) {
+	for _, chunk := range d.Chunks {
+		chunk.CommitSHA = commit.SHA
+		date := commit.Date.UTC()
+		chunk.CommitDate = &date
+	}
+}
+
+// FormatCommit returns the abbreviated commit and author date of a chunk like "commit 1a2b3c4 of
+// 2026-10-01", empty for chunks not indexed from a git repository
+func FormatCommit(sha string, date *time.Time) string {
+	if sha == "" {
+		return ""
+	}
+	if len(sha) > 7 {
+		sha = sha[:7]
+	}
+	if date == nil {
+		return "commit " + sha
+	}
+	return fmt.Sprintf("commit %s of %s", sha, date.UTC().Format(time.DateOnly))
+}
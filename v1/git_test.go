@@ -0,0 +1,250 @@
+package rag
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRepo is a git repository in a temporary directory committing with fixed author dates
+type testRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repo := &testRepo{t: t, dir: t.TempDir()}
+	repo.git("init", "-q")
+	return repo
+}
+
+func (r *testRepo) git(args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", r.dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.CombinedOutput()
+	require.NoError(r.t, err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+func (r *testRepo) write(path, text string) {
+	path = filepath.Join(r.dir, path)
+	require.NoError(r.t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(r.t, os.WriteFile(path, []byte(text), 0644))
+}
+
+// commit commits all changes authored at date and returns the commit
+func (r *testRepo) commit(date time.Time) string {
+	r.git("add", "-A")
+	r.git("commit", "-q", "-m", "change", "--date", date.Format(time.RFC3339))
+	return r.git("rev-parse", "HEAD")
+}
+
+func TestGitRepo(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepo(t)
+	_, err := OpenGitRepo(ctx, repo.dir)
+	assert.Error(t, err)
+
+	first := time.Date(2026, 3, 1, 10, 0, 0, 0, time.FixedZone("CET", 3600))
+	repo.write("a.md", "# A\n\nFirst.\n")
+	repo.write("b.md", "# B\n\nStays the same.\n")
+	repo.write("docs/c.md", "# C\n")
+	commit1 := repo.commit(first)
+	repo.write("a.md", "# A\n\nSecond.\n")
+	repo.git("mv", "b.md", "docs/b.md")
+	repo.git("rm", "-q", "docs/c.md")
+	repo.write("d.md", "# D\n")
+	commit2 := repo.commit(first.Add(24 * time.Hour))
+
+	g, err := OpenGitRepo(ctx, repo.dir)
+	require.NoError(t, err)
+	assert.Equal(t, commit2, g.Head)
+	assert.True(t, g.HasCommit(ctx, commit1))
+	assert.False(t, g.HasCommit(ctx, strings.Repeat("0", 40)))
+
+	files, err := g.Files(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.md", "d.md", "docs/b.md"}, files)
+
+	changes, err := g.Diff(ctx, commit1)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []GitChange{
+		{Status: 'M', Path: "a.md"},
+		{Status: 'A', Path: "d.md"},
+		{Status: 'R', Path: "docs/b.md", OldPath: "b.md"},
+		{Status: 'D', Path: "docs/c.md"},
+	}, changes)
+
+	commits, err := g.LastCommits(ctx, "", []string{"a.md", "docs/b.md", "missing.md"})
+	require.NoError(t, err)
+	assert.Len(t, commits, 2)
+	assert.Equal(t, commit2, commits["a.md"].SHA)
+	assert.Equal(t, commit2, commits["docs/b.md"].SHA)
+	assert.True(t, commits["a.md"].Date.Equal(time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)))
+	commits, err = g.LastCommits(ctx, commit2, []string{"a.md"})
+	require.NoError(t, err)
+	assert.Empty(t, commits)
+
+	// Paths are relative to a directory in the work tree
+	sub, err := OpenGitRepo(ctx, filepath.Join(repo.dir, "docs"))
+	require.NoError(t, err)
+	files, err = sub.Files(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b.md"}, files)
+	changes, err = sub.Diff(ctx, commit1)
+	require.NoError(t, err)
+	assert.Len(t, changes, 2)
+
+	dirty, err := g.Dirty(ctx)
+	require.NoError(t, err)
+	assert.False(t, dirty)
+	repo.write("a.md", "# A\n\nUncommitted.\n")
+	dirty, err = g.Dirty(ctx)
+	require.NoError(t, err)
+	assert.True(t, dirty)
+}
+
+func TestFindGitFilesToProcess(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepo(t)
+	date := time.Date(2026, 9, 30, 8, 0, 0, 0, time.UTC)
+	repo.write("guide.md", "# Guide\n\nLeases expire after twelve seconds.\n")
+	repo.write("old.md", "# Old\n\nRenamed later.\n")
+	repo.write("gone.md", "# Gone\n\nDeleted later.\n")
+	repo.write("main.go", "package main\n")
+	commit1 := repo.commit(date)
+
+	store := newMemStore(3)
+	r := &RAG{Store: store}
+	chunker := newMarkdownChunker(1000, 1)
+	chunker.cwd = repo.dir
+	// match accepts the files of pattern like the glob of srag update
+	pattern := "*.md"
+	match := func(filePath string) bool { return filepath.Ext(filePath) == ".md" }
+	// update processes the changed files like srag update --git
+	update := func(force bool) []string {
+		g, err := OpenGitRepo(ctx, repo.dir)
+		require.NoError(t, err)
+		infos, commits, err := r.FindGitFilesToProcess(ctx, g, pattern, match, force)
+		require.NoError(t, err)
+		var paths []string
+		for _, info := range infos {
+			assert.Empty(t, info.FileHash)
+			doc, err := chunker.GetDocumentChunks(ctx, info.FilePath)
+			require.NoError(t, err)
+			doc.SetCommit(commits[info.FilePath])
+			require.NoError(t, r.RemoveDocumentChunksByFilePath(ctx, info.FilePath))
+			require.NoError(t, r.UpsertDocumentChunks(ctx, &doc))
+			require.NoError(t, r.UpdateProcessedFileHash(ctx, info.FilePath, doc.DocumentID))
+			rel, err := filepath.Rel(repo.dir, info.FilePath)
+			require.NoError(t, err)
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		require.NoError(t, r.SetIndexedCommit(ctx, g, pattern))
+		slices.Sort(paths)
+		return paths
+	}
+	chunks := func() map[string]DocumentChunk {
+		list, err := store.ListDocumentChunks(ctx, true)
+		require.NoError(t, err)
+		chunks := map[string]DocumentChunk{}
+		for _, chunk := range list {
+			chunks[chunk.FilePath] = chunk
+		}
+		return chunks
+	}
+
+	assert.Equal(t, []string{"gone.md", "guide.md", "old.md"}, update(false))
+	guide := chunks()["guide.md"]
+	assert.Equal(t, commit1, guide.CommitSHA)
+	require.NotNil(t, guide.CommitDate)
+	assert.Equal(t, date, *guide.CommitDate)
+	g, err := OpenGitRepo(ctx, repo.dir)
+	require.NoError(t, err)
+	indexed, indexedPattern, err := r.IndexedCommit(ctx, g)
+	require.NoError(t, err)
+	assert.Equal(t, commit1, indexed)
+	assert.Equal(t, "*.md", indexedPattern)
+
+	// Nothing changed
+	assert.Empty(t, update(false))
+
+	// Modified, renamed and deleted files
+	repo.write("guide.md", "# Guide\n\nLeases expire after a minute.\n")
+	repo.git("mv", "old.md", "new.md")
+	repo.git("rm", "-q", "gone.md")
+	repo.write("main.go", "package main\n\nfunc main() {}\n")
+	commit2 := repo.commit(date.Add(time.Hour))
+	assert.Equal(t, []string{"guide.md", "new.md"}, update(false))
+	current := chunks()
+	assert.Len(t, current, 2)
+	assert.Equal(t, "# Guide\n\nLeases expire after a minute.", current["guide.md"].Text)
+	assert.Equal(t, commit2, current["new.md"].CommitSHA)
+	assert.Equal(t, "guide.md (Guide), commit "+commit2[:7]+" of 2026-09-30",
+		newSource(1, current["guide.md"]).String())
+	assert.Contains(t, BuildCitationPrompt("When?", []DocumentChunk{current["guide.md"]}, DefaultSystemPrompt),
+		"(source: guide.md > Guide, commit "+commit2[:7]+" of 2026-09-30)")
+
+	// Only the files of the last commits are processed
+	repo.write("new.md", "# Old\n\nRenamed and changed.\n")
+	repo.commit(date.Add(2 * time.Hour))
+	assert.Equal(t, []string{"new.md"}, update(false))
+	assert.Equal(t, []string{"guide.md", "new.md"}, update(true))
+
+	// Widening the pattern processes the files it adds although they didn't change
+	pattern = "*.{md,go}"
+	match = func(filePath string) bool { return filepath.Ext(filePath) == ".md" || filepath.Ext(filePath) == ".go" }
+	assert.Equal(t, []string{"guide.md", "main.go", "new.md"}, update(false))
+	assert.Empty(t, update(false))
+	pattern = "*.md"
+	match = func(filePath string) bool { return filepath.Ext(filePath) == ".md" }
+	require.NoError(t, r.RemoveDocumentChunksByFilePath(ctx, filepath.Join(repo.dir, "main.go")))
+	assert.Equal(t, []string{"guide.md", "new.md"}, update(false))
+
+	// History rewritten, the indexed commit is unknown and all files are processed. Recorded files
+	// no longer tracked are removed.
+	require.NoError(t, store.SetMeta(ctx, gitCommitKey(repo.dir), strings.Repeat("1", 40)))
+	repo.git("rm", "-q", "new.md")
+	repo.commit(date.Add(3 * time.Hour))
+	assert.Equal(t, []string{"guide.md"}, update(false))
+	assert.Len(t, chunks(), 1)
+	info, err := store.GetProcessedFile(ctx, filepath.Join(repo.dir, "new.md"))
+	require.NoError(t, err)
+	assert.Nil(t, info)
+}
+
+func TestChunkCommitColumns(t *testing.T) {
+	ctx := context.Background()
+	date := time.Date(2026, 9, 30, 8, 0, 0, 0, time.UTC)
+	chunk := &DocumentChunk{ID: "c1", DocumentID: "d1", Text: "Leases expire.", FilePath: "guide.md",
+		CommitSHA: "0123456789abcdef0123456789abcdef01234567", CommitDate: &date}
+	store := newPlainDuckDBStore(t, 3)
+	require.NoError(t, store.UpsertDocumentChunks(ctx, []*DocumentChunk{chunk,
+		{ID: "c2", DocumentID: "d2", Text: "Not from git."}}))
+
+	stored, err := store.GetDocumentChunk(ctx, "c1")
+	require.NoError(t, err)
+	assert.Equal(t, chunk.CommitSHA, stored.CommitSHA)
+	require.NotNil(t, stored.CommitDate)
+	assert.True(t, date.Equal(*stored.CommitDate))
+	assert.Equal(t, "commit 0123456 of 2026-09-30", FormatCommit(stored.CommitSHA, stored.CommitDate))
+
+	stored, err = store.GetDocumentChunk(ctx, "c2")
+	require.NoError(t, err)
+	assert.Empty(t, stored.CommitSHA)
+	assert.Nil(t, stored.CommitDate)
+	assert.Empty(t, FormatCommit(stored.CommitSHA, stored.CommitDate))
+}
@@ -0,0 +1,108 @@
+package rag
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+// goLoader finds the declarations of Go files with go/parser, files that don't parse fall back to
+// the brace heuristics of other languages
+type goLoader struct{}
+
+func (l goLoader) Load(ctx context.Context, filePath string) (*LoadedFile, error) {
+	return loadFromStream(ctx, l, filePath)
+}
+
+func (goLoader) LoadStream(_ context.Context, r io.Reader) (*LoadedFile, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text := string(buf)
+	symbols, err := goSymbols(buf)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to parse Go file, splitting by braces")
+		symbols = braceSymbols(text, false)
+	}
+	return &LoadedFile{Text: text, Code: true, Symbols: symbols}, nil
+}
+
+// goSymbols returns the package clause with the imports, and the top-level declarations of a Go
+// file with their doc comments. Grouped declarations are a symbol named by all their names.
+func goSymbols(src []byte) ([]CodeSymbol, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	offset := func(pos token.Pos) int {
+		return utf8.RuneCount(src[:fset.Position(pos).Offset])
+	}
+	span := func(doc *ast.CommentGroup, node ast.Node) (int, int) {
+		start := node.Pos()
+		if doc != nil {
+			start = doc.Pos()
+		}
+		return offset(start), offset(node.End())
+	}
+
+	// The package clause keeps the license and package comments above it
+	header := CodeSymbol{Name: f.Name.Name, Kind: "package", End: offset(f.Name.End())}
+	var symbols []CodeSymbol
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			symbol := CodeSymbol{Name: d.Name.Name, Kind: "func"}
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				symbol.Name = receiverType(d.Recv.List[0].Type) + "." + d.Name.Name
+				symbol.Kind = "method"
+			}
+			symbol.Start, symbol.End = span(d.Doc, d)
+			symbols = append(symbols, symbol)
+		case *ast.GenDecl:
+			if d.Tok == token.IMPORT {
+				header.End = offset(d.End())
+				continue
+			}
+			var names []string
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					names = append(names, s.Name.Name)
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						names = append(names, name.Name)
+					}
+				}
+			}
+			symbol := CodeSymbol{Name: strings.Join(names, ", "), Kind: d.Tok.String()}
+			symbol.Start, symbol.End = span(d.Doc, d)
+			symbols = append(symbols, symbol)
+		}
+	}
+	return append([]CodeSymbol{header}, symbols...), nil
+}
+
+// receiverType returns the type name of a method receiver without pointer and type parameters
+func receiverType(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverType(t.X)
+	case *ast.IndexExpr:
+		return receiverType(t.X)
+	case *ast.IndexListExpr:
+		return receiverType(t.X)
+	case *ast.ParenExpr:
+		return receiverType(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
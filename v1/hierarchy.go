@@ -0,0 +1,239 @@
+package rag
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Expansions of the selected chunks, see AskParameter.Expand
+const (
+	ExpandParent    = "parent"
+	ExpandNeighbors = "neighbors"
+)
+
+// paragraphBreakPattern matches the blank lines between paragraphs
+var paragraphBreakPattern = regexp.MustCompile(`\n[ \t]*\n\s*`)
+
+// sectionStarts returns the rune offsets where the sections of content start, split like
+// splitIntoSections does: at headings, or at paragraphs in content without headings
+func sectionStarts(content string) []int {
+	starts := []int{0}
+	add := func(offset int) {
+		if offset > 0 && offset < len(content) {
+			starts = append(starts, utf8.RuneCountInString(content[:offset]))
+		}
+	}
+	if headings := sectionHeaderPattern.FindAllStringIndex(content, -1); len(headings) > 0 {
+		for _, match := range headings {
+			add(match[0])
+		}
+	} else {
+		for _, match := range paragraphBreakPattern.FindAllStringIndex(content, -1) {
+			add(match[1])
+		}
+	}
+	return starts
+}
+
+// linkParents groups consecutive chunks into parent sections for small-to-big retrieval. Whole
+// sections are packed up to ParentChunkSize, larger sections are split between their chunks.
+// A parent is the span of content its chunks cover, a chunk alone in its group has no parent.
+// Parents are appended after the chunks and numbered on their own.
+func (c *DocumentChunker) linkParents(content string, chunks []*DocumentChunk) []*DocumentChunk {
+	runes := []rune(content)
+	starts := sectionStarts(content)
+	sectionEnd := func(offset int) int {
+		if i := sort.SearchInts(starts, offset+1); i < len(starts) {
+			return starts[i]
+		}
+		return len(runes)
+	}
+	fits := func(start, end int) bool {
+		return c.size(string(runes[start:end])) <= c.config.ParentChunkSize
+	}
+
+	var groups [][]*DocumentChunk
+	for _, chunk := range chunks {
+		if chunk.EndOffset <= chunk.StartOffset || chunk.EndOffset > len(runes) {
+			// Not located in the content, nothing to take the parent from
+			groups = append(groups, nil)
+			continue
+		}
+		if n := len(groups); n > 0 && len(groups[n-1]) > 0 {
+			group := groups[n-1]
+			first, last := group[0], group[len(group)-1]
+			end := max(chunk.EndOffset, last.EndOffset)
+			if sectionEnd(last.StartOffset) <= chunk.StartOffset {
+				// Another section only joins if all of it fits
+				end = max(end, sectionEnd(chunk.StartOffset))
+			}
+			if fits(first.StartOffset, end) {
+				groups[n-1] = append(group, chunk)
+				continue
+			}
+		}
+		groups = append(groups, []*DocumentChunk{chunk})
+	}
+
+	var parents []*DocumentChunk
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		start, end := group[0].StartOffset, group[0].EndOffset
+		for _, chunk := range group {
+			end = max(end, chunk.EndOffset)
+		}
+		parent := &DocumentChunk{
+			Text:        string(runes[start:end]),
+			Index:       len(parents),
+			StartOffset: start,
+			EndOffset:   end,
+			HeadingPath: group[0].HeadingPath,
+			IsParent:    true,
+		}
+		parent.ID = CalculateStringHash(parent.Text)
+		for _, chunk := range group {
+			chunk.ParentID = parent.ID
+		}
+		parents = append(parents, parent)
+	}
+	return append(chunks, parents...)
+}
+
+// ValidateExpand checks an AskParameter.Expand value
+func ValidateExpand(expand string) error {
+	switch expand {
+	case "", ExpandParent, ExpandNeighbors:
+		return nil
+	}
+	return fmt.Errorf("unknown expansion %q, expected %s or %s", expand, ExpandParent, ExpandNeighbors)
+}
+
+// ExpandChunks replaces selected chunks with the context around them for the answer: with
+// ExpandParent by their parent sections without duplicates, with ExpandNeighbors by the runs of
+// chunks up to p.Neighbors indexes away, overlapping runs merged. An expanded chunk keeps the ID,
+// ranks and scores of the best ranked chunk in it, chunks without parent are kept as they are.
+func (r *RAG) ExpandChunks(ctx context.Context, p *AskParameter, chunks []DocumentChunk) ([]DocumentChunk, error) {
+	err := ValidateExpand(p.Expand)
+	if err != nil {
+		return nil, err
+	}
+	switch p.Expand {
+	case ExpandParent:
+		return r.expandParents(ctx, chunks)
+	case ExpandNeighbors:
+		return r.expandNeighbors(ctx, chunks, p.Neighbors)
+	}
+	return chunks, nil
+}
+
+func (r *RAG) expandParents(ctx context.Context, chunks []DocumentChunk) ([]DocumentChunk, error) {
+	var expanded []DocumentChunk
+	seen := make(map[string]bool)
+	for _, chunk := range chunks {
+		if chunk.ParentID == "" {
+			expanded = append(expanded, chunk)
+			continue
+		}
+		if seen[chunk.ParentID] {
+			continue
+		}
+		seen[chunk.ParentID] = true
+
+		parent, err := r.Store.GetDocumentChunk(ctx, chunk.ParentID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Reindexed since retrieval
+			expanded = append(expanded, chunk)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, withRetrieval(*parent, chunk))
+	}
+	return expanded, nil
+}
+
+func (r *RAG) expandNeighbors(ctx context.Context, chunks []DocumentChunk, neighbors int) ([]DocumentChunk, error) {
+	// Runs of indexes per document, best is the position of the best ranked chunk in the run
+	type run struct {
+		from, to, best int
+	}
+	positions := make(map[string][]int)
+	for i, chunk := range chunks {
+		positions[chunk.DocumentID] = append(positions[chunk.DocumentID], i)
+	}
+	var runs []run
+	for documentID, selected := range positions {
+		if documentID == "" {
+			for _, i := range selected {
+				runs = append(runs, run{from: -1, best: i})
+			}
+			continue
+		}
+		sort.Slice(selected, func(a, b int) bool { return chunks[selected[a]].Index < chunks[selected[b]].Index })
+		current := run{from: -1}
+		for _, i := range selected {
+			from, to := max(chunks[i].Index-neighbors, 0), chunks[i].Index+neighbors
+			if current.from >= 0 && from <= current.to+1 {
+				current.to = max(current.to, to)
+				current.best = min(current.best, i)
+				continue
+			}
+			if current.from >= 0 {
+				runs = append(runs, current)
+			}
+			current = run{from: from, to: to, best: i}
+		}
+		runs = append(runs, current)
+	}
+	sort.Slice(runs, func(a, b int) bool { return runs[a].best < runs[b].best })
+
+	expanded := make([]DocumentChunk, 0, len(runs))
+	for _, run := range runs {
+		chunk := chunks[run.best]
+		if run.from < 0 {
+			// Chunks indexed before provenance have no document to look in
+			expanded = append(expanded, chunk)
+			continue
+		}
+		window, err := r.Store.ListChunksByIndex(ctx, chunk.DocumentID, run.from, run.to)
+		if err != nil {
+			return nil, err
+		}
+		if len(window) == 0 {
+			expanded = append(expanded, chunk)
+			continue
+		}
+
+		texts := make([]string, len(window))
+		merged := window[0]
+		for i, c := range window {
+			texts[i] = c.Text
+			merged.EndOffset = max(merged.EndOffset, c.EndOffset)
+		}
+		merged.Text = strings.Join(texts, "\n")
+		merged.ID, merged.Index, merged.ParentID = chunk.ID, chunk.Index, chunk.ParentID
+		expanded = append(expanded, withRetrieval(merged, chunk))
+	}
+	return expanded, nil
+}
+
+// withRetrieval returns expanded with the retrieval results of chunk
+func withRetrieval(expanded DocumentChunk, chunk DocumentChunk) DocumentChunk {
+	expanded.Embedding = nil
+	expanded.Distance = chunk.Distance
+	expanded.Score = chunk.Score
+	expanded.KeywordScore = chunk.KeywordScore
+	expanded.FusionScore = chunk.FusionScore
+	expanded.RetrievalRank = chunk.RetrievalRank
+	expanded.RerankRank = chunk.RerankRank
+	return expanded
+}
@@ -0,0 +1,146 @@
+package rag
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkParents(t *testing.T) {
+	ctx := context.Background()
+	content := "# Install\n\n" + strings.Repeat("Download the release. ", 6) + "\n\n" +
+		strings.Repeat("Unpack the archive. ", 6) + "\n\n# Usage\n\nRun it.\n\n# FAQ\n\n" +
+		strings.Repeat("Why not? ", 40)
+
+	c := newMarkdownChunker(80, 1)
+	c.config.ParentChunkSize = 400
+	doc, err := c.ChunkDocument(ctx, content, "guide.md")
+	require.NoError(t, err)
+
+	var children, parents []*DocumentChunk
+	for _, chunk := range doc.Chunks {
+		if chunk.IsParent {
+			parents = append(parents, chunk)
+		} else {
+			children = append(children, chunk)
+		}
+	}
+	assertVerbatim(t, content, children)
+	assertVerbatim(t, content, parents)
+
+	// Install and Usage fit in one parent, FAQ is split between parents
+	require.GreaterOrEqual(t, len(parents), 2)
+	assert.True(t, strings.HasPrefix(parents[0].Text, "# Install"))
+	assert.Contains(t, parents[0].Text, "Run it.")
+	assert.NotContains(t, parents[0].Text, "# FAQ")
+	byID := make(map[string]*DocumentChunk)
+	for _, parent := range parents {
+		assert.LessOrEqual(t, c.size(parent.Text), 400)
+		assert.Equal(t, CalculateStringHash(parent.Text), parent.ID)
+		assert.Empty(t, parent.ParentID)
+		byID[parent.ID] = parent
+	}
+	for _, child := range children {
+		if child.ParentID == "" {
+			continue
+		}
+		parent := byID[child.ParentID]
+		require.NotNil(t, parent, child.Text)
+		assert.GreaterOrEqual(t, child.StartOffset, parent.StartOffset)
+		assert.LessOrEqual(t, child.EndOffset, parent.EndOffset)
+	}
+
+	// A chunk alone in its section has no parent
+	c.config.MaxChunkSize = 1000
+	doc, err = c.ChunkDocument(ctx, "# One\n\nShort.", "one.md")
+	require.NoError(t, err)
+	require.Len(t, doc.Chunks, 1)
+	assert.Empty(t, doc.Chunks[0].ParentID)
+}
+
+func TestExpandChunks(t *testing.T) {
+	ctx := context.Background()
+	chunk := func(index int, parentID string) DocumentChunk {
+		return DocumentChunk{ID: "c" + string(rune('0'+index)), DocumentID: "doc", Text: "chunk " + string(rune('0'+index)),
+			Index: index, ParentID: parentID}
+	}
+	stored := []DocumentChunk{chunk(0, "p0"), chunk(1, "p0"), chunk(2, "p1"), chunk(3, "p1"), chunk(4, ""), chunk(5, ""),
+		{ID: "p0", DocumentID: "doc", Text: "chunk 0\nchunk 1", IsParent: true},
+		{ID: "p1", DocumentID: "doc", Text: "chunk 2\nchunk 3", Index: 1, IsParent: true}}
+	r, _ := newTestRAG("", stored...)
+
+	selected := []DocumentChunk{chunk(3, "p1"), chunk(0, "p0"), chunk(2, "p1"), chunk(5, ""), chunk(4, "gone")}
+	for i := range selected {
+		selected[i].RetrievalRank = i + 1
+		selected[i].FusionScore = 1 / float64(i+1)
+	}
+
+	// Unchanged without expansion
+	expanded, err := r.ExpandChunks(ctx, &AskParameter{}, selected)
+	require.NoError(t, err)
+	assert.Equal(t, selected, expanded)
+
+	// Parents in the order of their best child, without duplicates
+	expanded, err = r.ExpandChunks(ctx, &AskParameter{Expand: ExpandParent}, selected)
+	require.NoError(t, err)
+	require.Len(t, expanded, 4)
+	assert.Equal(t, []string{"p1", "p0", "c5", "c4"},
+		[]string{expanded[0].ID, expanded[1].ID, expanded[2].ID, expanded[3].ID})
+	assert.Equal(t, "chunk 2\nchunk 3", expanded[0].Text)
+	assert.Equal(t, 1, expanded[0].RetrievalRank)
+	assert.Equal(t, 2, expanded[1].RetrievalRank)
+	assert.Equal(t, 0.5, expanded[1].FusionScore)
+
+	// With one neighbor 0 and 2,3 merge into one run, 4 joins it
+	expanded, err = r.ExpandChunks(ctx, &AskParameter{Expand: ExpandNeighbors, Neighbors: 1}, selected[:3])
+	require.NoError(t, err)
+	require.Len(t, expanded, 1)
+	assert.Equal(t, "chunk 0\nchunk 1\nchunk 2\nchunk 3\nchunk 4", expanded[0].Text)
+	assert.Equal(t, "c3", expanded[0].ID)
+	assert.Equal(t, 1, expanded[0].RetrievalRank)
+
+	// Without neighbors, runs are the selected chunks in rank order
+	expanded, err = r.ExpandChunks(ctx, &AskParameter{Expand: ExpandNeighbors}, []DocumentChunk{chunk(5, ""), chunk(0, "p0")})
+	require.NoError(t, err)
+	require.Len(t, expanded, 2)
+	assert.Equal(t, "chunk 5", expanded[0].Text)
+	assert.Equal(t, "chunk 0", expanded[1].Text)
+
+	_, err = r.ExpandChunks(ctx, &AskParameter{Expand: "section"}, selected)
+	assert.Error(t, err)
+}
+
+func TestDuckDBParentChunks(t *testing.T) {
+	ctx := context.Background()
+	store := newPlainDuckDBStore(t, 8)
+
+	chunks := []*DocumentChunk{
+		{ID: "c0", DocumentID: "doc", Text: "chunk 0", Index: 0, ParentID: "p0"},
+		{ID: "c1", DocumentID: "doc", Text: "chunk 1", Index: 1, ParentID: "p0"},
+		{ID: "c2", DocumentID: "doc", Text: "chunk 2", Index: 2},
+		{ID: "p0", DocumentID: "doc", Text: "chunk 0\nchunk 1", Index: 0, IsParent: true},
+	}
+	require.NoError(t, store.UpsertDocumentChunks(ctx, chunks))
+
+	listed, err := store.ListDocumentChunks(ctx, true)
+	require.NoError(t, err)
+	assert.Len(t, listed, 3)
+	for _, chunk := range listed {
+		assert.False(t, chunk.IsParent)
+	}
+
+	window, err := store.ListChunksByIndex(ctx, "doc", 0, 1)
+	require.NoError(t, err)
+	require.Len(t, window, 2)
+	assert.Equal(t, "c0", window[0].ID)
+	assert.Equal(t, "p0", window[0].ParentID)
+	assert.Equal(t, "c1", window[1].ID)
+
+	parent, err := store.GetDocumentChunk(ctx, "p0")
+	require.NoError(t, err)
+	assert.True(t, parent.IsParent)
+	assert.Equal(t, "chunk 0\nchunk 1", parent.Text)
+}
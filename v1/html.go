@@ -0,0 +1,325 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlLoader converts HTML files to markdown, see htmlToMarkdown
+type htmlLoader struct{}
+
+func (l htmlLoader) Load(ctx context.Context, filePath string) (*LoadedFile, error) {
+	return loadFromStream(ctx, l, filePath)
+}
+
+func (htmlLoader) LoadStream(_ context.Context, r io.Reader) (*LoadedFile, error) {
+	return loadHTML(r)
+}
+
+func loadHTML(r io.Reader) (*LoadedFile, error) {
+	text, err := htmlToMarkdown(r)
+	if err != nil {
+		return nil, err
+	}
+	return &LoadedFile{Text: text}, nil
+}
+
+// htmlBoilerplate are elements never part of the content of a page
+var htmlBoilerplate = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true,
+	atom.Nav: true, atom.Header: true, atom.Footer: true, atom.Aside: true,
+	atom.Form: true, atom.Button: true, atom.Svg: true, atom.Iframe: true,
+	atom.Img: true, atom.Head: true,
+}
+
+// htmlBoilerplateRoles are ARIA landmarks of navigation and page chrome
+var htmlBoilerplateRoles = map[string]bool{
+	"navigation": true, "banner": true, "contentinfo": true, "search": true, "complementary": true,
+}
+
+var inlineSpacePattern = regexp.MustCompile(`\s+`)
+
+// htmlToMarkdown converts the content of an HTML page to markdown with the structure the markdown
+// chunker splits on: headings, paragraphs, lists, tables and fenced code. Navigation, headers,
+// footers and scripts are dropped, and only the main element or article is kept if there is one.
+// Pages without h1 get their title as heading.
+func htmlToMarkdown(r io.Reader) (string, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return "", err
+	}
+
+	root := findElement(doc, atom.Main)
+	if root == nil {
+		root = findElement(doc, atom.Article)
+	}
+	if root == nil {
+		root = doc
+	}
+
+	w := &markdownWriter{content: root != doc}
+	if title := findElement(doc, atom.Title); title != nil && findElement(root, atom.H1) == nil {
+		if text := collapseSpace(textContent(title)); text != "" {
+			w.block("# " + text)
+		}
+	}
+	w.blocks(root, "")
+	return strings.TrimSpace(w.b.String()) + "\n", nil
+}
+
+// markdownWriter writes the blocks of an HTML tree separated by blank lines
+type markdownWriter struct {
+	b       bytes.Buffer
+	content bool // Writing a main element or article, their headers are content
+}
+
+func (w *markdownWriter) block(text string) {
+	if text = strings.TrimRight(text, " \n"); text == "" {
+		return
+	}
+	if w.b.Len() > 0 {
+		w.b.WriteString("\n\n")
+	}
+	w.b.WriteString(text)
+}
+
+// blocks writes the block content of n, indent prefixes the lines of nested list items
+func (w *markdownWriter) blocks(n *html.Node, indent string) {
+	var inline strings.Builder
+	flush := func() {
+		if text := collapseSpace(inline.String()); text != "" {
+			w.block(indent + text)
+		}
+		inline.Reset()
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if w.content && c.DataAtom == atom.Header {
+			flush()
+			w.blocks(c, indent)
+			continue
+		}
+		if skipNode(c) {
+			continue
+		}
+		if c.Type != html.ElementNode || !isBlock(c.DataAtom) {
+			writeInline(&inline, c)
+			continue
+		}
+
+		flush()
+		switch c.DataAtom {
+		case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+			level := int(c.Data[1] - '0')
+			w.block(strings.Repeat("#", level) + " " + collapseSpace(inlineText(c)))
+		case atom.Ul, atom.Ol:
+			w.list(c, indent)
+		case atom.Pre:
+			w.block(indent + codeFence(c))
+		case atom.Table:
+			w.block(table(c))
+		case atom.Blockquote:
+			inner := &markdownWriter{content: w.content}
+			inner.blocks(c, "")
+			quoted := strings.ReplaceAll(strings.TrimSpace(inner.b.String()), "\n", "\n> ")
+			w.block(indent + "> " + quoted)
+		case atom.Hr:
+		default:
+			w.blocks(c, indent)
+		}
+	}
+	flush()
+}
+
+// list writes the items of a ul or ol, nested lists are indented below their item
+func (w *markdownWriter) list(n *html.Node, indent string) {
+	var items []string
+	for item := n.FirstChild; item != nil; item = item.NextSibling {
+		if item.Type != html.ElementNode || item.DataAtom != atom.Li {
+			continue
+		}
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = fmt.Sprintf("%d. ", len(items)+1)
+		}
+
+		inner := &markdownWriter{content: w.content}
+		inner.blocks(item, "")
+		var lines []string
+		for i, line := range strings.Split(strings.TrimSpace(inner.b.String()), "\n") {
+			switch {
+			case i == 0:
+				lines = append(lines, indent+marker+line)
+			case line != "":
+				lines = append(lines, indent+strings.Repeat(" ", len(marker))+line)
+			}
+		}
+		items = append(items, strings.Join(lines, "\n"))
+	}
+	w.block(strings.Join(items, "\n"))
+}
+
+// codeFence returns a pre element as fenced code, the language is taken from a language-* class
+func codeFence(pre *html.Node) string {
+	language := ""
+	for n := pre; n != nil; n = n.FirstChild {
+		for _, class := range strings.Fields(attr(n, "class")) {
+			if l, ok := strings.CutPrefix(class, "language-"); ok {
+				language = l
+			}
+		}
+		if n.FirstChild == nil || n.FirstChild != n.LastChild {
+			break
+		}
+	}
+	code := strings.Trim(textContent(pre), "\n")
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	return fence + language + "\n" + code + "\n" + fence
+}
+
+// table returns a table as a pipe table, the first row is the header
+func table(n *html.Node) string {
+	var rows [][]string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			if c.DataAtom != atom.Tr {
+				walk(c)
+				continue
+			}
+			var row []string
+			for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.DataAtom == atom.Th || cell.DataAtom == atom.Td) {
+					row = append(row, strings.ReplaceAll(collapseSpace(inlineText(cell)), "|", `\|`))
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	walk(n)
+	if len(rows) == 0 {
+		return ""
+	}
+
+	columns := 0
+	for _, row := range rows {
+		columns = max(columns, len(row))
+	}
+	var b strings.Builder
+	for i, row := range rows {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		b.WriteString("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			b.WriteString(strings.Repeat("| --- ", columns) + "|\n")
+		}
+	}
+	return b.String()
+}
+
+// writeInline writes the text of an inline node, code spans keep their backticks
+func writeInline(b *strings.Builder, n *html.Node) {
+	switch {
+	case n.Type == html.TextNode:
+		b.WriteString(n.Data)
+	case n.Type != html.ElementNode:
+	case n.DataAtom == atom.Br:
+		b.WriteString(" ")
+	case n.DataAtom == atom.Code:
+		b.WriteString("`" + textContent(n) + "`")
+	default:
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if !skipNode(c) {
+				writeInline(b, c)
+			}
+		}
+	}
+}
+
+func inlineText(n *html.Node) string {
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if !skipNode(c) {
+			writeInline(&b, c)
+		}
+	}
+	return b.String()
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(textContent(c))
+	}
+	return b.String()
+}
+
+func collapseSpace(s string) string {
+	return strings.TrimSpace(inlineSpacePattern.ReplaceAllString(s, " "))
+}
+
+func skipNode(n *html.Node) bool {
+	if n.Type == html.CommentNode {
+		return true
+	}
+	if n.Type != html.ElementNode {
+		return false
+	}
+	_, hidden := attrValue(n, "hidden")
+	return htmlBoilerplate[n.DataAtom] || htmlBoilerplateRoles[attr(n, "role")] || hidden ||
+		attr(n, "aria-hidden") == "true"
+}
+
+func isBlock(a atom.Atom) bool {
+	switch a {
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Main, atom.Body, atom.Html,
+		atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Ul, atom.Ol, atom.Li, atom.Pre,
+		atom.Table, atom.Blockquote, atom.Hr, atom.Dl, atom.Dt, atom.Dd, atom.Figure, atom.Figcaption,
+		atom.Details, atom.Summary:
+		return true
+	}
+	return false
+}
+
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func attr(n *html.Node, key string) string {
+	value, _ := attrValue(n, key)
+	return value
+}
+
+func attrValue(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
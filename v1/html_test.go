@@ -0,0 +1,129 @@
+package rag
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testHTMLPage = `<!DOCTYPE html>
+<html>
+<head><title>Locks - Docs</title><style>body { color: red }</style></head>
+<body>
+<header><a href="/">Home</a></header>
+<nav><ul><li><a href="/a">Guide</a></li><li><a href="/b">API</a></li></ul></nav>
+<div class="sidebar" role="complementary">Related pages</div>
+<main>
+  <h2>Acquiring a lock</h2>
+  <p>Call <code>Acquire</code> with a
+     <em>lease</em>.<br>It blocks.</p>
+  <ul>
+    <li>Exclusive locks
+      <ol><li>one writer</li><li>no readers</li></ol>
+    </li>
+    <li>Shared locks</li>
+  </ul>
+  <pre><code class="language-go">l.Acquire(ctx)
+defer l.Release()</code></pre>
+  <table>
+    <thead><tr><th>Mode</th><th>Holders</th></tr></thead>
+    <tbody><tr><td>exclusive</td><td>1</td></tr><tr><td>shared | read</td><td>many</td></tr></tbody>
+  </table>
+  <blockquote><p>Leases expire.</p></blockquote>
+  <div hidden>Hidden text</div>
+  <script>track()</script>
+</main>
+<footer>Copyright</footer>
+</body>
+</html>`
+
+func TestHTMLToMarkdown(t *testing.T) {
+	text, err := htmlToMarkdown(strings.NewReader(testHTMLPage))
+	require.NoError(t, err)
+	assert.Equal(t, "# Locks - Docs\n\n"+
+		"## Acquiring a lock\n\n"+
+		"Call `Acquire` with a lease. It blocks.\n\n"+
+		"- Exclusive locks\n  1. one writer\n  2. no readers\n- Shared locks\n\n"+
+		"```go\nl.Acquire(ctx)\ndefer l.Release()\n```\n\n"+
+		"| Mode | Holders |\n| --- | --- |\n| exclusive | 1 |\n| shared \\| read | many |\n\n"+
+		"> Leases expire.\n", text)
+
+	// Without main or article the body is converted and its h1 is kept
+	text, err = htmlToMarkdown(strings.NewReader(`<html><head><title>Title</title></head><body>
+		<nav>Menu</nav><div><h1>Heading</h1>Loose <b>text</b><p>Paragraph</p></div></body></html>`))
+	require.NoError(t, err)
+	assert.Equal(t, "# Heading\n\nLoose text\n\nParagraph\n", text)
+
+	// The header of an article is content
+	text, err = htmlToMarkdown(strings.NewReader(`<body><header>Site</header>
+		<article><header><h1>Post</h1></header><p>Body</p></article></body>`))
+	require.NoError(t, err)
+	assert.Equal(t, "# Post\n\nBody\n", text)
+}
+
+func TestChunkHTML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.html")
+	require.NoError(t, os.WriteFile(path, []byte(testHTMLPage), 0644))
+	assert.IsType(t, htmlLoader{}, LoaderFor("index.HTM"))
+
+	c := newMarkdownChunker(60, 1)
+	doc, err := c.GetDocumentChunks(context.Background(), path)
+	require.NoError(t, err)
+	require.NotEmpty(t, doc.Chunks)
+	for _, chunk := range doc.Chunks {
+		assert.NotContains(t, chunk.Text, "Guide")
+		assert.NotContains(t, chunk.Text, "Copyright")
+	}
+	last := doc.Chunks[len(doc.Chunks)-1]
+	assert.Equal(t, "Locks - Docs > Acquiring a lock", last.HeadingPath)
+	assert.Contains(t, last.Text, "Leases expire.")
+}
+
+func TestUpdateHTMLFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "locks.html")
+	store := newMemStore(3)
+	r := &RAG{Store: store}
+	c := newMarkdownChunker(1000, 1)
+	// update processes the changed files like srag update
+	update := func() {
+		infos, err := r.FindFilesToProcess(ctx, []string{path}, false)
+		require.NoError(t, err)
+		for _, info := range infos {
+			doc, err := c.GetDocumentChunks(ctx, info.FilePath)
+			require.NoError(t, err)
+			assert.Equal(t, info.FileHash, doc.DocumentID)
+			require.NoError(t, r.RemoveDocumentChunksByFilePath(ctx, info.FilePath))
+			require.NoError(t, r.UpsertDocumentChunks(ctx, &doc))
+			require.NoError(t, r.UpdateProcessedFileHash(ctx, info.FilePath, info.FileHash))
+		}
+	}
+	texts := func() []string {
+		chunks, err := store.ListDocumentChunks(ctx, true)
+		require.NoError(t, err)
+		var texts []string
+		for _, chunk := range chunks {
+			texts = append(texts, chunk.Text)
+		}
+		return texts
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("<main><h1>Locks</h1><p>Leases expire after twelve seconds.</p></main>"), 0644))
+	update()
+	assert.Equal(t, []string{"# Locks\n\nLeases expire after twelve seconds."}, texts())
+
+	// The chunks of the converted text of the previous version are replaced
+	require.NoError(t, os.WriteFile(path, []byte("<main><h1>Locks</h1><p>Leases expire after a minute.</p></main>"), 0644))
+	update()
+	assert.Equal(t, []string{"# Locks\n\nLeases expire after a minute."}, texts())
+
+	require.NoError(t, os.Remove(path))
+	_, err := r.FindFilesToProcess(ctx, nil, false)
+	require.NoError(t, err)
+	assert.Empty(t, texts())
+}
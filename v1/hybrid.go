@@ -0,0 +1,87 @@
+package rag
+
+import (
+	"sort"
+)
+
+// rrfK is the rank constant of reciprocal-rank fusion, it damps the influence of top ranks
+const rrfK = 60
+
+const (
+	DefaultVectorWeight  = 1.0
+	DefaultKeywordWeight = 1.0
+)
+
+// rankedChunks is a single retrieval channel result, ordered from best to worst
+type rankedChunks struct {
+	chunks []DocumentChunk
+	weight float64
+}
+
+// fuseRankings merges ranked lists with weighted reciprocal-rank fusion:
+// score(d) = sum(weight / (rrfK + rank(d))), rank starting from 1.
+// The result has FusionScore and RetrievalRank filled in.
+func fuseRankings(limit int, lists ...rankedChunks) []DocumentChunk {
+	scores := make(map[string]float64)
+	chunks := make(map[string]DocumentChunk)
+	var ids []string
+
+	for _, list := range lists {
+		if list.weight <= 0 {
+			continue
+		}
+		for i, chunk := range list.chunks {
+			if existing, ok := chunks[chunk.ID]; !ok {
+				chunks[chunk.ID] = chunk
+				ids = append(ids, chunk.ID)
+			} else if chunk.KeywordScore != 0 {
+				existing.KeywordScore = chunk.KeywordScore
+				chunks[chunk.ID] = existing
+			}
+			scores[chunk.ID] += list.weight / float64(rrfK+i+1)
+		}
+	}
+
+	// Stable sort keeps the channel order for ties
+	sort.SliceStable(ids, func(i, j int) bool {
+		return scores[ids[i]] > scores[ids[j]]
+	})
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	result := make([]DocumentChunk, 0, len(ids))
+	for i, id := range ids {
+		chunk := chunks[id]
+		chunk.FusionScore = scores[id]
+		chunk.RetrievalRank = i + 1
+		result = append(result, chunk)
+	}
+	return result
+}
+
+// filterByScore drops chunks whose similarity score is below minScore and re-ranks the rest.
+// A non-positive minScore keeps everything.
+func filterByScore(chunks []DocumentChunk, minScore float64) []DocumentChunk {
+	if minScore <= 0 {
+		return chunks
+	}
+
+	kept := make([]DocumentChunk, 0, len(chunks))
+	for _, chunk := range chunks {
+		if chunk.Score < minScore {
+			continue
+		}
+		chunk.RetrievalRank = len(kept) + 1
+		kept = append(kept, chunk)
+	}
+	return kept
+}
+
+// FusionWeights returns the vector and keyword channel weights, both unset means defaults
+func (p *AskParameter) FusionWeights() (vector float64, keyword float64) {
+	if p.VectorWeight == 0 && p.KeywordWeight == 0 {
+		return DefaultVectorWeight, DefaultKeywordWeight
+	}
+	return p.VectorWeight, p.KeywordWeight
+}
@@ -0,0 +1,112 @@
+package rag
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func chunkIDs(chunks []DocumentChunk) []string {
+	ids := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		ids = append(ids, chunk.ID)
+	}
+	return ids
+}
+
+func chunksOf(ids ...string) []DocumentChunk {
+	chunks := make([]DocumentChunk, 0, len(ids))
+	for _, id := range ids {
+		chunks = append(chunks, DocumentChunk{ID: id, Text: "text of " + id})
+	}
+	return chunks
+}
+
+func TestFuseRankings(t *testing.T) {
+	t.Run("ChunksFoundByBothChannelsWin", func(t *testing.T) {
+		fused := fuseRankings(10,
+			rankedChunks{chunks: chunksOf("a", "b", "c"), weight: 1},
+			rankedChunks{chunks: chunksOf("c", "d"), weight: 1},
+		)
+		assert.Equal(t, []string{"c", "a", "b", "d"}, chunkIDs(fused))
+	})
+
+	t.Run("WeightsShiftTheRanking", func(t *testing.T) {
+		fused := fuseRankings(10,
+			rankedChunks{chunks: chunksOf("a", "b"), weight: 1},
+			rankedChunks{chunks: chunksOf("E1234"), weight: 3},
+		)
+		assert.Equal(t, []string{"E1234", "a", "b"}, chunkIDs(fused))
+	})
+
+	t.Run("ZeroWeightDisablesChannel", func(t *testing.T) {
+		fused := fuseRankings(10,
+			rankedChunks{chunks: chunksOf("a", "b"), weight: 1},
+			rankedChunks{chunks: chunksOf("x"), weight: 0},
+		)
+		assert.Equal(t, []string{"a", "b"}, chunkIDs(fused))
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		fused := fuseRankings(2,
+			rankedChunks{chunks: chunksOf("a", "b", "c"), weight: 1},
+			rankedChunks{chunks: chunksOf("d", "e"), weight: 1},
+		)
+		assert.Len(t, fused, 2)
+		assert.Equal(t, "text of a", fused[0].Text)
+	})
+}
+
+func TestFuseRankingsScores(t *testing.T) {
+	vector := chunksOf("a", "b")
+	vector[0].Score, vector[0].Distance = 0.9, 0.4
+	vector[1].Score, vector[1].Distance = 0.5, 1.0
+	keyword := chunksOf("b")
+	keyword[0].KeywordScore = 7.5
+
+	fused := fuseRankings(10,
+		rankedChunks{chunks: vector, weight: 1},
+		rankedChunks{chunks: keyword, weight: 1},
+	)
+	assert.Equal(t, []string{"b", "a"}, chunkIDs(fused))
+	assert.Equal(t, 1, fused[0].RetrievalRank)
+	assert.Equal(t, 2, fused[1].RetrievalRank)
+	assert.Equal(t, 7.5, fused[0].KeywordScore)
+	assert.Equal(t, 0.5, fused[0].Score)
+	assert.InDelta(t, 1.0/62+1.0/61, fused[0].FusionScore, 1e-9)
+	assert.InDelta(t, 1.0/61, fused[1].FusionScore, 1e-9)
+}
+
+func TestFilterByScore(t *testing.T) {
+	chunks := chunksOf("a", "b", "c")
+	chunks[0].Score, chunks[1].Score, chunks[2].Score = 0.8, 0.1, 0.5
+	for i := range chunks {
+		chunks[i].RetrievalRank = i + 1
+	}
+
+	assert.Equal(t, chunks, filterByScore(chunks, 0))
+
+	kept := filterByScore(chunks, 0.3)
+	assert.Equal(t, []string{"a", "c"}, chunkIDs(kept))
+	assert.Equal(t, 2, kept[1].RetrievalRank)
+}
+
+func TestWithRerankRanks(t *testing.T) {
+	chunks := chunksOf("a", "b")
+	ranked := withRerankRanks(chunks)
+	assert.Equal(t, 1, ranked[0].RerankRank)
+	assert.Equal(t, 2, ranked[1].RerankRank)
+	assert.Zero(t, chunks[0].RerankRank)
+}
+
+func TestAskParameterFusionWeights(t *testing.T) {
+	p := &AskParameter{}
+	vector, keyword := p.FusionWeights()
+	assert.Equal(t, DefaultVectorWeight, vector)
+	assert.Equal(t, DefaultKeywordWeight, keyword)
+
+	p = &AskParameter{VectorWeight: 1}
+	vector, keyword = p.FusionWeights()
+	assert.Equal(t, 1.0, vector)
+	assert.Equal(t, 0.0, keyword)
+}
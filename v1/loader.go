@@ -0,0 +1,174 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Loader extracts the text of a file for chunking
+type Loader interface {
+	Load(ctx context.Context, filePath string) (*LoadedFile, error)
+}
+
+// StreamLoader is a Loader that also reads files from a stream, such as objects of a bucket
+type StreamLoader interface {
+	Loader
+	LoadStream(ctx context.Context, r io.Reader) (*LoadedFile, error)
+}
+
+// LoadedFile is the text of a file, chunk offsets are relative to Text
+type LoadedFile struct {
+	Text    string
+	Pages   []int        // Rune offsets where pages 1, 2, ... start, empty for sources without pages
+	Code    bool         // Source code is chunked along its Symbols instead of by the chunking strategy
+	Symbols []CodeSymbol // Declarations of source code in order
+}
+
+// PageAt returns the 1-based page of the rune offset, 0 without pages
+func (f *LoadedFile) PageAt(offset int) int {
+	return sort.Search(len(f.Pages), func(i int) bool { return f.Pages[i] > offset })
+}
+
+var (
+	loadersMu sync.RWMutex
+	loaders   = map[string]Loader{
+		".pdf":  pdfLoader{},
+		".html": htmlLoader{},
+		".htm":  htmlLoader{},
+
+		// Source code
+		".go":    goLoader{},
+		".py":    codeLoader{indent: true, singleQuoteStrings: true},
+		".js":    codeLoader{singleQuoteStrings: true},
+		".jsx":   codeLoader{singleQuoteStrings: true},
+		".mjs":   codeLoader{singleQuoteStrings: true},
+		".ts":    codeLoader{singleQuoteStrings: true},
+		".tsx":   codeLoader{singleQuoteStrings: true},
+		".php":   codeLoader{singleQuoteStrings: true},
+		".c":     codeLoader{},
+		".h":     codeLoader{},
+		".cc":    codeLoader{},
+		".cpp":   codeLoader{},
+		".hpp":   codeLoader{},
+		".cs":    codeLoader{},
+		".java":  codeLoader{},
+		".kt":    codeLoader{},
+		".rs":    codeLoader{},
+		".scala": codeLoader{},
+		".swift": codeLoader{},
+	}
+)
+
+// RegisterLoader selects loader for files with the extension, e.g. ".pdf"
+func RegisterLoader(ext string, loader Loader) {
+	loadersMu.Lock()
+	defer loadersMu.Unlock()
+	loaders[strings.ToLower(ext)] = loader
+}
+
+// LoaderFor returns the loader for the extension of filePath, other files are read as text
+func LoaderFor(filePath string) Loader {
+	loadersMu.RLock()
+	defer loadersMu.RUnlock()
+	if loader, ok := loaders[strings.ToLower(filepath.Ext(filePath))]; ok {
+		return loader
+	}
+	return textLoader{}
+}
+
+// LoadFile loads filePath with the loader for its type
+func LoadFile(ctx context.Context, filePath string) (*LoadedFile, error) {
+	file, err := LoaderFor(filePath).Load(ctx, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", filePath, err)
+	}
+	return file, nil
+}
+
+// LoadStream loads the file named name from r with the loader for its type. Loaders registered
+// without stream support read a temporary copy.
+func LoadStream(ctx context.Context, name string, r io.Reader) (*LoadedFile, error) {
+	loader := LoaderFor(name)
+	if stream, ok := loader.(StreamLoader); ok {
+		file, err := stream.LoadStream(ctx, r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", name, err)
+		}
+		return file, nil
+	}
+
+	tmp, err := os.CreateTemp("", "srag-*"+filepath.Ext(name))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	file, err := loader.Load(ctx, tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", name, err)
+	}
+	return file, nil
+}
+
+// loadFromStream opens filePath for the stream of loader
+func loadFromStream(ctx context.Context, loader StreamLoader, filePath string) (*LoadedFile, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return loader.LoadStream(ctx, f)
+}
+
+// textLoader reads files as they are
+type textLoader struct{}
+
+func (l textLoader) Load(ctx context.Context, filePath string) (*LoadedFile, error) {
+	return loadFromStream(ctx, l, filePath)
+}
+
+func (textLoader) LoadStream(_ context.Context, r io.Reader) (*LoadedFile, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return &LoadedFile{Text: string(buf)}, nil
+}
+
+// annotatePages sets the pages of chunks located in file
+func annotatePages(file *LoadedFile, chunks []*DocumentChunk) {
+	if len(file.Pages) == 0 {
+		return
+	}
+	for _, chunk := range chunks {
+		if chunk.EndOffset <= chunk.StartOffset {
+			continue
+		}
+		chunk.PageStart = file.PageAt(chunk.StartOffset)
+		chunk.PageEnd = file.PageAt(chunk.EndOffset - 1)
+	}
+}
+
+// FormatPages returns "p. 7" or "pp. 7-8" for the pages of a chunk, empty if unknown
+func FormatPages(start, end int) string {
+	switch {
+	case start == 0:
+		return ""
+	case end <= start:
+		return fmt.Sprintf("p. %d", start)
+	default:
+		return fmt.Sprintf("pp. %d-%d", start, end)
+	}
+}
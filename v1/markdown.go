@@ -0,0 +1,308 @@
+package rag
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	extast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// markdownParser parses GFM tables too, so they are kept whole instead of read as paragraphs
+var markdownParser = goldmark.New(goldmark.WithExtensions(extension.Table)).Parser()
+
+// markdownBlock is a top-level block of a markdown document
+type markdownBlock struct {
+	start, end int // byte span in the source, without trailing whitespace
+	level      int // heading level, 0 if not a heading
+	title      string
+	atomic     bool     // code blocks, tables and HTML are never split
+	keep       [][2]int // spans of code blocks nested in the block, e.g. in list items, not split either
+}
+
+// markdownBlocks partitions source into its top-level blocks. A block spans from its first line
+// to the first line of the next block, so closing fences and link definitions stay with it.
+func markdownBlocks(source []byte) []markdownBlock {
+	doc := markdownParser.Parse(text.NewReader(source))
+
+	var blocks []markdownBlock
+	for n := doc.FirstChild(); n != nil; n = n.NextSibling() {
+		start := blockStart(n, source)
+		if start < 0 || (len(blocks) > 0 && start <= blocks[len(blocks)-1].start) {
+			// Nothing to anchor it on, e.g. a thematic break, it stays with the previous block
+			continue
+		}
+		if len(blocks) > 0 {
+			blocks[len(blocks)-1].end = trimRightSpace(source, blocks[len(blocks)-1].start, start)
+		}
+
+		block := markdownBlock{start: start}
+		switch node := n.(type) {
+		case *ast.Heading:
+			block.level = node.Level
+			block.title = strings.TrimSpace(string(node.Text(source)))
+		case *ast.FencedCodeBlock, *ast.CodeBlock, *ast.HTMLBlock, *extast.Table:
+			block.atomic = true
+		default:
+			block.keep = nestedCodeSpans(n, source)
+		}
+		blocks = append(blocks, block)
+	}
+	if len(blocks) > 0 {
+		blocks[len(blocks)-1].end = trimRightSpace(source, blocks[len(blocks)-1].start, len(source))
+	}
+	return blocks
+}
+
+// blockStart returns the byte offset of the first line of a block, -1 if it has no text
+func blockStart(n ast.Node, source []byte) int {
+	if fenced, ok := n.(*ast.FencedCodeBlock); ok {
+		// Lines are the code, the opening fence is the line before
+		switch {
+		case fenced.Info != nil:
+			return lineStart(source, fenced.Info.Segment.Start)
+		case fenced.Lines().Len() > 0:
+			return lineStart(source, max(lineStart(source, fenced.Lines().At(0).Start)-1, 0))
+		}
+		return -1
+	}
+
+	if n.Type() == ast.TypeBlock && n.Lines().Len() > 0 {
+		return lineStart(source, n.Lines().At(0).Start)
+	}
+	if t, ok := n.(*ast.Text); ok {
+		return lineStart(source, t.Segment.Start)
+	}
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		if start := blockStart(c, source); start >= 0 {
+			return start
+		}
+	}
+	return -1
+}
+
+// nestedCodeSpans returns the spans of the code blocks nested in n, from their first line to the
+// end of their closing fence
+func nestedCodeSpans(n ast.Node, source []byte) [][2]int {
+	var spans [][2]int
+	_ = ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering || c == n {
+			return ast.WalkContinue, nil
+		}
+		switch c.(type) {
+		case *ast.FencedCodeBlock, *ast.CodeBlock:
+			if start := blockStart(c, source); start >= 0 {
+				spans = append(spans, [2]int{start, codeEnd(c, source)})
+			}
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return spans
+}
+
+// codeEnd returns the byte offset after the last line of a code block, its closing fence if fenced
+func codeEnd(n ast.Node, source []byte) int {
+	fenced, ok := n.(*ast.FencedCodeBlock)
+	var end int
+	switch {
+	case n.Lines().Len() > 0:
+		end = n.Lines().At(n.Lines().Len() - 1).Stop
+	case ok && fenced.Info != nil:
+		end = lineEnd(source, fenced.Info.Segment.Stop)
+	default:
+		end = lineEnd(source, blockStart(n, source))
+	}
+	if !ok || end >= len(source) {
+		return end
+	}
+	fence := source[end:lineEnd(source, end)]
+	if trimmed := bytes.TrimLeft(fence, " \t>"); bytes.HasPrefix(trimmed, []byte("```")) || bytes.HasPrefix(trimmed, []byte("~~~")) {
+		return end + len(fence)
+	}
+	return end
+}
+
+// lineEnd returns the offset after the line break of the line at offset, or the end of source
+func lineEnd(source []byte, offset int) int {
+	if i := bytes.IndexByte(source[offset:], '\n'); i >= 0 {
+		return offset + i + 1
+	}
+	return len(source)
+}
+
+func lineStart(source []byte, offset int) int {
+	return bytes.LastIndexByte(source[:offset], '\n') + 1
+}
+
+func trimRightSpace(source []byte, start, end int) int {
+	for end > start {
+		r, size := utf8.DecodeLastRune(source[start:end])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		end -= size
+	}
+	return end
+}
+
+// markdownChunking chunks along the heading hierarchy of the original content. A chunk never
+// spans two sections, except that a heading without text and a section shorter than MinChunkSize
+// are joined with their subsection. Blocks are packed up to MaxChunkSize, code blocks, tables and
+// HTML stay whole even if larger, long paragraphs and lists are split at sentence ends outside of
+// the code blocks they contain.
+// Chunks are verbatim slices of content with their offsets and heading breadcrumb set.
+func (c *DocumentChunker) markdownChunking(content string) []*DocumentChunk {
+	source := []byte(content)
+	maxSize := c.config.MaxChunkSize
+
+	var chunks []*DocumentChunk
+	var headings []heading // breadcrumb of the current section
+	start, end := -1, -1   // span of the pending chunk
+	headingOnly := false   // the pending chunk has no text besides headings
+	level := 0             // heading level of the section the pending chunk starts in
+	path := ""
+
+	flush := func() {
+		if start < 0 {
+			return
+		}
+		chunks = append(chunks, &DocumentChunk{
+			Text:        content[start:end],
+			StartOffset: utf8.RuneCount(source[:start]),
+			EndOffset:   utf8.RuneCount(source[:end]),
+			HeadingPath: path,
+		})
+		start, end = -1, -1
+	}
+	add := func(blockStart, blockEnd int) {
+		if start < 0 {
+			start = blockStart
+			path = breadcrumb(headings)
+		}
+		end = blockEnd
+	}
+	size := func(from, to int) int {
+		return c.size(string(source[from:to]))
+	}
+
+	for _, block := range markdownBlocks(source) {
+		if block.level > 0 {
+			short := start >= 0 && size(start, end) < c.config.MinChunkSize && block.level > level
+			if !headingOnly && !short {
+				flush()
+			}
+			for len(headings) > 0 && headings[len(headings)-1].level >= block.level {
+				headings = headings[:len(headings)-1]
+			}
+			headings = append(headings, heading{offset: block.start, level: block.level, title: block.title})
+			if start < 0 {
+				headingOnly = true
+				level = block.level
+			}
+			add(block.start, block.end)
+			continue
+		}
+
+		headingOnly = false
+		if start < 0 {
+			level = 0
+			if len(headings) > 0 {
+				level = headings[len(headings)-1].level
+			}
+		}
+		if start >= 0 && size(start, block.end) <= maxSize {
+			add(block.start, block.end)
+			continue
+		}
+		if block.atomic || size(block.start, block.end) <= maxSize {
+			flush()
+			add(block.start, block.end)
+			continue
+		}
+
+		// The first piece fills up the pending chunk, usually its heading
+		budget := maxSize
+		if start >= 0 {
+			budget -= size(start, block.start)
+		}
+		for _, piece := range c.splitSpan(source, block.start, block.end, budget, maxSize, block.keep, c.size) {
+			if start >= 0 && size(start, piece[1]) > maxSize {
+				flush()
+			}
+			add(piece[0], piece[1])
+		}
+	}
+	flush()
+	return chunks
+}
+
+// splitSpan splits source[start:end] at sentence ends and line breaks into pieces whose size is
+// at most limit, the first at most first. A sentence longer than limit is a piece of its own, and
+// so are the spans in keep, which are never cut.
+func (c *DocumentChunker) splitSpan(source []byte, start, end, first, limit int, keep [][2]int,
+	size func(string) int) [][2]int {
+	var pieces [][2]int
+	pieceStart, last := start, -1
+	for _, cut := range append(c.sentenceEnds(source, start, end), end) {
+		if cut <= pieceStart || within(cut, keep) {
+			continue
+		}
+		budget := limit
+		if len(pieces) == 0 {
+			budget = first
+		}
+		if last > pieceStart && size(string(source[pieceStart:cut])) > budget {
+			pieces = append(pieces, [2]int{pieceStart, trimRightSpace(source, pieceStart, last)})
+			pieceStart = skipSpace(source, last, end)
+		}
+		last = cut
+	}
+	if pieceStart < end {
+		pieces = append(pieces, [2]int{pieceStart, trimRightSpace(source, pieceStart, end)})
+	}
+	return pieces
+}
+
+// sentenceEnds returns the byte offsets after the sentence ends and line breaks in source[start:end]
+func (c *DocumentChunker) sentenceEnds(source []byte, start, end int) []int {
+	var cuts []int
+	for i := start; i < end; {
+		r, size := utf8.DecodeRune(source[i:end])
+		i += size
+		if !c.isSentenceBoundary(r) {
+			continue
+		}
+		next, _ := utf8.DecodeRune(source[i:end])
+		if r == '\n' || i == end || unicode.IsSpace(next) || r > unicode.MaxASCII {
+			cuts = append(cuts, i)
+		}
+	}
+	return cuts
+}
+
+// within tells whether offset is inside one of spans, their bounds are not
+func within(offset int, spans [][2]int) bool {
+	for _, span := range spans {
+		if span[0] < offset && offset < span[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func skipSpace(source []byte, start, end int) int {
+	for start < end {
+		r, size := utf8.DecodeRune(source[start:end])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		start += size
+	}
+	return start
+}
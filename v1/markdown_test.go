@@ -0,0 +1,146 @@
+package rag
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files")
+
+func newMarkdownChunker(maxSize, minSize int) *DocumentChunker {
+	config := DefaultChunkingConfig()
+	config.Strategy = "markdown"
+	config.MaxChunkSize = maxSize
+	config.MinChunkSize = minSize
+	return &DocumentChunker{config: config}
+}
+
+// assertVerbatim checks that chunks are the source text at their offsets
+func assertVerbatim(t *testing.T, content string, chunks []*DocumentChunk) {
+	runes := []rune(content)
+	for i, chunk := range chunks {
+		assert.Equal(t, i, chunk.Index)
+		require.LessOrEqual(t, chunk.EndOffset, len(runes))
+		assert.Equal(t, string(runes[chunk.StartOffset:chunk.EndOffset]), chunk.Text, "chunk %d", i)
+	}
+}
+
+func TestMarkdownChunking(t *testing.T) {
+	code := "```go\nfunc main() {\n\n\t# not a heading\n}\n```"
+	table := "| flag | meaning |\n| ---- | ------- |\n| -v   | verbose |"
+	content := "Preamble.\n\n# Guide\n\n## Install\n\n" + code + "\n\nRun it.  Twice.\n\n" +
+		"## Usage\n\n" + table + "\n\n### Flags\n\n- one\n- two\n\n<div>\n\nraw\n\n</div>\n\n# FAQ\n\n" +
+		strings.Repeat("Why not? ", 12)
+
+	chunks, err := newMarkdownChunker(60, 1).chunkContent(context.Background(), content)
+	require.NoError(t, err)
+	assertVerbatim(t, content, chunks)
+
+	var texts, paths []string
+	for _, chunk := range chunks {
+		texts = append(texts, chunk.Text)
+		paths = append(paths, chunk.HeadingPath)
+	}
+	assert.Equal(t, []string{
+		"Preamble.",
+		"# Guide\n\n## Install",
+		code + "\n\nRun it.  Twice.",
+		"## Usage",
+		table,
+		"### Flags\n\n- one\n- two\n\n<div>\n\nraw\n\n</div>",
+		"# FAQ\n\n" + strings.TrimSpace(strings.Repeat("Why not? ", 6)),
+		strings.TrimSpace(strings.Repeat("Why not? ", 6)),
+	}, texts)
+	assert.Equal(t, []string{"", "Guide", "Guide > Install", "Guide > Usage", "Guide > Usage",
+		"Guide > Usage > Flags", "FAQ", "FAQ"}, paths)
+
+	// Short sections are joined with their subsections, not with their siblings
+	chunks, err = newMarkdownChunker(1000, 50).chunkContent(context.Background(), "# A\n\nintro\n\n## B\n\nbody\n\n# C\n\nend\n")
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+	assert.Equal(t, "# A\n\nintro\n\n## B\n\nbody", chunks[0].Text)
+	assert.Equal(t, "A", chunks[0].HeadingPath)
+	assert.Equal(t, "# C\n\nend", chunks[1].Text)
+}
+
+func TestMarkdownChunkingNestedCode(t *testing.T) {
+	code := "   ```sh\n   make build.\n   make test.\n   make install.\n   ```\n"
+	content := "# Setup\n\n1. Clone the repository. Enter it.\n2. Build it:\n\n" + code +
+		"3. Run it. Check the logs. Stop it.\n"
+
+	chunks, err := newMarkdownChunker(40, 1).chunkContent(context.Background(), content)
+	require.NoError(t, err)
+	assertVerbatim(t, content, chunks)
+
+	// The list is split at sentence ends, but not within the code of its second item
+	var texts []string
+	for _, chunk := range chunks {
+		texts = append(texts, chunk.Text)
+	}
+	assert.Equal(t, []string{
+		"# Setup\n\n1. Clone the repository.",
+		"Enter it.\n2. Build it:",
+		strings.TrimSpace(code),
+		"3. Run it. Check the logs. Stop it.",
+	}, texts)
+	assert.Len(t, markdownBlocks([]byte(content))[1].keep, 1)
+}
+
+func TestMarkdownChunkingGolden(t *testing.T) {
+	content, err := os.ReadFile("../testdata/chubby-osdi06.md")
+	require.NoError(t, err)
+
+	c := newMarkdownChunker(1000, 100)
+	chunks, err := c.chunkContent(context.Background(), string(content))
+	require.NoError(t, err)
+	require.NotEmpty(t, chunks)
+	assertVerbatim(t, string(content), chunks)
+
+	// Every block is in exactly one chunk and only atomic blocks exceed the maximum size
+	blocks := markdownBlocks(content)
+	for _, block := range blocks {
+		start := utf8.RuneCount(content[:block.start])
+		end := utf8.RuneCount(content[:block.end])
+		var covering []int
+		for i, chunk := range chunks {
+			if chunk.StartOffset < end && start < chunk.EndOffset {
+				covering = append(covering, i)
+			}
+		}
+		require.NotEmpty(t, covering, "block at %d", start)
+		if block.atomic || block.level > 0 {
+			assert.Len(t, covering, 1, "block at %d", start)
+		}
+	}
+	for i, chunk := range chunks {
+		if n := utf8.RuneCountInString(chunk.Text); n > c.config.MaxChunkSize {
+			assert.True(t, strings.HasPrefix(chunk.Text, "<table>"), "chunk %d has %d characters", i, n)
+		}
+	}
+
+	var golden strings.Builder
+	for _, chunk := range chunks {
+		first, _, _ := strings.Cut(chunk.Text, "\n")
+		if utf8.RuneCountInString(first) > 40 {
+			first = string([]rune(first)[:40])
+		}
+		_, _ = fmt.Fprintf(&golden, "%d\t%d-%d\t%s\t%s\n",
+			chunk.Index, chunk.StartOffset, chunk.EndOffset, chunk.HeadingPath, first)
+	}
+
+	const goldenPath = "../testdata/chubby-osdi06.markdown.golden"
+	if *updateGolden {
+		require.NoError(t, os.WriteFile(goldenPath, []byte(golden.String()), 0644))
+	}
+	want, err := os.ReadFile(goldenPath)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), golden.String())
+}
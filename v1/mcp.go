@@ -0,0 +1,550 @@
+package rag
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+// MCPProtocolVersion is the latest Model Context Protocol revision the server speaks
+const MCPProtocolVersion = "2025-06-18"
+
+var mcpProtocolVersions = []string{MCPProtocolVersion, "2025-03-26", "2024-11-05"}
+
+// JSON-RPC error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+)
+
+// MCPServer exposes the knowledge base to agents over the Model Context Protocol: retrieval,
+// chunk lookup and answering as tools, and the processed files as resources.
+type MCPServer struct {
+	r             *RAG
+	vectorWeight  float64
+	keywordWeight float64
+	minScore      float64
+}
+
+func NewMCPServer(r *RAG) *MCPServer {
+	return &MCPServer{r: r, vectorWeight: DefaultVectorWeight, keywordWeight: DefaultKeywordWeight}
+}
+
+// WithFusionWeights sets the hybrid retrieval weights used by the tools
+func (s *MCPServer) WithFusionWeights(vector, keyword float64) *MCPServer {
+	s.vectorWeight = vector
+	s.keywordWeight = keyword
+	return s
+}
+
+// WithMinScore sets the similarity cutoff used when a tool call doesn't specify one
+func (s *MCPServer) WithMinScore(minScore float64) *MCPServer {
+	s.minScore = minScore
+	return s
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// ServeStdio reads newline-delimited JSON-RPC messages from in and writes the responses to out
+// until in is closed or ctx is done. Requests are handled concurrently.
+func (s *MCPServer) ServeStdio(ctx context.Context, in io.Reader, out io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	lines := make(chan []byte)
+	errc := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(nil, 16<<20)
+		for scanner.Scan() {
+			line := append([]byte(nil), scanner.Bytes()...)
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+				return
+			}
+		}
+		errc <- scanner.Err()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errc:
+			return err
+		case line := <-lines:
+			if len(strings.TrimSpace(string(line))) == 0 {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rsp := s.Handle(ctx, line)
+				if rsp == nil {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				_, err := out.Write(append(rsp, '\n'))
+				if err != nil {
+					log.Error().Err(err).Msg("Failed to write MCP response")
+				}
+			}()
+		}
+	}
+}
+
+// HTTPHandler serves the streamable HTTP transport. Every POST carries one message and is
+// answered with a JSON body, the server never opens a stream on its own.
+func (s *MCPServer) HTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rsp := s.Handle(req.Context(), body)
+		if rsp == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(rsp)
+	})
+}
+
+// Handle processes one JSON-RPC message and returns the encoded response, nil for notifications
+func (s *MCPServer) Handle(ctx context.Context, message []byte) []byte {
+	var req rpcRequest
+	err := json.Unmarshal(message, &req)
+	if err != nil {
+		return encodeResponse(rpcResponse{ID: json.RawMessage("null"),
+			Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return encodeResponse(rpcResponse{ID: nullID(req.ID),
+			Error: &rpcError{Code: rpcInvalidRequest, Message: "invalid JSON-RPC 2.0 request"}})
+	}
+
+	result, err := s.dispatch(ctx, req.Method, req.Params)
+	if len(req.ID) == 0 {
+		// Notifications are never answered
+		return nil
+	}
+
+	rsp := rpcResponse{ID: req.ID, Result: result}
+	if err != nil {
+		var rpcErr *rpcError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &rpcError{Code: rpcInternalError, Message: err.Error()}
+		}
+		rsp.Result, rsp.Error = nil, rpcErr
+	}
+	return encodeResponse(rsp)
+}
+
+func encodeResponse(rsp rpcResponse) []byte {
+	rsp.JSONRPC = "2.0"
+	b, err := json.Marshal(rsp)
+	if err != nil {
+		b, _ = json.Marshal(rpcResponse{JSONRPC: "2.0", ID: rsp.ID,
+			Error: &rpcError{Code: rpcInternalError, Message: err.Error()}})
+	}
+	return b
+}
+
+func nullID(id json.RawMessage) json.RawMessage {
+	if len(id) == 0 {
+		return json.RawMessage("null")
+	}
+	return id
+}
+
+func (s *MCPServer) dispatch(ctx context.Context, method string, params json.RawMessage) (interface{}, error) {
+	switch method {
+	case "initialize":
+		return s.initialize(params)
+	case "ping":
+		return struct{}{}, nil
+	case "tools/list":
+		return map[string]interface{}{"tools": mcpTools}, nil
+	case "tools/call":
+		return s.callTool(ctx, params)
+	case "resources/list":
+		return s.listResources(ctx)
+	case "resources/templates/list":
+		return map[string]interface{}{"resourceTemplates": []interface{}{}}, nil
+	case "resources/read":
+		return s.readResource(ctx, params)
+	default:
+		if strings.HasPrefix(method, "notifications/") {
+			return nil, nil
+		}
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + method}
+	}
+}
+
+func (s *MCPServer) initialize(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		ProtocolVersion string `json:"protocolVersion"`
+	}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+	}
+
+	// Answer with the client's revision if we speak it, otherwise with our latest
+	version := MCPProtocolVersion
+	for _, v := range mcpProtocolVersions {
+		if v == p.ProtocolVersion {
+			version = v
+		}
+	}
+
+	return map[string]interface{}{
+		"protocolVersion": version,
+		"capabilities": map[string]interface{}{
+			"tools":     map[string]interface{}{},
+			"resources": map[string]interface{}{},
+		},
+		"serverInfo": map[string]interface{}{
+			"name":    "srag",
+			"title":   "SlimRAG",
+			"version": "0.1.0",
+		},
+		"instructions": "Search the knowledge base with search, read a whole chunk with get_chunk, " +
+			"or let ask retrieve chunks and generate an answer with citations.",
+	}, nil
+}
+
+type mcpTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"inputSchema"`
+}
+
+func objectSchema(required []string, properties map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+}
+
+var mcpTools = []mcpTool{
+	{
+		Name:        "search",
+		Description: "Retrieve the document chunks most relevant to a query with hybrid vector and keyword search.",
+		InputSchema: objectSchema([]string{"query"}, map[string]interface{}{
+			"query":     map[string]interface{}{"type": "string", "description": "Search query"},
+			"limit":     map[string]interface{}{"type": "integer", "description": "Maximum number of chunks, default 10"},
+			"min_score": map[string]interface{}{"type": "number", "description": "Minimum cosine similarity of returned chunks"},
+		}),
+	},
+	{
+		Name:        "get_chunk",
+		Description: "Get a document chunk by ID with its text and source location.",
+		InputSchema: objectSchema([]string{"id"}, map[string]interface{}{
+			"id": map[string]interface{}{"type": "string", "description": "Chunk ID returned by search"},
+		}),
+	},
+	{
+		Name:        "ask",
+		Description: "Answer a question from the knowledge base, citing the chunks the answer is based on.",
+		InputSchema: objectSchema([]string{"query"}, map[string]interface{}{
+			"query":           map[string]interface{}{"type": "string", "description": "Question"},
+			"retrieval_limit": map[string]interface{}{"type": "integer", "description": "Number of chunks to retrieve, default 40"},
+			"selected_limit":  map[string]interface{}{"type": "integer", "description": "Number of chunks to answer from, default 10"},
+		}),
+	},
+}
+
+// mcpChunk is a chunk as returned by the tools, without embedding and fusion internals
+type mcpChunk struct {
+	ID          string     `json:"id"`
+	DocumentID  string     `json:"document_id"`
+	FilePath    string     `json:"file_path,omitempty"`
+	HeadingPath string     `json:"heading_path,omitempty"`
+	StartOffset int        `json:"start_offset,omitempty"`
+	EndOffset   int        `json:"end_offset,omitempty"`
+	PageStart   int        `json:"page_start,omitempty"`
+	PageEnd     int        `json:"page_end,omitempty"`
+	ImagePath   string     `json:"image_path,omitempty"`
+	Symbol      string     `json:"symbol,omitempty"`
+	SymbolKind  string     `json:"symbol_kind,omitempty"`
+	LineStart   int        `json:"line_start,omitempty"`
+	LineEnd     int        `json:"line_end,omitempty"`
+	CommitSHA   string     `json:"commit_sha,omitempty"`
+	CommitDate  *time.Time `json:"commit_date,omitempty"`
+	Score       float64    `json:"score,omitempty"`
+	Text        string     `json:"text"`
+}
+
+func newMCPChunk(chunk *DocumentChunk) mcpChunk {
+	return mcpChunk{
+		ID:          chunk.ID,
+		DocumentID:  chunk.DocumentID,
+		FilePath:    chunk.FilePath,
+		HeadingPath: chunk.HeadingPath,
+		StartOffset: chunk.StartOffset,
+		EndOffset:   chunk.EndOffset,
+		PageStart:   chunk.PageStart,
+		PageEnd:     chunk.PageEnd,
+		ImagePath:   chunk.ImagePath,
+		Symbol:      chunk.Symbol,
+		SymbolKind:  chunk.SymbolKind,
+		LineStart:   chunk.LineStart,
+		LineEnd:     chunk.LineEnd,
+		CommitSHA:   chunk.CommitSHA,
+		CommitDate:  chunk.CommitDate,
+		Score:       chunk.Score,
+		Text:        chunk.Text,
+	}
+}
+
+type toolArguments struct {
+	Query          string  `json:"query"`
+	Limit          int     `json:"limit"`
+	MinScore       float64 `json:"min_score"`
+	ID             string  `json:"id"`
+	RetrievalLimit int     `json:"retrieval_limit"`
+	SelectedLimit  int     `json:"selected_limit"`
+}
+
+func (s *MCPServer) callTool(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name      string        `json:"name"`
+		Arguments toolArguments `json:"arguments"`
+	}
+	err := json.Unmarshal(params, &p)
+	if err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+
+	var result interface{}
+	switch p.Name {
+	case "search":
+		result, err = s.search(ctx, &p.Arguments)
+	case "get_chunk":
+		result, err = s.getChunk(ctx, &p.Arguments)
+	case "ask":
+		result, err = s.ask(ctx, &p.Arguments)
+	default:
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "unknown tool: " + p.Name}
+	}
+
+	// Tool failures are reported to the model rather than as protocol errors
+	if err != nil {
+		return toolResult(err.Error(), nil, true), nil
+	}
+	return result, nil
+}
+
+func toolResult(text string, structured interface{}, isError bool) map[string]interface{} {
+	result := map[string]interface{}{
+		"content": []map[string]interface{}{{"type": "text", "text": text}},
+		"isError": isError,
+	}
+	if structured != nil {
+		result["structuredContent"] = structured
+	}
+	return result
+}
+
+func jsonToolResult(v interface{}) (interface{}, error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return toolResult(string(b), v, false), nil
+}
+
+func (s *MCPServer) askParameter(query string) *AskParameter {
+	return &AskParameter{
+		Query:          query,
+		RetrievalLimit: defaultRetrievalLimit,
+		SelectedLimit:  defaultSelectedLimit,
+		VectorWeight:   s.vectorWeight,
+		KeywordWeight:  s.keywordWeight,
+		MinScore:       s.minScore,
+	}
+}
+
+func (s *MCPServer) search(ctx context.Context, args *toolArguments) (interface{}, error) {
+	if args.Query == "" {
+		return nil, errors.New("query is required")
+	}
+	p := s.askParameter(args.Query)
+	p.RetrievalLimit = defaultSelectedLimit
+	if args.Limit > 0 {
+		p.RetrievalLimit = args.Limit
+	}
+	if args.MinScore > 0 {
+		p.MinScore = args.MinScore
+	}
+
+	chunks, err := s.r.QueryDocumentChunks(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]mcpChunk, 0, len(chunks))
+	for i := range chunks {
+		result = append(result, newMCPChunk(&chunks[i]))
+	}
+	return jsonToolResult(map[string]interface{}{"chunks": result})
+}
+
+func (s *MCPServer) getChunk(ctx context.Context, args *toolArguments) (interface{}, error) {
+	if args.ID == "" {
+		return nil, errors.New("id is required")
+	}
+	chunk, err := s.r.GetDocumentChunk(ctx, args.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("chunk %s not found", args.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return jsonToolResult(newMCPChunk(chunk))
+}
+
+func (s *MCPServer) ask(ctx context.Context, args *toolArguments) (interface{}, error) {
+	if args.Query == "" {
+		return nil, errors.New("query is required")
+	}
+	p := s.askParameter(args.Query)
+	p.Citations = true
+	if args.RetrievalLimit > 0 {
+		p.RetrievalLimit = args.RetrievalLimit
+	}
+	if args.SelectedLimit > 0 {
+		p.SelectedLimit = args.SelectedLimit
+	}
+
+	chunks, err := s.r.QueryDocumentChunks(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	p.SelectedChunks, err = s.r.Rerank(ctx, p.Query, chunks, p.SelectedLimit)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := s.r.Ask(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return toolResult(answer.Markdown(), answer, false), nil
+}
+
+func fileURI(path string) string {
+	return "file://" + filepath.ToSlash(path)
+}
+
+func (s *MCPServer) listResources(ctx context.Context) (interface{}, error) {
+	files, err := s.r.Store.ListProcessedFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resources := make([]map[string]interface{}, 0, len(files))
+	for _, file := range files {
+		// Crawled pages and bucket objects have no local file to read
+		if isURL(file.FilePath) {
+			continue
+		}
+		name := file.FileName
+		if name == "" {
+			name = filepath.Base(file.FilePath)
+		}
+		resources = append(resources, map[string]interface{}{
+			"uri":      fileURI(file.FilePath),
+			"name":     name,
+			"title":    file.FilePath,
+			"mimeType": mimeType(file.FilePath),
+		})
+	}
+	return map[string]interface{}{"resources": resources}, nil
+}
+
+// readResource returns the content of an indexed local file, other paths are not readable
+func (s *MCPServer) readResource(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		URI string `json:"uri"`
+	}
+	err := json.Unmarshal(params, &p)
+	if err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+
+	path := filepath.FromSlash(strings.TrimPrefix(p.URI, "file://"))
+	info, err := s.r.Store.GetProcessedFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(p.URI, "file://") || info == nil || isURL(info.FilePath) {
+		return nil, &rpcError{Code: -32002, Message: "resource not found: " + p.URI}
+	}
+
+	file, err := LoadFile(ctx, info.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"contents": []map[string]interface{}{{
+			"uri":      p.URI,
+			"mimeType": mimeType(info.FilePath),
+			"text":     file.Text,
+		}},
+	}, nil
+}
+
+func mimeType(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown":
+		return "text/markdown"
+	default:
+		return "text/plain"
+	}
+}
@@ -0,0 +1,278 @@
+package rag
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mcpClient drives an MCPServer over an in-process pipe
+type mcpClient struct {
+	t      *testing.T
+	in     *io.PipeWriter
+	out    *bufio.Scanner
+	nextID int
+}
+
+func newMCPClient(t *testing.T, s *MCPServer) *mcpClient {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ServeStdio(context.Background(), inR, outW)
+		_ = outW.Close()
+	}()
+	t.Cleanup(func() {
+		_ = inW.Close()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Error("MCP server did not stop after stdin was closed")
+		}
+	})
+	return &mcpClient{t: t, in: inW, out: bufio.NewScanner(outR)}
+}
+
+func (c *mcpClient) send(message string) {
+	_, err := fmt.Fprintln(c.in, message)
+	require.NoError(c.t, err)
+}
+
+func (c *mcpClient) receive() rpcResponse {
+	require.True(c.t, c.out.Scan(), "no response: %v", c.out.Err())
+	var rsp struct {
+		rpcResponse
+		Result json.RawMessage `json:"result"`
+	}
+	require.NoError(c.t, json.Unmarshal(c.out.Bytes(), &rsp))
+	assert.Equal(c.t, "2.0", rsp.JSONRPC)
+	rsp.rpcResponse.Result = rsp.Result
+	return rsp.rpcResponse
+}
+
+// call sends a request and decodes its result into result
+func (c *mcpClient) call(method string, params interface{}, result interface{}) *rpcError {
+	c.nextID++
+	b, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": c.nextID, "method": method, "params": params})
+	require.NoError(c.t, err)
+	c.send(string(b))
+
+	rsp := c.receive()
+	assert.Equal(c.t, fmt.Sprint(c.nextID), string(rsp.ID))
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	require.NoError(c.t, json.Unmarshal(rsp.Result.(json.RawMessage), result))
+	return nil
+}
+
+type callToolResult struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StructuredContent json.RawMessage `json:"structuredContent"`
+	IsError           bool            `json:"isError"`
+}
+
+func (c *mcpClient) callTool(name string, arguments map[string]interface{}) callToolResult {
+	var result callToolResult
+	rpcErr := c.call("tools/call", map[string]interface{}{"name": name, "arguments": arguments}, &result)
+	require.Nil(c.t, rpcErr)
+	require.Len(c.t, result.Content, 1)
+	assert.Equal(c.t, "text", result.Content[0].Type)
+	return result
+}
+
+func TestMCPLifecycle(t *testing.T) {
+	r, _ := newTestRAG("")
+	c := newMCPClient(t, NewMCPServer(r))
+
+	var init struct {
+		ProtocolVersion string                     `json:"protocolVersion"`
+		Capabilities    map[string]json.RawMessage `json:"capabilities"`
+		ServerInfo      struct{ Name string }      `json:"serverInfo"`
+	}
+	require.Nil(t, c.call("initialize", map[string]interface{}{
+		"protocolVersion": "2025-03-26",
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]interface{}{"name": "test", "version": "1"},
+	}, &init))
+	assert.Equal(t, "2025-03-26", init.ProtocolVersion)
+	assert.Contains(t, init.Capabilities, "tools")
+	assert.Contains(t, init.Capabilities, "resources")
+	assert.Equal(t, "srag", init.ServerInfo.Name)
+
+	// Notifications get no response, the next line answers the ping
+	c.send(`{"jsonrpc": "2.0", "method": "notifications/initialized"}`)
+	var pong map[string]interface{}
+	require.Nil(t, c.call("ping", nil, &pong))
+	assert.Empty(t, pong)
+
+	var tools struct {
+		Tools []mcpTool `json:"tools"`
+	}
+	require.Nil(t, c.call("tools/list", nil, &tools))
+	var names []string
+	for _, tool := range tools.Tools {
+		names = append(names, tool.Name)
+		assert.Equal(t, "object", tool.InputSchema["type"])
+	}
+	assert.Equal(t, []string{"search", "get_chunk", "ask"}, names)
+
+	rpcErr := c.call("sampling/createMessage", nil, &pong)
+	require.NotNil(t, rpcErr)
+	assert.Equal(t, rpcMethodNotFound, rpcErr.Code)
+
+	c.send(`{"jsonrpc": "2.0", "id": 99, "method": `)
+	rsp := c.receive()
+	require.NotNil(t, rsp.Error)
+	assert.Equal(t, rpcParseError, rsp.Error.Code)
+	assert.Equal(t, "null", string(rsp.ID))
+
+	// Unknown initialize revisions are answered with the latest one
+	require.Nil(t, c.call("initialize", map[string]interface{}{"protocolVersion": "1999-01-01"}, &init))
+	assert.Equal(t, MCPProtocolVersion, init.ProtocolVersion)
+}
+
+func TestMCPTools(t *testing.T) {
+	r, chat := newTestRAG("Cells have five replicas [1].", citationChunks...)
+	c := newMCPClient(t, NewMCPServer(r))
+
+	result := c.callTool("search", map[string]interface{}{"query": "replicas in a cell", "limit": 2})
+	assert.False(t, result.IsError)
+	var search struct {
+		Chunks []mcpChunk `json:"chunks"`
+	}
+	require.NoError(t, json.Unmarshal(result.StructuredContent, &search))
+	require.Len(t, search.Chunks, 2)
+	assert.NotEmpty(t, search.Chunks[0].Text)
+	assert.Contains(t, result.Content[0].Text, search.Chunks[0].ID)
+
+	result = c.callTool("get_chunk", map[string]interface{}{"id": "c2"})
+	assert.False(t, result.IsError)
+	var chunk mcpChunk
+	require.NoError(t, json.Unmarshal(result.StructuredContent, &chunk))
+	assert.Equal(t, "Cells consist of five replicas.", chunk.Text)
+	assert.Equal(t, "Design > System structure", chunk.HeadingPath)
+
+	result = c.callTool("get_chunk", map[string]interface{}{"id": "missing"})
+	assert.True(t, result.IsError)
+	assert.Contains(t, result.Content[0].Text, "not found")
+
+	result = c.callTool("ask", map[string]interface{}{"query": "How many replicas are in a cell?"})
+	assert.False(t, result.IsError)
+	assert.Contains(t, chat.prompt, citationInstruction)
+	assert.True(t, strings.HasPrefix(result.Content[0].Text, "Cells have five replicas [1]."))
+	assert.Contains(t, result.Content[0].Text, "**Sources:**")
+	var answer Answer
+	require.NoError(t, json.Unmarshal(result.StructuredContent, &answer))
+	assert.Len(t, answer.Sources, 1)
+
+	result = c.callTool("search", map[string]interface{}{})
+	assert.True(t, result.IsError)
+
+	var unused map[string]interface{}
+	rpcErr := c.call("tools/call", map[string]interface{}{"name": "drop_tables"}, &unused)
+	require.NotNil(t, rpcErr)
+	assert.Equal(t, rpcInvalidParams, rpcErr.Code)
+}
+
+func TestMCPResources(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "chubby.md")
+	require.NoError(t, os.WriteFile(path, []byte("# Chubby\n"), 0644))
+	secret := filepath.Join(dir, "secret.txt")
+	require.NoError(t, os.WriteFile(secret, []byte("do not serve"), 0644))
+
+	r, _ := newTestRAG("")
+	require.NoError(t, r.Store.UpsertProcessedFile(context.Background(), &FileInfo{FilePath: path, FileName: "chubby.md", FileHash: "h"}))
+	page := "https://docs.example.com/cells.html"
+	require.NoError(t, r.Store.UpsertProcessedFile(context.Background(), &FileInfo{FilePath: page, FileName: "cells.html", FileHash: "etag:1"}))
+	object := "s3://wiki/docs/lease.md"
+	require.NoError(t, r.Store.UpsertProcessedFile(context.Background(), &FileInfo{FilePath: object, FileName: "lease.md", FileHash: "etag:2"}))
+	c := newMCPClient(t, NewMCPServer(r))
+
+	var list struct {
+		Resources []struct {
+			URI      string `json:"uri"`
+			Name     string `json:"name"`
+			MimeType string `json:"mimeType"`
+		} `json:"resources"`
+	}
+	require.Nil(t, c.call("resources/list", nil, &list))
+	require.Len(t, list.Resources, 1)
+	assert.Equal(t, fileURI(path), list.Resources[0].URI)
+	assert.Equal(t, "chubby.md", list.Resources[0].Name)
+	assert.Equal(t, "text/markdown", list.Resources[0].MimeType)
+
+	var read struct {
+		Contents []struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+		} `json:"contents"`
+	}
+	require.Nil(t, c.call("resources/read", map[string]interface{}{"uri": list.Resources[0].URI}, &read))
+	require.Len(t, read.Contents, 1)
+	assert.Equal(t, "# Chubby\n", read.Contents[0].Text)
+
+	// Only indexed local files can be read, crawled pages and bucket objects are not resources
+	rpcErr := c.call("resources/read", map[string]interface{}{"uri": fileURI(secret)}, &read)
+	require.NotNil(t, rpcErr)
+	assert.Contains(t, rpcErr.Message, "not found")
+	for _, uri := range []string{fileURI(page), fileURI(object)} {
+		rpcErr = c.call("resources/read", map[string]interface{}{"uri": uri}, &read)
+		require.NotNil(t, rpcErr)
+		assert.Contains(t, rpcErr.Message, "not found")
+	}
+}
+
+func TestMCPHTTP(t *testing.T) {
+	r, _ := newTestRAG("", citationChunks...)
+	srv := httptest.NewServer(NewMCPServer(r).HTTPHandler())
+	defer srv.Close()
+
+	post := func(body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json, text/event-stream")
+		rsp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = rsp.Body.Close() })
+		return rsp
+	}
+
+	rsp := post(`{"jsonrpc": "2.0", "id": "a", "method": "tools/call", "params": {"name": "get_chunk", "arguments": {"id": "c1"}}}`)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "application/json", rsp.Header.Get("Content-Type"))
+	var body struct {
+		ID     string         `json:"id"`
+		Result callToolResult `json:"result"`
+	}
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&body))
+	assert.Equal(t, "a", body.ID)
+	assert.False(t, body.Result.IsError)
+	assert.Contains(t, body.Result.Content[0].Text, "Chubby is a lock service.")
+
+	rsp = post(`{"jsonrpc": "2.0", "method": "notifications/initialized"}`)
+	assert.Equal(t, http.StatusAccepted, rsp.StatusCode)
+
+	get, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	_ = get.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, get.StatusCode)
+}
@@ -0,0 +1,357 @@
+package rag
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openai/openai-go"
+)
+
+// memStore is an in-memory Store for tests that don't need a database. Vector search is
+// brute force and keyword search counts the query words found in a chunk.
+type memStore struct {
+	mu        sync.Mutex
+	dimension int64
+	chunks    map[string]*DocumentChunk
+	files     map[string]FileInfo
+	meta      map[string]string
+	metadata  map[string]Metadata
+	captions  map[string]string // by model and image hash
+	batches   int               // number of UpdateEmbeddings calls
+}
+
+func newMemStore(dimension int64) *memStore {
+	return &memStore{dimension: dimension, chunks: map[string]*DocumentChunk{}, files: map[string]FileInfo{},
+		meta: map[string]string{}, metadata: map[string]Metadata{}, captions: map[string]string{}}
+}
+
+func (s *memStore) UpsertDocumentChunks(_ context.Context, chunks []*DocumentChunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, chunk := range chunks {
+		c := *chunk
+		if old, ok := s.chunks[c.ID]; ok {
+			c.Embedding = old.Embedding
+		}
+		s.chunks[c.ID] = &c
+	}
+	return nil
+}
+
+func (s *memStore) GetDocumentChunk(_ context.Context, id string) (*DocumentChunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chunk, ok := s.chunks[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	c := *chunk
+	return &c, nil
+}
+
+func (s *memStore) ListDocumentChunks(_ context.Context, withoutEmbedding bool) ([]DocumentChunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var chunks []DocumentChunk
+	for _, chunk := range s.sorted() {
+		if chunk.IsParent || (withoutEmbedding && chunk.Embedding != nil) {
+			continue
+		}
+		c := *chunk
+		c.Embedding = nil
+		chunks = append(chunks, c)
+	}
+	return chunks, nil
+}
+
+func (s *memStore) ListChunksByIndex(_ context.Context, documentID string, from, to int) ([]DocumentChunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var chunks []DocumentChunk
+	for _, chunk := range s.sorted() {
+		if chunk.DocumentID == documentID && !chunk.IsParent && chunk.Index >= from && chunk.Index <= to {
+			c := *chunk
+			c.Embedding = nil
+			chunks = append(chunks, c)
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].Index < chunks[j].Index })
+	return chunks, nil
+}
+
+func (s *memStore) UpdateEmbedding(_ context.Context, id string, embedding []float32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chunk, ok := s.chunks[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	chunk.Embedding = embedding
+	return nil
+}
+
+func (s *memStore) UpdateEmbeddings(_ context.Context, chunks []DocumentChunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches++
+	for _, chunk := range chunks {
+		if _, ok := s.chunks[chunk.ID]; !ok {
+			return sql.ErrNoRows
+		}
+	}
+	for _, chunk := range chunks {
+		s.chunks[chunk.ID].Embedding = chunk.Embedding
+	}
+	return nil
+}
+
+func (s *memStore) RemoveDocumentChunks(_ context.Context, documentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, chunk := range s.chunks {
+		if chunk.DocumentID == documentID {
+			delete(s.chunks, id)
+		}
+	}
+	delete(s.metadata, documentID)
+	return nil
+}
+
+func (s *memStore) SetDocumentMetadata(_ context.Context, documentID string, metadata Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metadata[documentID] = metadata
+	return nil
+}
+
+// matches reports whether the metadata of a document matches all filters, as metadataCondition does
+func (s *memStore) matches(documentID string, filters []MetadataFilter) bool {
+	values := s.metadata[documentID].Values()
+	for _, f := range filters {
+		from, to := f.timeRange()
+		matched := false
+		for _, v := range values[f.Key] {
+			if len(f.Values) > 0 && !slices.ContainsFunc(f.Values, func(want string) bool {
+				if t, ok := parseMetadataTime(want); ok {
+					want = t.Format(metadataTimeLayout)
+				}
+				return want == v
+			}) {
+				continue
+			}
+			if from != "" || to != "" {
+				if _, err := time.Parse(metadataTimeLayout, v); err != nil {
+					continue
+				}
+				if (from != "" && v < from) || (to != "" && v >= to) {
+					continue
+				}
+			}
+			matched = true
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *memStore) VectorSearch(_ context.Context, embedding []float32, limit int, filters []MetadataFilter) ([]DocumentChunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var chunks []DocumentChunk
+	for _, chunk := range s.sorted() {
+		if chunk.Embedding == nil || chunk.IsParent || !s.matches(chunk.DocumentID, filters) {
+			continue
+		}
+		c := *chunk
+		c.Distance, c.Score = l2Distance(embedding, c.Embedding), cosineSimilarity(embedding, c.Embedding)
+		chunks = append(chunks, c)
+	}
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].Distance < chunks[j].Distance })
+	if len(chunks) > limit {
+		chunks = chunks[:limit]
+	}
+	return chunks, nil
+}
+
+func (s *memStore) KeywordSearch(_ context.Context, query string, embedding []float32, limit int, filters []MetadataFilter) ([]DocumentChunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	words := strings.Fields(strings.ToLower(query))
+	var chunks []DocumentChunk
+	for _, chunk := range s.sorted() {
+		text := strings.ToLower(chunk.Text)
+		c := *chunk
+		for _, word := range words {
+			if strings.Contains(text, word) {
+				c.KeywordScore++
+			}
+		}
+		if c.KeywordScore == 0 || chunk.IsParent || !s.matches(chunk.DocumentID, filters) {
+			continue
+		}
+		if c.Embedding != nil {
+			c.Distance, c.Score = l2Distance(embedding, c.Embedding), cosineSimilarity(embedding, c.Embedding)
+		}
+		chunks = append(chunks, c)
+	}
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].KeywordScore > chunks[j].KeywordScore })
+	if len(chunks) > limit {
+		chunks = chunks[:limit]
+	}
+	return chunks, nil
+}
+
+func (s *memStore) RebuildKeywordIndex(context.Context) error { return nil }
+
+func (s *memStore) GetProcessedFile(_ context.Context, filePath string) (*FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.files[filePath]
+	if !ok {
+		return nil, nil
+	}
+	return &info, nil
+}
+
+func (s *memStore) ListProcessedFiles(context.Context) ([]FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []FileInfo
+	for _, info := range s.files {
+		files = append(files, info)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].FilePath < files[j].FilePath })
+	return files, nil
+}
+
+func (s *memStore) UpsertProcessedFile(_ context.Context, info *FileInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[info.FilePath] = *info
+	return nil
+}
+
+func (s *memStore) RemoveProcessedFile(_ context.Context, filePath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, filePath)
+	return nil
+}
+
+func (s *memStore) GetMeta(_ context.Context, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.meta[key], nil
+}
+
+func (s *memStore) SetMeta(_ context.Context, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.meta[key] = value
+	return nil
+}
+
+func (s *memStore) GetCachedCaption(_ context.Context, model, imageHash string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.captions[model+" "+imageHash], nil
+}
+
+func (s *memStore) PutCachedCaption(_ context.Context, model, imageHash, caption string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.captions[model+" "+imageHash] = caption
+	return nil
+}
+
+func (s *memStore) EmbeddingDimension() int64  { return s.dimension }
+func (s *memStore) Ping(context.Context) error { return nil }
+func (s *memStore) Close() error               { return nil }
+
+// sorted returns the chunks in a stable order, the caller holds the lock
+func (s *memStore) sorted() []*DocumentChunk {
+	chunks := make([]*DocumentChunk, 0, len(s.chunks))
+	for _, chunk := range s.chunks {
+		chunks = append(chunks, chunk)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		if chunks[i].FilePath != chunks[j].FilePath {
+			return chunks[i].FilePath < chunks[j].FilePath
+		}
+		return chunks[i].Index < chunks[j].Index
+	})
+	return chunks
+}
+
+func l2Distance(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		d := float64(a[i] - b[i])
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+// fakeEmbeddingClient embeds text as normalized letter frequencies folded into its dimension
+type fakeEmbeddingClient struct {
+	dimension int
+	calls     int
+}
+
+func (c *fakeEmbeddingClient) New(_ context.Context, params openai.EmbeddingNewParams) (*openai.CreateEmbeddingResponse, error) {
+	c.calls++
+	inputs := params.Input.OfArrayOfStrings
+	if params.Input.OfString.Valid() {
+		inputs = []string{params.Input.OfString.Value}
+	}
+	rsp := &openai.CreateEmbeddingResponse{}
+	for i, input := range inputs {
+		rsp.Data = append(rsp.Data, openai.Embedding{Index: int64(i), Embedding: fakeEmbedding(input, c.dimension)})
+	}
+	return rsp, nil
+}
+
+func fakeEmbedding(text string, dimension int) []float64 {
+	v := make([]float64, dimension)
+	for _, r := range strings.ToLower(text) {
+		if r >= 'a' && r <= 'z' {
+			v[int(r-'a')%dimension]++
+		}
+	}
+	var norm float64
+	for _, x := range v {
+		norm += x * x
+	}
+	if norm > 0 {
+		for i := range v {
+			v[i] /= math.Sqrt(norm)
+		}
+	}
+	return v
+}
+
+// newTestRAG returns a RAG over an in-memory store holding chunks with their fake embeddings
+func newTestRAG(reply string, chunks ...DocumentChunk) (*RAG, *fakeChatClient) {
+	const dimension = 8
+	store := newMemStore(dimension)
+	for i := range chunks {
+		chunk := chunks[i]
+		chunk.Embedding = toFloat32Slice(fakeEmbedding(chunk.Text, dimension))
+		store.chunks[chunk.ID] = &chunk
+	}
+	chat := &fakeChatClient{reply: reply}
+	return &RAG{
+		Store:               store,
+		EmbeddingClient:     &fakeEmbeddingClient{dimension: dimension},
+		EmbeddingDimensions: dimension,
+		AssistantClient:     chat,
+	}, chat
+}
@@ -0,0 +1,279 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Metadata is the front matter of a document, e.g. title, tags, lang and date. Values are strings,
+// numbers, booleans, times, lists or nested maps as decoded from YAML or TOML.
+type Metadata map[string]interface{}
+
+// metadataTimeLayout is how times are stored, it sorts like the times it encodes
+const metadataTimeLayout = "2006-01-02T15:04:05Z"
+
+// parseFrontMatter reads the YAML front matter between --- lines or the TOML front matter between
+// +++ lines at the start of content. It returns the metadata and the byte offset of the body,
+// nil and 0 without front matter.
+func parseFrontMatter(content string) (Metadata, int, error) {
+	var delimiter string
+	switch {
+	case strings.HasPrefix(content, "---\n"), strings.HasPrefix(content, "---\r\n"):
+		delimiter = "---"
+	case strings.HasPrefix(content, "+++\n"), strings.HasPrefix(content, "+++\r\n"):
+		delimiter = "+++"
+	default:
+		return nil, 0, nil
+	}
+
+	start := strings.IndexByte(content, '\n') + 1
+	for offset := start; offset < len(content); {
+		end := strings.IndexByte(content[offset:], '\n')
+		next := len(content)
+		if end >= 0 {
+			next = offset + end + 1
+		}
+		line := strings.TrimRight(content[offset:next], "\r\n")
+		if line == delimiter || (delimiter == "---" && line == "...") {
+			metadata, err := decodeFrontMatter(delimiter, content[start:offset])
+			if err != nil {
+				return nil, 0, err
+			}
+			return metadata, next, nil
+		}
+		offset = next
+	}
+	return nil, 0, errors.New("front matter is not closed")
+}
+
+func decodeFrontMatter(delimiter, source string) (Metadata, error) {
+	metadata := Metadata{}
+	if delimiter == "+++" {
+		_, err := toml.Decode(source, &metadata)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TOML front matter: %w", err)
+		}
+		return metadata, nil
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader([]byte(source)))
+	err := decoder.Decode(&metadata)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid YAML front matter: %w", err)
+	}
+	return metadata, nil
+}
+
+// Values flattens the metadata into the strings filters match: lists are one value per element,
+// nested keys are joined by dots, and times and dates are in UTC as 2006-01-02T15:04:05Z
+func (m Metadata) Values() map[string][]string {
+	values := make(map[string][]string)
+	var add func(key string, v interface{})
+	add = func(key string, v interface{}) {
+		switch v := v.(type) {
+		case nil:
+		case time.Time:
+			values[key] = append(values[key], v.UTC().Format(metadataTimeLayout))
+		case string:
+			if t, ok := parseMetadataTime(v); ok {
+				values[key] = append(values[key], t.Format(metadataTimeLayout))
+			} else {
+				values[key] = append(values[key], v)
+			}
+		default:
+			switch rv := reflect.ValueOf(v); rv.Kind() {
+			case reflect.Slice, reflect.Array:
+				for i := 0; i < rv.Len(); i++ {
+					add(key, rv.Index(i).Interface())
+				}
+			case reflect.Map:
+				for iter := rv.MapRange(); iter.Next(); {
+					add(key+"."+fmt.Sprint(iter.Key().Interface()), iter.Value().Interface())
+				}
+			default:
+				values[key] = append(values[key], fmt.Sprint(v))
+			}
+		}
+	}
+	for key, v := range m {
+		add(key, v)
+	}
+	for key := range values {
+		sort.Strings(values[key])
+	}
+	return values
+}
+
+// parseMetadataTime parses RFC 3339 times and 2006-01-02 dates
+func parseMetadataTime(s string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// MetadataFilter restricts retrieval to the chunks of documents whose metadata key has one of
+// Values, or a time between From and To. The filters of a query must all match.
+type MetadataFilter struct {
+	Key    string   `json:"key"`
+	Values []string `json:"values,omitempty"` // One value is equality, more are IN
+	From   string   `json:"from,omitempty"`   // Earliest time, RFC 3339 or 2006-01-02
+	To     string   `json:"to,omitempty"`     // Latest time, a date includes the whole day
+}
+
+// ParseMetadataFilter parses key=value, key=v1,v2 for any of the values, and key>=time or
+// key<=time for a time range
+func ParseMetadataFilter(s string) (MetadataFilter, error) {
+	for _, op := range []string{">=", "<=", "="} {
+		key, value, ok := strings.Cut(s, op)
+		if !ok {
+			continue
+		}
+		f := MetadataFilter{Key: strings.TrimSpace(key)}
+		value = strings.TrimSpace(value)
+		switch op {
+		case ">=":
+			f.From = value
+		case "<=":
+			f.To = value
+		default:
+			for _, v := range strings.Split(value, ",") {
+				f.Values = append(f.Values, strings.TrimSpace(v))
+			}
+		}
+		return f, f.Validate()
+	}
+	return MetadataFilter{}, fmt.Errorf("invalid metadata filter %q, expected key=value, key>=time or key<=time", s)
+}
+
+// Validate checks that the filter has a key and a condition, and that its times parse
+func (f MetadataFilter) Validate() error {
+	if f.Key == "" {
+		return errors.New("metadata filter without key")
+	}
+	if len(f.Values) == 0 && f.From == "" && f.To == "" {
+		return fmt.Errorf("metadata filter on %s without values or time range", f.Key)
+	}
+	for _, bound := range []string{f.From, f.To} {
+		if _, ok := parseMetadataTime(bound); bound != "" && !ok {
+			return fmt.Errorf("metadata filter on %s: invalid time %q, expected RFC 3339 or 2006-01-02", f.Key, bound)
+		}
+	}
+	return nil
+}
+
+// timeRange returns the stored forms of the range, from inclusive and to exclusive, empty if unbounded
+func (f MetadataFilter) timeRange() (from, to string) {
+	if t, ok := parseMetadataTime(f.From); ok {
+		from = t.Format(metadataTimeLayout)
+	}
+	if t, ok := parseMetadataTime(f.To); ok {
+		if _, err := time.Parse(time.DateOnly, f.To); err == nil {
+			t = t.AddDate(0, 0, 1)
+		} else {
+			t = t.Add(time.Second)
+		}
+		to = t.Format(metadataTimeLayout)
+	}
+	return from, to
+}
+
+// metadataCondition returns the SQL condition of filters on document_chunks rows and its
+// arguments, placeholders are numbered from next
+func metadataCondition(filters []MetadataFilter, next int) (string, []interface{}, error) {
+	var conditions []string
+	var args []interface{}
+	placeholder := func(arg interface{}) string {
+		args = append(args, arg)
+		return "$" + strconv.Itoa(next+len(args)-1)
+	}
+
+	for _, f := range filters {
+		err := f.Validate()
+		if err != nil {
+			return "", nil, err
+		}
+
+		condition := "m.key = " + placeholder(f.Key)
+		if len(f.Values) > 0 {
+			in := make([]string, len(f.Values))
+			for i, v := range f.Values {
+				if t, ok := parseMetadataTime(v); ok {
+					v = t.Format(metadataTimeLayout)
+				}
+				in[i] = placeholder(v)
+			}
+			condition += " AND m.value IN (" + strings.Join(in, ", ") + ")"
+		}
+		from, to := f.timeRange()
+		if from != "" || to != "" {
+			// Only stored times compare as times
+			condition += " AND m.value LIKE '____-__-__T__:__:__Z'"
+		}
+		if from != "" {
+			condition += " AND m.value >= " + placeholder(from)
+		}
+		if to != "" {
+			condition += " AND m.value < " + placeholder(to)
+		}
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM document_metadata m
+			WHERE m.document_id = document_chunks.document_id AND `+condition+`)`)
+	}
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+// andMetadata is metadataCondition to append to a WHERE clause, empty without filters
+func andMetadata(filters []MetadataFilter, next int) (string, []interface{}, error) {
+	condition, args, err := metadataCondition(filters, next)
+	if err != nil || condition == "" {
+		return "", nil, err
+	}
+	return "AND " + condition, args, nil
+}
+
+// metadataWhere is the WHERE clause of metadataCondition, empty without filters
+func metadataWhere(filters []MetadataFilter, next int) (string, []interface{}, error) {
+	condition, args, err := metadataCondition(filters, next)
+	if err != nil || condition == "" {
+		return "", nil, err
+	}
+	return "WHERE " + condition, args, nil
+}
+
+// setDocumentMetadata replaces the metadata rows of a document in the document_metadata table
+func setDocumentMetadata(ctx context.Context, db *sql.DB, documentID string, metadata Metadata) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM document_metadata WHERE document_id = $1`, documentID)
+	if err != nil {
+		return err
+	}
+	for key, values := range metadata.Values() {
+		for _, value := range values {
+			_, err = tx.ExecContext(ctx, `INSERT INTO document_metadata (document_id, key, value)
+				VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, documentID, key, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
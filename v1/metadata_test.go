@@ -0,0 +1,202 @@
+package rag
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFrontMatter(t *testing.T) {
+	content := "---\ntitle: Download\ntags: [install, release]\nlang: zh\ndate: 2024-03-01\n" +
+		"hero:\n  name: EasyTier\n---\n# Download\n"
+	metadata, bodyStart, err := parseFrontMatter(content)
+	require.NoError(t, err)
+	assert.Equal(t, "# Download\n", content[bodyStart:])
+	assert.Equal(t, map[string][]string{
+		"title":     {"Download"},
+		"tags":      {"install", "release"},
+		"lang":      {"zh"},
+		"date":      {"2024-03-01T00:00:00Z"},
+		"hero.name": {"EasyTier"},
+	}, metadata.Values())
+
+	content = "+++\ntitle = \"Guide\"\ndate = 2024-03-01T08:00:00+08:00\ndraft = false\n+++\nBody"
+	metadata, bodyStart, err = parseFrontMatter(content)
+	require.NoError(t, err)
+	assert.Equal(t, "Body", content[bodyStart:])
+	assert.Equal(t, map[string][]string{
+		"title": {"Guide"},
+		"date":  {"2024-03-01T00:00:00Z"},
+		"draft": {"false"},
+	}, metadata.Values())
+
+	// Empty front matter, no front matter and a thematic break later on
+	metadata, bodyStart, err = parseFrontMatter("---\n---\nBody")
+	require.NoError(t, err)
+	assert.Empty(t, metadata)
+	assert.Equal(t, 8, bodyStart)
+	metadata, bodyStart, err = parseFrontMatter("Body\n---\ntitle: x\n---\n")
+	require.NoError(t, err)
+	assert.Nil(t, metadata)
+	assert.Zero(t, bodyStart)
+
+	_, _, err = parseFrontMatter("---\ntitle: x\n")
+	assert.Error(t, err)
+	_, _, err = parseFrontMatter("---\ntitle: [x\n---\n")
+	assert.Error(t, err)
+	_, _, err = parseFrontMatter("+++\ntitle = \n+++\n")
+	assert.Error(t, err)
+}
+
+func TestChunkFrontMatter(t *testing.T) {
+	ctx := context.Background()
+	content := "---\nhome: hello\ntitle: 下载\n---\n# Download\n\nGet the latest release.\n"
+
+	// Offsets point into the whole file, past the front matter
+	body := len([]rune("---\nhome: hello\ntitle: 下载\n---\n"))
+	for _, strategy := range []string{"markdown", "fixed"} {
+		c := newMarkdownChunker(1000, 1)
+		c.config.Strategy = strategy
+		doc, err := c.ChunkDocument(ctx, content, "download.md")
+		require.NoError(t, err)
+		assert.Equal(t, Metadata{"home": "hello", "title": "下载"}, doc.Metadata)
+
+		require.NotEmpty(t, doc.Chunks)
+		assert.Equal(t, body, doc.Chunks[0].StartOffset, strategy)
+		for _, chunk := range doc.Chunks {
+			assert.NotContains(t, chunk.Text, "home: hello")
+		}
+		if strategy == "markdown" {
+			assertVerbatim(t, content, doc.Chunks)
+		}
+	}
+
+	// Invalid front matter stays in the text
+	c := newMarkdownChunker(1000, 1)
+	doc, err := c.ChunkDocument(ctx, "---\nhome: [hello\n---\n# Download\n", "download.md")
+	require.NoError(t, err)
+	assert.Nil(t, doc.Metadata)
+	assert.Contains(t, doc.Chunks[0].Text, "home: [hello")
+}
+
+func TestParseMetadataFilter(t *testing.T) {
+	f, err := ParseMetadataFilter("lang=en")
+	require.NoError(t, err)
+	assert.Equal(t, MetadataFilter{Key: "lang", Values: []string{"en"}}, f)
+
+	f, err = ParseMetadataFilter("tags = go, db")
+	require.NoError(t, err)
+	assert.Equal(t, MetadataFilter{Key: "tags", Values: []string{"go", "db"}}, f)
+
+	f, err = ParseMetadataFilter("date>=2024-01-01")
+	require.NoError(t, err)
+	assert.Equal(t, MetadataFilter{Key: "date", From: "2024-01-01"}, f)
+
+	f, err = ParseMetadataFilter("date<=2024-01-31T12:00:00Z")
+	require.NoError(t, err)
+	assert.Equal(t, MetadataFilter{Key: "date", To: "2024-01-31T12:00:00Z"}, f)
+
+	for _, s := range []string{"lang", "=en", "date>=yesterday", "date<=2024-13-01"} {
+		_, err = ParseMetadataFilter(s)
+		assert.Error(t, err, s)
+	}
+
+	// A date as upper bound includes the whole day
+	from, to := MetadataFilter{Key: "date", From: "2024-01-01", To: "2024-01-31"}.timeRange()
+	assert.Equal(t, "2024-01-01T00:00:00Z", from)
+	assert.Equal(t, "2024-02-01T00:00:00Z", to)
+}
+
+// metadataDocuments are three documents with one chunk each and their front matter
+var metadataDocuments = []struct {
+	id       string
+	text     string
+	metadata Metadata
+}{
+	{"install-en", "How to install the release", Metadata{"lang": "en", "tags": []interface{}{"install", "release"},
+		"date": time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)}},
+	{"install-zh", "How to install the release in Chinese", Metadata{"lang": "zh", "tags": []interface{}{"install"},
+		"date": "2024-02-01"}},
+	{"faq-en", "Frequently asked install questions", Metadata{"lang": "en", "tags": "faq", "date": "soon"}},
+}
+
+func assertMetadataFilters(t *testing.T, search func(filters []MetadataFilter) ([]DocumentChunk, error)) {
+	documents := func(filters ...MetadataFilter) []string {
+		chunks, err := search(filters)
+		require.NoError(t, err)
+		var ids []string
+		for _, chunk := range chunks {
+			ids = append(ids, chunk.DocumentID)
+		}
+		return ids
+	}
+
+	assert.Len(t, documents(), 3)
+	assert.ElementsMatch(t, []string{"install-en", "faq-en"}, documents(MetadataFilter{Key: "lang", Values: []string{"en"}}))
+	assert.ElementsMatch(t, []string{"install-en", "faq-en"}, documents(MetadataFilter{Key: "tags", Values: []string{"release", "faq"}}))
+	assert.ElementsMatch(t, []string{"install-en"}, documents(
+		MetadataFilter{Key: "lang", Values: []string{"en"}},
+		MetadataFilter{Key: "tags", Values: []string{"install"}},
+	))
+	assert.ElementsMatch(t, []string{"install-zh"}, documents(MetadataFilter{Key: "date", Values: []string{"2024-02-01"}}))
+
+	// Ranges only match times, "soon" is not one
+	assert.ElementsMatch(t, []string{"install-en", "install-zh"}, documents(MetadataFilter{Key: "date", From: "2024-01-01"}))
+	assert.ElementsMatch(t, []string{"install-en"}, documents(MetadataFilter{Key: "date", From: "2024-01-01", To: "2024-01-31"}))
+	assert.ElementsMatch(t, []string{"install-zh"}, documents(MetadataFilter{Key: "date", From: "2024-02-01T00:00:00Z"}))
+	assert.Empty(t, documents(MetadataFilter{Key: "author", Values: []string{"en"}}))
+
+	_, err := search([]MetadataFilter{{Key: "date", From: "yesterday"}})
+	assert.Error(t, err)
+}
+
+func TestQueryDocumentChunksMetadataFilters(t *testing.T) {
+	ctx := context.Background()
+	var chunks []DocumentChunk
+	for _, doc := range metadataDocuments {
+		chunks = append(chunks, DocumentChunk{ID: doc.id, DocumentID: doc.id, Text: doc.text})
+	}
+	r, _ := newTestRAG("", chunks...)
+	for _, doc := range metadataDocuments {
+		require.NoError(t, r.Store.SetDocumentMetadata(ctx, doc.id, doc.metadata))
+	}
+
+	assertMetadataFilters(t, func(filters []MetadataFilter) ([]DocumentChunk, error) {
+		return r.QueryDocumentChunks(ctx, &AskParameter{Query: "install", RetrievalLimit: 10, Filters: filters})
+	})
+
+	// Removing a document removes its metadata
+	require.NoError(t, r.RemoveDocumentChunks(ctx, "install-zh"))
+	assert.NotContains(t, r.Store.(*memStore).metadata, "install-zh")
+}
+
+func TestDuckDBMetadataFilters(t *testing.T) {
+	ctx := context.Background()
+	store := newPlainDuckDBStore(t, 8)
+	db := store.db
+
+	for _, doc := range metadataDocuments {
+		err := store.UpsertDocumentChunks(ctx, []*DocumentChunk{{ID: doc.id, DocumentID: doc.id, Text: doc.text,
+			Embedding: toFloat32Slice(fakeEmbedding(doc.text, 8))}})
+		require.NoError(t, err)
+		// Replacing keeps one set of rows
+		require.NoError(t, store.SetDocumentMetadata(ctx, doc.id, Metadata{"lang": "fr"}))
+		require.NoError(t, store.SetDocumentMetadata(ctx, doc.id, doc.metadata))
+	}
+
+	query := toFloat32Slice(fakeEmbedding("install", 8))
+	assertMetadataFilters(t, func(filters []MetadataFilter) ([]DocumentChunk, error) {
+		return store.VectorSearch(ctx, query, 10, filters)
+	})
+
+	require.NoError(t, store.RemoveDocumentChunks(ctx, "install-zh"))
+	var n int
+	require.NoError(t, db.QueryRowContext(ctx, `SELECT count(*) FROM document_metadata WHERE document_id = 'install-zh'`).Scan(&n))
+	assert.Zero(t, n)
+	err := db.QueryRowContext(ctx, `SELECT value FROM document_metadata WHERE key = 'lang' AND value = 'fr'`).Scan(new(string))
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
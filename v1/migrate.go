@@ -0,0 +1,244 @@
+package rag
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Migration upgrades the schema to Version. Plan inspects the current schema and returns the
+// statements to run, so migrations can adopt databases created by older releases in place.
+type Migration struct {
+	Version     int
+	Description string
+	Plan        func(ctx context.Context, db execer, dimension int64) ([]string, error)
+}
+
+// MigrationStep is a planned or applied migration
+type MigrationStep struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+// Migrator applies numbered migrations in order and records the schema version in the meta table
+type Migrator struct {
+	db               *sql.DB
+	migrations       []Migration
+	defaultDimension int64
+	// dimension resolves the embedding dimension of an existing database, 0 if unknown
+	dimension func(ctx context.Context, db *sql.DB) (int64, error)
+}
+
+// LatestVersion is the schema version after all migrations are applied
+func (m *Migrator) LatestVersion() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Migrations returns all known migrations in order
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// Close closes the underlying database
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// SchemaVersion returns the recorded schema version, 0 for empty or unversioned databases
+func (m *Migrator) SchemaVersion(ctx context.Context) (int, error) {
+	exists, err := tableExists(ctx, m.db, "meta")
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var value string
+	err = m.db.QueryRowContext(ctx, "SELECT value FROM meta WHERE key = 'schema_version'").Scan(&value)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "Failed to query schema version")
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Invalid schema version %q", value)
+	}
+	return version, nil
+}
+
+// Pending plans the migrations that have not been applied yet without changing the database. Each
+// is planned against the schema the earlier ones leave, they are applied in a transaction that is
+// rolled back.
+func (m *Migrator) Pending(ctx context.Context) ([]MigrationStep, error) {
+	version, err := m.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if version > m.LatestVersion() {
+		return nil, errors.Newf("schema version %d is newer than supported version %d", version, m.LatestVersion())
+	}
+
+	dimension, err := m.resolveDimension(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var steps []MigrationStep
+	for _, migration := range m.migrations {
+		if migration.Version <= version {
+			continue
+		}
+		statements, err := migration.Plan(ctx, tx, dimension)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to plan migration %d", migration.Version)
+		}
+		for _, statement := range statements {
+			_, err = tx.ExecContext(ctx, statement)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to plan migration %d, statement %q", migration.Version, statement)
+			}
+		}
+		steps = append(steps, MigrationStep{
+			Version:     migration.Version,
+			Description: migration.Description,
+			Statements:  statements,
+		})
+	}
+	return steps, nil
+}
+
+// Migrate applies pending migrations, each in its own transaction, and returns the applied steps
+func (m *Migrator) Migrate(ctx context.Context) ([]MigrationStep, error) {
+	version, err := m.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if version > m.LatestVersion() {
+		return nil, errors.Newf("schema version %d is newer than supported version %d", version, m.LatestVersion())
+	}
+
+	dimension, err := m.resolveDimension(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []MigrationStep
+	for _, migration := range m.migrations {
+		if migration.Version <= version {
+			continue
+		}
+
+		// Plan right before applying, earlier migrations may have changed the schema
+		statements, err := migration.Plan(ctx, m.db, dimension)
+		if err != nil {
+			return applied, errors.Wrapf(err, "Failed to plan migration %d", migration.Version)
+		}
+		err = m.apply(ctx, migration.Version, statements)
+		if err != nil {
+			return applied, errors.Wrapf(err, "Failed to apply migration %d (%s)", migration.Version, migration.Description)
+		}
+		applied = append(applied, MigrationStep{
+			Version:     migration.Version,
+			Description: migration.Description,
+			Statements:  statements,
+		})
+	}
+	return applied, nil
+}
+
+func (m *Migrator) apply(ctx context.Context, version int, statements []string) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			return errors.Wrapf(err, "statement %q", statement)
+		}
+	}
+
+	// Every migration list starts by creating the meta table
+	_, err = tx.ExecContext(ctx, `INSERT INTO meta (key, value) VALUES ('schema_version', $1)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value`, strconv.Itoa(version))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *Migrator) resolveDimension(ctx context.Context) (int64, error) {
+	dimension, err := m.dimension(ctx, m.db)
+	if err != nil {
+		return 0, err
+	}
+	if dimension == 0 {
+		dimension = m.defaultDimension
+	}
+	return dimension, nil
+}
+
+// metaDimension reads embedding_dimension from a key/value table, 0 if the table or key doesn't exist
+func metaDimension(ctx context.Context, db execer, table string) (int64, error) {
+	exists, err := tableExists(ctx, db, table)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var value string
+	err = db.QueryRowContext(ctx, fmt.Sprintf("SELECT value FROM %s WHERE key = 'embedding_dimension'", table)).
+		Scan(&value)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "Failed to query embedding dimension")
+	}
+	d, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Invalid embedding dimension %q", value)
+	}
+	return d, nil
+}
+
+func tableExists(ctx context.Context, db execer, table string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM information_schema.tables WHERE table_name = $1", table).Scan(&count)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to look up table %s", table)
+	}
+	return count > 0, nil
+}
+
+// columnType returns the data type of a column, empty if the column doesn't exist
+func columnType(ctx context.Context, db execer, table, column string) (string, error) {
+	var dataType string
+	err := db.QueryRowContext(ctx,
+		"SELECT data_type FROM information_schema.columns WHERE table_name = $1 AND column_name = $2",
+		table, column).Scan(&dataType)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "Failed to look up column %s.%s", table, column)
+	}
+	return dataType, nil
+}
@@ -0,0 +1,206 @@
+package rag
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/marcboeker/go-duckdb/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openPlainDuckDB(t *testing.T) *sql.DB {
+	connector, err := duckdb.NewConnector("", nil)
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// newPlainDuckDBStore returns a store on a plain DuckDB with the tables of all migrations,
+// without the HNSW index that needs the vss extension
+func newPlainDuckDBStore(t *testing.T, dimension int64) *DuckDBStore {
+	ctx := context.Background()
+	db := openPlainDuckDB(t)
+	for _, migration := range duckDBMigrations {
+		statements, err := migration.Plan(ctx, db, dimension)
+		require.NoError(t, err)
+		for _, statement := range statements {
+			if strings.Contains(statement, "hnsw") {
+				continue
+			}
+			_, err = db.ExecContext(ctx, statement)
+			require.NoError(t, err)
+		}
+	}
+	return &DuckDBStore{db: db, dimension: dimension}
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	db := openPlainDuckDB(t)
+
+	m := &Migrator{
+		db:               db,
+		defaultDimension: 8,
+		dimension: func(ctx context.Context, db *sql.DB) (int64, error) {
+			return metaDimension(ctx, db, "meta")
+		},
+		migrations: []Migration{
+			{
+				Version:     1,
+				Description: "create meta",
+				Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+					return []string{`CREATE TABLE IF NOT EXISTS meta (key VARCHAR PRIMARY KEY, value VARCHAR NOT NULL)`}, nil
+				},
+			},
+			{
+				Version:     2,
+				Description: "create items",
+				Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+					exists, err := tableExists(ctx, db, "items")
+					if err != nil || exists {
+						return nil, err
+					}
+					return []string{`CREATE TABLE items (id BIGINT)`}, nil
+				},
+			},
+			{
+				Version:     3,
+				Description: "widen items.id of older databases",
+				Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+					dataType, err := columnType(ctx, db, "items", "id")
+					if err != nil || dataType == "BIGINT" {
+						return nil, err
+					}
+					return []string{`ALTER TABLE items ALTER COLUMN id TYPE BIGINT`}, nil
+				},
+			},
+		},
+	}
+	assert.Equal(t, 3, m.LatestVersion())
+
+	version, err := m.SchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	// Dry run plans everything against the schema the earlier steps leave and changes nothing
+	pending, err := m.Pending(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 3)
+	assert.Equal(t, []string{`CREATE TABLE items (id BIGINT)`}, pending[1].Statements)
+	assert.Empty(t, pending[2].Statements)
+	exists, err := tableExists(ctx, db, "meta")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	applied, err := m.Migrate(ctx)
+	require.NoError(t, err)
+	assert.Len(t, applied, 3)
+	for i := range applied {
+		assert.Equal(t, pending[i].Statements, applied[i].Statements)
+	}
+	version, err = m.SchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, version)
+
+	// Nothing left to do
+	pending, err = m.Pending(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	applied, err = m.Migrate(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	// Refuse databases from the future
+	_, err = db.Exec(`UPDATE meta SET value = '4' WHERE key = 'schema_version'`)
+	require.NoError(t, err)
+	_, err = m.Migrate(ctx)
+	assert.Error(t, err)
+}
+
+func TestMigrateLegacyDuckDB(t *testing.T) {
+	ctx := context.Background()
+	db := openPlainDuckDB(t)
+	if err := loadDuckDBExtensions(db); err != nil {
+		t.Skipf("DuckDB extensions not available: %v", err)
+	}
+
+	// Schema written by earlier releases, see docs/note.md
+	for _, statement := range []string{
+		`CREATE TABLE document_chunks (id VARCHAR PRIMARY KEY, document_id VARCHAR, file_path VARCHAR,
+			text VARCHAR, start_offset INTEGER, end_offset INTEGER, embedding FLOAT[])`,
+		`INSERT INTO document_chunks VALUES ('c1', 'd1', 'guide/a.md', 'hello', 0, 0, [1.0, 2.0, 3.0, 4.0])`,
+		`CREATE TABLE processed_files (file_path VARCHAR PRIMARY KEY, file_hash VARCHAR NOT NULL,
+			processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+		`INSERT INTO processed_files (file_path, file_hash) VALUES ('/docs/guide/a.md', 'h1')`,
+		`CREATE TABLE rag_metadata (key VARCHAR PRIMARY KEY, value VARCHAR NOT NULL)`,
+		`INSERT INTO rag_metadata VALUES ('embedding_dimension', '4')`,
+	} {
+		_, err := db.Exec(statement)
+		require.NoError(t, err)
+	}
+
+	m := NewDuckDBMigrator(db, 1024)
+	pending, err := m.Pending(ctx)
+	require.NoError(t, err)
+	assert.Len(t, pending, m.LatestVersion())
+
+	_, err = m.Migrate(ctx)
+	require.NoError(t, err)
+
+	version, err := m.SchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, m.LatestVersion(), version)
+
+	s := &DuckDBStore{db: db, dimension: 4}
+	chunk, err := s.GetDocumentChunk(ctx, "c1")
+	require.NoError(t, err)
+	assert.Equal(t, []float32{1, 2, 3, 4}, chunk.Embedding)
+	assert.Equal(t, "guide/a.md", chunk.FilePath)
+
+	info, err := s.GetProcessedFile(ctx, "/docs/guide/a.md")
+	require.NoError(t, err)
+	require.NotNil(t, info)
+	assert.Equal(t, "a.md", info.FileName)
+
+	exists, err := tableExists(ctx, db, "rag_metadata")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	d, err := metaDimension(ctx, db, "meta")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), d)
+}
+
+func TestOpenDuckDBKeepsKeywordIndex(t *testing.T) {
+	ctx := context.Background()
+	exists, err := fullTextIndexExists(openPlainDuckDB(t))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	path := filepath.Join(t.TempDir(), "rag.duckdb")
+	s, err := OpenDuckDB(path, 3)
+	if err != nil {
+		t.Skipf("DuckDB extensions not available: %v", err)
+	}
+	exists, err = fullTextIndexExists(s.db)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	require.NoError(t, s.UpsertDocumentChunks(ctx, []*DocumentChunk{{ID: "c1", DocumentID: "d1", Text: "lease expiry"}}))
+	require.NoError(t, s.Close())
+
+	// Opening doesn't rebuild the index, writers do
+	s, err = OpenDuckDB(path, 3)
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+	chunks, err := s.KeywordSearch(ctx, "lease", []float32{1, 0, 0}, 10, nil)
+	require.NoError(t, err)
+	assert.Empty(t, chunks)
+	require.NoError(t, s.RebuildKeywordIndex(ctx))
+	chunks, err = s.KeywordSearch(ctx, "lease", []float32{1, 0, 0}, 10, nil)
+	require.NoError(t, err)
+	assert.Len(t, chunks, 1)
+}
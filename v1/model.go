@@ -21,6 +21,35 @@ type DocumentChunk struct {
 	Text       string
 	Embedding  []float32
 	Index      int
+
+	// Provenance in the source document
+	FilePath    string // Path relative to the indexed directory, slash separated
+	StartOffset int    // Character offset of the first character in the source file
+	EndOffset   int    // Character offset after the last character in the source file
+	HeadingPath string // Heading breadcrumb, e.g. "Guide > Install > Linux"
+	PageStart   int    `json:",omitempty"` // First page of the chunk in paginated sources such as PDF
+	PageEnd     int    `json:",omitempty"` // Last page of the chunk in paginated sources
+	ImagePath   string `json:",omitempty"` // Image a caption chunk describes, slash separated like FilePath
+	Symbol      string `json:",omitempty"` // Declaration of a source code chunk, e.g. "RAG.Ask"
+	SymbolKind  string `json:",omitempty"` // Kind of the declaration, e.g. "func", "method", "type", "class"
+	LineStart   int    `json:",omitempty"` // First line of the chunk in source code
+	LineEnd     int    `json:",omitempty"` // Last line of the chunk in source code
+
+	// Commit of a file indexed from a git repository, see GitRepo
+	CommitSHA  string     `json:",omitempty"` // Commit that last changed the file
+	CommitDate *time.Time `json:",omitempty"` // Author date of the commit, UTC
+
+	// Small-to-big retrieval, see ChunkingConfig.ParentChunkSize
+	ParentID string `json:",omitempty"` // Parent section a child chunk is part of
+	IsParent bool   `json:",omitempty"` // Parent sections are context for their children, never embedded or searched
+
+	// Retrieval results, only set on chunks returned by a query
+	Distance      float64 `json:",omitempty"` // L2 distance to the query embedding
+	Score         float64 `json:",omitempty"` // Cosine similarity to the query embedding
+	KeywordScore  float64 `json:",omitempty"` // BM25 score, zero when not matched by keywords
+	FusionScore   float64 `json:",omitempty"` // Reciprocal-rank fusion score
+	RetrievalRank int     `json:",omitempty"` // 1-based rank after retrieval
+	RerankRank    int     `json:",omitempty"` // 1-based rank after LLM selection
 }
 
 func hashString(s string) string {
@@ -36,12 +65,46 @@ type Document struct {
 	FilePath   string           `json:"file_path"`
 	DocumentID string           `json:"document_id"`
 	Chunks     []*DocumentChunk `json:"chunks"`
+	Metadata   Metadata         `json:"metadata,omitempty"` // Front matter, e.g. title, tags, lang and date
 }
 
 type AskParameter struct {
-	Query          string          `json:"query"`
-	SelectedChunks []DocumentChunk `json:"selected_chunks"`
-	RetrievalLimit int             `json:"retrieval_limit"` // Number of vector retrievals, e.g., 100
-	SelectedLimit  int             `json:"selected_limit"`  // Number of LLM selections, e.g., 10
-	SystemPrompt   string          `json:"system_prompt"`   // Custom system prompt
+	Query          string           `json:"query"`
+	SelectedChunks []DocumentChunk  `json:"selected_chunks"`
+	RetrievalLimit int              `json:"retrieval_limit"` // Number of vector retrievals, e.g., 100
+	SelectedLimit  int              `json:"selected_limit"`  // Number of LLM selections, e.g., 10
+	SystemPrompt   string           `json:"system_prompt"`   // Custom system prompt
+	VectorWeight   float64          `json:"vector_weight"`   // Fusion weight of the vector channel
+	KeywordWeight  float64          `json:"keyword_weight"`  // Fusion weight of the BM25 keyword channel
+	MinScore       float64          `json:"min_score"`       // Minimum similarity score of retrieved chunks, e.g., 0.3
+	Citations      bool             `json:"citations"`       // Ask the model to cite the selected chunks
+	Filters        []MetadataFilter `json:"filters"`         // Metadata filters on the documents of retrieved chunks
+	Expand         string           `json:"expand"`          // Answer from the "parent" sections or the "neighbors" of selected chunks
+	Neighbors      int              `json:"neighbors"`       // Chunks on each side of a selected chunk to answer from with Expand "neighbors"
+}
+
+// Answer is a generated answer with the chunks it is based on
+type Answer struct {
+	Text    string   `json:"text"`
+	Sources []Source `json:"sources"` // Cited chunks, empty unless citations were asked for
+}
+
+// Source is a chunk an answer is based on, cited as [Number] in the answer text
+type Source struct {
+	Number      int        `json:"number"`
+	ChunkID     string     `json:"chunk_id"`
+	DocumentID  string     `json:"document_id"`
+	FilePath    string     `json:"file_path,omitempty"`
+	HeadingPath string     `json:"heading_path,omitempty"`
+	StartOffset int        `json:"start_offset,omitempty"`
+	EndOffset   int        `json:"end_offset,omitempty"`
+	PageStart   int        `json:"page_start,omitempty"`
+	PageEnd     int        `json:"page_end,omitempty"`
+	ImagePath   string     `json:"image_path,omitempty"`
+	Symbol      string     `json:"symbol,omitempty"`
+	SymbolKind  string     `json:"symbol_kind,omitempty"`
+	LineStart   int        `json:"line_start,omitempty"`
+	LineEnd     int        `json:"line_end,omitempty"`
+	CommitSHA   string     `json:"commit_sha,omitempty"`
+	CommitDate  *time.Time `json:"commit_date,omitempty"`
 }
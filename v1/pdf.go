@@ -0,0 +1,102 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// pdfLoader extracts the text of PDF files page by page, pages are separated by a blank line
+type pdfLoader struct{}
+
+func (pdfLoader) Load(ctx context.Context, filePath string) (*LoadedFile, error) {
+	f, r, err := pdf.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return loadPDF(ctx, r)
+}
+
+// LoadStream reads the whole stream, PDFs are parsed from their trailer at the end
+func (pdfLoader) LoadStream(ctx context.Context, r io.Reader) (*LoadedFile, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := pdf.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return nil, err
+	}
+	return loadPDF(ctx, reader)
+}
+
+func loadPDF(ctx context.Context, r *pdf.Reader) (*LoadedFile, error) {
+	var b strings.Builder
+	file := &LoadedFile{}
+	offset := 0
+	for i := 1; i <= r.NumPage(); i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		text, err := pdfPageText(r.Page(i))
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %w", i, err)
+		}
+		if i > 1 {
+			b.WriteString("\n\n")
+			offset += 2
+		}
+		file.Pages = append(file.Pages, offset)
+		b.WriteString(text)
+		offset += utf8.RuneCountInString(text)
+	}
+	file.Text = b.String()
+	return file, nil
+}
+
+// pdfPageText lays out the glyphs of a page in content order, which follows the columns of the
+// page. Lines break where the baseline moves, words where glyphs are further apart than a space
+// would place them and paragraphs at larger vertical gaps.
+func pdfPageText(page pdf.Page) (text string, err error) {
+	if page.V.IsNull() {
+		return "", nil
+	}
+	defer func() {
+		// The parser panics on malformed content streams
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed content: %v", r)
+		}
+	}()
+
+	var b strings.Builder
+	var prev *pdf.Text
+	for _, glyph := range page.Content().Text {
+		if glyph.S == "\n" || glyph.S == "" {
+			// Marks the end of a TJ array, not a glyph
+			continue
+		}
+		if prev != nil {
+			size := math.Max(prev.FontSize, 1)
+			dy := prev.Y - glyph.Y
+			switch {
+			case dy > 1.8*size:
+				b.WriteString("\n\n")
+			case math.Abs(dy) > 0.5*size || glyph.X < prev.X-size:
+				b.WriteString("\n")
+			case glyph.X-(prev.X+prev.W) > 0.15*size && glyph.S != " " && prev.S != " ":
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString(glyph.S)
+		g := glyph
+		prev = &g
+	}
+	return strings.TrimSpace(b.String()), nil
+}
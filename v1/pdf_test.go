@@ -0,0 +1,162 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestPDF writes a PDF with a page of Helvetica text lines per element of pages, words are
+// placed by TJ offsets rather than spaces like TeX does, empty lines separate paragraphs
+func writeTestPDF(t *testing.T, pages ...[]string) string {
+	widths := strings.TrimSpace(strings.Repeat("500 ", 95))
+	objects := []string{
+		"", // Catalog
+		"", // Pages
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding " +
+			"/FirstChar 32 /LastChar 126 /Widths [" + widths + "] >>",
+	}
+	var kids []string
+	for _, lines := range pages {
+		var content strings.Builder
+		content.WriteString("BT /F1 12 Tf 14 TL 72 720 Td\n")
+		for _, line := range lines {
+			if line != "" {
+				content.WriteString("[(" + strings.Join(strings.Fields(line), ") -300 (") + ")] TJ\n")
+			}
+			content.WriteString("T*\n")
+		}
+		content.WriteString("ET")
+		objects = append(objects, fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+		objects = append(objects, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] "+
+			"/Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", len(objects)))
+		kids = append(kids, fmt.Sprintf("%d 0 R", len(objects)))
+	}
+	objects[0] = "<< /Type /Catalog /Pages 2 0 R >>"
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	path := filepath.Join(t.TempDir(), "test.pdf")
+	require.NoError(t, os.WriteFile(path, b.Bytes(), 0644))
+	return path
+}
+
+func TestPDFLoader(t *testing.T) {
+	path := writeTestPDF(t,
+		[]string{"The Chubby lock service", "for distributed systems.", "", "Clients elect a master."},
+		[]string{"Paxos keeps the replicas consistent."})
+
+	file, err := LoadFile(context.Background(), path)
+	require.NoError(t, err)
+	assert.Equal(t, "The Chubby lock service\nfor distributed systems.\n\nClients elect a master.\n\n"+
+		"Paxos keeps the replicas consistent.", file.Text)
+	require.Len(t, file.Pages, 2)
+	assert.Equal(t, 0, file.Pages[0])
+	assert.True(t, strings.HasPrefix(string([]rune(file.Text)[file.Pages[1]:]), "Paxos"))
+	assert.Equal(t, 1, file.PageAt(0))
+	assert.Equal(t, 1, file.PageAt(file.Pages[1]-1))
+	assert.Equal(t, 2, file.PageAt(file.Pages[1]))
+
+	_, err = LoadFile(context.Background(), filepath.Join(t.TempDir(), "missing.pdf"))
+	assert.Error(t, err)
+	assert.IsType(t, textLoader{}, LoaderFor("guide.md"))
+	assert.IsType(t, pdfLoader{}, LoaderFor("paper.PDF"))
+}
+
+func TestChunkPDFPages(t *testing.T) {
+	var pages [][]string
+	for i := 1; i <= 3; i++ {
+		pages = append(pages, []string{
+			fmt.Sprintf("Page %d starts with a sentence about locks.", i), "",
+			fmt.Sprintf("Page %d ends with a sentence about caching.", i),
+		})
+	}
+	path := writeTestPDF(t, pages...)
+
+	c := newMarkdownChunker(60, 1)
+	doc, err := c.GetDocumentChunks(context.Background(), path)
+	require.NoError(t, err)
+	require.Len(t, doc.Chunks, 6)
+	for i, chunk := range doc.Chunks {
+		page := i/2 + 1
+		assert.Equal(t, page, chunk.PageStart, chunk.Text)
+		assert.Equal(t, page, chunk.PageEnd, chunk.Text)
+		assert.Contains(t, chunk.Text, fmt.Sprintf("Page %d", page))
+	}
+
+	// A chunk across page breaks covers all its pages
+	c = newMarkdownChunker(1000, 1)
+	doc, err = c.GetDocumentChunks(context.Background(), path)
+	require.NoError(t, err)
+	require.Len(t, doc.Chunks, 1)
+	assert.Equal(t, 1, doc.Chunks[0].PageStart)
+	assert.Equal(t, 3, doc.Chunks[0].PageEnd)
+
+	source := newSource(1, *doc.Chunks[0])
+	assert.True(t, strings.HasSuffix(source.String(), "test.pdf, pp. 1-3"), source.String())
+	assert.Equal(t, "p. 7", FormatPages(7, 7))
+	assert.Empty(t, FormatPages(0, 0))
+}
+
+// TestChubbyPDF compares the text of the bundled paper with its hand conversion to markdown
+func TestChubbyPDF(t *testing.T) {
+	buf, err := os.ReadFile("../testdata/chubby-osdi06.pdf")
+	require.NoError(t, err)
+	if !bytes.HasPrefix(buf, []byte("%PDF")) {
+		t.Skip("chubby-osdi06.pdf is a Git LFS pointer, run git lfs pull")
+	}
+	markdown, err := os.ReadFile("../testdata/chubby-osdi06.md")
+	require.NoError(t, err)
+
+	file, err := LoadFile(context.Background(), "../testdata/chubby-osdi06.pdf")
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(file.Pages), 10)
+	runes := []rune(file.Text)
+	assert.Contains(t, string(runes[:file.Pages[1]]), "Chubby lock service")
+
+	// Most words of the conversion are extracted
+	word := regexp.MustCompile(`[a-z]{4,}`)
+	extracted := make(map[string]bool)
+	for _, w := range word.FindAllString(strings.ToLower(file.Text), -1) {
+		extracted[w] = true
+	}
+	words := word.FindAllString(strings.ToLower(string(markdown)), -1)
+	found := 0
+	for _, w := range words {
+		if extracted[w] {
+			found++
+		}
+	}
+	assert.Greater(t, float64(found)/float64(len(words)), 0.9)
+
+	// Chunks are on the pages they are cut from
+	doc, err := newMarkdownChunker(1000, 1).GetDocumentChunks(context.Background(), "../testdata/chubby-osdi06.pdf")
+	require.NoError(t, err)
+	for _, chunk := range doc.Chunks {
+		require.GreaterOrEqual(t, chunk.PageStart, 1)
+		require.GreaterOrEqual(t, chunk.PageEnd, chunk.PageStart)
+		start := string(runes[file.Pages[chunk.PageStart-1]:])
+		assert.Contains(t, start, chunk.Text)
+	}
+}
@@ -0,0 +1,626 @@
+package rag
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/rs/zerolog/log"
+)
+
+// pgvectorMaxIndexDimension is the largest vector pgvector can build an HNSW index on
+const pgvectorMaxIndexDimension = 2000
+
+// PostgresStore is the Store backed by PostgreSQL with the pgvector extension
+type PostgresStore struct {
+	db        *sql.DB
+	dimension int64
+}
+
+var _ Store = (*PostgresStore)(nil)
+
+func OpenPostgres(dsn string, defaultDimension int64) (*PostgresStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = MigratePostgres(db, defaultDimension)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	dimension, err := readEmbeddingDimension(db, "SELECT value FROM meta WHERE key = 'embedding_dimension'")
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &PostgresStore{db: db, dimension: dimension}, nil
+}
+
+// MigratePostgres creates the vector extension and upgrades the schema to the latest version
+func MigratePostgres(db *sql.DB, defaultDimension int64) error {
+	_, err := db.Exec(`CREATE EXTENSION IF NOT EXISTS vector`)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create vector extension")
+	}
+
+	applied, err := NewPostgresMigrator(db, defaultDimension).Migrate(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, step := range applied {
+		log.Info().Int("version", step.Version).Str("description", step.Description).
+			Msg("Applied schema migration")
+	}
+	return nil
+}
+
+// NewPostgresMigrator returns the migrator of a PostgreSQL database, the vector extension must exist
+func NewPostgresMigrator(db *sql.DB, defaultDimension int64) *Migrator {
+	return &Migrator{
+		db:               db,
+		migrations:       postgresMigrations,
+		defaultDimension: defaultDimension,
+		dimension: func(ctx context.Context, db *sql.DB) (int64, error) {
+			return metaDimension(ctx, db, "meta")
+		},
+	}
+}
+
+var postgresMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "create meta, document_chunks and processed_files tables",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			statements := []string{
+				`CREATE TABLE IF NOT EXISTS meta (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL)`,
+				fmt.Sprintf(`CREATE TABLE IF NOT EXISTS document_chunks (
+	id TEXT PRIMARY KEY,
+	document_id TEXT,
+	text TEXT,
+	embedding vector(%d))`, dimension),
+				`CREATE TABLE IF NOT EXISTS processed_files (
+	file_path TEXT PRIMARY KEY,
+	file_name TEXT NOT NULL,
+	file_hash TEXT NOT NULL,
+	processed_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP)`,
+				fmt.Sprintf(`INSERT INTO meta (key, value) VALUES ('embedding_dimension', '%d') ON CONFLICT DO NOTHING`, dimension),
+				// Unlike DuckDB fts, the GIN index is maintained on writes
+				`CREATE INDEX IF NOT EXISTS fts_idx ON document_chunks USING gin (to_tsvector('simple', text))`,
+			}
+			if dimension <= pgvectorMaxIndexDimension {
+				statements = append(statements,
+					`CREATE INDEX IF NOT EXISTS hnsw_idx ON document_chunks USING hnsw (embedding vector_l2_ops)`)
+			}
+			return statements, nil
+		},
+	},
+	{
+		Version:     2,
+		Description: "add chunk provenance columns",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return []string{
+				`ALTER TABLE document_chunks
+	ADD COLUMN IF NOT EXISTS file_path TEXT,
+	ADD COLUMN IF NOT EXISTS start_offset INTEGER,
+	ADD COLUMN IF NOT EXISTS end_offset INTEGER,
+	ADD COLUMN IF NOT EXISTS chunk_index INTEGER,
+	ADD COLUMN IF NOT EXISTS heading_path TEXT`,
+			}, nil
+		},
+	},
+	{
+		Version:     3,
+		Description: "create embedding_cache table",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS embedding_cache (
+	model TEXT NOT NULL,
+	dimensions INTEGER NOT NULL,
+	text_hash TEXT NOT NULL,
+	embedding vector NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT now(),
+	last_used_at TIMESTAMPTZ DEFAULT now(),
+	PRIMARY KEY (model, dimensions, text_hash)
+)`,
+			}, nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "create document_metadata table",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS document_metadata (
+	document_id TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (document_id, key, value)
+)`,
+				`CREATE INDEX IF NOT EXISTS document_metadata_key_value_idx ON document_metadata (key, value)`,
+			}, nil
+		},
+	},
+	{
+		Version:     5,
+		Description: "add parent section columns",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return []string{
+				`ALTER TABLE document_chunks
+	ADD COLUMN IF NOT EXISTS parent_id TEXT,
+	ADD COLUMN IF NOT EXISTS is_parent BOOLEAN`,
+			}, nil
+		},
+	},
+	{
+		Version:     6,
+		Description: "add chunk page columns",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return []string{
+				`ALTER TABLE document_chunks
+	ADD COLUMN IF NOT EXISTS page_start INTEGER,
+	ADD COLUMN IF NOT EXISTS page_end INTEGER`,
+			}, nil
+		},
+	},
+	{
+		Version:     7,
+		Description: "add image captions",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return []string{
+				`ALTER TABLE document_chunks ADD COLUMN IF NOT EXISTS image_path TEXT`,
+				`CREATE TABLE IF NOT EXISTS caption_cache (
+	model TEXT NOT NULL,
+	image_hash TEXT NOT NULL,
+	caption TEXT NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT now(),
+	PRIMARY KEY (model, image_hash)
+)`,
+			}, nil
+		},
+	},
+	{
+		Version:     8,
+		Description: "add chunk symbol columns",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return []string{
+				`ALTER TABLE document_chunks
+	ADD COLUMN IF NOT EXISTS symbol TEXT,
+	ADD COLUMN IF NOT EXISTS symbol_kind TEXT,
+	ADD COLUMN IF NOT EXISTS line_start INTEGER,
+	ADD COLUMN IF NOT EXISTS line_end INTEGER`,
+			}, nil
+		},
+	},
+	{
+		Version:     9,
+		Description: "add chunk commit columns",
+		Plan: func(ctx context.Context, db execer, dimension int64) ([]string, error) {
+			return []string{
+				`ALTER TABLE document_chunks
+	ADD COLUMN IF NOT EXISTS commit_sha TEXT,
+	ADD COLUMN IF NOT EXISTS commit_date TIMESTAMPTZ`,
+			}, nil
+		},
+	},
+}
+
+// formatVector encodes an embedding as a pgvector text literal, nil stays NULL
+func formatVector(v []float32) interface{} {
+	if v == nil {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, f := range v {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(float64(f), 'g', -1, 32))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// parseVector decodes a pgvector text literal like [1,2.5,3]
+func parseVector(s string) ([]float32, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return nil, errors.Newf("invalid vector literal %q", s)
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	if s == "" {
+		return []float32{}, nil
+	}
+
+	parts := strings.Split(s, ",")
+	v := make([]float32, len(parts))
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid vector element %q", part)
+		}
+		v[i] = float32(f)
+	}
+	return v, nil
+}
+
+func (s *PostgresStore) GetMeta(ctx context.Context, key string) (string, error) {
+	return getMeta(ctx, s.db, key)
+}
+
+func (s *PostgresStore) SetMeta(ctx context.Context, key, value string) error {
+	return setMeta(ctx, s.db, key, value)
+}
+
+func (s *PostgresStore) EmbeddingDimension() int64 {
+	return s.dimension
+}
+
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *PostgresStore) UpsertDocumentChunks(ctx context.Context, chunks []*DocumentChunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO document_chunks (`+chunkColumns+`, embedding)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20::vector)
+		ON CONFLICT (id) DO UPDATE SET
+			document_id = EXCLUDED.document_id,
+			file_path = EXCLUDED.file_path,
+			start_offset = EXCLUDED.start_offset,
+			end_offset = EXCLUDED.end_offset,
+			chunk_index = EXCLUDED.chunk_index,
+			heading_path = EXCLUDED.heading_path,
+			parent_id = EXCLUDED.parent_id,
+			is_parent = EXCLUDED.is_parent,
+			page_start = EXCLUDED.page_start,
+			page_end = EXCLUDED.page_end,
+			image_path = EXCLUDED.image_path,
+			symbol = EXCLUDED.symbol,
+			symbol_kind = EXCLUDED.symbol_kind,
+			line_start = EXCLUDED.line_start,
+			line_end = EXCLUDED.line_end,
+			commit_sha = EXCLUDED.commit_sha,
+			commit_date = EXCLUDED.commit_date`)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+
+	for _, chunk := range chunks {
+		_, err = stmt.ExecContext(ctx, append(chunkArgs(chunk), formatVector(chunk.Embedding))...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetDocumentChunk(ctx context.Context, id string) (*DocumentChunk, error) {
+	row := s.db.QueryRowContext(ctx,
+		"SELECT "+chunkColumns+", embedding::text FROM document_chunks WHERE id = $1", id)
+
+	var chunk DocumentChunk
+	var cs chunkScanner
+	var embedding sql.NullString
+	err := row.Scan(append(cs.dest(&chunk), &embedding)...)
+	if err != nil {
+		return nil, err
+	}
+	cs.fill(&chunk)
+	if embedding.Valid {
+		chunk.Embedding, err = parseVector(embedding.String)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &chunk, nil
+}
+
+func (s *PostgresStore) ListDocumentChunks(ctx context.Context, withoutEmbedding bool) ([]DocumentChunk, error) {
+	query := "SELECT " + chunkColumns + " FROM document_chunks WHERE is_parent IS NOT TRUE"
+	if withoutEmbedding {
+		query += " AND embedding IS NULL"
+	}
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return scanChunks(rows)
+}
+
+func (s *PostgresStore) ListChunksByIndex(ctx context.Context, documentID string, from, to int) ([]DocumentChunk, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+chunkColumns+` FROM document_chunks
+		WHERE document_id = $1 AND chunk_index BETWEEN $2 AND $3 AND is_parent IS NOT TRUE
+		ORDER BY chunk_index`, documentID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return scanChunks(rows)
+}
+
+func (s *PostgresStore) UpdateEmbedding(ctx context.Context, id string, embedding []float32) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE document_chunks SET embedding = $1::vector WHERE id = $2",
+		formatVector(embedding), id)
+	return err
+}
+
+func (s *PostgresStore) UpdateEmbeddings(ctx context.Context, chunks []DocumentChunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx, "UPDATE document_chunks SET embedding = $1::vector WHERE id = $2")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+
+	for _, chunk := range chunks {
+		_, err = stmt.ExecContext(ctx, formatVector(chunk.Embedding), chunk.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) RemoveDocumentChunks(ctx context.Context, documentID string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM document_chunks WHERE document_id = $1", documentID)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, "DELETE FROM document_metadata WHERE document_id = $1", documentID)
+	return err
+}
+
+func (s *PostgresStore) SetDocumentMetadata(ctx context.Context, documentID string, metadata Metadata) error {
+	return setDocumentMetadata(ctx, s.db, documentID, metadata)
+}
+
+func (s *PostgresStore) VectorSearch(ctx context.Context, embedding []float32, limit int, filters []MetadataFilter) ([]DocumentChunk, error) {
+	condition, args, err := andMetadata(filters, 3)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+chunkColumns+`,
+			embedding <-> $1::vector,
+			1 - (embedding <=> $1::vector)
+		FROM document_chunks
+		WHERE embedding IS NOT NULL `+condition+`
+		ORDER BY embedding <-> $1::vector LIMIT $2`,
+		append([]interface{}{formatVector(embedding), limit}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var chunks []DocumentChunk
+	for rows.Next() {
+		var chunk DocumentChunk
+		var cs chunkScanner
+		var score sql.NullFloat64
+		err = rows.Scan(append(cs.dest(&chunk), &chunk.Distance, &score)...)
+		if err != nil {
+			return nil, err
+		}
+		cs.fill(&chunk)
+		chunk.Score = score.Float64
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, rows.Err()
+}
+
+func (s *PostgresStore) KeywordSearch(ctx context.Context, query string, embedding []float32, limit int, filters []MetadataFilter) ([]DocumentChunk, error) {
+	condition, args, err := andMetadata(filters, 4)
+	if err != nil {
+		return nil, err
+	}
+	// plainto_tsquery ANDs the terms, OR them so partial matches rank like BM25 does
+	rows, err := s.db.QueryContext(ctx, `
+		WITH q AS (
+			SELECT NULLIF(replace(plainto_tsquery('simple', $2)::text, '&', '|'), '')::tsquery AS query
+		)
+		SELECT `+chunkColumns+`,
+			ts_rank_cd(to_tsvector('simple', text), q.query) AS rank,
+			embedding <-> $1::vector,
+			1 - (embedding <=> $1::vector)
+		FROM document_chunks, q
+		WHERE to_tsvector('simple', text) @@ q.query AND is_parent IS NOT TRUE `+condition+`
+		ORDER BY rank DESC LIMIT $3`,
+		append([]interface{}{formatVector(embedding), query, limit}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var chunks []DocumentChunk
+	for rows.Next() {
+		var chunk DocumentChunk
+		var cs chunkScanner
+		var distance, score sql.NullFloat64
+		err = rows.Scan(append(cs.dest(&chunk), &chunk.KeywordScore, &distance, &score)...)
+		if err != nil {
+			return nil, err
+		}
+		cs.fill(&chunk)
+		chunk.Distance = distance.Float64
+		chunk.Score = score.Float64
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+// RebuildKeywordIndex is a no-op, the GIN index is kept up to date by PostgreSQL
+func (s *PostgresStore) RebuildKeywordIndex(ctx context.Context) error {
+	return nil
+}
+
+func (s *PostgresStore) GetProcessedFile(ctx context.Context, filePath string) (*FileInfo, error) {
+	var info FileInfo
+	err := s.db.QueryRowContext(ctx,
+		"SELECT file_path, file_name, file_hash, processed_at FROM processed_files WHERE file_path = $1", filePath).
+		Scan(&info.FilePath, &info.FileName, &info.FileHash, &info.ProcessedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (s *PostgresStore) ListProcessedFiles(ctx context.Context) ([]FileInfo, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT file_path, file_name, file_hash, processed_at FROM processed_files")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var infos []FileInfo
+	for rows.Next() {
+		var info FileInfo
+		err = rows.Scan(&info.FilePath, &info.FileName, &info.FileHash, &info.ProcessedAt)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
+
+func (s *PostgresStore) UpsertProcessedFile(ctx context.Context, info *FileInfo) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO processed_files (file_path, file_name, file_hash, processed_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (file_path) DO UPDATE SET
+			file_hash = EXCLUDED.file_hash,
+			processed_at = EXCLUDED.processed_at`,
+		info.FilePath, info.FileName, info.FileHash)
+	return err
+}
+
+func (s *PostgresStore) RemoveProcessedFile(ctx context.Context, filePath string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM processed_files WHERE file_path = $1", filePath)
+	return err
+}
+
+func (s *PostgresStore) embeddingCache() *sqlEmbeddingCache {
+	return &sqlEmbeddingCache{
+		db:           s.db,
+		vector:       func(expr string) string { return expr + "::vector" },
+		column:       "embedding::text",
+		encodeVector: formatVector,
+		decodeVector: func(v interface{}) ([]float32, error) {
+			switch literal := v.(type) {
+			case string:
+				return parseVector(literal)
+			case []byte:
+				return parseVector(string(literal))
+			default:
+				return nil, errors.Newf("unexpected embedding type %T", v)
+			}
+		},
+	}
+}
+
+func (s *PostgresStore) GetCachedEmbeddings(ctx context.Context, model string, dimensions int64, hashes []string) (map[string][]float32, error) {
+	return s.embeddingCache().get(ctx, model, dimensions, hashes)
+}
+
+func (s *PostgresStore) PutCachedEmbeddings(ctx context.Context, model string, dimensions int64, embeddings map[string][]float32) error {
+	return s.embeddingCache().put(ctx, model, dimensions, embeddings)
+}
+
+func (s *PostgresStore) GetCachedCaption(ctx context.Context, model, imageHash string) (string, error) {
+	return getCachedCaption(ctx, s.db, model, imageHash)
+}
+
+func (s *PostgresStore) PutCachedCaption(ctx context.Context, model, imageHash, caption string) error {
+	return putCachedCaption(ctx, s.db, model, imageHash, caption)
+}
+
+func (s *PostgresStore) EmbeddingCacheSummary(ctx context.Context) ([]EmbeddingCacheSummary, error) {
+	return s.embeddingCache().summary(ctx)
+}
+
+func (s *PostgresStore) PruneEmbeddingCache(ctx context.Context, opts PruneOptions) (int64, error) {
+	return s.embeddingCache().prune(ctx, opts)
+}
+
+func (s *PostgresStore) reembed() *sqlReembed {
+	return &sqlReembed{
+		db:             s.db,
+		vectorType:     "vector",
+		encodeVector:   formatVector,
+		swapStatements: postgresReembedSwap,
+	}
+}
+
+func postgresReembedSwap(dimension int64) []string {
+	statements := []string{
+		`DROP INDEX IF EXISTS hnsw_idx`,
+		fmt.Sprintf(`ALTER TABLE document_chunks ALTER COLUMN embedding TYPE vector(%d) USING NULL`, dimension),
+		fmt.Sprintf(`UPDATE document_chunks SET embedding = r.embedding::vector(%d)
+		FROM embedding_reembed r WHERE document_chunks.id = r.id`, dimension),
+	}
+	if dimension <= pgvectorMaxIndexDimension {
+		statements = append(statements,
+			`CREATE INDEX hnsw_idx ON document_chunks USING hnsw (embedding vector_l2_ops)`)
+	}
+	return statements
+}
+
+func (s *PostgresStore) BeginReembed(ctx context.Context, model string, dimension int64) (int64, error) {
+	return s.reembed().begin(ctx, model, dimension)
+}
+
+func (s *PostgresStore) ListReembedPending(ctx context.Context) ([]DocumentChunk, error) {
+	return s.reembed().pending(ctx)
+}
+
+func (s *PostgresStore) UpdateReembedEmbeddings(ctx context.Context, chunks []DocumentChunk) error {
+	return s.reembed().update(ctx, chunks)
+}
+
+func (s *PostgresStore) SwapReembed(ctx context.Context) error {
+	dimension, err := s.reembed().swap(ctx)
+	if err != nil {
+		return err
+	}
+	s.dimension = dimension
+	return nil
+}
@@ -5,8 +5,13 @@ import (
 	"strings"
 )
 
+const DefaultSystemPrompt = "Answer the question based on the following knowledge in Chinese: "
+
+const citationInstruction = "Cite the knowledge fragments that support each statement with their numbers " +
+	"in square brackets, e.g. [1] or [2][3]. Do not cite fragments that are not listed."
+
 func BuildPrompt(query string, documents []DocumentChunk) string {
-	return BuildPromptWithSystem(query, documents, "Answer the question based on the following knowledge in Chinese: ")
+	return BuildPromptWithSystem(query, documents, DefaultSystemPrompt)
 }
 
 func BuildPromptWithSystem(query string, documents []DocumentChunk, systemPrompt string) string {
@@ -20,3 +25,51 @@ func BuildPromptWithSystem(query string, documents []DocumentChunk, systemPrompt
 	b.WriteString(query)
 	return b.String()
 }
+
+// BuildCitationPrompt numbers the fragments from 1 with their source and asks the model to cite them
+func BuildCitationPrompt(query string, documents []DocumentChunk, systemPrompt string) string {
+	var b strings.Builder
+	b.WriteString(systemPrompt)
+	b.WriteString("\n")
+	b.WriteString(citationInstruction)
+	b.WriteString("\n\n")
+	for i, doc := range documents {
+		b.WriteString(fmt.Sprintf("Knowledge fragment [%d]", i+1))
+		if source := formatChunkSource(doc); source != "" {
+			b.WriteString(fmt.Sprintf(" (source: %s)", source))
+		}
+		b.WriteString(fmt.Sprintf(": %s\n\n", doc.Text))
+	}
+	b.WriteString("Question: ")
+	b.WriteString(query)
+	return b.String()
+}
+
+func formatChunkSource(chunk DocumentChunk) string {
+	filePath := chunk.FilePath
+	if filePath != "" {
+		filePath += FormatLines(chunk.LineStart, chunk.LineEnd)
+	}
+	heading := chunk.HeadingPath
+	if symbol := FormatSymbol(chunk.SymbolKind, chunk.Symbol); symbol != "" {
+		heading = symbol
+	}
+	source := filePath + HeadingPathSeparator + heading
+	if heading == "" {
+		source = filePath
+	} else if filePath == "" {
+		source = heading
+	}
+	// The commit date tells the model how fresh the source is
+	details := []string{FormatPages(chunk.PageStart, chunk.PageEnd), FormatCommit(chunk.CommitSHA, chunk.CommitDate)}
+	for _, detail := range details {
+		switch {
+		case detail == "":
+		case source == "":
+			source = detail
+		default:
+			source += ", " + detail
+		}
+	}
+	return source
+}
@@ -0,0 +1,160 @@
+package rag
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// HeadingPathSeparator joins the headings of a breadcrumb
+const HeadingPathSeparator = " > "
+
+var atxHeadingPattern = regexp.MustCompile(`^ {0,3}(#{1,6})[ \t]+(.*?)[ \t#]*$`)
+
+// heading is an ATX heading of the source document
+type heading struct {
+	offset int // byte offset of the heading line
+	level  int
+	title  string
+}
+
+// normalizedOffsets maps every byte of normalized, the output of preprocessText, back to its byte
+// offset in original. preprocessText only collapses ASCII whitespace runs into a single space, drops
+// NUL characters and trims the ends, so the two strings can be aligned in one pass.
+func normalizedOffsets(original, normalized string) []int {
+	offsets := make([]int, len(normalized))
+
+	i := 0
+	for i < len(original) {
+		r, size := utf8.DecodeRuneInString(original[i:])
+		if r != 0 && !unicode.IsSpace(r) {
+			break
+		}
+		i += size
+	}
+
+	for j := 0; j < len(normalized); j++ {
+		for i < len(original) && original[i] == 0 {
+			i++
+		}
+		if i >= len(original) {
+			offsets[j] = len(original)
+			continue
+		}
+
+		offsets[j] = i
+		i++
+		if normalized[j] == ' ' {
+			for i < len(original) && isASCIISpace(original[i]) {
+				i++
+			}
+		}
+	}
+	return offsets
+}
+
+func isASCIISpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\f' || b == '\r'
+}
+
+// parseHeadings returns the ATX headings of a markdown document, skipping fenced code blocks
+func parseHeadings(content string) []heading {
+	var headings []heading
+	var fence string
+	offset := 0
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case fence != "":
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+		case strings.HasPrefix(trimmed, "```"):
+			fence = "```"
+		case strings.HasPrefix(trimmed, "~~~"):
+			fence = "~~~"
+		default:
+			if m := atxHeadingPattern.FindStringSubmatch(strings.TrimRight(line, "\r\n")); m != nil {
+				headings = append(headings, heading{offset: offset, level: len(m[1]), title: m[2]})
+			}
+		}
+		offset += len(line)
+	}
+	return headings
+}
+
+// headingPathAt returns the heading breadcrumb in effect at byte offset of the document
+func headingPathAt(headings []heading, offset int) string {
+	var stack []heading
+	for _, h := range headings {
+		if h.offset > offset {
+			break
+		}
+		for len(stack) > 0 && stack[len(stack)-1].level >= h.level {
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, h)
+	}
+
+	return breadcrumb(stack)
+}
+
+// breadcrumb joins the titles of a heading stack
+func breadcrumb(headings []heading) string {
+	titles := make([]string, len(headings))
+	for i, h := range headings {
+		titles[i] = h.title
+	}
+	return strings.Join(titles, HeadingPathSeparator)
+}
+
+// annotateProvenance sets the source offsets and heading breadcrumb of chunks cut from normalized,
+// the preprocessed form of original. Chunks are located in order, overlapping chunks are allowed.
+func annotateProvenance(original, normalized string, chunks []*DocumentChunk) {
+	offsets := normalizedOffsets(original, normalized)
+	headings := parseHeadings(original)
+
+	cursor := 0
+	for _, chunk := range chunks {
+		start, end, ok := locateChunk(normalized, chunk.Text, cursor)
+		if !ok {
+			continue
+		}
+		cursor = start + 1
+
+		byteStart := offsets[start]
+		byteEnd := offsets[end-1] + 1
+		chunk.StartOffset = utf8.RuneCountInString(original[:byteStart])
+		chunk.EndOffset = chunk.StartOffset + utf8.RuneCountInString(original[byteStart:byteEnd])
+		chunk.HeadingPath = headingPathAt(headings, byteStart)
+	}
+}
+
+// locateChunk finds text in content at or after cursor. Chunks joined from several pieces don't
+// appear verbatim, those are located by their first and last pieces.
+func locateChunk(content, text string, cursor int) (start int, end int, ok bool) {
+	if text == "" || cursor > len(content) {
+		return 0, 0, false
+	}
+	if i := strings.Index(content[cursor:], text); i >= 0 {
+		return cursor + i, cursor + i + len(text), true
+	}
+
+	const probe = 32
+	head, tail := text, text
+	if len(text) > probe {
+		head = text[:probe]
+		tail = text[len(text)-probe:]
+	}
+	i := strings.Index(content[cursor:], head)
+	if i < 0 {
+		return 0, 0, false
+	}
+	start = cursor + i
+	j := strings.Index(content[start:], tail)
+	if j < 0 {
+		return 0, 0, false
+	}
+	return start, start + j + len(tail), true
+}
@@ -0,0 +1,74 @@
+package rag
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizedOffsets(t *testing.T) {
+	c := &DocumentChunker{config: DefaultChunkingConfig()}
+	original := "\n\n# 标题\r\n\r\nfirst  line\tand\u0000 more \x00 text\n\n"
+	normalized := c.preprocessText(original)
+	offsets := normalizedOffsets(original, normalized)
+	require.Len(t, offsets, len(normalized))
+
+	for j := 0; j < len(normalized); j++ {
+		if normalized[j] == ' ' {
+			assert.True(t, isASCIISpace(original[offsets[j]]), "offset %d", j)
+		} else {
+			assert.Equal(t, normalized[j], original[offsets[j]], "offset %d", j)
+		}
+	}
+}
+
+func TestHeadingPath(t *testing.T) {
+	content := "# Guide\n\nintro\n\n## Install\n\n```sh\n# not a heading\n```\n\n### Linux\n\ntext\n\n## Usage\n"
+	headings := parseHeadings(content)
+	require.Len(t, headings, 4)
+
+	assert.Equal(t, "", headingPathAt(nil, 0))
+	assert.Equal(t, "Guide", headingPathAt(headings, len("# Guide\n\nin")))
+	linux := len("# Guide\n\nintro\n\n## Install\n\n```sh\n# not a heading\n```\n\n### Linux\n\nte")
+	assert.Equal(t, "Guide > Install > Linux", headingPathAt(headings, linux))
+	assert.Equal(t, "Guide > Usage", headingPathAt(headings, len(content)-1))
+}
+
+func TestGetDocumentChunksProvenance(t *testing.T) {
+	dir := t.TempDir()
+	content := "# Guide\n\nSlimRAG is a minimalist   RAG system.\n\n## Install\n\nRun go build to install it. Then run srag update.\n"
+	path := filepath.Join(dir, "docs", "guide.md")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+
+	config := DefaultChunkingConfig()
+	config.Strategy = "fixed"
+	config.MaxChunkSize = 40
+	config.MinChunkSize = 1
+	config.OverlapSize = 0
+	c := &DocumentChunker{config: config, cwd: dir}
+
+	doc, err := c.GetDocumentChunks(context.Background(), path)
+	require.NoError(t, err)
+	require.NotEmpty(t, doc.Chunks)
+
+	runes := []rune(content)
+	for i, chunk := range doc.Chunks {
+		assert.Equal(t, "docs/guide.md", chunk.FilePath)
+		assert.Equal(t, i, chunk.Index)
+		require.Less(t, chunk.StartOffset, chunk.EndOffset)
+		require.LessOrEqual(t, chunk.EndOffset, utf8.RuneCountInString(content))
+
+		// The source span normalizes back to the chunk text
+		assert.Equal(t, chunk.Text, c.preprocessText(string(runes[chunk.StartOffset:chunk.EndOffset])))
+	}
+
+	assert.Equal(t, "Guide", doc.Chunks[0].HeadingPath)
+	last := doc.Chunks[len(doc.Chunks)-1]
+	assert.Equal(t, "Guide > Install", last.HeadingPath)
+}
@@ -2,142 +2,58 @@ package rag
 
 import (
 	"context"
-	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/cespare/xxhash"
 	"github.com/minio/minio-go/v7"
 	"github.com/openai/openai-go"
 	"github.com/rs/zerolog/log"
-	"github.com/schollz/progressbar/v3"
-	"github.com/sourcegraph/conc/pool"
 )
 
 type RAG struct {
-	DB                  *sql.DB
+	Store               Store
 	OSS                 *minio.Client
 	EmbeddingClient     interface{}
 	EmbeddingModel      string
 	EmbeddingDimensions int64
 	AssistantClient     interface{}
 	AssistantModel      string
-}
 
-func (r *RAG) UpsertDocumentChunks(document *Document) error {
-	if len(document.Chunks) == 0 {
-		return nil
-	}
+	// Embedding batches are limited by both, zero means the default
+	EmbeddingBatchSize  int // Maximum number of chunks per request
+	EmbeddingBatchChars int // Maximum number of characters per request
+	EmbeddingRetry      RetryPolicy
 
-	tx, err := r.DB.Begin()
-	if err != nil {
-		return err
-	}
-	defer func() { _ = tx.Rollback() }()
+	// Images referenced by markdown documents are captioned by this vision model of
+	// AssistantClient, empty disables. Captions are cached in stores implementing CaptionCacheStore.
+	CaptionModel string
 
-	stmt, err := tx.Prepare(`
-		INSERT INTO document_chunks (id, document_id, text)
-		VALUES (?, ?, ?)`)
-	if err != nil {
-		return err
-	}
-	defer func() { _ = stmt.Close() }()
+	// Embeddings are cached in stores implementing EmbeddingCacheStore unless disabled
+	DisableEmbeddingCache bool
+	cacheHits             int64
+	cacheMisses           int64
+}
 
+func (r *RAG) UpsertDocumentChunks(ctx context.Context, document *Document) error {
 	for _, chunk := range document.Chunks {
 		log.Trace().Str("chunk_id", chunk.ID).
 			Str("document_id", chunk.DocumentID).
 			Msg("Upserting document chunk")
-		_, err = stmt.Exec(chunk.ID, chunk.DocumentID, chunk.Text)
-		if err != nil {
-			return err
-		}
-	}
-
-	return tx.Commit()
-}
-
-func (r *RAG) ComputeEmbeddings(ctx context.Context, onlyEmpty bool, workers int, callback func()) error {
-	var err error
-	var rows *sql.Rows
-	if onlyEmpty {
-		rows, err = r.DB.QueryContext(ctx,
-			"SELECT id, text, embedding FROM document_chunks WHERE embedding IS NULL")
-	} else {
-		rows, err = r.DB.QueryContext(ctx,
-			"SELECT id, text, embedding FROM document_chunks")
 	}
+	err := r.Store.UpsertDocumentChunks(ctx, document.Chunks)
 	if err != nil {
 		return err
 	}
-	defer func() { _ = rows.Close() }()
-
-	bar := progressbar.Default(-1)
-	bar.Describe("Computing embeddings")
-	defer func() { _ = bar.Finish() }()
-
-	p := pool.New().WithMaxGoroutines(workers)
-	var wg sync.WaitGroup // wait for all jobs finished
-
-	for rows.Next() {
-		var chunk DocumentChunk
-		var embeddingBytes interface{}
-		err = rows.Scan(&chunk.ID, &chunk.Text, &embeddingBytes)
-		if err != nil {
-			return err
-		}
-
-		// Skip if embedding already exists or text is empty
-		if embeddingBytes != nil || len(chunk.Text) == 0 {
-			_ = bar.Add(1)
-			continue
-		}
-
-		p.Go(func() {
-			wg.Add(1)
-			defer func() {
-				_ = bar.Add(1)
-				wg.Done()
-			}()
-
-			var rsp *openai.CreateEmbeddingResponse
-			embeddingClient := ToEmbeddingClient(r.EmbeddingClient)
-			if embeddingClient == nil {
-				log.Error().Msg("Failed to get embedding client")
-				return
-			}
-			rsp, err = embeddingClient.New(ctx, openai.EmbeddingNewParams{
-				Model: r.EmbeddingModel,
-				Input: openai.EmbeddingNewParamsInputUnion{
-					OfString: openai.String(chunk.Text),
-				},
-				Dimensions:     openai.Int(r.EmbeddingDimensions),
-				EncodingFormat: openai.EmbeddingNewParamsEncodingFormatFloat,
-			})
-			if err != nil {
-				log.Error().Err(err).Stack().Str("chunk_id", chunk.ID).Msg("Compute embedding")
-				return
-			}
-
-			chunk.Embedding = toFloat32Slice(rsp.Data[0].Embedding)
-
-			_, err = r.DB.ExecContext(ctx, "UPDATE document_chunks SET embedding = ? WHERE id = ?", chunk.Embedding, chunk.ID)
-			if err != nil {
-				log.Error().Err(err).Stack().Str("chunk_id", chunk.ID).Msg("Update embedding")
-			} else {
-				callback()
-			}
-		})
+	if len(document.Metadata) == 0 {
+		return nil
 	}
-
-	wg.Wait()
-	p.Wait()
-	return nil
+	return r.Store.SetDocumentMetadata(ctx, document.DocumentID, document.Metadata)
 }
 
 func toFloat32Slice(v []float64) []float32 {
@@ -148,87 +64,90 @@ func toFloat32Slice(v []float64) []float32 {
 	return x
 }
 
-func (r *RAG) QueryDocumentChunks(ctx context.Context, query string, limit int) ([]DocumentChunk, error) {
-	embeddingClient := ToEmbeddingClient(r.EmbeddingClient)
-	if embeddingClient == nil {
-		return nil, errors.New("failed to get embedding client")
-	}
-
-	rsp, err := embeddingClient.New(ctx, openai.EmbeddingNewParams{
-		Model: r.EmbeddingModel,
-		Input: openai.EmbeddingNewParamsInputUnion{
-			OfString: openai.String(query),
-		},
-		Dimensions: openai.Int(r.EmbeddingDimensions),
-	})
-	if err != nil {
-		return nil, err
+// QueryDocumentChunks retrieves chunks by fusing vector search and BM25 keyword search.
+// Every returned chunk carries its similarity score, distance and retrieval rank,
+// chunks scoring below p.MinScore are dropped. With p.Filters only chunks of documents whose
+// metadata matches all filters are retrieved.
+func (r *RAG) QueryDocumentChunks(ctx context.Context, p *AskParameter) ([]DocumentChunk, error) {
+	vectorWeight, keywordWeight := p.FusionWeights()
+	for _, f := range p.Filters {
+		err := f.Validate()
+		if err != nil {
+			return nil, err
+		}
 	}
-	queryEmbedding := toFloat32Slice(rsp.Data[0].Embedding)
 
-	rows, err := r.DB.QueryContext(ctx, fmt.Sprintf(`
-		SELECT id, document_id, text, embedding FROM document_chunks
-		ORDER BY array_distance(embedding, ?::FLOAT[%d]) LIMIT ?`, r.EmbeddingDimensions), queryEmbedding, limit)
+	// The query embedding also scores keyword hits, so it is always computed
+	queryEmbedding, err := r.embedQuery(ctx, p.Query)
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = rows.Close() }()
 
-	var chunks []DocumentChunk
-	for rows.Next() {
-		var chunk DocumentChunk
-		var embeddingInterface interface{}
-		err = rows.Scan(&chunk.ID, &chunk.DocumentID, &chunk.Text, &embeddingInterface)
+	var vectorChunks []DocumentChunk
+	if vectorWeight > 0 {
+		vectorChunks, err = r.Store.VectorSearch(ctx, queryEmbedding, p.RetrievalLimit, p.Filters)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		// Convert embedding from []interface{} to []float32
-		if embeddingInterface != nil {
-			if embeddingSlice, ok := embeddingInterface.([]interface{}); ok {
-				chunk.Embedding = make([]float32, len(embeddingSlice))
-				for i, v := range embeddingSlice {
-					if f, ok := v.(float64); ok {
-						chunk.Embedding[i] = float32(f)
-					}
-				}
-			}
+	var keywordChunks []DocumentChunk
+	if keywordWeight > 0 {
+		keywordChunks, err = r.Store.KeywordSearch(ctx, p.Query, queryEmbedding, p.RetrievalLimit, p.Filters)
+		if err != nil {
+			// The keyword index may be missing on databases created before hybrid retrieval
+			log.Warn().Err(err).Msg("Keyword search failed, falling back to vector search only")
 		}
-		chunks = append(chunks, chunk)
 	}
 
-	return chunks, nil
+	chunks := fuseRankings(p.RetrievalLimit,
+		rankedChunks{chunks: vectorChunks, weight: vectorWeight},
+		rankedChunks{chunks: keywordChunks, weight: keywordWeight},
+	)
+	return filterByScore(chunks, p.MinScore), nil
 }
 
-func (r *RAG) GetDocumentChunk(id string) (*DocumentChunk, error) {
-	row := r.DB.QueryRow("SELECT id, document_id, file_path, text, embedding FROM document_chunks WHERE id = ?", id)
-
-	var chunk DocumentChunk
-	var embeddingInterface interface{}
-	err := row.Scan(&chunk.ID, &chunk.DocumentID, &chunk.Text, &embeddingInterface)
+func (r *RAG) embedQuery(ctx context.Context, query string) ([]float32, error) {
+	err := r.checkEmbeddingModel(ctx, false)
 	if err != nil {
 		return nil, err
 	}
 
-	// Convert embedding from []interface{} to []float32
-	if embeddingInterface != nil {
-		if embeddingSlice, ok := embeddingInterface.([]interface{}); ok {
-			chunk.Embedding = make([]float32, len(embeddingSlice))
-			for i, v := range embeddingSlice {
-				if f, ok := v.(float64); ok {
-					chunk.Embedding[i] = float32(f)
-				}
-			}
-		}
+	if embedding, ok := r.cachedEmbeddings(ctx, []string{query})[CalculateStringHash(query)]; ok {
+		return embedding, nil
+	}
+
+	embeddingClient := ToEmbeddingClient(r.EmbeddingClient)
+	if embeddingClient == nil {
+		return nil, errors.New("failed to get embedding client")
+	}
+
+	rsp, err := embeddingClient.New(ctx, openai.EmbeddingNewParams{
+		Model: r.EmbeddingModel,
+		Input: openai.EmbeddingNewParamsInputUnion{
+			OfString: openai.String(query),
+		},
+		Dimensions: openai.Int(r.EmbeddingDimensions),
+	})
+	if err != nil {
+		return nil, err
 	}
+	if len(rsp.Data) == 0 {
+		return nil, errors.New("no embedding returned for query")
+	}
+	embedding := toFloat32Slice(rsp.Data[0].Embedding)
+	r.cacheEmbeddings(ctx, []string{query}, [][]float32{embedding})
+	return embedding, nil
+}
 
-	return &chunk, nil
+func (r *RAG) GetDocumentChunk(ctx context.Context, id string) (*DocumentChunk, error) {
+	return r.Store.GetDocumentChunk(ctx, id)
 }
 
 // Rerank uses LLM to select the most relevant document chunks for the query
 func (r *RAG) Rerank(ctx context.Context, query string, chunks []DocumentChunk, selectedLimit int) ([]DocumentChunk, error) {
 	if len(chunks) <= selectedLimit {
-		return chunks, nil
+		return withRerankRanks(chunks), nil
 	}
 
 	// Build LLM selection prompt
@@ -270,7 +189,17 @@ func (r *RAG) Rerank(ctx context.Context, query string, chunks []DocumentChunk,
 	log.Info().Int("total_chunks", len(chunks)).
 		Int("selected_chunks", len(selectedChunks)).
 		Msg("LLM-based chunk selection completed")
-	return selectedChunks, nil
+	return withRerankRanks(selectedChunks), nil
+}
+
+// withRerankRanks returns a copy of chunks with RerankRank set to their 1-based position
+func withRerankRanks(chunks []DocumentChunk) []DocumentChunk {
+	ranked := make([]DocumentChunk, len(chunks))
+	for i, chunk := range chunks {
+		chunk.RerankRank = i + 1
+		ranked[i] = chunk
+	}
+	return ranked
 }
 
 // buildSelectionPrompt builds the prompt for LLM to select document chunks
@@ -327,32 +256,79 @@ func (r *RAG) parseSelectedIndices(content string, maxIndex int) ([]int, error)
 	return indices, nil
 }
 
-func (r *RAG) Ask(ctx context.Context, p *AskParameter) (string, error) {
-	var prompt string
-	if p.SystemPrompt != "" {
-		prompt = BuildPromptWithSystem(p.Query, p.SelectedChunks, p.SystemPrompt)
-	} else {
-		prompt = BuildPrompt(p.Query, p.SelectedChunks)
+// Ask generates an answer from p.SelectedChunks. With p.Citations the model cites the chunks
+// and the answer lists the cited ones, otherwise all selected chunks are listed as sources.
+func (r *RAG) Ask(ctx context.Context, p *AskParameter) (*Answer, error) {
+	chatClient := ToChatClient(r.AssistantClient)
+	if chatClient == nil {
+		return nil, errors.New("failed to get chat client")
+	}
+
+	c, err := chatClient.Completions().New(ctx, r.answerParams(p))
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Choices) == 0 {
+		return nil, errors.New("no choices returned from chat completion")
 	}
+	return newAnswer(p, c.Choices[0].Message.Content), nil
+}
 
+// AskStream is Ask with the answer streamed, onDelta receives each piece of text as it arrives.
+// Markers in the streamed text are not renumbered, the returned answer is.
+func (r *RAG) AskStream(ctx context.Context, p *AskParameter, onDelta func(delta string) error) (*Answer, error) {
 	chatClient := ToChatClient(r.AssistantClient)
 	if chatClient == nil {
-		return "", errors.New("failed to get chat client")
+		return nil, errors.New("failed to get chat client")
 	}
 
-	c, err := chatClient.Completions().New(ctx, openai.ChatCompletionNewParams{
+	stream := chatClient.Completions().NewStreaming(ctx, r.answerParams(p))
+	defer func() { _ = stream.Close() }()
+
+	var b strings.Builder
+	for stream.Next() {
+		chunk := stream.Current()
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		delta := chunk.Choices[0].Delta.Content
+		b.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			return nil, err
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+	return newAnswer(p, b.String()), nil
+}
+
+func (r *RAG) answerParams(p *AskParameter) openai.ChatCompletionNewParams {
+	systemPrompt := p.SystemPrompt
+	if systemPrompt == "" {
+		systemPrompt = DefaultSystemPrompt
+	}
+
+	var prompt string
+	if p.Citations {
+		prompt = BuildCitationPrompt(p.Query, p.SelectedChunks, systemPrompt)
+	} else {
+		prompt = BuildPromptWithSystem(p.Query, p.SelectedChunks, systemPrompt)
+	}
+
+	return openai.ChatCompletionNewParams{
 		Model: r.AssistantModel,
 		Messages: []openai.ChatCompletionMessageParamUnion{
 			openai.UserMessage(prompt),
 		},
-	})
-	if err != nil {
-		return "", err
 	}
-	if len(c.Choices) > 0 {
-		return c.Choices[0].Message.Content, nil
+}
+
+func newAnswer(p *AskParameter, text string) *Answer {
+	if p.Citations {
+		return resolveCitations(text, p.SelectedChunks)
 	}
-	return "", errors.New("no choices returned from chat completion")
+	return &Answer{Text: text}
 }
 
 // CalculateStringHash calculates xxh64 hash of a string
@@ -370,150 +346,108 @@ func CalculateFileHash(path string) (string, error) {
 	return CalculateStringHash(string(buf)), nil
 }
 
-func (r *RAG) GetProcessedFileHash(filePath string) (string, error) {
-	var storedHash string
-	err := r.DB.
-		QueryRow("SELECT file_hash FROM processed_files WHERE file_path = ?", filePath).
-		Scan(&storedHash)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			err = nil
-		}
+func (r *RAG) GetProcessedFileHash(ctx context.Context, filePath string) (string, error) {
+	info, err := r.Store.GetProcessedFile(ctx, filePath)
+	if err != nil || info == nil {
 		return "", err
 	}
-	return storedHash, nil
+	return info.FileHash, nil
 }
 
 // IsFileProcessed checks if a file has been processed and if its hash matches
-func (r *RAG) IsFileProcessed(filePath, currentHash string) (bool, error) {
-	var storedHash string
-	err := r.DB.QueryRow("SELECT file_hash FROM processed_files WHERE file_path = ?", filePath).Scan(&storedHash)
+func (r *RAG) IsFileProcessed(ctx context.Context, filePath, currentHash string) (bool, error) {
+	storedHash, err := r.GetProcessedFileHash(ctx, filePath)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return false, nil // File not processed yet
-		}
 		return false, err
 	}
 	return storedHash == currentHash, nil
 }
 
 // UpdateProcessedFileHash updates or inserts the file hash record
-func (r *RAG) UpdateProcessedFileHash(filePath, fileHash string) error {
-	_, err := r.DB.Exec(`INSERT INTO processed_files (file_path, file_name, file_hash, processed_at)
-		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
-		ON CONFLICT (file_path) DO UPDATE SET
-			file_hash = EXCLUDED.file_hash,
-			processed_at = EXCLUDED.processed_at`,
-		filePath, filepath.Base(filePath), fileHash)
-	return err
+func (r *RAG) UpdateProcessedFileHash(ctx context.Context, filePath, fileHash string) error {
+	return r.Store.UpsertProcessedFile(ctx, &FileInfo{
+		FilePath: filePath,
+		FileName: filepath.Base(filePath),
+		FileHash: fileHash,
+	})
 }
 
 // RemoveDocumentChunks removes all chunks for a specific document
-func (r *RAG) RemoveDocumentChunks(documentID string) error {
-	_, err := r.DB.Exec("DELETE FROM document_chunks WHERE document_id = ?", documentID)
-	return err
+func (r *RAG) RemoveDocumentChunks(ctx context.Context, documentID string) error {
+	return r.Store.RemoveDocumentChunks(ctx, documentID)
 }
 
-func (r *RAG) RemoveDocumentChunksByFileHash(fileHash string) error {
-	_, err := r.DB.Exec("DELETE FROM document_chunks WHERE file_hash = ?", fileHash)
-	return err
+// RemoveDocumentChunksByFileHash removes the chunks of a file version, the document ID is the content hash
+func (r *RAG) RemoveDocumentChunksByFileHash(ctx context.Context, fileHash string) error {
+	return r.Store.RemoveDocumentChunks(ctx, fileHash)
 }
 
-func (r *RAG) RemoveDocumentChunksByFilePath(filePath string) error {
+// RemoveDocumentChunksByFilePath removes the chunks of the recorded version of a file or crawled page
+func (r *RAG) RemoveDocumentChunksByFilePath(ctx context.Context, filePath string) error {
 	// find last file hash
-	storedHash, err := r.GetProcessedFileHash(filePath)
+	storedHash, err := r.GetProcessedFileHash(ctx, filePath)
 	if err != nil {
 		return err
 	}
 
-	if storedHash != "" {
-		err = r.RemoveDocumentChunksByFileHash(storedHash)
+	if storedHash != "" && isURL(filePath) {
+		err = r.RemoveDocumentChunks(ctx, pageDocumentID(filePath, storedHash))
 		if err != nil {
 			return err
 		}
-	}
-
-	_, err = r.DB.Exec("DELETE FROM processed_files WHERE file_hash = ?", storedHash)
-	return err
-}
-
-// FindFilesToProcess returns all file paths from the processed_files table
-// Delete non-exist files, update changed files
-func (r *RAG) FindFilesToProcess(filePathListForNow []string, force bool) ([]FileInfo, error) {
-	infos := make([]FileInfo, 0)
-	if force {
-		for _, filePath := range filePathListForNow {
-			var h string
-			h, err := CalculateFileHash(filePath)
-			if err != nil {
-				return nil, err
-			}
-
-			infos = append(infos, FileInfo{
-				FilePath:    filePath,
-				FileName:    filepath.Base(filePath),
-				FileHash:    h,
-				ProcessedAt: time.Now(),
-			})
+	} else if storedHash != "" {
+		err = r.RemoveDocumentChunksByFileHash(ctx, storedHash)
+		if err != nil {
+			return err
 		}
-		return infos, nil
 	}
 
-	filesMap := make(map[string]struct{})
-	for _, file := range filePathListForNow {
-		filesMap[file] = struct{}{}
-	}
+	return r.Store.RemoveProcessedFile(ctx, filePath)
+}
 
-	rows, err := r.DB.Query("SELECT file_path, file_name, file_hash FROM processed_files")
+// FindFilesToProcess returns new and changed files among filePathListForNow, or all of them if force is set.
+// Recorded files that no longer exist on disk are removed together with their chunks.
+func (r *RAG) FindFilesToProcess(ctx context.Context, filePathListForNow []string, force bool) ([]FileInfo, error) {
+	processed, err := r.Store.ListProcessedFiles(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = rows.Close() }()
-
-	haveRows := false
-	toDeleteFilePathList := make([]string, 0)
 
-	for rows.Next() {
-		fileInfo := FileInfo{}
-		err = rows.Scan(&fileInfo.FilePath, &fileInfo.FileName, &fileInfo.FileHash)
-		if err != nil {
-			return nil, err
-		}
-		haveRows = true
-
-		processed := false
-		_, processed = filesMap[fileInfo.FilePath]
-		if !processed {
-			infos = append(infos, fileInfo)
+	storedHashes := make(map[string]string, len(processed))
+	for _, info := range processed {
+		storedHashes[info.FilePath] = info.FileHash
+		if isURL(info.FilePath) {
+			// Crawled pages and bucket objects are updated by crawl and update s3://
 			continue
 		}
 
-		var h string
-		h, err = CalculateFileHash(fileInfo.FilePath)
-		if err != nil {
-			return nil, err
-		}
-		if h == "" {
+		_, err = os.Stat(info.FilePath)
+		if errors.Is(err, os.ErrNotExist) {
 			// file deleted
-			toDeleteFilePathList = append(toDeleteFilePathList, fileInfo.FilePath)
-			continue
-		}
-
-		if h != fileInfo.FileHash {
-			// file changed
-			infos = append(infos, fileInfo)
+			err = r.RemoveDocumentChunksByFilePath(ctx, info.FilePath)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	if !haveRows {
-		return r.FindFilesToProcess(filePathListForNow, true)
-	}
-
-	for _, filePath := range toDeleteFilePathList {
-		err = r.RemoveDocumentChunksByFilePath(filePath)
+	infos := make([]FileInfo, 0)
+	for _, filePath := range filePathListForNow {
+		h, err := CalculateFileHash(filePath)
 		if err != nil {
 			return nil, err
 		}
+
+		if storedHash, ok := storedHashes[filePath]; ok && storedHash == h && !force {
+			continue
+		}
+
+		infos = append(infos, FileInfo{
+			FilePath:    filePath,
+			FileName:    filepath.Base(filePath),
+			FileHash:    h,
+			ProcessedAt: time.Now(),
+		})
 	}
 
 	return infos, nil
@@ -0,0 +1,261 @@
+package rag
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrEmbeddingModelMismatch is returned when the chunks are embedded with another model than the
+// configured one, their vectors can't be compared with the query embedding
+var ErrEmbeddingModelMismatch = errors.New("embedding model mismatch")
+
+// ReembedStore is implemented by stores that can re-embed the chunks into a shadow table while the
+// current embeddings keep serving queries
+type ReembedStore interface {
+	// BeginReembed prepares the shadow table and returns the number of chunks already re-embedded.
+	// An interrupted re-embedding to the same model and dimension is resumed, any other is discarded.
+	BeginReembed(ctx context.Context, model string, dimension int64) (int64, error)
+	// ListReembedPending returns the chunks without a shadow embedding
+	ListReembedPending(ctx context.Context) ([]DocumentChunk, error)
+	// UpdateReembedEmbeddings writes shadow embeddings in a single transaction
+	UpdateReembedEmbeddings(ctx context.Context, chunks []DocumentChunk) error
+	// SwapReembed replaces the embeddings with the shadow ones, rebuilds the vector index and
+	// records the new model and dimension in one transaction
+	SwapReembed(ctx context.Context) error
+}
+
+// CheckEmbeddingModel returns ErrEmbeddingModelMismatch if the chunks are embedded with another
+// model than EmbeddingModel
+func (r *RAG) CheckEmbeddingModel(ctx context.Context) error {
+	return r.checkEmbeddingModel(ctx, false)
+}
+
+// checkEmbeddingModel compares the configured embedding model with the one recorded in meta.
+// If record and no model is recorded yet, the configured one is.
+func (r *RAG) checkEmbeddingModel(ctx context.Context, record bool) error {
+	if r.EmbeddingModel == "" {
+		return nil
+	}
+	stored, err := r.Store.GetMeta(ctx, metaEmbeddingModel)
+	if err != nil {
+		return err
+	}
+	switch {
+	case stored == "" && record:
+		return r.Store.SetMeta(ctx, metaEmbeddingModel, r.EmbeddingModel)
+	case stored == "" || stored == r.EmbeddingModel:
+		return nil
+	}
+	return fmt.Errorf("%w: chunks are embedded with %s, not %s, re-embed them to switch models",
+		ErrEmbeddingModelMismatch, stored, r.EmbeddingModel)
+}
+
+// Reembed embeds every chunk with model and dimension into a shadow table, then swaps the new
+// embeddings in. Until the swap queries keep using the current embeddings, an interrupted or
+// partially failed run is resumed by calling Reembed again with the same model and dimension.
+// Chunks added meanwhile are left without embedding for the next update.
+func (r *RAG) Reembed(ctx context.Context, model string, dimension int64, workers int, callback func()) error {
+	return r.reembed(ctx, model, dimension, workers, callback, func(swap func() error) error { return swap() })
+}
+
+// reembed is Reembed with the swap, which also switches the model of r, run by commit. The server
+// commits while no query is retrieving, so none embeds with one model and searches the other.
+func (r *RAG) reembed(ctx context.Context, model string, dimension int64, workers int, callback func(),
+	commit func(swap func() error) error) error {
+	store, ok := r.Store.(ReembedStore)
+	if !ok {
+		return fmt.Errorf("store %T doesn't support re-embedding", r.Store)
+	}
+	if ToEmbeddingClient(r.EmbeddingClient) == nil {
+		return errors.New("failed to get embedding client")
+	}
+
+	done, err := store.BeginReembed(ctx, model, dimension)
+	if err != nil {
+		return fmt.Errorf("failed to begin re-embedding: %w", err)
+	}
+	if done > 0 {
+		log.Info().Int64("chunks", done).Str("model", model).Msg("Resuming re-embedding")
+	}
+
+	chunks, err := store.ListReembedPending(ctx)
+	if err != nil {
+		return err
+	}
+
+	target := &RAG{
+		Store:                 r.Store,
+		EmbeddingClient:       r.EmbeddingClient,
+		EmbeddingModel:        model,
+		EmbeddingDimensions:   dimension,
+		EmbeddingBatchSize:    r.EmbeddingBatchSize,
+		EmbeddingBatchChars:   r.EmbeddingBatchChars,
+		EmbeddingRetry:        r.EmbeddingRetry,
+		DisableEmbeddingCache: r.DisableEmbeddingCache,
+	}
+	err = target.embedChunks(ctx, chunks, workers, callback, store.UpdateReembedEmbeddings)
+	if err != nil {
+		return err
+	}
+
+	return commit(func() error {
+		err := store.SwapReembed(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to swap embeddings: %w", err)
+		}
+		r.EmbeddingModel = model
+		r.EmbeddingDimensions = dimension
+		return nil
+	})
+}
+
+// sqlReembed implements ReembedStore on the embedding_reembed shadow table
+type sqlReembed struct {
+	db *sql.DB
+	// vectorType is the column type of shadow embeddings, any dimension
+	vectorType   string
+	encodeVector func([]float32) interface{}
+	// swapStatements move the shadow embeddings of dimension into document_chunks
+	swapStatements func(dimension int64) []string
+}
+
+func (r *sqlReembed) begin(ctx context.Context, model string, dimension int64) (int64, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	currentModel, err := getMeta(ctx, tx, metaReembedModel)
+	if err != nil {
+		return 0, err
+	}
+	currentDimension, err := getMeta(ctx, tx, metaReembedDimension)
+	if err != nil {
+		return 0, err
+	}
+	if currentModel != model || currentDimension != strconv.FormatInt(dimension, 10) {
+		if currentModel != "" {
+			log.Warn().Str("model", currentModel).Str("dimension", currentDimension).
+				Msg("Discarding interrupted re-embedding to another model")
+		}
+		_, err = tx.ExecContext(ctx, `DROP TABLE IF EXISTS embedding_reembed`)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS embedding_reembed (
+	id TEXT PRIMARY KEY,
+	embedding %s NOT NULL)`, r.vectorType))
+	if err != nil {
+		return 0, err
+	}
+	err = setMeta(ctx, tx, metaReembedModel, model)
+	if err != nil {
+		return 0, err
+	}
+	err = setMeta(ctx, tx, metaReembedDimension, strconv.FormatInt(dimension, 10))
+	if err != nil {
+		return 0, err
+	}
+
+	var done int64
+	err = tx.QueryRowContext(ctx, `SELECT count(*) FROM embedding_reembed`).Scan(&done)
+	if err != nil {
+		return 0, err
+	}
+	return done, tx.Commit()
+}
+
+func (r *sqlReembed) pending(ctx context.Context) ([]DocumentChunk, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+chunkColumns+` FROM document_chunks
+		WHERE is_parent IS NOT TRUE AND NOT EXISTS (SELECT 1 FROM embedding_reembed r WHERE r.id = document_chunks.id)`)
+	if err != nil {
+		return nil, err
+	}
+	return scanChunks(rows)
+}
+
+func (r *sqlReembed) update(ctx context.Context, chunks []DocumentChunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(`INSERT INTO embedding_reembed (id, embedding)
+		VALUES ($1, $2::%s)
+		ON CONFLICT (id) DO UPDATE SET embedding = EXCLUDED.embedding`, r.vectorType))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+
+	for _, chunk := range chunks {
+		_, err = stmt.ExecContext(ctx, chunk.ID, r.encodeVector(chunk.Embedding))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// swap returns the new embedding dimension
+func (r *sqlReembed) swap(ctx context.Context) (int64, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	model, err := getMeta(ctx, tx, metaReembedModel)
+	if err != nil {
+		return 0, err
+	}
+	value, err := getMeta(ctx, tx, metaReembedDimension)
+	if err != nil {
+		return 0, err
+	}
+	if model == "" {
+		return 0, errors.New("no re-embedding in progress")
+	}
+	dimension, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid re-embedding dimension %q: %w", value, err)
+	}
+
+	for _, statement := range r.swapStatements(dimension) {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			return 0, fmt.Errorf("statement %q: %w", statement, err)
+		}
+	}
+	for key, value := range map[string]string{
+		metaEmbeddingModel:     model,
+		metaEmbeddingDimension: value,
+	} {
+		err = setMeta(ctx, tx, key, value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM meta WHERE key IN ($1, $2)`, metaReembedModel, metaReembedDimension)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `DROP TABLE embedding_reembed`)
+	if err != nil {
+		return 0, err
+	}
+	return dimension, tx.Commit()
+}
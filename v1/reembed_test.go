@@ -0,0 +1,220 @@
+package rag
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memReembedStore is a memStore re-embedding into an in-memory shadow map
+type memReembedStore struct {
+	*memStore
+	shadow map[string][]float32
+}
+
+func (s *memReembedStore) BeginReembed(_ context.Context, model string, dimension int64) (int64, error) {
+	target := strconv.FormatInt(dimension, 10)
+	if s.shadow == nil || s.meta[metaReembedModel] != model || s.meta[metaReembedDimension] != target {
+		s.shadow = map[string][]float32{}
+	}
+	s.meta[metaReembedModel] = model
+	s.meta[metaReembedDimension] = target
+	return int64(len(s.shadow)), nil
+}
+
+func (s *memReembedStore) ListReembedPending(context.Context) ([]DocumentChunk, error) {
+	var chunks []DocumentChunk
+	for _, chunk := range s.sorted() {
+		if _, ok := s.shadow[chunk.ID]; !ok {
+			chunks = append(chunks, *chunk)
+		}
+	}
+	return chunks, nil
+}
+
+func (s *memReembedStore) UpdateReembedEmbeddings(_ context.Context, chunks []DocumentChunk) error {
+	for _, chunk := range chunks {
+		s.shadow[chunk.ID] = chunk.Embedding
+	}
+	return nil
+}
+
+func (s *memReembedStore) SwapReembed(context.Context) error {
+	for _, chunk := range s.chunks {
+		chunk.Embedding = s.shadow[chunk.ID]
+	}
+	s.dimension, _ = strconv.ParseInt(s.meta[metaReembedDimension], 10, 64)
+	s.meta[metaEmbeddingModel] = s.meta[metaReembedModel]
+	delete(s.meta, metaReembedModel)
+	delete(s.meta, metaReembedDimension)
+	s.shadow = nil
+	return nil
+}
+
+func TestCheckEmbeddingModel(t *testing.T) {
+	ctx := context.Background()
+	store := newEmbeddingStore(t, "alpha", "bravo")
+	r := &RAG{Store: store, EmbeddingClient: &fakeEmbeddingClient{dimension: 8}, EmbeddingModel: "m1", EmbeddingDimensions: 8}
+
+	// The first update records the model
+	require.NoError(t, r.ComputeEmbeddings(ctx, true, 1, func() {}))
+	assert.Equal(t, "m1", store.meta[metaEmbeddingModel])
+	_, err := r.embedQuery(ctx, "alpha")
+	require.NoError(t, err)
+
+	r.EmbeddingModel = "m2"
+	_, err = r.embedQuery(ctx, "alpha")
+	assert.ErrorIs(t, err, ErrEmbeddingModelMismatch)
+	err = r.ComputeEmbeddings(ctx, true, 1, func() {})
+	assert.ErrorIs(t, err, ErrEmbeddingModelMismatch)
+}
+
+func TestReembed(t *testing.T) {
+	ctx := context.Background()
+	store := &memReembedStore{memStore: newEmbeddingStore(t, "alpha", "bravo", "charlie", "delta")}
+	r := &RAG{Store: store, EmbeddingClient: &fakeEmbeddingClient{dimension: 8}, EmbeddingModel: "m1", EmbeddingDimensions: 8}
+	require.NoError(t, r.ComputeEmbeddings(ctx, true, 1, func() {}))
+
+	// A failed chunk leaves the current embeddings in place
+	client := &failingEmbeddingClient{fakeEmbeddingClient{dimension: 4}, "charlie"}
+	r.EmbeddingClient = client
+	r.EmbeddingBatchSize = 1
+	var embeddingErr *EmbeddingError
+	require.ErrorAs(t, r.Reembed(ctx, "m2", 4, 1, func() {}), &embeddingErr)
+	assert.Equal(t, 1, embeddingErr.Failed())
+	assert.Len(t, store.shadow, 3)
+	assert.Equal(t, "m1", store.meta[metaEmbeddingModel])
+	assert.Len(t, store.chunks["id-alpha"].Embedding, 8)
+	assert.Equal(t, "m1", r.EmbeddingModel)
+
+	// The next run only embeds the missing chunk and swaps
+	client.poison = ""
+	calls := client.calls
+	embedded := 0
+	require.NoError(t, r.Reembed(ctx, "m2", 4, 1, func() { embedded++ }))
+	assert.Equal(t, 1, embedded)
+	assert.Equal(t, calls+1, client.calls)
+	assert.Equal(t, "m2", store.meta[metaEmbeddingModel])
+	assert.Equal(t, int64(4), store.EmbeddingDimension())
+	for _, chunk := range store.chunks {
+		assert.Equal(t, toFloat32Slice(fakeEmbedding(chunk.Text, 4)), chunk.Embedding, chunk.Text)
+	}
+
+	assert.Equal(t, "m2", r.EmbeddingModel)
+	_, err := r.embedQuery(ctx, "alpha")
+	require.NoError(t, err)
+}
+
+func TestSQLReembed(t *testing.T) {
+	ctx := context.Background()
+	store := newPlainDuckDBStore(t, 3)
+	db := store.db
+	for _, statement := range []string{
+		`INSERT INTO meta VALUES ('embedding_model', 'm1')`,
+		`INSERT INTO document_chunks (id, text, embedding) VALUES
+			('a', 'alpha', [1, 0, 0]), ('b', 'bravo', [0, 1, 0]), ('c', 'charlie', NULL)`,
+	} {
+		_, err := db.ExecContext(ctx, statement)
+		require.NoError(t, err, statement)
+	}
+
+	// Plain DuckDB has no vss extension to build the HNSW index with
+	r := store.reembed()
+	r.swapStatements = func(dimension int64) []string {
+		var statements []string
+		for _, statement := range duckDBReembedSwap(dimension) {
+			if !strings.Contains(statement, "USING HNSW") {
+				statements = append(statements, statement)
+			}
+		}
+		return statements
+	}
+	ids := func(chunks []DocumentChunk) []string {
+		var ids []string
+		for _, chunk := range chunks {
+			ids = append(ids, chunk.ID)
+		}
+		return ids
+	}
+
+	done, err := r.begin(ctx, "m2", 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), done)
+	require.NoError(t, r.update(ctx, []DocumentChunk{{ID: "a", Embedding: []float32{1, 1}}}))
+
+	// Resumed with the same target
+	done, err = r.begin(ctx, "m2", 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), done)
+	pending, err := r.pending(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"b", "c"}, ids(pending))
+
+	// Discarded for another target
+	done, err = r.begin(ctx, "m3", 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), done)
+	done, err = r.begin(ctx, "m2", 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), done)
+
+	require.NoError(t, r.update(ctx, []DocumentChunk{
+		{ID: "a", Embedding: []float32{1, 1}},
+		{ID: "b", Embedding: []float32{2, 2}},
+	}))
+	dimension, err := r.swap(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), dimension)
+
+	store = &DuckDBStore{db: db, dimension: dimension}
+	a, err := store.GetDocumentChunk(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []float32{1, 1}, a.Embedding)
+	withoutEmbedding, err := store.ListDocumentChunks(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c"}, ids(withoutEmbedding))
+
+	for key, want := range map[string]string{
+		metaEmbeddingModel:     "m2",
+		metaEmbeddingDimension: "2",
+		metaReembedModel:       "",
+		metaReembedDimension:   "",
+	} {
+		value, err := store.GetMeta(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, want, value, key)
+	}
+
+	_, err = r.swap(ctx)
+	assert.Error(t, err)
+}
+
+func TestStoreReembed(t *testing.T) {
+	forEachStore(t, 4, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		var chunks []*DocumentChunk
+		for i, text := range []string{"alpha", "bravo", "charlie"} {
+			chunks = append(chunks, &DocumentChunk{ID: "id-" + text, DocumentID: "doc", Text: text, Index: i,
+				Embedding: toFloat32Slice(fakeEmbedding(text, 4))})
+		}
+		require.NoError(t, store.UpsertDocumentChunks(ctx, chunks))
+
+		r := &RAG{Store: store, EmbeddingClient: &fakeEmbeddingClient{dimension: 8}, EmbeddingModel: "m1", EmbeddingDimensions: 4}
+		require.NoError(t, r.Reembed(ctx, "m2", 8, 2, func() {}))
+		assert.Equal(t, int64(8), store.EmbeddingDimension())
+
+		model, err := store.GetMeta(ctx, metaEmbeddingModel)
+		require.NoError(t, err)
+		assert.Equal(t, "m2", model)
+
+		results, err := store.VectorSearch(ctx, toFloat32Slice(fakeEmbedding("charlie", 8)), 3, nil)
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+		assert.Equal(t, "id-charlie", results[0].ID)
+		assert.InDelta(t, 1, results[0].Score, 1e-5)
+	})
+}
@@ -0,0 +1,151 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// IsS3URL reports whether path names objects of a bucket, e.g. s3://bucket/docs/
+func IsS3URL(path string) bool {
+	return strings.HasPrefix(path, "s3://")
+}
+
+// ParseS3URL splits s3://bucket/prefix into the bucket and the key prefix, the prefix may be empty
+func ParseS3URL(s3URL string) (bucket, prefix string, err error) {
+	rest, ok := strings.CutPrefix(s3URL, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("%q is not an s3:// URL", s3URL)
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("%q has no bucket", s3URL)
+	}
+	return bucket, prefix, nil
+}
+
+// s3ObjectURL is the file path of an object, sources show it as s3://bucket/key
+func s3ObjectURL(bucket, key string) string {
+	return "s3://" + bucket + "/" + key
+}
+
+// objectValidator is the recorded version of an object, its ETag changes with its content
+func objectValidator(etag string) string {
+	return "etag:" + strings.Trim(etag, `"`)
+}
+
+// NewOSSClient connects to an S3 compatible object storage, the endpoint is a host like
+// "s3.amazonaws.com" or a URL like "http://localhost:9000" for plain HTTP. Without accessKey the
+// credentials are read from the AWS and MinIO environment variables or ~/.aws/credentials.
+func NewOSSClient(endpoint, accessKey, secretKey, region string) (*minio.Client, error) {
+	secure := true
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		endpoint = u.Host
+		secure = u.Scheme != "http"
+	}
+	creds := credentials.NewStaticV4(accessKey, secretKey, "")
+	if accessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{}, &credentials.EnvMinio{}, &credentials.FileAWSCredentials{},
+		})
+	}
+	return minio.New(endpoint, &minio.Options{Creds: creds, Secure: secure, Region: region})
+}
+
+// FindS3ObjectsToProcess lists the objects of bucket under prefix and returns those whose key is
+// accepted by match and whose ETag differs from the indexed one, all of them if force is set.
+// Recorded objects under prefix that are no longer listed are removed together with their chunks.
+func (r *RAG) FindS3ObjectsToProcess(ctx context.Context, bucket, prefix string, match func(key string) bool,
+	force bool) ([]FileInfo, error) {
+	if r.OSS == nil {
+		return nil, errors.New("object storage client is not configured")
+	}
+	processed, err := r.Store.ListProcessedFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	storedHashes := make(map[string]string)
+	for _, info := range processed {
+		if strings.HasPrefix(info.FilePath, s3ObjectURL(bucket, prefix)) {
+			storedHashes[info.FilePath] = info.FileHash
+		}
+	}
+
+	infos := make([]FileInfo, 0)
+	listed := make(map[string]bool)
+	for object := range r.OSS.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: %w", bucket, prefix, object.Err)
+		}
+		objectURL := s3ObjectURL(bucket, object.Key)
+		listed[objectURL] = true
+		// Keys ending with a slash are folder markers
+		if strings.HasSuffix(object.Key, "/") || !match(object.Key) {
+			continue
+		}
+		validator := objectValidator(object.ETag)
+		if storedHash, ok := storedHashes[objectURL]; ok && storedHash == validator && !force {
+			continue
+		}
+		infos = append(infos, FileInfo{
+			FilePath:    objectURL,
+			FileName:    path.Base(object.Key),
+			FileHash:    validator,
+			ProcessedAt: time.Now(),
+		})
+	}
+
+	for objectURL := range storedHashes {
+		if listed[objectURL] {
+			continue
+		}
+		// object deleted
+		err = r.RemoveDocumentChunksByFilePath(ctx, objectURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// IndexS3Object streams the object at objectURL through the loader for its type and the chunker,
+// and replaces the chunks of its previous version. The ETag of the object read is recorded, an
+// object deleted since it was listed is removed. It returns the number of chunks written.
+func (r *RAG) IndexS3Object(ctx context.Context, chunker *DocumentChunker, objectURL string) (int, error) {
+	if r.OSS == nil {
+		return 0, errors.New("object storage client is not configured")
+	}
+	bucket, key, err := ParseS3URL(objectURL)
+	if err != nil {
+		return 0, err
+	}
+	object, err := r.OSS.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = object.Close() }()
+
+	info, err := object.Stat()
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return 0, r.RemoveDocumentChunksByFilePath(ctx, objectURL)
+	}
+	if err != nil {
+		return 0, err
+	}
+	file, err := LoadStream(ctx, key, object)
+	if err != nil {
+		return 0, err
+	}
+	doc, err := r.replaceURLDocument(ctx, chunker, file, objectURL, path.Base(key), objectValidator(info.ETag))
+	if err != nil {
+		return 0, err
+	}
+	return len(doc.Chunks), nil
+}
@@ -0,0 +1,266 @@
+package rag
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBucket is a MinIO stand-in serving ListObjectsV2 and GetObject of one bucket, ETags are the
+// MD5 of the content like S3 computes them for single part uploads
+type testBucket struct {
+	mu      sync.Mutex
+	name    string
+	objects map[string]string
+	gets    []string
+}
+
+func newTestBucket(t *testing.T, name string) (*testBucket, *minio.Client) {
+	bucket := &testBucket{name: name, objects: map[string]string{}}
+	server := httptest.NewServer(bucket)
+	t.Cleanup(server.Close)
+	client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Region: "us-east-1",
+	})
+	require.NoError(t, err)
+	return bucket, client
+}
+
+func (b *testBucket) put(key, body string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = body
+}
+
+func (b *testBucket) remove(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, key)
+}
+
+// fetched returns the keys read since the previous call
+func (b *testBucket) fetched() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	gets := b.gets
+	b.gets = nil
+	sort.Strings(gets)
+	return gets
+}
+
+func objectETag(body string) string {
+	sum := md5.Sum([]byte(body))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+var testObjectModified = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+func (b *testBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != b.name {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if key == "" {
+		b.list(w, r.URL.Query().Get("prefix"))
+		return
+	}
+	body, ok := b.objects[key]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if r.Method == http.MethodGet {
+		b.gets = append(b.gets, key)
+	}
+	w.Header().Set("ETag", objectETag(body))
+	http.ServeContent(w, r, key, testObjectModified, strings.NewReader(body))
+}
+
+func (b *testBucket) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+		StorageClass string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		MaxKeys     int
+		IsTruncated bool
+		Contents    []content
+	}{Name: b.name, Prefix: prefix, MaxKeys: 1000}
+	for key, body := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{Key: key, ETag: objectETag(body), Size: len(body),
+				LastModified: testObjectModified.Format(time.RFC3339), StorageClass: "STANDARD"})
+		}
+	}
+	slices.SortFunc(result.Contents, func(a, b content) int { return strings.Compare(a.Key, b.Key) })
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+func TestParseS3URL(t *testing.T) {
+	bucket, prefix, err := ParseS3URL("s3://docs/guides/en/")
+	require.NoError(t, err)
+	assert.Equal(t, "docs", bucket)
+	assert.Equal(t, "guides/en/", prefix)
+	bucket, prefix, err = ParseS3URL("s3://docs")
+	require.NoError(t, err)
+	assert.Equal(t, "docs", bucket)
+	assert.Empty(t, prefix)
+
+	_, _, err = ParseS3URL("s3:///guides")
+	assert.Error(t, err)
+	_, _, err = ParseS3URL("./docs")
+	assert.Error(t, err)
+	assert.False(t, IsS3URL("docs/s3://x"))
+}
+
+func TestIndexS3Objects(t *testing.T) {
+	ctx := context.Background()
+	bucket, client := newTestBucket(t, "wiki")
+	bucket.put("docs/lease.md", "# Leases\n\nLeases expire after twelve seconds.\n")
+	bucket.put("docs/session.md", "# Sessions\n\nSessions are kept alive by KeepAlives.\n")
+	bucket.put("docs/api/cells.html", "<html><body><main><h1>Cells</h1><p>Cells have five replicas.</p></main></body></html>")
+	bucket.put("docs/logo.png", "\x89PNG")
+	bucket.put("docs/empty/", "")
+	bucket.put("archive/old.md", "# Old\n\nOutside of the prefix.\n")
+
+	store := newMemStore(3)
+	r := &RAG{Store: store, OSS: client}
+	chunker := newMarkdownChunker(1000, 1)
+	match := func(key string) bool {
+		ext := filepath.Ext(key)
+		return ext == ".md" || ext == ".html"
+	}
+	// update processes the changed objects like srag update s3://wiki/docs/
+	update := func(force bool) []string {
+		infos, err := r.FindS3ObjectsToProcess(ctx, "wiki", "docs/", match, force)
+		require.NoError(t, err)
+		var urls []string
+		for _, info := range infos {
+			_, err = r.IndexS3Object(ctx, chunker, info.FilePath)
+			require.NoError(t, err)
+			urls = append(urls, info.FilePath)
+		}
+		return urls
+	}
+	texts := func() map[string]string {
+		chunks, err := store.ListDocumentChunks(ctx, true)
+		require.NoError(t, err)
+		texts := map[string]string{}
+		for _, chunk := range chunks {
+			texts[chunk.FilePath] = chunk.Text
+		}
+		return texts
+	}
+
+	assert.Equal(t, []string{"s3://wiki/docs/api/cells.html", "s3://wiki/docs/lease.md", "s3://wiki/docs/session.md"},
+		update(false))
+	assert.Equal(t, map[string]string{
+		"s3://wiki/docs/api/cells.html": "# Cells\n\nCells have five replicas.",
+		"s3://wiki/docs/lease.md":       "# Leases\n\nLeases expire after twelve seconds.",
+		"s3://wiki/docs/session.md":     "# Sessions\n\nSessions are kept alive by KeepAlives.",
+	}, texts())
+	info, err := store.GetProcessedFile(ctx, "s3://wiki/docs/lease.md")
+	require.NoError(t, err)
+	assert.Equal(t, "etag:"+strings.Trim(objectETag("# Leases\n\nLeases expire after twelve seconds.\n"), `"`),
+		info.FileHash)
+	assert.Equal(t, []string{"docs/api/cells.html", "docs/lease.md", "docs/session.md"}, bucket.fetched())
+
+	// Unchanged objects are not read again
+	assert.Empty(t, update(false))
+	assert.Empty(t, bucket.fetched())
+
+	// Changed objects replace their chunks, deleted objects are removed
+	bucket.put("docs/lease.md", "# Leases\n\nLeases expire after a minute.\n")
+	bucket.remove("docs/session.md")
+	assert.Equal(t, []string{"s3://wiki/docs/lease.md"}, update(false))
+	assert.Equal(t, []string{"docs/lease.md"}, bucket.fetched())
+	assert.Equal(t, map[string]string{
+		"s3://wiki/docs/api/cells.html": "# Cells\n\nCells have five replicas.",
+		"s3://wiki/docs/lease.md":       "# Leases\n\nLeases expire after a minute.",
+	}, texts())
+	info, err = store.GetProcessedFile(ctx, "s3://wiki/docs/session.md")
+	require.NoError(t, err)
+	assert.Nil(t, info)
+
+	assert.Len(t, update(true), 2)
+
+	// Objects deleted after listing are removed, local updates leave objects alone
+	bucket.remove("docs/api/cells.html")
+	chunks, err := r.IndexS3Object(ctx, chunker, "s3://wiki/docs/api/cells.html")
+	require.NoError(t, err)
+	assert.Zero(t, chunks)
+	_, err = r.FindFilesToProcess(ctx, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"s3://wiki/docs/lease.md": "# Leases\n\nLeases expire after a minute."}, texts())
+
+	_, err = r.FindS3ObjectsToProcess(ctx, "missing", "", match, false)
+	assert.Error(t, err)
+}
+
+func TestLoadStream(t *testing.T) {
+	ctx := context.Background()
+	file, err := LoadStream(ctx, "docs/cells.html", strings.NewReader("<main><h1>Cells</h1><p>Five.</p></main>"))
+	require.NoError(t, err)
+	assert.Equal(t, "# Cells\n\nFive.\n", file.Text)
+
+	file, err = LoadStream(ctx, "locks.go", strings.NewReader(testGoSource))
+	require.NoError(t, err)
+	assert.True(t, file.Code)
+	assert.Equal(t, "locks", file.Symbols[0].Name)
+
+	// Loaders without stream support read a temporary copy
+	RegisterLoader(".upper", upperLoader{})
+	file, err = LoadStream(ctx, "notes.upper", strings.NewReader("cells"))
+	require.NoError(t, err)
+	assert.Equal(t, "CELLS", file.Text)
+}
+
+// upperLoader loads files as upper case text
+type upperLoader struct{}
+
+func (upperLoader) Load(ctx context.Context, filePath string) (*LoadedFile, error) {
+	file, err := textLoader{}.Load(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	file.Text = strings.ToUpper(file.Text)
+	return file, nil
+}
@@ -0,0 +1,112 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// WithEmbedder makes the semantic strategy place chunk boundaries by the similarity of sentence
+// embeddings computed with r, without it sentences are packed by paragraph
+func (c *DocumentChunker) WithEmbedder(r *RAG) *DocumentChunker {
+	c.embedder = r
+	return c
+}
+
+// embeddingChunking groups the sentences of content into chunks. Every sentence is embedded with
+// the SentenceWindow sentences around it, and a chunk ends where the windows of two adjacent
+// sentences are less similar than SimilarityThreshold. A chunk is not ended by a similarity drop
+// before it has MinChunkSize, and it is always ended before exceeding MaxChunkSize.
+func (c *DocumentChunker) embeddingChunking(ctx context.Context, content string) ([]*DocumentChunk, error) {
+	var sentences []string
+	start := 0
+	for _, end := range append(c.sentenceEnds([]byte(content), 0, len(content)), len(content)) {
+		if sentence := strings.TrimSpace(content[start:end]); sentence != "" {
+			sentences = append(sentences, c.splitToSize(sentence, c.config.MaxChunkSize)...)
+		}
+		start = end
+	}
+	if len(sentences) == 0 {
+		return nil, nil
+	}
+
+	embeddings, err := c.embedder.EmbedTexts(ctx, sentenceWindows(sentences, c.config.SentenceWindow))
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed sentences: %w", err)
+	}
+
+	var texts []string
+	var current []string
+	size := 0
+	for i, sentence := range sentences {
+		n := c.size(sentence)
+		if len(current) > 0 {
+			drop := cosineSimilarity(embeddings[i-1], embeddings[i]) < c.config.SimilarityThreshold
+			if size+1+n > c.config.MaxChunkSize || (drop && size >= c.config.MinChunkSize) {
+				texts = append(texts, strings.Join(current, " "))
+				current, size = nil, 0
+			}
+		}
+		if len(current) > 0 {
+			size++
+		}
+		current = append(current, sentence)
+		size += n
+	}
+
+	// The tail can't be ended by a similarity drop, it joins the previous chunk if it is short
+	last := strings.Join(current, " ")
+	if len(texts) > 0 && size < c.config.MinChunkSize &&
+		c.size(texts[len(texts)-1])+1+size <= c.config.MaxChunkSize {
+		texts[len(texts)-1] += " " + last
+	} else {
+		texts = append(texts, last)
+	}
+
+	chunks := make([]*DocumentChunk, len(texts))
+	for i, text := range texts {
+		chunks[i] = &DocumentChunk{Text: text, Index: i}
+	}
+	return chunks, nil
+}
+
+// sentenceWindows joins every sentence with its neighbours, window sentences in total
+func sentenceWindows(sentences []string, window int) []string {
+	before, after := max(window-1, 0)/2, max(window, 1)/2
+	windows := make([]string, len(sentences))
+	for i := range sentences {
+		windows[i] = strings.Join(sentences[max(i-before, 0):min(i+after+1, len(sentences))], " ")
+	}
+	return windows
+}
+
+// splitToSize cuts s into pieces whose size is at most limit
+func (c *DocumentChunker) splitToSize(s string, limit int) []string {
+	if limit <= 0 || c.size(s) <= limit {
+		return []string{s}
+	}
+	var pieces []string
+	runes := []rune(s)
+	for start := 0; start < len(runes); {
+		end := max(c.runesWithin(runes, start, limit), start+1)
+		if piece := strings.TrimSpace(string(runes[start:end])); piece != "" {
+			pieces = append(pieces, piece)
+		}
+		start = end
+	}
+	return pieces
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i] * b[i])
+		na += float64(a[i] * a[i])
+		nb += float64(b[i] * b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
@@ -0,0 +1,118 @@
+package rag
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/openai/openai-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// topicEmbeddingClient embeds text as the counts of its topic words
+type topicEmbeddingClient struct {
+	topics []string
+	inputs int
+}
+
+func (c *topicEmbeddingClient) New(_ context.Context, params openai.EmbeddingNewParams) (*openai.CreateEmbeddingResponse, error) {
+	rsp := &openai.CreateEmbeddingResponse{}
+	for i, input := range params.Input.OfArrayOfStrings {
+		c.inputs++
+		v := make([]float64, len(c.topics))
+		for j, topic := range c.topics {
+			v[j] = float64(strings.Count(strings.ToLower(input), topic))
+		}
+		rsp.Data = append(rsp.Data, openai.Embedding{Index: int64(i), Embedding: v})
+	}
+	return rsp, nil
+}
+
+func newSemanticChunker(maxSize, minSize, window int, r *RAG) *DocumentChunker {
+	config := DefaultChunkingConfig()
+	config.Strategy = "semantic"
+	config.MaxChunkSize = maxSize
+	config.MinChunkSize = minSize
+	config.SentenceWindow = window
+	return (&DocumentChunker{config: config}).WithEmbedder(r)
+}
+
+func TestEmbeddingChunking(t *testing.T) {
+	ctx := context.Background()
+	content := "Apples are red.  Apples are sweet.\n\nApples grow on trees. Zebras run fast. " +
+		"Zebras have stripes. Zebras live in Africa."
+	client := &topicEmbeddingClient{topics: []string{"apple", "zebra"}}
+	r := &RAG{EmbeddingClient: client, EmbeddingDimensions: 2}
+	texts := func(chunks []*DocumentChunk) []string {
+		var texts []string
+		for _, chunk := range chunks {
+			texts = append(texts, chunk.Text)
+		}
+		return texts
+	}
+
+	// The boundary is where the topic changes
+	c := newSemanticChunker(1000, 10, 1, r)
+	chunks, err := c.chunkContent(ctx, content)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"Apples are red. Apples are sweet. Apples grow on trees.",
+		"Zebras run fast. Zebras have stripes. Zebras live in Africa.",
+	}, texts(chunks))
+	assert.Equal(t, 6, client.inputs)
+
+	runes := []rune(content)
+	for i, chunk := range chunks {
+		assert.Equal(t, i, chunk.Index)
+		assert.Equal(t, chunk.Text, c.preprocessText(string(runes[chunk.StartOffset:chunk.EndOffset])))
+	}
+
+	// Chunks shorter than MinChunkSize are not ended by a similarity drop
+	chunks, err = newSemanticChunker(1000, 100, 1, r).chunkContent(ctx, content)
+	require.NoError(t, err)
+	assert.Len(t, chunks, 1)
+
+	// MaxChunkSize ends chunks of one topic
+	chunks, err = newSemanticChunker(40, 10, 1, r).chunkContent(ctx, content)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"Apples are red. Apples are sweet.",
+		"Apples grow on trees.",
+		"Zebras run fast. Zebras have stripes.",
+		"Zebras live in Africa.",
+	}, texts(chunks))
+	for _, chunk := range chunks {
+		assert.LessOrEqual(t, utf8.RuneCountInString(chunk.Text), 40)
+	}
+}
+
+func TestEmbeddingChunkingCache(t *testing.T) {
+	ctx := context.Background()
+	client := &topicEmbeddingClient{topics: []string{"apple", "zebra"}}
+	r := &RAG{Store: newMemCacheStore(newMemStore(2)), EmbeddingClient: client, EmbeddingModel: "m1", EmbeddingDimensions: 2}
+	c := newSemanticChunker(1000, 10, 3, r)
+
+	content := "Apples are red. Apples are sweet. Zebras run fast. Zebras have stripes."
+	first, err := c.chunkContent(ctx, content)
+	require.NoError(t, err)
+	inputs := client.inputs
+	second, err := c.chunkContent(ctx, content)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, inputs, client.inputs)
+}
+
+func TestEmbeddingChunkingError(t *testing.T) {
+	c := newSemanticChunker(1000, 10, 3, &RAG{EmbeddingClient: &failingEmbeddingClient{fakeEmbeddingClient{dimension: 4}, "Apples are red. Zebras run fast."}})
+	_, err := c.chunkContent(context.Background(), "Apples are red. Zebras run fast.")
+	assert.Error(t, err)
+}
+
+func TestSentenceWindows(t *testing.T) {
+	sentences := []string{"a", "b", "c", "d"}
+	assert.Equal(t, sentences, sentenceWindows(sentences, 1))
+	assert.Equal(t, []string{"a b", "b c", "c d", "d"}, sentenceWindows(sentences, 2))
+	assert.Equal(t, []string{"a b", "a b c", "b c d", "c d"}, sentenceWindows(sentences, 3))
+}
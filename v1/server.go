@@ -2,24 +2,71 @@ package rag
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/goccy/go-json"
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	defaultRetrievalLimit = 40
+	defaultSelectedLimit  = 10
+)
+
 type Server struct {
-	e *echo.Echo
-	r *RAG
+	e             *echo.Echo
+	r             *RAG
+	vectorWeight  float64
+	keywordWeight float64
+	minScore      float64
+	profiles      []Profile
+
+	// retrieval is held by queries while they embed and search, the re-embedding job takes it to
+	// swap the embeddings and the model in between
+	retrieval  sync.RWMutex
+	jobs       sync.WaitGroup
+	jobCtx     context.Context
+	cancelJobs context.CancelFunc
+	reembedMu  sync.Mutex
+	reembed    ReembedStatus
 }
 
 func NewServer(r *RAG) *Server {
-	s := &Server{r: r}
+	s := &Server{
+		r:             r,
+		vectorWeight:  DefaultVectorWeight,
+		keywordWeight: DefaultKeywordWeight,
+		profiles:      []Profile{{Name: DefaultProfileName}},
+	}
+	s.jobCtx, s.cancelJobs = context.WithCancel(context.Background())
 	e := echo.New()
 	s.e = e
 
 	e.GET("/", s.homeHandler)
 	e.POST("/v1/search", s.searchHandler)
+	e.POST("/v1/ask", s.askHandler)
+	e.POST("/v1/ask/stream", s.askStreamHandler)
+	e.GET("/v1/models", s.modelsHandler)
+	e.POST("/v1/chat/completions", s.chatCompletionsHandler)
+	e.POST("/v1/reembed", s.reembedHandler)
+	e.GET("/v1/reembed", s.reembedStatusHandler)
+	return s
+}
+
+// WithFusionWeights sets the hybrid retrieval weights used when a request doesn't specify them
+func (s *Server) WithFusionWeights(vector, keyword float64) *Server {
+	s.vectorWeight = vector
+	s.keywordWeight = keyword
+	return s
+}
+
+// WithMinScore sets the similarity cutoff used when a request doesn't specify one
+func (s *Server) WithMinScore(minScore float64) *Server {
+	s.minScore = minScore
 	return s
 }
 
@@ -27,13 +74,30 @@ func (s *Server) Start(bind string) error {
 	return s.e.Start(bind)
 }
 
+// Shutdown stops the server and interrupts a running re-embedding, which is resumed when started again
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.e.Shutdown(ctx)
+	s.cancelJobs()
+	err := s.e.Shutdown(ctx)
+	s.jobs.Wait()
+	return err
+}
+
+// queryDocumentChunks retrieves the chunks while no re-embedding swaps the embeddings
+func (s *Server) queryDocumentChunks(ctx context.Context, p *AskParameter) ([]DocumentChunk, error) {
+	s.retrieval.RLock()
+	defer s.retrieval.RUnlock()
+	return s.r.QueryDocumentChunks(ctx, p)
 }
 
 type SearchParam struct {
-	Query string `json:"query" validate:"required"`
-	Limit int
+	Query         string `json:"query" validate:"required"`
+	Limit         int
+	VectorWeight  float64          `json:"vector_weight"`
+	KeywordWeight float64          `json:"keyword_weight"`
+	MinScore      float64          `json:"min_score"`
+	Filters       []MetadataFilter `json:"filters"`
+	Expand        string           `json:"expand"`
+	Neighbors     int              `json:"neighbors"`
 }
 
 func (p *SearchParam) WithDefaults(limitStr string) {
@@ -52,8 +116,24 @@ func (s *Server) searchHandler(c echo.Context) error {
 		return err
 	}
 	p.WithDefaults(c.QueryParam("limit"))
+	err = validateRetrieval(p.Filters, p.Expand)
+	if err != nil {
+		return err
+	}
+
+	askParam := &AskParameter{
+		Query:          p.Query,
+		RetrievalLimit: p.Limit,
+		VectorWeight:   p.VectorWeight,
+		KeywordWeight:  p.KeywordWeight,
+		MinScore:       p.MinScore,
+		Filters:        p.Filters,
+		Expand:         p.Expand,
+		Neighbors:      p.Neighbors,
+	}
+	s.withDefaults(askParam)
 
-	chunks, err := s.r.QueryDocumentChunks(c.Request().Context(), p.Query, p.Limit)
+	chunks, err := s.queryDocumentChunks(c.Request().Context(), askParam)
 	if err != nil {
 		return err
 	}
@@ -62,6 +142,10 @@ func (s *Server) searchHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	chunks, err = s.r.ExpandChunks(c.Request().Context(), askParam, chunks)
+	if err != nil {
+		return err
+	}
 
 	return c.JSON(http.StatusOK, echo.Map{
 		"count":  len(chunks),
@@ -69,6 +153,171 @@ func (s *Server) searchHandler(c echo.Context) error {
 	})
 }
 
+// validateRetrieval rejects invalid metadata filters and expansions with 400 Bad Request
+func validateRetrieval(filters []MetadataFilter, expand string) error {
+	for _, f := range filters {
+		err := f.Validate()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	err := ValidateExpand(expand)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+// withDefaults fills the fields a request left empty with the server defaults
+func (s *Server) withDefaults(p *AskParameter) {
+	if p.RetrievalLimit <= 0 {
+		p.RetrievalLimit = defaultRetrievalLimit
+	}
+	if p.SelectedLimit <= 0 {
+		p.SelectedLimit = defaultSelectedLimit
+	}
+	if p.VectorWeight == 0 && p.KeywordWeight == 0 {
+		p.VectorWeight, p.KeywordWeight = s.vectorWeight, s.keywordWeight
+	}
+	if p.MinScore == 0 {
+		p.MinScore = s.minScore
+	}
+}
+
+// selectChunks runs the retrieve and rerank phases and stores the result in p.SelectedChunks,
+// expanded as p.Expand asks
+func (s *Server) selectChunks(ctx context.Context, p *AskParameter) error {
+	chunks, err := s.queryDocumentChunks(ctx, p)
+	if err != nil {
+		return err
+	}
+	chunks, err = s.r.Rerank(ctx, p.Query, chunks, p.SelectedLimit)
+	if err != nil {
+		return err
+	}
+	p.SelectedChunks, err = s.r.ExpandChunks(ctx, p, chunks)
+	return err
+}
+
+// AskResponse is the answer of POST /v1/ask with the chunks it was generated from
+type AskResponse struct {
+	Answer *Answer         `json:"answer"`
+	Chunks []DocumentChunk `json:"chunks"`
+	Timing AskTiming       `json:"timing"`
+}
+
+// AskTiming is the time spent in each phase in milliseconds
+type AskTiming struct {
+	Retrieval int64 `json:"retrieval_ms"`
+	Rerank    int64 `json:"rerank_ms"`
+	Answer    int64 `json:"answer_ms"`
+	Total     int64 `json:"total_ms"`
+}
+
+func (s *Server) askHandler(c echo.Context) error {
+	var p AskParameter
+	err := c.Bind(&p)
+	if err != nil {
+		return err
+	}
+	if p.Query == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "query is required")
+	}
+	err = validateRetrieval(p.Filters, p.Expand)
+	if err != nil {
+		return err
+	}
+	s.withDefaults(&p)
+
+	ctx := c.Request().Context()
+	var timing AskTiming
+	start := time.Now()
+
+	chunks, err := s.queryDocumentChunks(ctx, &p)
+	if err != nil {
+		return err
+	}
+	timing.Retrieval = time.Since(start).Milliseconds()
+
+	phase := time.Now()
+	chunks, err = s.r.Rerank(ctx, p.Query, chunks, p.SelectedLimit)
+	if err != nil {
+		return err
+	}
+	p.SelectedChunks, err = s.r.ExpandChunks(ctx, &p, chunks)
+	if err != nil {
+		return err
+	}
+	timing.Rerank = time.Since(phase).Milliseconds()
+
+	phase = time.Now()
+	answer, err := s.r.Ask(ctx, &p)
+	if err != nil {
+		return err
+	}
+	timing.Answer = time.Since(phase).Milliseconds()
+	timing.Total = time.Since(start).Milliseconds()
+
+	return c.JSON(http.StatusOK, AskResponse{Answer: answer, Chunks: p.SelectedChunks, Timing: timing})
+}
+
+// askStreamHandler answers with server-sent events: "chunks" with the selected chunks, "delta"
+// for each piece of the answer text, then "answer" with the final answer or "error"
+func (s *Server) askStreamHandler(c echo.Context) error {
+	var p AskParameter
+	err := c.Bind(&p)
+	if err != nil {
+		return err
+	}
+	if p.Query == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "query is required")
+	}
+	err = validateRetrieval(p.Filters, p.Expand)
+	if err != nil {
+		return err
+	}
+	s.withDefaults(&p)
+
+	ctx := c.Request().Context()
+	err = s.selectChunks(ctx, &p)
+	if err != nil {
+		return err
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	err = writeEvent(w, "chunks", p.SelectedChunks)
+	if err != nil {
+		return nil
+	}
+	answer, err := s.r.AskStream(ctx, &p, func(delta string) error {
+		return writeEvent(w, "delta", echo.Map{"text": delta})
+	})
+	if err != nil {
+		_ = writeEvent(w, "error", echo.Map{"message": err.Error()})
+		return nil
+	}
+	_ = writeEvent(w, "answer", answer)
+	return nil
+}
+
+func writeEvent(w *echo.Response, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
 func (s *Server) homeHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, echo.Map{
 		"name":    "SlimRAG Server",
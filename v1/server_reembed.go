@@ -0,0 +1,99 @@
+package rag
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultReembedWorkers = 3
+
+// ReembedRequest is the body of POST /v1/reembed
+type ReembedRequest struct {
+	Model     string `json:"model"`
+	Dimension int64  `json:"dimension"`
+	Workers   int    `json:"workers"`
+}
+
+// ReembedStatus is the state of the last re-embedding job of the server
+type ReembedStatus struct {
+	Running    bool       `json:"running"`
+	Model      string     `json:"model,omitempty"`
+	Dimension  int64      `json:"dimension,omitempty"`
+	Embedded   int64      `json:"embedded"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// reembedHandler starts re-embedding the chunks in the background while the server keeps
+// answering from the current embeddings. A job that failed or was interrupted by a shutdown is
+// resumed by starting it again with the same model and dimension.
+func (s *Server) reembedHandler(c echo.Context) error {
+	var p ReembedRequest
+	err := c.Bind(&p)
+	if err != nil {
+		return err
+	}
+	if p.Model == "" || p.Dimension <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "model and a positive dimension are required")
+	}
+	if _, ok := s.r.Store.(ReembedStore); !ok {
+		return echo.NewHTTPError(http.StatusNotImplemented, fmt.Sprintf("store %T doesn't support re-embedding", s.r.Store))
+	}
+	if p.Workers <= 0 {
+		p.Workers = defaultReembedWorkers
+	}
+
+	s.reembedMu.Lock()
+	if s.reembed.Running {
+		model := s.reembed.Model
+		s.reembedMu.Unlock()
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("re-embedding to %s is running", model))
+	}
+	now := time.Now()
+	s.reembed = ReembedStatus{Running: true, Model: p.Model, Dimension: p.Dimension, StartedAt: &now}
+	status := s.reembed
+	s.reembedMu.Unlock()
+
+	s.jobs.Add(1)
+	go s.runReembed(p)
+	return c.JSON(http.StatusAccepted, status)
+}
+
+func (s *Server) reembedStatusHandler(c echo.Context) error {
+	s.reembedMu.Lock()
+	status := s.reembed
+	s.reembedMu.Unlock()
+	return c.JSON(http.StatusOK, status)
+}
+
+func (s *Server) runReembed(p ReembedRequest) {
+	defer s.jobs.Done()
+
+	log.Info().Str("model", p.Model).Int64("dimension", p.Dimension).Msg("Re-embedding chunks in the background")
+	err := s.r.reembed(s.jobCtx, p.Model, p.Dimension, p.Workers, func() {
+		s.reembedMu.Lock()
+		s.reembed.Embedded++
+		s.reembedMu.Unlock()
+	}, func(swap func() error) error {
+		s.retrieval.Lock()
+		defer s.retrieval.Unlock()
+		return swap()
+	})
+
+	s.reembedMu.Lock()
+	defer s.reembedMu.Unlock()
+	now := time.Now()
+	s.reembed.Running = false
+	s.reembed.FinishedAt = &now
+	if err != nil {
+		s.reembed.Error = err.Error()
+		log.Error().Err(err).Str("model", p.Model).Msg("Re-embedding failed, start it again to resume")
+		return
+	}
+	log.Info().Str("model", p.Model).Int64("dimension", p.Dimension).Msg("Swapped in the new embeddings")
+}
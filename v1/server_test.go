@@ -0,0 +1,178 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(s *Server, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServerAsk(t *testing.T) {
+	r, chat := newTestRAG("Cells have five replicas [1].", citationChunks...)
+	s := NewServer(r)
+
+	rec := serve(s, http.MethodPost, "/v1/ask",
+		`{"query": "How many replicas are in a cell", "retrieval_limit": 2, "system_prompt": "Be brief.", "citations": true}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.True(t, strings.HasPrefix(chat.prompt, "Be brief."))
+
+	var rsp AskResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rsp))
+	require.Len(t, rsp.Chunks, 2)
+	assert.Equal(t, 1, rsp.Chunks[0].RerankRank)
+	assert.Equal(t, "Cells have five replicas [1].", rsp.Answer.Text)
+	require.Len(t, rsp.Answer.Sources, 1)
+	assert.Equal(t, rsp.Chunks[0].ID, rsp.Answer.Sources[0].ChunkID)
+	assert.GreaterOrEqual(t, rsp.Timing.Total, rsp.Timing.Retrieval+rsp.Timing.Rerank+rsp.Timing.Answer)
+
+	// The raw JSON uses the documented field names
+	var raw struct {
+		Answer map[string]interface{}
+		Timing map[string]interface{}
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &raw))
+	assert.Contains(t, raw.Timing, "retrieval_ms")
+	assert.Contains(t, raw.Answer, "sources")
+
+	rec = serve(s, http.MethodPost, "/v1/ask", `{"retrieval_limit": 2}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestServerSearchRerank(t *testing.T) {
+	// More chunks than the limit, so the assistant selects them
+	r, _ := newTestRAG("2\n0", citationChunks...)
+	s := NewServer(r)
+
+	rec := serve(s, http.MethodPost, "/v1/search?limit=2", `{"query": "Chubby lock replicas Paxos"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var rsp struct {
+		Count  int
+		Chunks []DocumentChunk
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rsp))
+	assert.Equal(t, 2, rsp.Count)
+	assert.Equal(t, 1, rsp.Chunks[0].RerankRank)
+	assert.Equal(t, 2, rsp.Chunks[1].RerankRank)
+}
+
+func TestServerSearchFilters(t *testing.T) {
+	var chunks []DocumentChunk
+	for _, doc := range metadataDocuments {
+		chunks = append(chunks, DocumentChunk{ID: doc.id, DocumentID: doc.id, Text: doc.text})
+	}
+	r, _ := newTestRAG("0", chunks...)
+	for _, doc := range metadataDocuments {
+		require.NoError(t, r.Store.SetDocumentMetadata(context.Background(), doc.id, doc.metadata))
+	}
+	s := NewServer(r)
+
+	rec := serve(s, http.MethodPost, "/v1/search?limit=5",
+		`{"query": "install", "filters": [{"key": "lang", "values": ["zh"]}]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var rsp struct {
+		Chunks []DocumentChunk
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rsp))
+	require.Len(t, rsp.Chunks, 1)
+	assert.Equal(t, "install-zh", rsp.Chunks[0].DocumentID)
+
+	rec = serve(s, http.MethodPost, "/v1/search", `{"query": "install", "filters": [{"key": "date", "from": "yesterday"}]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = serve(s, http.MethodPost, "/v1/ask", `{"query": "install", "filters": [{"key": "lang"}]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestServerSearchExpand(t *testing.T) {
+	r, _ := newTestRAG("0",
+		DocumentChunk{ID: "c0", DocumentID: "doc", Text: "install the release", ParentID: "p0"},
+		DocumentChunk{ID: "c1", DocumentID: "doc", Text: "unpack the archive", Index: 1, ParentID: "p0"},
+		DocumentChunk{ID: "p0", DocumentID: "doc", Text: "install the release\nunpack the archive", IsParent: true})
+	s := NewServer(r)
+
+	rec := serve(s, http.MethodPost, "/v1/search?limit=5", `{"query": "install", "expand": "parent"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var rsp struct {
+		Chunks []DocumentChunk
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rsp))
+	require.Len(t, rsp.Chunks, 1)
+	assert.Equal(t, "p0", rsp.Chunks[0].ID)
+
+	rec = serve(s, http.MethodPost, "/v1/ask", `{"query": "install", "expand": "section"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func reembedStatus(t *testing.T, s *Server) ReembedStatus {
+	rec := serve(s, http.MethodGet, "/v1/reembed", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var status ReembedStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	return status
+}
+
+func TestServerReembed(t *testing.T) {
+	ctx := context.Background()
+	store := &memReembedStore{memStore: newEmbeddingStore(t, "alpha", "bravo", "charlie")}
+	r := &RAG{Store: store, EmbeddingClient: &fakeEmbeddingClient{dimension: 8}, EmbeddingModel: "m1", EmbeddingDimensions: 8}
+	require.NoError(t, r.ComputeEmbeddings(ctx, true, 1, func() {}))
+	s := NewServer(r)
+
+	rec := serve(s, http.MethodPost, "/v1/reembed", `{"model": "m2"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(s, http.MethodPost, "/v1/reembed", `{"model": "m2", "dimension": 8, "workers": 1}`)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	require.Eventually(t, func() bool { return !reembedStatus(t, s).Running }, 5*time.Second, 10*time.Millisecond)
+
+	status := reembedStatus(t, s)
+	assert.Empty(t, status.Error)
+	assert.Equal(t, "m2", status.Model)
+	assert.Equal(t, int64(3), status.Embedded)
+	assert.NotNil(t, status.FinishedAt)
+	assert.Equal(t, "m2", store.meta[metaEmbeddingModel])
+
+	// Queries use the new model without a restart
+	assert.Equal(t, "m2", r.EmbeddingModel)
+	rec = serve(s, http.MethodPost, "/v1/search?limit=2", `{"query": "alpha"}`)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
+
+func TestServerReembedShutdown(t *testing.T) {
+	store := &memReembedStore{memStore: newEmbeddingStore(t, "alpha")}
+	client := &blockingEmbeddingClient{started: make(chan struct{})}
+	r := &RAG{Store: store, EmbeddingClient: client, EmbeddingModel: "m1", EmbeddingDimensions: 8}
+	s := NewServer(r)
+
+	rec := serve(s, http.MethodPost, "/v1/reembed", `{"model": "m2", "dimension": 8}`)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	<-client.started
+	rec = serve(s, http.MethodPost, "/v1/reembed", `{"model": "m3", "dimension": 8}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	// Shutting down interrupts the job, it is resumed by starting it again
+	require.NoError(t, s.Shutdown(context.Background()))
+	status := reembedStatus(t, s)
+	assert.False(t, status.Running)
+	assert.NotEmpty(t, status.Error)
+	assert.Equal(t, "m2", store.meta[metaReembedModel])
+	assert.Equal(t, "m1", r.EmbeddingModel)
+
+	r, _ = newTestRAG("")
+	rec = serve(NewServer(r), http.MethodPost, "/v1/reembed", `{"model": "m2", "dimension": 8}`)
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+}
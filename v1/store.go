@@ -0,0 +1,218 @@
+package rag
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/marcboeker/go-duckdb/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Store persists document chunks and processed files, and serves the vector and keyword
+// retrieval channels. Implementations are selected by the DSN scheme, see OpenStore.
+type Store interface {
+	// UpsertDocumentChunks inserts chunks, existing chunks keep their embedding
+	UpsertDocumentChunks(ctx context.Context, chunks []*DocumentChunk) error
+	// GetDocumentChunk returns the chunk with its embedding, sql.ErrNoRows if it doesn't exist
+	GetDocumentChunk(ctx context.Context, id string) (*DocumentChunk, error)
+	// ListDocumentChunks returns chunks without their embedding, parent sections are not listed
+	ListDocumentChunks(ctx context.Context, withoutEmbedding bool) ([]DocumentChunk, error)
+	// ListChunksByIndex returns the chunks of a document with an index from from to to, in index
+	// order, without parent sections and embeddings
+	ListChunksByIndex(ctx context.Context, documentID string, from, to int) ([]DocumentChunk, error)
+	UpdateEmbedding(ctx context.Context, id string, embedding []float32) error
+	// UpdateEmbeddings writes the embeddings of chunks in a single transaction
+	UpdateEmbeddings(ctx context.Context, chunks []DocumentChunk) error
+	// RemoveDocumentChunks removes the chunks and the metadata of a document
+	RemoveDocumentChunks(ctx context.Context, documentID string) error
+	// SetDocumentMetadata replaces the metadata of a document
+	SetDocumentMetadata(ctx context.Context, documentID string, metadata Metadata) error
+
+	// VectorSearch returns the nearest chunks by L2 distance with Distance and Score set, among the
+	// chunks of documents matching all filters
+	VectorSearch(ctx context.Context, embedding []float32, limit int, filters []MetadataFilter) ([]DocumentChunk, error)
+	// KeywordSearch returns full-text matches with KeywordScore set, scored against embedding too
+	KeywordSearch(ctx context.Context, query string, embedding []float32, limit int, filters []MetadataFilter) ([]DocumentChunk, error)
+	// RebuildKeywordIndex refreshes the full-text index after chunks were written
+	RebuildKeywordIndex(ctx context.Context) error
+
+	// GetProcessedFile returns nil if the file has not been processed
+	GetProcessedFile(ctx context.Context, filePath string) (*FileInfo, error)
+	ListProcessedFiles(ctx context.Context) ([]FileInfo, error)
+	UpsertProcessedFile(ctx context.Context, info *FileInfo) error
+	RemoveProcessedFile(ctx context.Context, filePath string) error
+
+	// GetMeta returns the value of a meta key, empty if it is not set
+	GetMeta(ctx context.Context, key string) (string, error)
+	SetMeta(ctx context.Context, key, value string) error
+
+	// EmbeddingDimension is the dimension of the embedding column
+	EmbeddingDimension() int64
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// OpenStore opens the store selected by the DSN scheme: postgres:// or postgresql://
+// open PostgreSQL with pgvector, duckdb:// or a plain path opens DuckDB
+func OpenStore(dsn string, defaultDimension int64) (Store, error) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return OpenPostgres(dsn, defaultDimension)
+	default:
+		return OpenDuckDB(strings.TrimPrefix(dsn, "duckdb://"), defaultDimension)
+	}
+}
+
+// OpenMigrator opens the database selected by the DSN scheme without migrating it
+func OpenMigrator(dsn string, defaultDimension int64) (*Migrator, error) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		db, err := sql.Open("pgx", dsn)
+		if err != nil {
+			return nil, err
+		}
+		_, err = db.Exec(`CREATE EXTENSION IF NOT EXISTS vector`)
+		if err != nil {
+			_ = db.Close()
+			return nil, errors.Wrap(err, "Failed to create vector extension")
+		}
+		return NewPostgresMigrator(db, defaultDimension), nil
+	default:
+		dsn = strings.TrimPrefix(dsn, "duckdb://")
+		if len(dsn) == 0 {
+			dsn = ":memory:"
+		}
+		connector, err := duckdb.NewConnector(dsn, nil)
+		if err != nil {
+			return nil, err
+		}
+		db := sql.OpenDB(connector)
+		err = loadDuckDBExtensions(db)
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+		return NewDuckDBMigrator(db, defaultDimension), nil
+	}
+}
+
+// GetStoredEmbeddingDimension returns the dimension of the store, warns if it differs from the requested one
+func GetStoredEmbeddingDimension(s Store, defaultDimension int64) int64 {
+	d := s.EmbeddingDimension()
+	if d != defaultDimension {
+		log.Warn().
+			Int64("stored_dimension", d).
+			Int64("default_dimension", defaultDimension).
+			Msg("Stored embedding dimension does not match default value, using stored value, run reembed to change it")
+	}
+	return d
+}
+
+// Keys of the meta table
+const (
+	metaEmbeddingDimension = "embedding_dimension"
+	metaEmbeddingModel     = "embedding_model"
+	metaReembedModel       = "reembed_model"
+	metaReembedDimension   = "reembed_dimension"
+)
+
+// execer is implemented by *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func getMeta(ctx context.Context, db execer, key string) (string, error) {
+	var value string
+	err := db.QueryRowContext(ctx, "SELECT value FROM meta WHERE key = $1", key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return value, err
+}
+
+func setMeta(ctx context.Context, db execer, key, value string) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO meta (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value`, key, value)
+	return err
+}
+
+// chunkColumns are the document_chunks columns read by chunkScanner, in order
+const chunkColumns = "id, document_id, text, file_path, start_offset, end_offset, chunk_index, heading_path, " +
+	"parent_id, is_parent, page_start, page_end, image_path, symbol, symbol_kind, line_start, line_end, " +
+	"commit_sha, commit_date"
+
+// chunkScanner scans chunkColumns, provenance columns are NULL for chunks indexed by older releases
+type chunkScanner struct {
+	documentID, filePath, headingPath, parentID sql.NullString
+	imagePath, symbol, symbolKind, commitSHA    sql.NullString
+	startOffset, endOffset, index               sql.NullInt64
+	pageStart, pageEnd, lineStart, lineEnd      sql.NullInt64
+	isParent                                    sql.NullBool
+	commitDate                                  sql.NullTime
+}
+
+func (s *chunkScanner) dest(chunk *DocumentChunk) []interface{} {
+	return []interface{}{&chunk.ID, &s.documentID, &chunk.Text, &s.filePath,
+		&s.startOffset, &s.endOffset, &s.index, &s.headingPath, &s.parentID, &s.isParent,
+		&s.pageStart, &s.pageEnd, &s.imagePath, &s.symbol, &s.symbolKind, &s.lineStart, &s.lineEnd,
+		&s.commitSHA, &s.commitDate}
+}
+
+func (s *chunkScanner) fill(chunk *DocumentChunk) {
+	chunk.DocumentID = s.documentID.String
+	chunk.FilePath = s.filePath.String
+	chunk.StartOffset = int(s.startOffset.Int64)
+	chunk.EndOffset = int(s.endOffset.Int64)
+	chunk.Index = int(s.index.Int64)
+	chunk.HeadingPath = s.headingPath.String
+	chunk.ParentID = s.parentID.String
+	chunk.IsParent = s.isParent.Bool
+	chunk.PageStart = int(s.pageStart.Int64)
+	chunk.PageEnd = int(s.pageEnd.Int64)
+	chunk.ImagePath = s.imagePath.String
+	chunk.Symbol = s.symbol.String
+	chunk.SymbolKind = s.symbolKind.String
+	chunk.LineStart = int(s.lineStart.Int64)
+	chunk.LineEnd = int(s.lineEnd.Int64)
+	chunk.CommitSHA = s.commitSHA.String
+	if s.commitDate.Valid {
+		date := s.commitDate.Time.UTC()
+		chunk.CommitDate = &date
+	}
+}
+
+// chunkArgs are the values of chunkColumns for an insert
+func chunkArgs(chunk *DocumentChunk) []interface{} {
+	var parentID, commitDate interface{}
+	if chunk.ParentID != "" {
+		parentID = chunk.ParentID
+	}
+	if chunk.CommitDate != nil {
+		commitDate = chunk.CommitDate.UTC()
+	}
+	return []interface{}{chunk.ID, chunk.DocumentID, chunk.Text, chunk.FilePath,
+		chunk.StartOffset, chunk.EndOffset, chunk.Index, chunk.HeadingPath, parentID, chunk.IsParent,
+		chunk.PageStart, chunk.PageEnd, chunk.ImagePath, chunk.Symbol, chunk.SymbolKind, chunk.LineStart, chunk.LineEnd,
+		chunk.CommitSHA, commitDate}
+}
+
+// scanChunks reads rows of chunkColumns
+func scanChunks(rows *sql.Rows) ([]DocumentChunk, error) {
+	defer func() { _ = rows.Close() }()
+
+	var chunks []DocumentChunk
+	for rows.Next() {
+		var chunk DocumentChunk
+		var cs chunkScanner
+		err := rows.Scan(cs.dest(&chunk)...)
+		if err != nil {
+			return nil, err
+		}
+		cs.fill(&chunk)
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
@@ -0,0 +1,145 @@
+package rag
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAskStream(t *testing.T) {
+	r := &RAG{AssistantClient: &fakeChatClient{reply: "Chubby is a lock service [2]."}}
+
+	var deltas []string
+	answer, err := r.AskStream(context.Background(), &AskParameter{
+		Query:          "What is Chubby?",
+		SelectedChunks: citationChunks,
+		Citations:      true,
+	}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Chubby ", "is ", "a ", "lock ", "service ", "[2]."}, deltas)
+	assert.Equal(t, "Chubby is a lock service [1].", answer.Text)
+	require.Len(t, answer.Sources, 1)
+	assert.Equal(t, "c2", answer.Sources[0].ChunkID)
+
+	// An error from the callback stops the stream
+	_, err = r.AskStream(context.Background(), &AskParameter{Query: "q"}, func(string) error {
+		return assert.AnError
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+}
+
+func TestAuditChatStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, word := range []string{"Hello", ", ", "world"} {
+			_, _ = fmt.Fprintf(w, "data: {\"id\":\"c1\",\"object\":\"chat.completion.chunk\",\"model\":\"m\","+
+				"\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":%q}}]}\n\n", word)
+		}
+		_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer srv.Close()
+
+	client := openai.NewClient(option.WithBaseURL(srv.URL), option.WithAPIKey("test-key"))
+	logDir := t.TempDir()
+	chat := NewAuditChatClient(&client, NewAuditLogger(true, logDir), "m")
+
+	r := &RAG{AssistantClient: chat, AssistantModel: "m"}
+	var streamed strings.Builder
+	answer, err := r.AskStream(context.Background(), &AskParameter{Query: "hi"}, func(delta string) error {
+		streamed.WriteString(delta)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Hello, world", streamed.String())
+	assert.Equal(t, "Hello, world", answer.Text)
+
+	files, err := os.ReadDir(logDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	content, err := os.ReadFile(filepath.Join(logDir, files[0].Name()))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "chat_stream")
+	assert.Contains(t, string(content), `"content": "Hello, world"`)
+}
+
+func TestServerAskStream(t *testing.T) {
+	r, _ := newTestRAG("Chubby is a lock service [1].", citationChunks...)
+	s := NewServer(r)
+
+	body := `{"query": "What is Chubby lock service", "citations": true}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/ask/stream", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+
+	events := readEvents(t, rec.Body.String())
+	require.GreaterOrEqual(t, len(events), 3)
+	assert.Equal(t, "chunks", events[0].name)
+	var chunks []DocumentChunk
+	require.NoError(t, json.Unmarshal([]byte(events[0].data), &chunks))
+	assert.Len(t, chunks, len(citationChunks))
+
+	var text strings.Builder
+	for _, e := range events[1 : len(events)-1] {
+		assert.Equal(t, "delta", e.name)
+		var delta struct{ Text string }
+		require.NoError(t, json.Unmarshal([]byte(e.data), &delta))
+		text.WriteString(delta.Text)
+	}
+	assert.Equal(t, "Chubby is a lock service [1].", text.String())
+
+	last := events[len(events)-1]
+	assert.Equal(t, "answer", last.name)
+	var answer Answer
+	require.NoError(t, json.Unmarshal([]byte(last.data), &answer))
+	require.Len(t, answer.Sources, 1)
+	assert.Equal(t, chunks[0].ID, answer.Sources[0].ChunkID)
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/ask/stream", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+func readEvents(t *testing.T, body string) []sseEvent {
+	var events []sseEvent
+	var e sseEvent
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			e.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			events = append(events, e)
+			e = sseEvent{}
+		}
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
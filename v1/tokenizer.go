@@ -0,0 +1,348 @@
+package rag
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Tokenizer splits text into the tokens of an embedding model
+type Tokenizer interface {
+	// Encode returns the token ids of text
+	Encode(text string) []int
+}
+
+// TokenCounter is implemented by tokenizers that count tokens without allocating their ids, the
+// chunker measures sizes with Count when available
+type TokenCounter interface {
+	// Count returns the number of tokens of text
+	Count(text string) int
+}
+
+// bpePattern splits text into the pieces BPE merges within, as cl100k_base does. RE2 has no
+// lookahead, so the `\s+(?!\S)` branch is done by giving back the last space of a run, see pieces.
+var bpePattern = regexp.MustCompile(`^(?:(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+)`)
+
+// maxCountedPieces bounds the piece counts a BPETokenizer keeps, they are dropped when full
+const maxCountedPieces = 1 << 16
+
+// BPETokenizer is a byte pair encoding tokenizer with a tiktoken vocab, e.g. cl100k_base.tiktoken
+type BPETokenizer struct {
+	ranks map[string]int
+
+	mu     sync.Mutex
+	counts map[string]int // Token counts of the pieces counted recently, see Count
+}
+
+// LoadBPETokenizer loads a tiktoken vocab file, every line is a base64 token and its rank
+func LoadBPETokenizer(path string) (*BPETokenizer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	t, err := NewBPETokenizer(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vocab %s: %w", path, err)
+	}
+	return t, nil
+}
+
+// NewBPETokenizer reads a tiktoken vocab
+func NewBPETokenizer(r io.Reader) (*BPETokenizer, error) {
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a token and its rank", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("vocab is empty")
+	}
+	return &BPETokenizer{ranks: ranks, counts: make(map[string]int)}, nil
+}
+
+func (t *BPETokenizer) Encode(text string) []int {
+	var tokens []int
+	for _, piece := range bpePieces(text) {
+		tokens = append(tokens, t.encodePiece(piece)...)
+	}
+	return tokens
+}
+
+// Count returns the number of tokens of text. Counts of pieces are remembered, so measuring a
+// chunk again as it grows or shrinks only encodes the pieces not seen before.
+func (t *BPETokenizer) Count(text string) int {
+	n := 0
+	for _, piece := range bpePieces(text) {
+		t.mu.Lock()
+		count, ok := t.counts[piece]
+		t.mu.Unlock()
+		if !ok {
+			count = len(t.encodePiece(piece))
+			t.mu.Lock()
+			if len(t.counts) >= maxCountedPieces {
+				clear(t.counts)
+			}
+			t.counts[piece] = count
+			t.mu.Unlock()
+		}
+		n += count
+	}
+	return n
+}
+
+// encodePiece merges the bytes of piece, lowest ranked pair first and the leftmost of equally
+// ranked pairs. Bytes missing from the vocab are tokens of their own with id -1. Mergeable pairs
+// are kept in a heap, a long piece like a run of Chinese text takes O(n log n) instead of a scan
+// of all pairs per merge.
+func (t *BPETokenizer) encodePiece(piece string) []int {
+	if rank, ok := t.ranks[piece]; ok {
+		return []int{rank}
+	}
+
+	// Parts are linked by the offsets they start at, next[i] is where the part after i starts
+	n := len(piece)
+	next := make([]int, n)
+	prev := make([]int, n)
+	for i := range next {
+		next[i], prev[i] = i+1, i-1
+	}
+	merged := make([]bool, n)
+	var pairs mergeHeap
+	push := func(i int) {
+		if i < 0 || next[i] >= n {
+			return
+		}
+		end := next[next[i]]
+		if rank, ok := t.ranks[piece[i:end]]; ok {
+			heap.Push(&pairs, mergePair{rank: rank, start: i, end: end})
+		}
+	}
+	for i := 0; i+1 < n; i++ {
+		push(i)
+	}
+	for pairs.Len() > 0 {
+		pair := heap.Pop(&pairs).(mergePair)
+		// Pairs pushed before a neighbor was merged no longer match the parts
+		right := next[pair.start]
+		if merged[pair.start] || right >= n || next[right] != pair.end {
+			continue
+		}
+		merged[right] = true
+		next[pair.start] = pair.end
+		if pair.end < n {
+			prev[pair.end] = pair.start
+		}
+		push(prev[pair.start])
+		push(pair.start)
+	}
+
+	var tokens []int
+	for i := 0; i < n; i = next[i] {
+		rank, ok := t.ranks[piece[i:next[i]]]
+		if !ok {
+			rank = -1
+		}
+		tokens = append(tokens, rank)
+	}
+	return tokens
+}
+
+// mergePair is a pair of adjacent parts of a piece, piece[start:end], and the rank of its merge
+type mergePair struct {
+	rank, start, end int
+}
+
+// mergeHeap orders pairs by rank, then leftmost first
+type mergeHeap []mergePair
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	return h[i].rank < h[j].rank || (h[i].rank == h[j].rank && h[i].start < h[j].start)
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergePair)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// bpePieces splits text with bpePattern
+func bpePieces(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		end := len(bpePattern.FindString(text))
+		if end == 0 {
+			_, end = utf8.DecodeRuneInString(text)
+		}
+		// A run of spaces before a word leaves its last space to the word
+		if end < len(text) && end > 1 && strings.TrimFunc(text[:end], unicode.IsSpace) == "" {
+			r, size := utf8.DecodeLastRuneInString(text[:end])
+			if r != '\r' && r != '\n' {
+				end -= size
+			}
+		}
+		pieces = append(pieces, text[:end])
+		text = text[end:]
+	}
+	return pieces
+}
+
+// size measures text in the configured size unit
+func (c *DocumentChunker) size(text string) int {
+	if c.config.SizeUnit == "tokens" && c.tokenizer != nil {
+		return c.tokens(text)
+	}
+	return utf8.RuneCountInString(text)
+}
+
+func (c *DocumentChunker) tokens(text string) int {
+	if counter, ok := c.tokenizer.(TokenCounter); ok {
+		return counter.Count(text)
+	}
+	return len(c.tokenizer.Encode(text))
+}
+
+// runesWithin returns the largest end such that runes[from:end] has a size of at most limit
+func (c *DocumentChunker) runesWithin(runes []rune, from, limit int) int {
+	if c.config.SizeUnit != "tokens" || c.tokenizer == nil {
+		return min(from+limit, len(runes))
+	}
+	return runesWithin(runes, from, limit, c.tokens)
+}
+
+// runesBefore returns the smallest start such that runes[start:end] has a size of at most limit,
+// for characters it may be negative
+func (c *DocumentChunker) runesBefore(runes []rune, end, limit int) int {
+	if c.config.SizeUnit != "tokens" || c.tokenizer == nil {
+		return end - limit
+	}
+	return runesBefore(runes, end, limit, c.tokens)
+}
+
+// limitInput splits the chunks with more than MaxInputTokens tokens at sentence ends, and the
+// sentences still too long anywhere, so that every chunk fits the input of the embedding model.
+// A heading breadcrumb already set on a chunk is embedded with it and counts against the limit.
+func (c *DocumentChunker) limitInput(chunks []*DocumentChunk) []*DocumentChunk {
+	if c.config.MaxInputTokens <= 0 || c.tokenizer == nil {
+		return chunks
+	}
+
+	var limited []*DocumentChunk
+	for _, chunk := range chunks {
+		limit := c.config.MaxInputTokens
+		if chunk.HeadingPath != "" {
+			limit = max(limit-c.tokens(chunk.HeadingPath+"\n\n"), 1)
+		}
+		if c.tokens(chunk.Text) <= limit {
+			limited = append(limited, chunk)
+			continue
+		}
+
+		source := []byte(chunk.Text)
+		n := len(limited)
+		for _, span := range c.splitSpan(source, 0, len(source), limit, limit, nil, c.tokens) {
+			runes := []rune(string(source[span[0]:span[1]]))
+			offset := chunk.StartOffset + utf8.RuneCount(source[:span[0]])
+			for from := 0; from < len(runes); {
+				to := max(runesWithin(runes, from, limit, c.tokens), from+1)
+				piece := *chunk
+				piece.Text = string(runes[from:to])
+				piece.StartOffset = offset + from
+				piece.EndOffset = offset + to
+				limited = append(limited, &piece)
+				from = to
+			}
+		}
+		log.Debug().Int("tokens", c.tokens(chunk.Text)).Int("pieces", len(limited)-n).
+			Msg("Split chunk exceeding the embedding model input")
+	}
+	return limited
+}
+
+// runesWithin returns the largest end such that runes[from:end] measures at most limit
+func runesWithin(runes []rune, from, limit int, size func(string) int) int {
+	fits := func(end int) bool {
+		return size(string(runes[from:end])) <= limit
+	}
+
+	// Widen until it doesn't fit, then bisect
+	lo, step := from, max(limit, 1)
+	hi := min(from+step, len(runes))
+	for hi < len(runes) && fits(hi) {
+		lo = hi
+		step *= 2
+		hi = min(from+step, len(runes))
+	}
+	if fits(hi) {
+		return hi
+	}
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if fits(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// runesBefore returns the smallest start such that runes[start:end] measures at most limit
+func runesBefore(runes []rune, end, limit int, size func(string) int) int {
+	fits := func(start int) bool {
+		return size(string(runes[start:end])) <= limit
+	}
+
+	hi, step := end, max(limit, 1)
+	lo := max(end-step, 0)
+	for lo > 0 && fits(lo) {
+		hi = lo
+		step *= 2
+		lo = max(end-step, 0)
+	}
+	if fits(lo) {
+		return lo
+	}
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if fits(mid) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi
+}
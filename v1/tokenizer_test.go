@@ -0,0 +1,190 @@
+package rag
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeVocab writes a tiktoken vocab of the single bytes followed by merges, in rank order
+func writeVocab(t testing.TB, merges ...string) string {
+	var b strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	for i, merge := range merges {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(merge)), 256+i)
+	}
+	path := filepath.Join(t.TempDir(), "vocab.tiktoken")
+	require.NoError(t, os.WriteFile(path, []byte(b.String()), 0644))
+	return path
+}
+
+func TestBPETokenizer(t *testing.T) {
+	tokenizer, err := LoadBPETokenizer(writeVocab(t, "he", "ll", "hell", "hello", " w", " wor", "ld", " world"))
+	require.NoError(t, err)
+
+	assert.Equal(t, []int{259, 263}, tokenizer.Encode("hello world"))
+	assert.Equal(t, []int{258, 257}, tokenizer.Encode("hellll"))
+	// A run of spaces leaves its last one to the next word
+	assert.Equal(t, []int{' ', 263}, tokenizer.Encode("  world"))
+	// Multi-byte characters are their bytes unless merged
+	assert.Len(t, tokenizer.Encode("中文"), 6)
+	for _, text := range []string{"hello world", "hellll", "  world", "中文", ""} {
+		assert.Equal(t, len(tokenizer.Encode(text)), tokenizer.Count(text), text)
+	}
+
+	// The lowest ranked pair is merged first, the leftmost of equally ranked ones
+	tokenizer, err = LoadBPETokenizer(writeVocab(t, "aa", "bc", "ab", "中文"[:2], "中文"[:3]))
+	require.NoError(t, err)
+	assert.Equal(t, []int{256, 256}, tokenizer.Encode("aaaa"))
+	assert.Equal(t, []int{256, 'a'}, tokenizer.Encode("aaa"))
+	assert.Equal(t, []int{'a', 257}, tokenizer.Encode("abc"))
+	assert.Equal(t, []int{260, 260, 260}, tokenizer.Encode("中中中"))
+	assert.Equal(t, 3, tokenizer.Count("中中中"))
+
+	assert.Equal(t, []string{"Hello", ",", " world", "'s", " ", " ", "123", "4", "\n\n", "中文"},
+		bpePieces("Hello, world's  1234\n\n中文"))
+
+	_, err = NewBPETokenizer(strings.NewReader("aGk= x\n"))
+	assert.Error(t, err)
+	_, err = NewBPETokenizer(strings.NewReader(""))
+	assert.Error(t, err)
+}
+
+func TestTokenSizing(t *testing.T) {
+	config := DefaultChunkingConfig()
+	config.Strategy = "fixed"
+	config.SizeUnit = "tokens"
+	config.VocabFile = writeVocab(t, "Red", " Red", " apples")
+	config.MaxChunkSize = 12
+	config.MinChunkSize = 1
+	config.OverlapSize = 2
+	c, err := NewDocumentChunker(config, t.TempDir())
+	require.NoError(t, err)
+
+	// Twelve tokens are several English sentences but one Chinese
+	english := strings.Repeat("Red apples. ", 10)
+	chunks, err := c.chunkContent(context.Background(), english)
+	require.NoError(t, err)
+	require.NotEmpty(t, chunks)
+	for _, chunk := range chunks {
+		assert.LessOrEqual(t, c.tokens(chunk.Text), 12, chunk.Text)
+	}
+	assert.GreaterOrEqual(t, strings.Count(chunks[0].Text, "Red apples."), 3)
+
+	chinese := strings.Repeat("红苹果。", 10)
+	chunks, err = c.chunkContent(context.Background(), chinese)
+	require.NoError(t, err)
+	for _, chunk := range chunks {
+		assert.LessOrEqual(t, c.tokens(chunk.Text), 12, chunk.Text)
+	}
+	assert.Equal(t, "红苹果。", chunks[0].Text)
+
+	config.VocabFile = ""
+	_, err = NewDocumentChunker(config, t.TempDir())
+	assert.Error(t, err)
+	config.SizeUnit = "words"
+	_, err = NewDocumentChunker(config, t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestLimitInput(t *testing.T) {
+	tokenizer, err := LoadBPETokenizer(writeVocab(t))
+	require.NoError(t, err)
+
+	// Character sized markdown chunks are split to fit 27 tokens with the 7 of their breadcrumb
+	// "Guide\n\n", the pieces keep their offsets
+	content := "# Guide\n\nOne two three. Four five six.\n\n" + strings.Repeat("x", 45)
+	c := newMarkdownChunker(1000, 1)
+	c.config.MaxInputTokens = 27
+	c.tokenizer = tokenizer
+	chunks, err := c.chunkContent(context.Background(), content)
+	require.NoError(t, err)
+	assertVerbatim(t, content, chunks)
+
+	var texts []string
+	for _, chunk := range chunks {
+		assert.LessOrEqual(t, c.tokens(chunk.EmbeddingText()), 27)
+		assert.Equal(t, "Guide", chunk.HeadingPath)
+		texts = append(texts, chunk.Text)
+	}
+	assert.Equal(t, []string{
+		"# Guide",
+		"One two three.",
+		"Four five six.",
+		strings.Repeat("x", 20),
+		strings.Repeat("x", 20),
+		strings.Repeat("x", 5),
+	}, texts)
+}
+
+// writeCJKVocab writes a vocab merging the bytes of the Chinese characters of benchmarkDocument
+// and a few of their pairs, so that runs of Chinese text are merged step by step like with
+// cl100k_base
+func writeCJKVocab(b *testing.B) string {
+	var merges []string
+	seen := map[string]bool{}
+	for _, r := range benchmarkChinese {
+		s := string(r)
+		if len(s) < 3 || seen[s] {
+			continue
+		}
+		seen[s] = true
+		merges = append(merges, s[:2], s)
+	}
+	runes := []rune(benchmarkChinese)
+	for i := 0; i+1 < len(runes); i += 2 {
+		merges = append(merges, string(runes[i:i+2]))
+	}
+	return writeVocab(b, append(merges, " the", " embedding", " model")...)
+}
+
+const benchmarkChinese = "分布式锁服务为松耦合系统提供粗粒度的锁以及可靠的小文件存储" +
+	"客户端通过会话与主副本通信并在租约到期前续约"
+
+// benchmarkDocument is a mixed Chinese and English markdown document of about 160 KB, with
+// sentences and with runs of Chinese text hundreds of characters long without punctuation
+func benchmarkDocument() string {
+	var b strings.Builder
+	for section := 0; section < 40; section++ {
+		fmt.Fprintf(&b, "## 第%d节 Section %d\n\n", section, section)
+		for i := 0; i < 10; i++ {
+			b.WriteString(benchmarkChinese + "，the embedding model 使用 cl100k_base 分词。")
+		}
+		b.WriteString("\n\n" + strings.Repeat(benchmarkChinese, 15) + "\n\n")
+	}
+	return b.String()
+}
+
+func BenchmarkTokenChunkingCJK(b *testing.B) {
+	content := benchmarkDocument()
+	vocab := writeCJKVocab(b)
+	for _, strategy := range []string{"markdown", "sentence", "fixed"} {
+		b.Run(strategy, func(b *testing.B) {
+			config := DefaultChunkingConfig()
+			config.Strategy = strategy
+			config.SizeUnit = "tokens"
+			config.MaxChunkSize = 256
+			config.MinChunkSize = 32
+			config.OverlapSize = 16
+			config.MaxInputTokens = 200
+			config.VocabFile = vocab
+			c, err := NewDocumentChunker(config, b.TempDir())
+			require.NoError(b, err)
+			b.SetBytes(int64(len(content)))
+			for b.Loop() {
+				chunks, err := c.chunkContent(context.Background(), content)
+				require.NoError(b, err)
+				require.NotEmpty(b, chunks)
+			}
+		})
+	}
+}